@@ -12,7 +12,9 @@ import (
 
 	"amy/minecraft-server/internal/config"
 	"amy/minecraft-server/internal/db"
+	"amy/minecraft-server/internal/discord"
 	"amy/minecraft-server/internal/handlers"
+	"amy/minecraft-server/internal/minecraft"
 	"amy/minecraft-server/internal/observability"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -42,22 +44,49 @@ func main() {
 			"oauth":          cfg.DiscordClientID != "" && cfg.DiscordClientSecret != "" && cfg.DiscordRedirectURL != "",
 			"rp_application": cfg.DiscordRPWebhook != "",
 			"support_ticket": cfg.DiscordTicketWebhook != "",
+			"support_email":  cfg.SMTPHost != "" && cfg.SupportEmailFrom != "" && cfg.SupportEmailSecret != "",
 			"news_fetch":     cfg.DiscordBotToken != "" && cfg.DiscordNewsChannelID != "",
 		},
 	)
 
+	handlers.SetSessionSecret(cfg.SessionSecret)
+	notifier := handlers.NewNotifier(postgres, cfg.VAPIDPublicKey, cfg.VAPIDPrivateKey, cfg.SupportPushSubject)
+	discordOutbox := handlers.NewDiscordOutbox(postgres)
+	discordClient := discord.New(cfg.DiscordBotToken)
 	healthHandler := handlers.NewHealthHandler(postgres)
 	playerHandler := handlers.NewPlayerHandler(postgres)
-	newsHandler := handlers.NewNewsHandler(postgres, cfg.TelegramNewsChannel, cfg.DiscordBotToken, cfg.DiscordNewsChannelID, cfg.DiscordGuildID)
+	newsHandler := handlers.NewNewsHandler(postgres, notifier, discordClient, cfg.TelegramNewsChannel, cfg.DiscordNewsChannelID, cfg.DiscordGuildID)
 	mediaProxyHandler := handlers.NewMediaProxyHandler(cfg.MediaCacheDir)
-	communityChatHandler := handlers.NewCommunityChatHandler(postgres, cfg.DiscordBotToken)
+	communityChatHandler := handlers.NewCommunityChatHandler(postgres, discordClient, cfg.DiscordChatChannelID)
+	minecraftChatBridge := handlers.NewMinecraftChatBridge(postgres, minecraft.NewRCON(cfg.MinecraftRCONAddr, cfg.MinecraftRCONPassword), cfg.MinecraftChatToken, communityChatHandler)
+	communityChatHandler.SetMinecraftBridge(minecraftChatBridge)
 	tenorHandler := handlers.NewTenorHandler(cfg.TenorAPIKey)
-	supportHandler := handlers.NewSupportHandler(postgres, cfg.DiscordTicketWebhook, cfg.FrontendURL, cfg.VAPIDPublicKey, cfg.VAPIDPrivateKey, cfg.SupportPushSubject, cfg.SupportStorageDir)
-	discordMemberSync := handlers.NewDiscordMemberSync(postgres, cfg.DiscordBotToken, cfg.DiscordGuildID, cfg.DiscordTicketChannelID, supportHandler.NotifyTicketReply)
-	serverStatusHandler := handlers.NewServerStatusHandler(cfg.MinecraftServerAddr)
+	supportMailer := handlers.NewSupportMailer(
+		postgres,
+		cfg.SMTPHost,
+		cfg.SMTPPort,
+		cfg.SMTPUsername,
+		cfg.SMTPPassword,
+		cfg.SupportEmailFrom,
+		cfg.SupportEmailReplyTo,
+		cfg.FrontendURL,
+		cfg.SupportEmailSecret,
+		cfg.SupportInboundToken,
+	)
+	supportHandler := handlers.NewSupportHandler(postgres, notifier, discordOutbox, discordClient, cfg.DiscordTicketWebhook, cfg.FrontendURL, cfg.SupportStorageDir, cfg.SupportStaffIDs, cfg.DiscordTicketChannelID, cfg.SupportCaptchaSecret, cfg.SupportCaptchaURL, supportMailer)
+	if cfg.SupportClamdAddr != "" {
+		supportHandler.SetAttachmentScanner(handlers.NewClamdScanner(cfg.SupportClamdAddr))
+	}
+	discordMemberSync := handlers.NewDiscordMemberSync(postgres, discordClient, cfg.DiscordBotToken, cfg.DiscordGuildID, cfg.DiscordTicketChannelID, cfg.DiscordShardID, cfg.DiscordShardCount, supportHandler.GatewayHooks())
+	discordMemberSync.SetCommunityChat(communityChatHandler)
+	healthHandler.SetDiscordGateway(discordMemberSync.Gateway())
+	serverStatusHandler := handlers.NewServerStatusHandler(cfg.MinecraftServerAddr, notifier)
 	skinsManifestHandler := handlers.NewSkinsManifestHandler(postgres)
 	discordHandler := handlers.NewDiscordAuthHandler(
 		postgres,
+		notifier,
+		discordOutbox,
+		discordClient,
 		cfg.DiscordClientID,
 		cfg.DiscordClientSecret,
 		cfg.DiscordRedirectURL,
@@ -65,17 +94,38 @@ func main() {
 		cfg.DiscordTicketWebhook,
 		cfg.DiscordRPWebhook,
 		cfg.RPModeratorIDs,
-		cfg.DiscordBotToken,
 		cfg.DiscordGuildID,
 		cfg.SkinStorageDir,
 	)
+	accountHandler := handlers.NewAccountHandler(postgres, discordHandler, supportHandler)
+	discordInteractionsHandler := handlers.NewDiscordInteractionsHandler(cfg.DiscordPublicKey, discordClient, cfg.DiscordClientID, cfg.DiscordGuildID, discordHandler, supportHandler, serverStatusHandler)
+	if discordInteractionsHandler.Enabled() {
+		discordHandler.SetDiscordInteractions(true)
+		supportHandler.SetDiscordInteractions(true)
+	}
 
 	syncCtx, syncCancel := context.WithTimeout(context.Background(), 30*time.Second)
 	if err := discordHandler.RunMigrations(syncCtx); err != nil {
 		log.Printf("discord migrations failed: %v", err)
 	}
 	syncCancel()
+	go func() {
+		commandsCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		if err := discordInteractionsHandler.RegisterCommands(commandsCtx); err != nil {
+			log.Printf("discord slash commands registration failed: %v", err)
+		}
+	}()
 	discordMemberSync.Start(ctx)
+	communityChatHandler.Start(ctx)
+	minecraftChatBridge.Start(ctx)
+	supportHandler.StartSLAMonitor(ctx)
+	supportHandler.StartAutoClose(ctx)
+	supportMailer.Start(ctx)
+	notifier.Start(ctx)
+	discordOutbox.Start(ctx)
+	accountHandler.Start(ctx)
+	serverStatusHandler.StartMonitor(ctx)
 
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
@@ -87,23 +137,34 @@ func main() {
 	mux.HandleFunc("/api/news/likes", newsHandler.Like)
 	mux.HandleFunc("/api/news/comments", newsHandler.Comments)
 	mux.HandleFunc("/api/community/chat", communityChatHandler.Handle)
+	mux.HandleFunc("/api/community/chat/events", communityChatHandler.Events)
+	mux.HandleFunc("/api/minecraft/chat", minecraftChatBridge.Handle)
 	mux.HandleFunc("/api/tenor/search", tenorHandler.Search)
 	mux.HandleFunc("/api/server/status", serverStatusHandler.Handle)
 	mux.HandleFunc("/api/skins/manifest", skinsManifestHandler.Handle)
 	mux.HandleFunc("/api/auth/discord/start", discordHandler.Start)
 	mux.HandleFunc("/api/auth/discord/callback", discordHandler.Callback)
+	mux.HandleFunc("/api/discord/interactions", discordInteractionsHandler.Handle)
 	mux.HandleFunc("/api/auth/me", discordHandler.Me)
 	mux.HandleFunc("/api/auth/logout", discordHandler.Logout)
 	mux.HandleFunc("/api/auth/presence", discordHandler.PresencePing)
+	mux.HandleFunc("/api/me/export", accountHandler.Export)
+	mux.HandleFunc("/api/me/deletion", accountHandler.Deletion)
 	mux.HandleFunc("/api/profiles/theme", discordHandler.UpdateProfileTheme)
 	mux.HandleFunc("/api/profiles/", discordHandler.PublicProfile)
 	mux.HandleFunc("/api/rp/skins", discordHandler.UploadRPSkin)
 	mux.Handle("/api/uploads/skins/", discordHandler.SkinFileServer())
 	mux.HandleFunc("/api/rp/applications", discordHandler.SubmitRPApplication)
 	mux.HandleFunc("/api/rp/applications/", discordHandler.ModerateRPApplication)
-	mux.HandleFunc("/api/support/notifications", supportHandler.Notifications)
+	mux.HandleFunc("/api/notifications", notifier.List)
+	mux.HandleFunc("/api/notifications/read", notifier.Read)
+	mux.HandleFunc("/api/notifications/preferences", notifier.Preferences)
+	mux.HandleFunc("/api/notifications/push", notifier.Push)
+	mux.HandleFunc("/api/support/notifications", notifier.Push)
 	mux.HandleFunc("/api/support/tickets", supportHandler.Create)
 	mux.HandleFunc("/api/support/tickets/", supportHandler.Moderate)
+	mux.HandleFunc("/api/support/staff/", supportHandler.Staff)
+	mux.HandleFunc("/api/support/email/", supportHandler.Email)
 
 	server := &http.Server{
 		Addr:              ":" + cfg.Port,
@@ -145,6 +206,12 @@ func (r *statusRecorder) WriteHeader(status int) {
 	r.ResponseWriter.WriteHeader(status)
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer, which
+// streaming handlers need to flush.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
 func withMetrics(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/metrics" {
@@ -173,7 +240,7 @@ func withCORS(allowedOrigin string, next http.Handler) http.Handler {
 		}
 		w.Header().Set("Access-Control-Allow-Origin", allowedOrigin)
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
-		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PATCH,DELETE,OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,DELETE,OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type,X-Server-Token")
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusNoContent)
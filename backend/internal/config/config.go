@@ -9,19 +9,39 @@ type Config struct {
 	DiscordClientID        string
 	DiscordClientSecret    string
 	DiscordRedirectURL     string
+	SessionSecret          string
 	DiscordTicketWebhook   string
 	DiscordRPWebhook       string
 	RPModeratorIDs         string
+	SupportStaffIDs        string
 	MinecraftServerAddr    string
 	TelegramNewsChannel    string
 	DiscordNewsChannelID   string
 	DiscordTicketChannelID string
 	DiscordBotToken        string
 	DiscordGuildID         string
+	DiscordShardID         string
+	DiscordShardCount      string
+	DiscordPublicKey       string
+	DiscordChatChannelID   string
+	MinecraftRCONAddr      string
+	MinecraftRCONPassword  string
+	MinecraftChatToken     string
 	VAPIDPublicKey         string
 	VAPIDPrivateKey        string
 	SupportPushSubject     string
 	SupportStorageDir      string
+	SMTPHost               string
+	SMTPPort               string
+	SMTPUsername           string
+	SMTPPassword           string
+	SupportEmailFrom       string
+	SupportEmailReplyTo    string
+	SupportEmailSecret     string
+	SupportInboundToken    string
+	SupportCaptchaSecret   string
+	SupportCaptchaURL      string
+	SupportClamdAddr       string
 	SkinStorageDir         string
 	MediaCacheDir          string
 	TenorAPIKey            string
@@ -35,19 +55,39 @@ func Load() Config {
 		DiscordClientID:        getEnv("DISCORD_CLIENT_ID", ""),
 		DiscordClientSecret:    getEnv("DISCORD_CLIENT_SECRET", ""),
 		DiscordRedirectURL:     getEnv("DISCORD_REDIRECT_URL", "http://localhost:8080/api/auth/discord/callback"),
+		SessionSecret:          getEnv("SESSION_SECRET", ""),
 		DiscordTicketWebhook:   getEnv("DISCORD_TICKET_WEBHOOK", ""),
 		DiscordRPWebhook:       getEnv("DISCORD_RP_WEBHOOK", ""),
 		RPModeratorIDs:         getEnv("DISCORD_RP_MODERATOR_IDS", ""),
+		SupportStaffIDs:        getEnv("DISCORD_SUPPORT_STAFF_IDS", ""),
 		MinecraftServerAddr:    getEnv("MINECRAFT_SERVER_ADDRESS", "amyworld.ru"),
 		TelegramNewsChannel:    getEnv("TELEGRAM_NEWS_CHANNEL", ""),
 		DiscordNewsChannelID:   getEnv("DISCORD_NEWS_CHANNEL_ID", ""),
 		DiscordTicketChannelID: getEnv("DISCORD_TICKET_CHANNEL_ID", ""),
 		DiscordBotToken:        getEnv("DISCORD_BOT_TOKEN", ""),
 		DiscordGuildID:         getEnv("DISCORD_GUILD_ID", ""),
+		DiscordShardID:         getEnv("DISCORD_SHARD_ID", "0"),
+		DiscordShardCount:      getEnv("DISCORD_SHARD_COUNT", "1"),
+		DiscordPublicKey:       getEnv("DISCORD_PUBLIC_KEY", ""),
+		DiscordChatChannelID:   getEnv("DISCORD_CHAT_CHANNEL_ID", "1458094528723423338"),
+		MinecraftRCONAddr:      getEnv("MINECRAFT_RCON_ADDRESS", ""),
+		MinecraftRCONPassword:  getEnv("MINECRAFT_RCON_PASSWORD", ""),
+		MinecraftChatToken:     getEnv("MINECRAFT_CHAT_TOKEN", ""),
 		VAPIDPublicKey:         getEnv("VAPID_PUBLIC_KEY", ""),
 		VAPIDPrivateKey:        getEnv("VAPID_PRIVATE_KEY", ""),
 		SupportPushSubject:     getEnv("SUPPORT_PUSH_SUBJECT", "mailto:support@amyworld.ru"),
 		SupportStorageDir:      getEnv("SUPPORT_STORAGE_DIR", "data/support"),
+		SMTPHost:               getEnv("SMTP_HOST", ""),
+		SMTPPort:               getEnv("SMTP_PORT", "587"),
+		SMTPUsername:           getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:           getEnv("SMTP_PASSWORD", ""),
+		SupportEmailFrom:       getEnv("SUPPORT_EMAIL_FROM", ""),
+		SupportEmailReplyTo:    getEnv("SUPPORT_EMAIL_REPLY_TO", ""),
+		SupportEmailSecret:     getEnv("SUPPORT_EMAIL_SECRET", ""),
+		SupportInboundToken:    getEnv("SUPPORT_EMAIL_INBOUND_TOKEN", ""),
+		SupportCaptchaSecret:   getEnv("SUPPORT_CAPTCHA_SECRET", ""),
+		SupportCaptchaURL:      getEnv("SUPPORT_CAPTCHA_VERIFY_URL", ""),
+		SupportClamdAddr:       getEnv("SUPPORT_CLAMD_ADDR", ""),
 		SkinStorageDir:         getEnv("SKIN_STORAGE_DIR", "data/skins"),
 		MediaCacheDir:          getEnv("MEDIA_CACHE_DIR", "data/media-cache"),
 		TenorAPIKey:            getEnv("TENOR_API_KEY", ""),
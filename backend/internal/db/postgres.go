@@ -105,6 +105,52 @@ func Migrate(ctx context.Context, db *sql.DB) error {
 		`CREATE INDEX IF NOT EXISTS support_tickets_status_created_at_idx ON support_tickets(status, created_at DESC)`,
 		`CREATE INDEX IF NOT EXISTS support_tickets_owner_created_at_idx ON support_tickets(owner_discord_id, created_at DESC)`,
 		`CREATE INDEX IF NOT EXISTS support_tickets_discord_message_id_idx ON support_tickets(discord_message_id)`,
+		`ALTER TABLE support_tickets ADD COLUMN IF NOT EXISTS discord_thread_id TEXT NOT NULL DEFAULT ''`,
+		`CREATE INDEX IF NOT EXISTS support_tickets_discord_thread_id_idx ON support_tickets(discord_thread_id) WHERE discord_thread_id <> ''`,
+		`ALTER TABLE support_tickets ADD COLUMN IF NOT EXISTS priority TEXT NOT NULL DEFAULT 'normal'`,
+		`ALTER TABLE support_tickets ADD COLUMN IF NOT EXISTS assignee_discord_id TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE support_tickets ADD COLUMN IF NOT EXISTS assignee_name TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE support_tickets ADD COLUMN IF NOT EXISTS assigned_at TIMESTAMPTZ`,
+		`ALTER TABLE support_tickets ADD COLUMN IF NOT EXISTS first_response_at TIMESTAMPTZ`,
+		`CREATE INDEX IF NOT EXISTS support_tickets_assignee_status_idx ON support_tickets(assignee_discord_id, status)`,
+		`CREATE TABLE IF NOT EXISTS support_sla_policies (
+			category TEXT PRIMARY KEY,
+			first_response_minutes INTEGER NOT NULL,
+			resolution_minutes INTEGER NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`INSERT INTO support_sla_policies (category, first_response_minutes, resolution_minutes)
+		 VALUES ('', 240, 4320), ('Оплата', 60, 1440), ('Техническая проблема', 120, 2880)
+		 ON CONFLICT (category) DO NOTHING`,
+		`CREATE TABLE IF NOT EXISTS support_autoclose_policies (
+			category TEXT PRIMARY KEY,
+			warn_after_hours INTEGER NOT NULL DEFAULT 0,
+			resolve_after_hours INTEGER NOT NULL DEFAULT 0,
+			archive_after_hours INTEGER NOT NULL DEFAULT 0,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`INSERT INTO support_autoclose_policies (category, warn_after_hours, resolve_after_hours, archive_after_hours)
+		 VALUES ('', 72, 120, 336)
+		 ON CONFLICT (category) DO NOTHING`,
+		`ALTER TABLE support_tickets ADD COLUMN IF NOT EXISTS autoclose_warned_at TIMESTAMPTZ`,
+		`CREATE TABLE IF NOT EXISTS support_ticket_ratings (
+			ticket_id BIGINT PRIMARY KEY REFERENCES support_tickets(id) ON DELETE CASCADE,
+			score SMALLINT NOT NULL CHECK (score BETWEEN 1 AND 5),
+			comment TEXT NOT NULL DEFAULT '',
+			staff_discord_id TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS support_ticket_ratings_updated_at_idx ON support_ticket_ratings(updated_at DESC)`,
+		`CREATE TABLE IF NOT EXISTS support_macros (
+			name TEXT PRIMARY KEY,
+			title TEXT NOT NULL DEFAULT '',
+			body TEXT NOT NULL,
+			set_status TEXT NOT NULL DEFAULT '',
+			set_category TEXT,
+			updated_by TEXT NOT NULL DEFAULT '',
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
 		`CREATE TABLE IF NOT EXISTS support_ticket_messages (
 			id BIGSERIAL PRIMARY KEY,
 			ticket_id BIGINT NOT NULL REFERENCES support_tickets(id) ON DELETE CASCADE,
@@ -119,6 +165,51 @@ func Migrate(ctx context.Context, db *sql.DB) error {
 		)`,
 		`CREATE INDEX IF NOT EXISTS support_ticket_messages_ticket_created_at_idx ON support_ticket_messages(ticket_id, created_at ASC)`,
 		`CREATE UNIQUE INDEX IF NOT EXISTS support_ticket_messages_discord_message_id_uq ON support_ticket_messages(discord_message_id) WHERE discord_message_id <> ''`,
+		`ALTER TABLE support_ticket_messages ADD COLUMN IF NOT EXISTS edited_at TIMESTAMPTZ`,
+		`ALTER TABLE support_ticket_messages ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ`,
+		`ALTER TABLE support_ticket_messages ADD COLUMN IF NOT EXISTS read_by_user_at TIMESTAMPTZ`,
+		`ALTER TABLE support_ticket_messages ADD COLUMN IF NOT EXISTS read_by_staff_at TIMESTAMPTZ`,
+		`ALTER TABLE support_ticket_messages ADD COLUMN IF NOT EXISTS read_by_staff_id TEXT NOT NULL DEFAULT ''`,
+		`UPDATE support_ticket_messages SET read_by_user_at = created_at
+		 WHERE author_type = 'admin' AND read_by_user = TRUE AND read_by_user_at IS NULL`,
+		`UPDATE support_ticket_messages m SET read_by_staff_at = m.created_at
+		 WHERE m.author_type = 'user' AND m.read_by_staff_at IS NULL
+		   AND EXISTS (
+		     SELECT 1 FROM support_ticket_messages a
+		     WHERE a.ticket_id = m.ticket_id AND a.author_type = 'admin' AND a.created_at >= m.created_at
+		   )`,
+		`CREATE INDEX IF NOT EXISTS support_ticket_messages_unread_staff_idx ON support_ticket_messages(ticket_id) WHERE author_type = 'user' AND read_by_staff_at IS NULL`,
+		`CREATE TABLE IF NOT EXISTS support_ticket_message_edits (
+			id BIGSERIAL PRIMARY KEY,
+			message_id BIGINT NOT NULL REFERENCES support_ticket_messages(id) ON DELETE CASCADE,
+			previous_message TEXT NOT NULL,
+			edited_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS support_ticket_message_edits_message_idx ON support_ticket_message_edits(message_id, edited_at ASC)`,
+		`UPDATE support_tickets t
+		 SET first_response_at = (SELECT MIN(m.created_at) FROM support_ticket_messages m WHERE m.ticket_id = t.id AND m.author_type = 'admin')
+		 WHERE t.first_response_at IS NULL
+		   AND EXISTS (SELECT 1 FROM support_ticket_messages m WHERE m.ticket_id = t.id AND m.author_type = 'admin')`,
+		`CREATE TABLE IF NOT EXISTS support_email_outbox (
+			id BIGSERIAL PRIMARY KEY,
+			ticket_id BIGINT NOT NULL REFERENCES support_tickets(id) ON DELETE CASCADE,
+			kind TEXT NOT NULL,
+			to_email TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			text_body TEXT NOT NULL,
+			html_body TEXT NOT NULL,
+			attempts INT NOT NULL DEFAULT 0,
+			last_error TEXT NOT NULL DEFAULT '',
+			next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			sent_at TIMESTAMPTZ,
+			failed_at TIMESTAMPTZ,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS support_email_outbox_pending_idx ON support_email_outbox(next_attempt_at) WHERE sent_at IS NULL AND failed_at IS NULL`,
+		`CREATE TABLE IF NOT EXISTS support_email_unsubscribes (
+			email TEXT PRIMARY KEY,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
 		`CREATE TABLE IF NOT EXISTS support_ticket_attachments (
 			id BIGSERIAL PRIMARY KEY,
 			ticket_id BIGINT NOT NULL REFERENCES support_tickets(id) ON DELETE CASCADE,
@@ -187,6 +278,118 @@ func Migrate(ctx context.Context, db *sql.DB) error {
 			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 		)`,
 		`CREATE INDEX IF NOT EXISTS news_comments_news_id_created_at_idx ON news_comments(news_id, created_at ASC)`,
+		`CREATE TABLE IF NOT EXISTS account_deletion_requests (
+			discord_id TEXT PRIMARY KEY,
+			requested_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			scheduled_at TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS support_ticket_verifications (
+			token TEXT PRIMARY KEY,
+			discord_id TEXT NOT NULL,
+			payload JSONB NOT NULL,
+			client_ip TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			expires_at TIMESTAMPTZ NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS support_ticket_verifications_expires_at_idx ON support_ticket_verifications(expires_at)`,
+		`ALTER TABLE support_ticket_attachments ADD COLUMN IF NOT EXISTS thumbnail_path TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE support_ticket_attachments ADD COLUMN IF NOT EXISTS quarantine_reason TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE support_ticket_attachments ADD COLUMN IF NOT EXISTS quarantined_at TIMESTAMPTZ`,
+		`ALTER TABLE news_comments ADD COLUMN IF NOT EXISTS reply_to_id BIGINT REFERENCES news_comments(id) ON DELETE SET NULL`,
+		`CREATE TABLE IF NOT EXISTS notifications (
+			id BIGSERIAL PRIMARY KEY,
+			discord_id TEXT NOT NULL REFERENCES discord_users(discord_id) ON DELETE CASCADE,
+			kind TEXT NOT NULL,
+			title TEXT NOT NULL,
+			body TEXT NOT NULL DEFAULT '',
+			url TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			read_at TIMESTAMPTZ
+		)`,
+		`CREATE INDEX IF NOT EXISTS notifications_discord_id_idx ON notifications(discord_id, id DESC)`,
+		`CREATE TABLE IF NOT EXISTS notification_preferences (
+			discord_id TEXT NOT NULL REFERENCES discord_users(discord_id) ON DELETE CASCADE,
+			kind TEXT NOT NULL,
+			inbox BOOLEAN NOT NULL DEFAULT TRUE,
+			push BOOLEAN NOT NULL DEFAULT TRUE,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			PRIMARY KEY (discord_id, kind)
+		)`,
+		`CREATE INDEX IF NOT EXISTS notification_preferences_kind_idx ON notification_preferences(kind)`,
+		`ALTER TABLE support_push_subscriptions ADD COLUMN IF NOT EXISTS failure_count INT NOT NULL DEFAULT 0`,
+		`ALTER TABLE support_push_subscriptions ADD COLUMN IF NOT EXISTS last_error TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE support_push_subscriptions ADD COLUMN IF NOT EXISTS last_success_at TIMESTAMPTZ`,
+		`ALTER TABLE support_push_subscriptions ADD COLUMN IF NOT EXISTS last_failure_at TIMESTAMPTZ`,
+		`CREATE TABLE IF NOT EXISTS push_outbox (
+			id BIGSERIAL PRIMARY KEY,
+			subscription_id BIGINT NOT NULL REFERENCES support_push_subscriptions(id) ON DELETE CASCADE,
+			kind TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			topic TEXT NOT NULL DEFAULT '',
+			urgency TEXT NOT NULL DEFAULT 'normal',
+			attempts INT NOT NULL DEFAULT 0,
+			last_error TEXT NOT NULL DEFAULT '',
+			next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			expires_at TIMESTAMPTZ NOT NULL,
+			sent_at TIMESTAMPTZ,
+			failed_at TIMESTAMPTZ,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS push_outbox_pending_idx ON push_outbox(next_attempt_at) WHERE sent_at IS NULL AND failed_at IS NULL`,
+		`CREATE INDEX IF NOT EXISTS push_outbox_subscription_id_idx ON push_outbox(subscription_id)`,
+		`CREATE TABLE IF NOT EXISTS discord_outbox (
+			id BIGSERIAL PRIMARY KEY,
+			entity_type TEXT NOT NULL,
+			entity_id TEXT NOT NULL,
+			action TEXT NOT NULL,
+			ref TEXT NOT NULL DEFAULT '',
+			attempts INT NOT NULL DEFAULT 0,
+			last_error TEXT NOT NULL DEFAULT '',
+			next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			done_at TIMESTAMPTZ,
+			failed_at TIMESTAMPTZ,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS discord_outbox_pending_idx ON discord_outbox(next_attempt_at) WHERE done_at IS NULL AND failed_at IS NULL`,
+		`CREATE INDEX IF NOT EXISTS discord_outbox_entity_idx ON discord_outbox(entity_type, entity_id, id) WHERE done_at IS NULL AND failed_at IS NULL`,
+		`ALTER TABLE rp_applications ADD COLUMN IF NOT EXISTS discord_sync_status TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE rp_applications ADD COLUMN IF NOT EXISTS discord_sync_error TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE support_tickets ADD COLUMN IF NOT EXISTS discord_sync_status TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE support_tickets ADD COLUMN IF NOT EXISTS discord_sync_error TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE support_ticket_messages ADD COLUMN IF NOT EXISTS reply_source TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE discord_member_states ADD COLUMN IF NOT EXISTS left_at TIMESTAMPTZ`,
+		`ALTER TABLE rp_applications ADD COLUMN IF NOT EXISTS moderation_reason TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE discord_member_states ADD COLUMN IF NOT EXISTS guild_joined_at TIMESTAMPTZ`,
+		`CREATE TABLE IF NOT EXISTS discord_member_events (
+			id BIGSERIAL PRIMARY KEY,
+			discord_id TEXT NOT NULL,
+			event_type TEXT NOT NULL,
+			role_id TEXT NOT NULL DEFAULT '',
+			old_value TEXT NOT NULL DEFAULT '',
+			new_value TEXT NOT NULL DEFAULT '',
+			source TEXT NOT NULL DEFAULT '',
+			occurred_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS discord_member_events_member_idx ON discord_member_events(discord_id, occurred_at DESC, id DESC)`,
+		`CREATE TABLE IF NOT EXISTS community_chat_messages (
+			id BIGINT PRIMARY KEY,
+			channel_id TEXT NOT NULL,
+			author_discord_id TEXT NOT NULL DEFAULT '',
+			author TEXT NOT NULL DEFAULT '',
+			avatar_url TEXT NOT NULL DEFAULT '',
+			message TEXT NOT NULL DEFAULT '',
+			image_url TEXT NOT NULL DEFAULT '',
+			gif_url TEXT NOT NULL DEFAULT '',
+			source TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL,
+			edited_at TIMESTAMPTZ,
+			deleted_at TIMESTAMPTZ
+		)`,
+		`CREATE INDEX IF NOT EXISTS community_chat_messages_channel_idx ON community_chat_messages(channel_id, id DESC) WHERE deleted_at IS NULL`,
+		`CREATE TABLE IF NOT EXISTS deleted_accounts (
+			discord_id TEXT PRIMARY KEY,
+			deleted_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
 	}
 
 	for _, statement := range statements {
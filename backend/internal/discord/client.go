@@ -0,0 +1,312 @@
+// Package discord is the backend's REST client for the Discord API and
+// webhooks. It tracks Discord's rate limit buckets, retries 429s and
+// transient failures, and records every attempt in the outbound metrics.
+package discord
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	"amy/minecraft-server/internal/observability"
+)
+
+const (
+	DefaultBaseURL = "https://discord.com/api/v10"
+
+	userAgent        = "DiscordBot (https://amyworld.ru, 1.0)"
+	maxResponseBytes = 8 * 1024 * 1024
+)
+
+// Client is safe for concurrent use. One client should be shared by every
+// caller using the same bot token, so they all see the same buckets.
+type Client struct {
+	token        string
+	baseURL      string
+	httpClient   *http.Client
+	maxRetries   int
+	maxRetryWait time.Duration
+	limiter      *limiter
+}
+
+type Option func(*Client)
+
+// WithBaseURL points the client at another API root, such as an httptest
+// server. Absolute webhook URLs on discord.com are rewritten to it as well.
+func WithBaseURL(baseURL string) Option {
+	return func(c *Client) { c.baseURL = strings.TrimRight(baseURL, "/") }
+}
+
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) { c.httpClient = httpClient }
+}
+
+// WithRetries sets how many times a request is retried and the longest
+// rate limit the client waits out instead of returning a RateLimitError.
+func WithRetries(maxRetries int, maxRetryWait time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.maxRetryWait = maxRetryWait
+	}
+}
+
+func New(botToken string, options ...Option) *Client {
+	c := &Client{
+		token:        strings.TrimSpace(botToken),
+		baseURL:      DefaultBaseURL,
+		httpClient:   &http.Client{Timeout: 15 * time.Second},
+		maxRetries:   3,
+		maxRetryWait: 30 * time.Second,
+		limiter:      newLimiter(),
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// Configured reports whether the client has a bot token for API calls.
+// Webhook calls work without one.
+func (c *Client) Configured() bool {
+	return c != nil && c.token != ""
+}
+
+// Request describes one API call.
+type Request struct {
+	// Kind labels the call in the amy_backend_discord_outbound_* metrics.
+	Kind   string
+	Method string
+	// Path is relative to the API root ("/channels/1/messages") or a full
+	// webhook URL, which is called without the bot token.
+	Path  string
+	Query url.Values
+	// JSON is the request body. With Files it is sent as payload_json of a
+	// multipart form.
+	JSON  any
+	Files []File
+	// Form sends an urlencoded body, as the OAuth token endpoint expects.
+	Form url.Values
+	// Bearer replaces the bot token with a user's OAuth access token.
+	Bearer string
+	// Anonymous sends no Authorization header.
+	Anonymous bool
+}
+
+type File struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// Do sends req, waiting for its rate limit bucket first, and decodes a JSON
+// response into out when out is not nil. Non-2xx responses come back as
+// *Error, and a rate limit longer than the client is willing to wait as
+// *RateLimitError.
+func (c *Client) Do(ctx context.Context, req Request, out any) error {
+	if req.Method == "" {
+		req.Method = http.MethodGet
+	}
+	target, webhook, err := c.resolve(req)
+	if err != nil {
+		return err
+	}
+	body, contentType, err := encodeBody(req)
+	if err != nil {
+		return err
+	}
+	route := routeFor(req.Method, target.Path)
+
+	for attempt := 0; ; attempt++ {
+		if err := c.limiter.wait(ctx, route); err != nil {
+			return err
+		}
+
+		httpReq, err := http.NewRequestWithContext(ctx, req.Method, target.String(), bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		httpReq.Header.Set("User-Agent", userAgent)
+		if contentType != "" {
+			httpReq.Header.Set("Content-Type", contentType)
+		}
+		switch {
+		case webhook || req.Anonymous:
+		case req.Bearer != "":
+			httpReq.Header.Set("Authorization", "Bearer "+req.Bearer)
+		case c.token != "":
+			httpReq.Header.Set("Authorization", "Bot "+c.token)
+		}
+
+		startedAt := time.Now()
+		resp, err := c.httpClient.Do(httpReq)
+		if err != nil {
+			observability.ObserveDiscordOutbound(req.Kind, startedAt, 0, err)
+			// url.Error repeats the request URL, which holds the token of
+			// a webhook.
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				err = urlErr.Err
+			}
+			if ctx.Err() == nil && idempotent(req.Method) && attempt < c.maxRetries {
+				if sleep(ctx, backoff(attempt)) == nil {
+					continue
+				}
+			}
+			return fmt.Errorf("discord %s: %w", route.name, err)
+		}
+		observability.ObserveDiscordOutbound(req.Kind, startedAt, resp.StatusCode, nil)
+		c.limiter.update(route, resp.Header)
+
+		if resp.StatusCode == http.StatusTooManyRequests {
+			limited := readRateLimit(resp)
+			observability.DiscordRateLimited.WithLabelValues(req.Kind, limited.Scope).Inc()
+			c.limiter.penalize(route, limited)
+			if attempt < c.maxRetries && limited.RetryAfter <= c.maxRetryWait {
+				continue
+			}
+			limited.Route = route.name
+			return limited
+		}
+		if resp.StatusCode >= 500 && idempotent(req.Method) && attempt < c.maxRetries {
+			drain(resp)
+			if err := sleep(ctx, backoff(attempt)); err != nil {
+				return err
+			}
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return readError(resp, route.name)
+		}
+
+		defer resp.Body.Close()
+		if out == nil || resp.StatusCode == http.StatusNoContent {
+			return nil
+		}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseBytes)).Decode(out); err != nil {
+			return fmt.Errorf("discord %s: decode response: %w", route.name, err)
+		}
+		return nil
+	}
+}
+
+// resolve turns the request path into a URL and reports whether it is a
+// webhook URL given in full.
+func (c *Client) resolve(req Request) (*url.URL, bool, error) {
+	webhook := strings.HasPrefix(req.Path, "https://") || strings.HasPrefix(req.Path, "http://")
+	raw := req.Path
+	if !webhook {
+		raw = c.baseURL + req.Path
+	}
+	target, err := url.Parse(raw)
+	if err != nil {
+		return nil, false, fmt.Errorf("discord: invalid request url")
+	}
+	if webhook && c.baseURL != DefaultBaseURL && strings.EqualFold(target.Hostname(), "discord.com") {
+		base, err := url.Parse(c.baseURL)
+		if err != nil {
+			return nil, false, err
+		}
+		target.Scheme = base.Scheme
+		target.Host = base.Host
+		target.Path = base.Path + apiVersionPrefix.ReplaceAllString(target.Path, "")
+	}
+	if len(req.Query) > 0 {
+		query := target.Query()
+		for key, values := range req.Query {
+			query[key] = values
+		}
+		target.RawQuery = query.Encode()
+	}
+	return target, webhook, nil
+}
+
+func encodeBody(req Request) ([]byte, string, error) {
+	switch {
+	case req.Form != nil:
+		return []byte(req.Form.Encode()), "application/x-www-form-urlencoded", nil
+	case len(req.Files) > 0:
+		var form bytes.Buffer
+		writer := multipart.NewWriter(&form)
+		if req.JSON != nil {
+			raw, err := json.Marshal(req.JSON)
+			if err != nil {
+				return nil, "", err
+			}
+			if err := writer.WriteField("payload_json", string(raw)); err != nil {
+				return nil, "", err
+			}
+		}
+		for index, file := range req.Files {
+			header := make(textproto.MIMEHeader)
+			header.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{"name": fmt.Sprintf("files[%d]", index), "filename": file.Name}))
+			contentType := file.ContentType
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+			header.Set("Content-Type", contentType)
+			part, err := writer.CreatePart(header)
+			if err != nil {
+				return nil, "", err
+			}
+			if _, err := part.Write(file.Data); err != nil {
+				return nil, "", err
+			}
+		}
+		if err := writer.Close(); err != nil {
+			return nil, "", err
+		}
+		return form.Bytes(), writer.FormDataContentType(), nil
+	case req.JSON != nil:
+		raw, err := json.Marshal(req.JSON)
+		if err != nil {
+			return nil, "", err
+		}
+		return raw, "application/json", nil
+	default:
+		return nil, "", nil
+	}
+}
+
+// idempotent methods are retried after 5xx and network errors. A POST may
+// have been applied before the failure, and retrying it could post twice.
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+func backoff(attempt int) time.Duration {
+	return 500 * time.Millisecond << uint(attempt)
+}
+
+func sleep(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func drain(resp *http.Response) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	_ = resp.Body.Close()
+}
@@ -0,0 +1,217 @@
+package discord
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeAPI answers every request with respond(n), n counting from 1, and
+// remembers when each request arrived.
+type fakeAPI struct {
+	mu       sync.Mutex
+	arrivals []time.Time
+	paths    []string
+	calls    atomic.Int32
+}
+
+func newFakeAPI(t *testing.T, respond func(w http.ResponseWriter, n int)) (*fakeAPI, *httptest.Server) {
+	t.Helper()
+	api := &fakeAPI{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api.mu.Lock()
+		api.arrivals = append(api.arrivals, time.Now())
+		api.paths = append(api.paths, r.URL.Path)
+		api.mu.Unlock()
+		respond(w, int(api.calls.Add(1)))
+	}))
+	t.Cleanup(server.Close)
+	return api, server
+}
+
+func rateLimited(w http.ResponseWriter, retryAfter float64, global bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if global {
+		w.Header().Set("X-RateLimit-Global", "true")
+		w.Header().Set("X-RateLimit-Scope", "global")
+	}
+	w.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprintf(w, `{"message":"You are being rate limited.","retry_after":%g,"global":%t}`, retryAfter, global)
+}
+
+func TestDoWaitsForExhaustedBucket(t *testing.T) {
+	api, server := newFakeAPI(t, func(w http.ResponseWriter, n int) {
+		w.Header().Set("X-RateLimit-Bucket", "abcd")
+		w.Header().Set("X-RateLimit-Limit", "1")
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset-After", "0.3")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	client := New("token", WithBaseURL(server.URL))
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := client.Do(ctx, Request{Kind: "test", Path: "/channels/1/messages/2"}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Another channel is a different bucket and goes through at once.
+	if err := client.Do(ctx, Request{Kind: "test", Path: "/channels/9/messages/2"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if gap := api.arrivals[1].Sub(api.arrivals[0]); gap < 250*time.Millisecond {
+		t.Errorf("second request came %s after the first, want the 300ms reset", gap)
+	}
+	if gap := api.arrivals[2].Sub(api.arrivals[1]); gap > 200*time.Millisecond {
+		t.Errorf("request on another channel waited %s", gap)
+	}
+}
+
+func TestDoRetriesShortRateLimit(t *testing.T) {
+	api, server := newFakeAPI(t, func(w http.ResponseWriter, n int) {
+		if n == 1 {
+			rateLimited(w, 0.2, false)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"42"}`)
+	})
+	client := New("token", WithBaseURL(server.URL), WithRetries(3, time.Second))
+
+	var out struct {
+		ID string `json:"id"`
+	}
+	if err := client.Do(context.Background(), Request{Kind: "test", Method: http.MethodPost, Path: "/channels/1/messages"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.ID != "42" || api.calls.Load() != 2 {
+		t.Fatalf("got id %q after %d calls, want 42 after 2", out.ID, api.calls.Load())
+	}
+	if gap := api.arrivals[1].Sub(api.arrivals[0]); gap < 150*time.Millisecond {
+		t.Errorf("retried %s after the 429, want retry_after", gap)
+	}
+}
+
+func TestDoReturnsLongRateLimit(t *testing.T) {
+	api, server := newFakeAPI(t, func(w http.ResponseWriter, n int) {
+		rateLimited(w, 60, true)
+	})
+	client := New("token", WithBaseURL(server.URL), WithRetries(3, time.Second))
+	ctx := context.Background()
+
+	err := client.Do(ctx, Request{Kind: "test", Path: "/channels/1/messages/2"}, nil)
+	var limited *RateLimitError
+	if !errors.As(err, &limited) {
+		t.Fatalf("got %v, want *RateLimitError", err)
+	}
+	if limited.RetryAfter != time.Minute || !limited.Global || limited.Scope != "global" || limited.Route != "GET /channels/1/messages/:id" {
+		t.Errorf("unexpected rate limit %+v", limited)
+	}
+	if StatusCode(err) != http.StatusTooManyRequests {
+		t.Errorf("StatusCode = %d, want 429", StatusCode(err))
+	}
+	if api.calls.Load() != 1 {
+		t.Errorf("got %d calls, want no retry", api.calls.Load())
+	}
+
+	// The global limit now holds back every route until the context ends.
+	waitCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := client.Do(waitCtx, Request{Kind: "test", Path: "/guilds/5/members"}, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the request to wait for the global limit", err)
+	}
+	if api.calls.Load() != 1 {
+		t.Errorf("a request went out during the global limit")
+	}
+}
+
+func TestDoRetriesServerErrorsOnlyWhenIdempotent(t *testing.T) {
+	api, server := newFakeAPI(t, func(w http.ResponseWriter, n int) {
+		if n == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	client := New("token", WithBaseURL(server.URL), WithRetries(1, time.Second))
+	ctx := context.Background()
+
+	if err := client.Do(ctx, Request{Kind: "test", Method: http.MethodPatch, Path: "/channels/1/messages/2", JSON: map[string]string{"content": "x"}}, nil); err != nil {
+		t.Fatalf("PATCH after a 502: %v", err)
+	}
+	if api.calls.Load() != 2 {
+		t.Fatalf("got %d calls, want a retry", api.calls.Load())
+	}
+
+	api.calls.Store(0)
+	err := client.Do(ctx, Request{Kind: "test", Method: http.MethodPost, Path: "/channels/1/messages", JSON: map[string]string{"content": "x"}}, nil)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusBadGateway {
+		t.Fatalf("POST after a 502: got %v, want *Error 502", err)
+	}
+	if api.calls.Load() != 1 {
+		t.Errorf("POST was sent %d times, want 1", api.calls.Load())
+	}
+}
+
+func TestDoGivesUpAfterMaxRetries(t *testing.T) {
+	api, server := newFakeAPI(t, func(w http.ResponseWriter, n int) {
+		rateLimited(w, 0.01, false)
+	})
+	client := New("token", WithBaseURL(server.URL), WithRetries(2, time.Second))
+
+	err := client.Do(context.Background(), Request{Kind: "test", Path: "/channels/1/messages/2"}, nil)
+	var limited *RateLimitError
+	if !errors.As(err, &limited) {
+		t.Fatalf("got %v, want *RateLimitError", err)
+	}
+	if api.calls.Load() != 3 {
+		t.Errorf("got %d calls, want the first try and 2 retries", api.calls.Load())
+	}
+}
+
+func TestDoErrorBody(t *testing.T) {
+	api, server := newFakeAPI(t, func(w http.ResponseWriter, n int) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message":"Unknown Message","code":10008}`)
+	})
+	client := New("token", WithBaseURL(server.URL))
+
+	err := client.DeleteWebhookMessage(context.Background(), "test", "https://discord.com/api/webhooks/1/secret-token", "2")
+	if !IsNotFound(err) {
+		t.Fatalf("got %v, want not found", err)
+	}
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Code != 10008 || apiErr.Message != "Unknown Message" {
+		t.Fatalf("unexpected error %+v", err)
+	}
+	if apiErr.Route != "DELETE /webhooks/1/:token/messages/:id" {
+		t.Errorf("route %q should hide the webhook token", apiErr.Route)
+	}
+	// WithBaseURL redirects discord.com webhook URLs to the fake API.
+	if api.paths[0] != "/webhooks/1/secret-token/messages/2" {
+		t.Errorf("webhook request went to %q", api.paths[0])
+	}
+}
+
+func TestRouteFor(t *testing.T) {
+	cases := map[string]route{
+		"/api/v10/channels/1/messages/2": {key: "GET /channels/1/messages/:id", major: "channels/1", name: "GET /channels/1/messages/:id"},
+		"/guilds/5/members/7":            {key: "GET /guilds/5/members/:id", major: "guilds/5", name: "GET /guilds/5/members/:id"},
+		"/webhooks/1/tok/messages/3":     {key: "GET /webhooks/1/tok/messages/:id", major: "webhooks/1/tok", name: "GET /webhooks/1/:token/messages/:id"},
+		"/users/@me":                     {key: "GET /users/@me", major: "", name: "GET /users/@me"},
+	}
+	for path, want := range cases {
+		if got := routeFor(http.MethodGet, path); got != want {
+			t.Errorf("%s: got %+v, want %+v", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package discord
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error is a non-2xx response other than 429.
+type Error struct {
+	Route  string
+	Status int
+	// Code and Message come from Discord's JSON error body, for example
+	// 10008 "Unknown Message".
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	text := fmt.Sprintf("discord %s: status %d", e.Route, e.Status)
+	if e.Code != 0 {
+		text += fmt.Sprintf(" (%d %s)", e.Code, e.Message)
+	} else if e.Message != "" {
+		text += ": " + e.Message
+	}
+	return text
+}
+
+// RateLimitError is a 429 the client did not wait out.
+type RateLimitError struct {
+	Route      string
+	RetryAfter time.Duration
+	Global     bool
+	// Scope is the X-RateLimit-Scope header: user, global or shared.
+	Scope string
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("discord %s: rate limited (%s), retry after %s", e.Route, e.Scope, e.RetryAfter.Round(time.Millisecond))
+}
+
+// StatusCode returns the HTTP status behind err, or 0 when the request did
+// not get a response.
+func StatusCode(err error) int {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Status
+	}
+	var limited *RateLimitError
+	if errors.As(err, &limited) {
+		return http.StatusTooManyRequests
+	}
+	return 0
+}
+
+// IsNotFound reports whether the target of the request no longer exists,
+// such as a message deleted by hand in Discord.
+func IsNotFound(err error) bool {
+	return StatusCode(err) == http.StatusNotFound
+}
+
+func readError(resp *http.Response, routeName string) error {
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	apiErr := &Error{Route: routeName, Status: resp.StatusCode}
+	var body struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(raw, &body) == nil && (body.Code != 0 || body.Message != "") {
+		apiErr.Code = body.Code
+		apiErr.Message = body.Message
+	} else {
+		apiErr.Message = strings.TrimSpace(string(raw))
+		if len(apiErr.Message) > 300 {
+			apiErr.Message = apiErr.Message[:300]
+		}
+	}
+	return apiErr
+}
+
+func readRateLimit(resp *http.Response) *RateLimitError {
+	defer resp.Body.Close()
+	limited := &RateLimitError{
+		Global: resp.Header.Get("X-RateLimit-Global") == "true",
+		Scope:  resp.Header.Get("X-RateLimit-Scope"),
+	}
+	var body struct {
+		RetryAfter float64 `json:"retry_after"`
+		Global     bool    `json:"global"`
+	}
+	if json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&body) == nil && body.RetryAfter > 0 {
+		limited.RetryAfter = time.Duration(body.RetryAfter * float64(time.Second))
+		limited.Global = limited.Global || body.Global
+	} else if seconds, err := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); err == nil {
+		limited.RetryAfter = time.Duration(seconds * float64(time.Second))
+	} else {
+		limited.RetryAfter = time.Second
+	}
+	if limited.Scope == "" {
+		limited.Scope = "user"
+		if limited.Global {
+			limited.Scope = "global"
+		}
+	}
+	return limited
+}
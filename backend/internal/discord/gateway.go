@@ -0,0 +1,552 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"amy/minecraft-server/internal/observability"
+	"github.com/gorilla/websocket"
+)
+
+// GatewayState is where the gateway connection is in its lifecycle.
+type GatewayState string
+
+const (
+	GatewayDisconnected GatewayState = "disconnected"
+	GatewayConnecting   GatewayState = "connecting"
+	GatewayIdentifying  GatewayState = "identifying"
+	GatewayResuming     GatewayState = "resuming"
+	GatewayReady        GatewayState = "ready"
+	GatewayBackoff      GatewayState = "backoff"
+	// GatewayFailed means Discord refused the session for good, for example
+	// because of a wrong token or intents the bot is not allowed to use.
+	GatewayFailed GatewayState = "failed"
+)
+
+var gatewayStates = []GatewayState{GatewayDisconnected, GatewayConnecting, GatewayIdentifying, GatewayResuming, GatewayReady, GatewayBackoff, GatewayFailed}
+
+const (
+	gatewayOpDispatch       = 0
+	gatewayOpHeartbeat      = 1
+	gatewayOpIdentify       = 2
+	gatewayOpResume         = 6
+	gatewayOpReconnect      = 7
+	gatewayOpInvalidSession = 9
+	gatewayOpHello          = 10
+	gatewayOpHeartbeatACK   = 11
+
+	gatewayVersionQuery = "?v=10&encoding=json"
+	gatewayMaxBackoff   = time.Minute
+)
+
+// DispatchFunc receives every dispatch event (op 0) in the order Discord
+// sent it, including the events replayed after a resume.
+type DispatchFunc func(ctx context.Context, event string, data json.RawMessage)
+
+// GatewayStatus is a snapshot of the connection for health checks.
+type GatewayStatus struct {
+	State GatewayState `json:"state"`
+	// Shard is [shard id, shard count].
+	Shard       [2]int     `json:"shard"`
+	Resumable   bool       `json:"resumable"`
+	LatencyMS   int64      `json:"latencyMs"`
+	ReadySince  *time.Time `json:"readySince,omitempty"`
+	Reconnects  int64      `json:"reconnects"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+// Gateway keeps one shard connected to the Discord gateway. It resumes the
+// session after a dropped connection, so events sent in the meantime are
+// replayed instead of lost, and only identifies again when Discord refuses
+// the resume.
+type Gateway struct {
+	client     *Client
+	intents    int
+	shardID    int
+	shardCount int
+	dispatch   DispatchFunc
+	gatewayURL string
+	dialer     websocket.Dialer
+
+	mu          sync.Mutex
+	state       GatewayState
+	sessionID   string
+	resumeURL   string
+	sequence    int64
+	latency     time.Duration
+	readySince  time.Time
+	reconnects  int64
+	lastError   string
+	lastErrorAt time.Time
+}
+
+type GatewayOption func(*Gateway)
+
+// WithShard identifies as shard id of count. A bot in a single guild runs
+// shard 0 of 1.
+func WithShard(id, count int) GatewayOption {
+	return func(g *Gateway) {
+		if count > 0 && id >= 0 && id < count {
+			g.shardID = id
+			g.shardCount = count
+		}
+	}
+}
+
+// WithGatewayURL connects to gatewayURL instead of asking GET /gateway/bot,
+// such as an httptest server.
+func WithGatewayURL(gatewayURL string) GatewayOption {
+	return func(g *Gateway) { g.gatewayURL = strings.TrimRight(gatewayURL, "/") }
+}
+
+func NewGateway(client *Client, intents int, dispatch DispatchFunc, options ...GatewayOption) *Gateway {
+	g := &Gateway{
+		client:     client,
+		intents:    intents,
+		shardCount: 1,
+		dispatch:   dispatch,
+		dialer:     websocket.Dialer{HandshakeTimeout: 10 * time.Second},
+	}
+	for _, option := range options {
+		option(g)
+	}
+	g.setState(GatewayDisconnected)
+	return g
+}
+
+// ShardForGuild returns the shard that receives the events of guildID.
+func ShardForGuild(guildID string, shardCount int) int {
+	id, err := strconv.ParseUint(strings.TrimSpace(guildID), 10, 64)
+	if err != nil || shardCount <= 1 {
+		return 0
+	}
+	return int((id >> 22) % uint64(shardCount))
+}
+
+// Status is safe to call on a nil gateway, which reports itself disconnected.
+func (g *Gateway) Status() GatewayStatus {
+	if g == nil {
+		return GatewayStatus{State: GatewayDisconnected, Shard: [2]int{0, 1}}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	status := GatewayStatus{
+		State:      g.state,
+		Shard:      [2]int{g.shardID, g.shardCount},
+		Resumable:  g.sessionID != "",
+		LatencyMS:  g.latency.Milliseconds(),
+		Reconnects: g.reconnects,
+		LastError:  g.lastError,
+	}
+	if g.state == GatewayReady && !g.readySince.IsZero() {
+		readySince := g.readySince
+		status.ReadySince = &readySince
+	}
+	if !g.lastErrorAt.IsZero() {
+		lastErrorAt := g.lastErrorAt
+		status.LastErrorAt = &lastErrorAt
+	}
+	return status
+}
+
+// Run keeps the gateway connected until ctx is done or Discord rejects the
+// session with a close code that retrying cannot fix.
+func (g *Gateway) Run(ctx context.Context) {
+	attempt := 0
+	for {
+		startedAt := time.Now()
+		ready, err := g.connect(ctx)
+		if ctx.Err() != nil {
+			g.setState(GatewayDisconnected)
+			return
+		}
+		var fatal *gatewayFatalError
+		if errors.As(err, &fatal) {
+			log.Printf("discord gateway stopped: %v", err)
+			g.recordError(err)
+			g.setState(GatewayFailed)
+			return
+		}
+
+		reason := "error"
+		var disconnect *gatewayDisconnect
+		if errors.As(err, &disconnect) {
+			reason = disconnect.reason
+		}
+		if err != nil {
+			g.recordError(err)
+			log.Printf("discord gateway disconnected (%s): %v", reason, err)
+		}
+		observability.DiscordGatewayReconnects.WithLabelValues(reason).Inc()
+		g.mu.Lock()
+		g.reconnects++
+		g.mu.Unlock()
+
+		// A session that stayed up for a while starts the backoff over; one
+		// that drops right after READY keeps growing it.
+		if ready && time.Since(startedAt) > gatewayMaxBackoff {
+			attempt = 0
+		}
+		g.setState(GatewayBackoff)
+		if sleep(ctx, gatewayBackoff(attempt)) != nil {
+			g.setState(GatewayDisconnected)
+			return
+		}
+		attempt++
+	}
+}
+
+// gatewayBackoff grows from about a second to a minute, with jitter so a
+// restart of Discord's gateway does not bring every client back at once.
+func gatewayBackoff(attempt int) time.Duration {
+	delay := gatewayMaxBackoff
+	if attempt < 6 {
+		delay = time.Second << uint(attempt)
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+type gatewayMessage struct {
+	Op int             `json:"op"`
+	D  json.RawMessage `json:"d"`
+	S  *int64          `json:"s"`
+	T  string          `json:"t"`
+}
+
+type gatewayDisconnect struct {
+	reason string
+	err    error
+}
+
+func (e *gatewayDisconnect) Error() string {
+	if e.err == nil {
+		return e.reason
+	}
+	return e.err.Error()
+}
+
+func (e *gatewayDisconnect) Unwrap() error { return e.err }
+
+type gatewayFatalError struct {
+	code int
+	text string
+}
+
+func (e *gatewayFatalError) Error() string {
+	return fmt.Sprintf("%s (%d)", e.text, e.code)
+}
+
+// connect runs one connection from dial to disconnect. ready reports whether
+// the session got as far as READY or RESUMED.
+func (g *Gateway) connect(ctx context.Context) (bool, error) {
+	g.mu.Lock()
+	sessionID, resumeURL, sequence := g.sessionID, g.resumeURL, g.sequence
+	g.mu.Unlock()
+	resuming := sessionID != "" && resumeURL != ""
+
+	g.setState(GatewayConnecting)
+	target := resumeURL
+	if !resuming {
+		var err error
+		if target, err = g.identifyURL(ctx); err != nil {
+			return false, err
+		}
+	}
+
+	conn, _, err := g.dialer.DialContext(ctx, target+"/"+gatewayVersionQuery, http.Header{"User-Agent": []string{userAgent}})
+	if err != nil {
+		return false, &gatewayDisconnect{reason: "dial", err: err}
+	}
+	defer conn.Close()
+
+	var writeMu sync.Mutex
+	write := func(payload any) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return conn.WriteJSON(payload)
+	}
+	// Closing with 1000 ends the session, so only a shutdown does that.
+	// Every other disconnect drops the socket and keeps the session
+	// resumable.
+	stopClose := context.AfterFunc(ctx, func() {
+		writeMu.Lock()
+		_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		writeMu.Unlock()
+		_ = conn.Close()
+	})
+	defer stopClose()
+
+	_ = conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	var hello gatewayMessage
+	if err := conn.ReadJSON(&hello); err != nil {
+		return false, &gatewayDisconnect{reason: "hello", err: err}
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	var helloData struct {
+		HeartbeatInterval int64 `json:"heartbeat_interval"`
+	}
+	if hello.Op != gatewayOpHello || json.Unmarshal(hello.D, &helloData) != nil || helloData.HeartbeatInterval <= 0 {
+		return false, &gatewayDisconnect{reason: "hello", err: fmt.Errorf("expected hello, got op %d", hello.Op)}
+	}
+
+	heart := &gatewayHeartbeat{write: write, sequence: g.currentSequence, latency: g.setLatency}
+	heart.acked.Store(true)
+	heartbeatDone := make(chan struct{})
+	defer close(heartbeatDone)
+	go heart.run(conn, time.Duration(helloData.HeartbeatInterval)*time.Millisecond, heartbeatDone)
+
+	if resuming {
+		g.setState(GatewayResuming)
+		observability.DiscordGatewaySessions.WithLabelValues("resume").Inc()
+		err = write(map[string]any{
+			"op": gatewayOpResume,
+			"d": map[string]any{
+				"token":      g.client.token,
+				"session_id": sessionID,
+				"seq":        sequence,
+			},
+		})
+	} else {
+		g.setState(GatewayIdentifying)
+		observability.DiscordGatewaySessions.WithLabelValues("identify").Inc()
+		err = write(map[string]any{
+			"op": gatewayOpIdentify,
+			"d": map[string]any{
+				"token":   g.client.token,
+				"intents": g.intents,
+				"shard":   []int{g.shardID, g.shardCount},
+				"properties": map[string]string{
+					"os":      "linux",
+					"browser": "amy-world",
+					"device":  "amy-world",
+				},
+			},
+		})
+	}
+	if err != nil {
+		return false, &gatewayDisconnect{reason: "write", err: err}
+	}
+
+	ready := false
+	for {
+		var message gatewayMessage
+		if err := conn.ReadJSON(&message); err != nil {
+			if heart.zombie.Load() {
+				return ready, &gatewayDisconnect{reason: "zombie", err: errors.New("no heartbeat ack from discord")}
+			}
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				return ready, g.closed(closeErr)
+			}
+			return ready, &gatewayDisconnect{reason: "read", err: err}
+		}
+		if message.S != nil {
+			g.mu.Lock()
+			g.sequence = *message.S
+			g.mu.Unlock()
+		}
+
+		switch message.Op {
+		case gatewayOpDispatch:
+			switch message.T {
+			case "READY":
+				var data struct {
+					SessionID        string `json:"session_id"`
+					ResumeGatewayURL string `json:"resume_gateway_url"`
+				}
+				if err := json.Unmarshal(message.D, &data); err != nil {
+					return ready, &gatewayDisconnect{reason: "read", err: err}
+				}
+				g.mu.Lock()
+				g.sessionID = data.SessionID
+				g.resumeURL = strings.TrimRight(data.ResumeGatewayURL, "/")
+				g.mu.Unlock()
+				ready = true
+				g.setState(GatewayReady)
+			case "RESUMED":
+				ready = true
+				g.setState(GatewayReady)
+			}
+			if g.dispatch != nil {
+				g.dispatch(ctx, message.T, message.D)
+			}
+		case gatewayOpHeartbeat:
+			if err := heart.beat(); err != nil {
+				return ready, &gatewayDisconnect{reason: "write", err: err}
+			}
+		case gatewayOpReconnect:
+			return ready, &gatewayDisconnect{reason: "reconnect"}
+		case gatewayOpInvalidSession:
+			var resumable bool
+			_ = json.Unmarshal(message.D, &resumable)
+			if !resumable {
+				g.clearSession()
+			}
+			// Discord asks for a random wait of one to five seconds before
+			// the next identify.
+			_ = sleep(ctx, time.Second+rand.N(4*time.Second))
+			return ready, &gatewayDisconnect{reason: "invalid_session"}
+		case gatewayOpHeartbeatACK:
+			heart.ack()
+		}
+	}
+}
+
+// closed decides what a close frame from Discord means for the session.
+func (g *Gateway) closed(closeErr *websocket.CloseError) error {
+	switch closeErr.Code {
+	case 4004, 4010, 4011, 4012, 4013, 4014:
+		// Authentication failed, invalid shard, sharding required, invalid
+		// API version, invalid or disallowed intents.
+		return &gatewayFatalError{code: closeErr.Code, text: closeErr.Text}
+	case 4003, 4007, 4009:
+		// Not authenticated, invalid resume sequence, session timed out.
+		g.clearSession()
+	}
+	return &gatewayDisconnect{reason: "closed", err: closeErr}
+}
+
+// identifyURL asks Discord where to connect for a new session and waits out
+// the daily session start limit when it is used up.
+func (g *Gateway) identifyURL(ctx context.Context) (string, error) {
+	if g.gatewayURL != "" {
+		return g.gatewayURL, nil
+	}
+	var info struct {
+		URL               string `json:"url"`
+		Shards            int    `json:"shards"`
+		SessionStartLimit struct {
+			Remaining  int   `json:"remaining"`
+			ResetAfter int64 `json:"reset_after"`
+		} `json:"session_start_limit"`
+	}
+	if err := g.client.Do(ctx, Request{Kind: "gateway", Path: "/gateway/bot"}, &info); err != nil {
+		if StatusCode(err) == http.StatusUnauthorized {
+			return "", &gatewayFatalError{code: http.StatusUnauthorized, text: "invalid bot token"}
+		}
+		return "", &gatewayDisconnect{reason: "gateway_url", err: err}
+	}
+	if info.Shards > g.shardCount {
+		log.Printf("discord gateway recommends %d shards, running shard %d of %d", info.Shards, g.shardID, g.shardCount)
+	}
+	if info.SessionStartLimit.Remaining <= 0 && info.SessionStartLimit.ResetAfter > 0 {
+		wait := time.Duration(info.SessionStartLimit.ResetAfter) * time.Millisecond
+		log.Printf("discord gateway session start limit reached, waiting %s", wait.Round(time.Second))
+		g.setState(GatewayBackoff)
+		if err := sleep(ctx, wait); err != nil {
+			return "", err
+		}
+	}
+	if info.URL == "" {
+		info.URL = "wss://gateway.discord.gg"
+	}
+	return strings.TrimRight(info.URL, "/"), nil
+}
+
+func (g *Gateway) currentSequence() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.sequence
+}
+
+func (g *Gateway) clearSession() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.sessionID = ""
+	g.resumeURL = ""
+	g.sequence = 0
+}
+
+func (g *Gateway) setState(state GatewayState) {
+	g.mu.Lock()
+	if state == GatewayReady && g.state != GatewayReady {
+		g.readySince = time.Now().UTC()
+	}
+	g.state = state
+	g.mu.Unlock()
+	for _, known := range gatewayStates {
+		value := 0.0
+		if known == state {
+			value = 1
+		}
+		observability.DiscordGatewayState.WithLabelValues(string(known)).Set(value)
+	}
+}
+
+func (g *Gateway) setLatency(latency time.Duration) {
+	g.mu.Lock()
+	g.latency = latency
+	g.mu.Unlock()
+	observability.DiscordGatewayLatency.Set(latency.Seconds())
+}
+
+func (g *Gateway) recordError(err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.lastError = err.Error()
+	g.lastErrorAt = time.Now().UTC()
+}
+
+// gatewayHeartbeat sends heartbeats and notices a zombie connection: one that
+// stays open but no longer acknowledges them.
+type gatewayHeartbeat struct {
+	write    func(any) error
+	sequence func() int64
+	acked    atomic.Bool
+	zombie   atomic.Bool
+	sentAt   atomic.Int64
+	latency  func(time.Duration)
+}
+
+func (h *gatewayHeartbeat) run(conn *websocket.Conn, interval time.Duration, done <-chan struct{}) {
+	// The first heartbeat goes out after a random part of the interval, as
+	// Discord asks, so reconnecting clients do not beat in step.
+	timer := time.NewTimer(rand.N(interval))
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+		if !h.acked.Load() {
+			h.zombie.Store(true)
+			_ = conn.Close()
+			return
+		}
+		h.acked.Store(false)
+		h.sentAt.Store(time.Now().UnixNano())
+		if err := h.beat(); err != nil {
+			_ = conn.Close()
+			return
+		}
+		timer.Reset(interval)
+	}
+}
+
+func (h *gatewayHeartbeat) beat() error {
+	var d any
+	if sequence := h.sequence(); sequence > 0 {
+		d = sequence
+	}
+	return h.write(map[string]any{"op": gatewayOpHeartbeat, "d": d})
+}
+
+func (h *gatewayHeartbeat) ack() {
+	h.acked.Store(true)
+	if sentAt := h.sentAt.Load(); sentAt > 0 {
+		h.latency(time.Since(time.Unix(0, sentAt)))
+	}
+}
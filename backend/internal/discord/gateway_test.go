@@ -0,0 +1,169 @@
+package discord
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeGateway runs session(conn, n) for the nth connection after sending
+// HELLO and returns the ws:// URL of the server.
+func fakeGateway(t *testing.T, session func(t *testing.T, conn *websocket.Conn, n int)) string {
+	t.Helper()
+	var calls atomic.Int32
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		if err := conn.WriteJSON(map[string]any{"op": gatewayOpHello, "d": map[string]int{"heartbeat_interval": 45000}}); err != nil {
+			t.Error(err)
+			return
+		}
+		session(t, conn, int(calls.Add(1)))
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// readOp reads until a message with op arrives, skipping heartbeats.
+func readOp(t *testing.T, conn *websocket.Conn, op int) map[string]any {
+	t.Helper()
+	for {
+		var message struct {
+			Op int            `json:"op"`
+			D  map[string]any `json:"d"`
+		}
+		if err := conn.ReadJSON(&message); err != nil {
+			t.Errorf("waiting for op %d: %v", op, err)
+			return nil
+		}
+		if message.Op == op {
+			return message.D
+		}
+		if message.Op != gatewayOpHeartbeat {
+			t.Errorf("got op %d, want %d", message.Op, op)
+			return nil
+		}
+	}
+}
+
+func closeGateway(conn *websocket.Conn, code int) {
+	_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, "test"))
+}
+
+func TestGatewayResumesUntilDiscordClosesTheSession(t *testing.T) {
+	var gatewayURL string
+	gatewayURL = fakeGateway(t, func(t *testing.T, conn *websocket.Conn, n int) {
+		switch n {
+		case 1:
+			if d := readOp(t, conn, gatewayOpIdentify); d == nil || d["token"] != "token" {
+				t.Errorf("identify %v", d)
+			}
+			_ = conn.WriteJSON(map[string]any{"op": gatewayOpDispatch, "t": "READY", "s": 1, "d": map[string]string{"session_id": "abc", "resume_gateway_url": gatewayURL + "/"}})
+			_ = conn.WriteJSON(map[string]any{"op": gatewayOpDispatch, "t": "GUILD_MEMBER_ADD", "s": 2, "d": map[string]string{}})
+			// Drop the socket without a close frame.
+			return
+		case 2:
+			if d := readOp(t, conn, gatewayOpResume); d == nil || d["session_id"] != "abc" || d["seq"] != float64(2) {
+				t.Errorf("resume %v", d)
+			}
+			_ = conn.WriteJSON(map[string]any{"op": gatewayOpDispatch, "t": "RESUMED", "s": 3, "d": map[string]string{}})
+			closeGateway(conn, 4009)
+		case 3:
+			readOp(t, conn, gatewayOpIdentify)
+			closeGateway(conn, 4004)
+		}
+		_, _, _ = conn.ReadMessage()
+	})
+
+	var mu sync.Mutex
+	var events []string
+	g := NewGateway(New("token"), 0, func(ctx context.Context, event string, data json.RawMessage) {
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	}, WithGatewayURL(gatewayURL))
+	ctx := context.Background()
+
+	ready, err := g.connect(ctx)
+	var disconnect *gatewayDisconnect
+	if !ready || !errors.As(err, &disconnect) || disconnect.reason != "closed" {
+		t.Fatalf("first connection: ready %t, %v", ready, err)
+	}
+	if status := g.Status(); !status.Resumable || g.currentSequence() != 2 {
+		t.Fatalf("session should be resumable at sequence 2, got %+v at %d", status, g.currentSequence())
+	}
+
+	ready, err = g.connect(ctx)
+	if !ready || !errors.As(err, &disconnect) || disconnect.reason != "closed" {
+		t.Fatalf("resumed connection: ready %t, %v", ready, err)
+	}
+	if g.Status().Resumable || g.currentSequence() != 0 {
+		t.Fatal("close code 4009 should drop the session")
+	}
+
+	_, err = g.connect(ctx)
+	var fatal *gatewayFatalError
+	if !errors.As(err, &fatal) || fatal.code != 4004 {
+		t.Fatalf("got %v, want a fatal 4004", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(events, ",") != "READY,GUILD_MEMBER_ADD,RESUMED" {
+		t.Errorf("dispatched %v", events)
+	}
+}
+
+func TestGatewayInvalidSession(t *testing.T) {
+	for _, resumable := range []bool{false, true} {
+		t.Run(map[bool]string{false: "fresh", true: "resumable"}[resumable], func(t *testing.T) {
+			t.Parallel()
+			gatewayURL := fakeGateway(t, func(t *testing.T, conn *websocket.Conn, n int) {
+				readOp(t, conn, gatewayOpResume)
+				_ = conn.WriteJSON(map[string]any{"op": gatewayOpInvalidSession, "d": resumable})
+				_, _, _ = conn.ReadMessage()
+			})
+			g := NewGateway(New("token"), 0, nil, WithGatewayURL(gatewayURL))
+			g.sessionID, g.resumeURL, g.sequence = "abc", gatewayURL, 7
+
+			_, err := g.connect(context.Background())
+			var disconnect *gatewayDisconnect
+			if !errors.As(err, &disconnect) || disconnect.reason != "invalid_session" {
+				t.Fatalf("got %v, want an invalid_session disconnect", err)
+			}
+			if g.Status().Resumable != resumable {
+				t.Errorf("resumable after op 9 = %t, want %t", g.Status().Resumable, resumable)
+			}
+		})
+	}
+}
+
+func TestGatewayClosedCodes(t *testing.T) {
+	g := NewGateway(New("token"), 0, nil)
+	for code, fatal := range map[int]bool{4004: true, 4014: true, 4000: false, 4009: false, 1001: false} {
+		g.sessionID = "abc"
+		err := g.closed(&websocket.CloseError{Code: code})
+		var fatalErr *gatewayFatalError
+		if errors.As(err, &fatalErr) != fatal {
+			t.Errorf("close %d: got %v, fatal want %t", code, err, fatal)
+		}
+	}
+	g.sessionID = "abc"
+	_ = g.closed(&websocket.CloseError{Code: 4000})
+	if !g.Status().Resumable {
+		t.Error("close 4000 should keep the session resumable")
+	}
+}
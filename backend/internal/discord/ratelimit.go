@@ -0,0 +1,160 @@
+package discord
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	apiVersionPrefix = regexp.MustCompile(`^/api(/v\d+)?`)
+	snowflakeSegment = regexp.MustCompile(`^\d+$`)
+)
+
+// route identifies a request for rate limiting. Discord shares buckets
+// between routes, keyed by the X-RateLimit-Bucket hash, but keeps them apart
+// per top-level resource (channel, guild or webhook).
+type route struct {
+	// key is the method and path with every id but the major one replaced.
+	key string
+	// major is the top-level resource, such as "channels/123".
+	major string
+	// name is key with webhook tokens removed, safe for logs and errors.
+	name string
+}
+
+func routeFor(method, path string) route {
+	path = apiVersionPrefix.ReplaceAllString(path, "")
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	major := ""
+	named := make([]string, len(segments))
+	for index, segment := range segments {
+		named[index] = segment
+		if index == 1 && (segments[0] == "channels" || segments[0] == "guilds" || segments[0] == "webhooks") {
+			major = segments[0] + "/" + segment
+			continue
+		}
+		if index == 2 && segments[0] == "webhooks" {
+			// The webhook token is part of the major parameter.
+			major += "/" + segment
+			named[index] = ":token"
+			continue
+		}
+		if snowflakeSegment.MatchString(segment) {
+			segments[index] = ":id"
+			named[index] = ":id"
+		}
+	}
+	return route{
+		key:   method + " /" + strings.Join(segments, "/"),
+		major: major,
+		name:  method + " /" + strings.Join(named, "/"),
+	}
+}
+
+type bucket struct {
+	remaining int
+	resetAt   time.Time
+}
+
+type limiter struct {
+	mu          sync.Mutex
+	globalUntil time.Time
+	// hashes maps a route key to the bucket hash Discord reported for it.
+	hashes  map[string]string
+	buckets map[string]*bucket
+}
+
+func newLimiter() *limiter {
+	return &limiter{
+		hashes:  make(map[string]string),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (l *limiter) bucketKey(r route) string {
+	hash, ok := l.hashes[r.key]
+	if !ok {
+		hash = r.key
+	}
+	return hash + "|" + r.major
+}
+
+// wait blocks until a request on r may be sent and takes one slot of its
+// bucket. Routes whose bucket is still unknown go through at once.
+func (l *limiter) wait(ctx context.Context, r route) error {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		delay := l.globalUntil.Sub(now)
+		if delay <= 0 {
+			b := l.buckets[l.bucketKey(r)]
+			switch {
+			case b == nil:
+			case !now.Before(b.resetAt):
+				// The window has passed; the next response reports the
+				// new count.
+				delete(l.buckets, l.bucketKey(r))
+			case b.remaining > 0:
+				b.remaining--
+			default:
+				delay = b.resetAt.Sub(now)
+			}
+		}
+		l.mu.Unlock()
+		if delay <= 0 {
+			return nil
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// update records the bucket state from the X-RateLimit-* headers.
+func (l *limiter) update(r route, header http.Header) {
+	hash := header.Get("X-RateLimit-Bucket")
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if hash == "" || err != nil {
+		return
+	}
+	resetAfter, err := strconv.ParseFloat(header.Get("X-RateLimit-Reset-After"), 64)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hashes[r.key] = hash
+	l.buckets[l.bucketKey(r)] = &bucket{
+		remaining: remaining,
+		resetAt:   time.Now().Add(time.Duration(resetAfter * float64(time.Second))),
+	}
+}
+
+// penalize holds back requests after a 429: all of them for a global limit,
+// otherwise those sharing the bucket of r.
+func (l *limiter) penalize(r route, limited *RateLimitError) {
+	until := time.Now().Add(limited.RetryAfter)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limited.Global {
+		if until.After(l.globalUntil) {
+			l.globalUntil = until
+		}
+		return
+	}
+	key := l.bucketKey(r)
+	b := l.buckets[key]
+	if b == nil {
+		b = &bucket{}
+		l.buckets[key] = b
+	}
+	b.remaining = 0
+	if until.After(b.resetAt) {
+		b.resetAt = until
+	}
+}
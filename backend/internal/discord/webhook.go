@@ -0,0 +1,66 @@
+package discord
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Message is the part of a Discord message the backend keeps.
+type Message struct {
+	ID        string `json:"id"`
+	ChannelID string `json:"channel_id"`
+}
+
+// ExecuteWebhook posts a message through webhookURL and returns it. Components
+// are allowed, which Discord only accepts from application-owned webhooks.
+func (c *Client) ExecuteWebhook(ctx context.Context, kind, webhookURL string, payload any, files []File) (Message, error) {
+	var message Message
+	err := c.Do(ctx, Request{
+		Kind:   kind,
+		Method: http.MethodPost,
+		Path:   webhookURL,
+		Query:  url.Values{"wait": {"true"}, "with_components": {"true"}},
+		JSON:   payload,
+		Files:  files,
+	}, &message)
+	message.ID = strings.TrimSpace(message.ID)
+	message.ChannelID = strings.TrimSpace(message.ChannelID)
+	return message, err
+}
+
+// EditWebhookMessage replaces a message sent by the webhook.
+func (c *Client) EditWebhookMessage(ctx context.Context, kind, webhookURL, messageID string, payload any) error {
+	path, err := webhookMessagePath(webhookURL, messageID)
+	if err != nil {
+		return err
+	}
+	return c.Do(ctx, Request{
+		Kind:   kind,
+		Method: http.MethodPatch,
+		Path:   path,
+		Query:  url.Values{"with_components": {"true"}},
+		JSON:   payload,
+	}, nil)
+}
+
+// DeleteWebhookMessage removes a message sent by the webhook.
+func (c *Client) DeleteWebhookMessage(ctx context.Context, kind, webhookURL, messageID string) error {
+	path, err := webhookMessagePath(webhookURL, messageID)
+	if err != nil {
+		return err
+	}
+	return c.Do(ctx, Request{Kind: kind, Method: http.MethodDelete, Path: path}, nil)
+}
+
+// webhookMessagePath keeps the query of webhookURL, so a thread_id set on
+// the webhook still applies.
+func webhookMessagePath(webhookURL, messageID string) (string, error) {
+	parsed, err := url.Parse(webhookURL)
+	if err != nil {
+		return "", err
+	}
+	parsed.Path = strings.TrimRight(parsed.Path, "/") + "/messages/" + url.PathEscape(strings.TrimSpace(messageID))
+	return parsed.String(), nil
+}
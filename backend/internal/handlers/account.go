@@ -0,0 +1,561 @@
+package handlers
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"amy/minecraft-server/internal/models"
+)
+
+// accountDeletionGrace is how long a deletion request can still be cancelled.
+const accountDeletionGrace = 7 * 24 * time.Hour
+
+const deletedAccountName = "Удалённый пользователь"
+
+// AccountHandler serves the player's own data: a full export and the account
+// deletion request.
+type AccountHandler struct {
+	db      *sql.DB
+	auth    *DiscordAuthHandler
+	support *SupportHandler
+}
+
+type accountDeletionRequest struct {
+	Confirm bool `json:"confirm"`
+}
+
+type rpApplicationExport struct {
+	ID           string     `json:"id"`
+	Nickname     string     `json:"nickname"`
+	Source       string     `json:"source"`
+	RPName       string     `json:"rpName"`
+	BirthDate    string     `json:"birthDate"`
+	Race         string     `json:"race"`
+	Gender       string     `json:"gender"`
+	HeightCm     int        `json:"heightCm"`
+	Skills       string     `json:"skills"`
+	Plan         string     `json:"plan"`
+	Biography    string     `json:"biography"`
+	PrisonReason string     `json:"prisonReason"`
+	SkinURL      string     `json:"skinUrl"`
+	SkinFile     string     `json:"skinFile,omitempty"`
+	Status       string     `json:"status"`
+	ModeratedAt  *time.Time `json:"moderatedAt,omitempty"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	UpdatedAt    time.Time  `json:"updatedAt"`
+}
+
+type supportTicketExport struct {
+	Ticket   models.Ticket          `json:"ticket"`
+	Messages []models.TicketMessage `json:"messages"`
+}
+
+func NewAccountHandler(db *sql.DB, auth *DiscordAuthHandler, support *SupportHandler) *AccountHandler {
+	return &AccountHandler{db: db, auth: auth, support: support}
+}
+
+// Start runs deletion requests once their grace period is over.
+func (h *AccountHandler) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			h.processDueDeletions(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Export streams a ZIP with everything stored about the signed-in player:
+// GET /api/me/export.
+func (h *AccountHandler) Export(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	user, err := h.auth.requireAuthenticatedUser(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+	defer cancel()
+
+	// Everything is loaded before the first byte is written so a database
+	// error can still become a proper JSON error.
+	member, err := h.loadMemberState(ctx, user.DiscordID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load profile")
+		return
+	}
+	memberEvents, err := loadDiscordMemberEvents(ctx, h.db, user.DiscordID, 0, 10000)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load profile")
+		return
+	}
+	applications, err := h.loadRPApplications(ctx, user.DiscordID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load rp applications")
+		return
+	}
+	tickets, err := h.loadSupportTickets(ctx, user.DiscordID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load support tickets")
+		return
+	}
+	comments, err := h.queryRows(ctx, `SELECT id, news_id, author_name, message, created_at FROM news_comments WHERE discord_id = $1 ORDER BY created_at`, user.DiscordID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load news comments")
+		return
+	}
+	chatMessages, err := h.queryRows(ctx, `SELECT id::text AS id, message, image_url, gif_url, source, created_at, edited_at, deleted_at FROM community_chat_messages WHERE author_discord_id = $1 ORDER BY id`, user.DiscordID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load chat messages")
+		return
+	}
+	likes, err := h.queryRows(ctx, `SELECT news_id, created_at FROM news_likes WHERE discord_id = $1 ORDER BY created_at`, user.DiscordID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load news likes")
+		return
+	}
+	subscriptions, err := h.queryRows(ctx, `SELECT endpoint, created_at, updated_at FROM support_push_subscriptions WHERE discord_id = $1 ORDER BY created_at`, user.DiscordID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load push subscriptions")
+		return
+	}
+	notifications, err := h.queryRows(ctx, `SELECT id, kind, title, body, url, created_at, read_at FROM notifications WHERE discord_id = $1 ORDER BY id`, user.DiscordID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load notifications")
+		return
+	}
+	notificationPrefs, err := h.queryRows(ctx, `SELECT kind, inbox, push, updated_at FROM notification_preferences WHERE discord_id = $1 ORDER BY kind`, user.DiscordID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load notification preferences")
+		return
+	}
+	deletion, err := h.loadDeletionRequest(ctx, user.DiscordID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load deletion request")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="amy-world-%s-%s.zip"`, user.DiscordID, time.Now().UTC().Format("20060102")))
+	w.Header().Set("Cache-Control", "no-store")
+
+	archive := zip.NewWriter(w)
+	writeFile := func(name string, write func(io.Writer) error) {
+		if err != nil {
+			return
+		}
+		var file io.Writer
+		if file, err = archive.Create(name); err != nil {
+			return
+		}
+		err = write(file)
+	}
+	writeJSONFile := func(name string, value any) {
+		writeFile(name, func(file io.Writer) error {
+			encoder := json.NewEncoder(file)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(value)
+		})
+	}
+	copyFile := func(name, path string) {
+		source, openErr := os.Open(path)
+		if openErr != nil {
+			// Files removed from disk by hand are left out rather than
+			// failing the whole export.
+			return
+		}
+		defer source.Close()
+		writeFile(name, func(file io.Writer) error {
+			_, copyErr := io.Copy(file, source)
+			return copyErr
+		})
+	}
+
+	writeJSONFile("profile.json", map[string]any{
+		"user":                user,
+		"discordMember":       member,
+		"discordMemberEvents": memberEvents,
+		"pushDevices":         subscriptions,
+		"deletionRequest":     deletion,
+	})
+	for index, application := range applications {
+		if name, ok := localSkinFileName(application.SkinURL); ok {
+			applications[index].SkinFile = "rp_skins/" + name
+			copyFile(applications[index].SkinFile, filepath.Join(h.skinStorageDir(), name))
+		}
+	}
+	writeJSONFile("rp_applications.json", applications)
+	writeJSONFile("support/tickets.json", tickets)
+	for _, ticket := range tickets {
+		dir := "support/tickets/" + strconv.FormatInt(ticket.Ticket.ID, 10) + "/"
+		writeFile(dir+"history.html", func(file io.Writer) error {
+			_, writeErr := io.WriteString(file, renderTicketHistoryHTML(ticket.Ticket, ticket.Messages))
+			return writeErr
+		})
+		for _, message := range ticket.Messages {
+			for _, attachment := range message.Attachments {
+				if attachment.Quarantined {
+					continue
+				}
+				copyFile(dir+"attachments/"+filepath.Base(attachment.StoragePath), attachment.StoragePath)
+			}
+		}
+	}
+	writeJSONFile("news_comments.json", comments)
+	writeJSONFile("news_likes.json", likes)
+	writeJSONFile("community_chat.json", chatMessages)
+	writeJSONFile("notifications.json", map[string]any{"notifications": notifications, "preferences": notificationPrefs})
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		// Headers are already sent; the client sees a truncated archive.
+		log.Printf("account export for %s failed: %v", user.DiscordID, err)
+	}
+}
+
+// Deletion manages the account deletion request: GET /api/me/deletion shows
+// it, POST with {"confirm": true} schedules it and DELETE cancels it.
+func (h *AccountHandler) Deletion(w http.ResponseWriter, r *http.Request) {
+	user, err := h.auth.requireAuthenticatedUser(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var payload accountDeletionRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4*1024)).Decode(&payload); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+		if !payload.Confirm {
+			writeError(w, http.StatusBadRequest, "confirm must be true")
+			return
+		}
+		now := time.Now().UTC()
+		_, err := h.db.ExecContext(
+			ctx,
+			`INSERT INTO account_deletion_requests (discord_id, requested_at, scheduled_at)
+			 VALUES ($1, $2, $3)
+			 ON CONFLICT (discord_id) DO NOTHING`,
+			user.DiscordID,
+			now,
+			now.Add(accountDeletionGrace),
+		)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to request deletion")
+			return
+		}
+	case http.MethodDelete:
+		if _, err := h.db.ExecContext(ctx, `DELETE FROM account_deletion_requests WHERE discord_id = $1`, user.DiscordID); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to cancel deletion")
+			return
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	deletion, err := h.loadDeletionRequest(ctx, user.DiscordID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load deletion request")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"deletion": deletion})
+}
+
+func (h *AccountHandler) loadDeletionRequest(ctx context.Context, discordID string) (map[string]any, error) {
+	var requestedAt, scheduledAt time.Time
+	err := h.db.QueryRowContext(
+		ctx,
+		`SELECT requested_at, scheduled_at FROM account_deletion_requests WHERE discord_id = $1`,
+		discordID,
+	).Scan(&requestedAt, &scheduledAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"requestedAt": requestedAt, "scheduledAt": scheduledAt}, nil
+}
+
+func (h *AccountHandler) processDueDeletions(ctx context.Context) {
+	queryCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	rows, err := h.db.QueryContext(queryCtx, `SELECT discord_id FROM account_deletion_requests WHERE scheduled_at <= $1 ORDER BY scheduled_at LIMIT 20`, time.Now().UTC())
+	if err != nil {
+		cancel()
+		log.Printf("account deletion queue failed: %v", err)
+		return
+	}
+	discordIDs := make([]string, 0)
+	for rows.Next() {
+		var discordID string
+		if err := rows.Scan(&discordID); err == nil {
+			discordIDs = append(discordIDs, discordID)
+		}
+	}
+	rows.Close()
+	cancel()
+
+	for _, discordID := range discordIDs {
+		deleteCtx, cancel := context.WithTimeout(ctx, 60*time.Second)
+		if err := h.deleteAccount(deleteCtx, discordID); err != nil {
+			log.Printf("account deletion for %s failed: %v", discordID, err)
+		}
+		cancel()
+	}
+}
+
+// deleteAccount removes the player's own records and files and anonymizes
+// the places where they appear in other people's data, such as staff replies
+// on someone else's ticket.
+func (h *AccountHandler) deleteAccount(ctx context.Context, discordID string) error {
+	ticketIDs := make([]int64, 0)
+	discordRefs := make(map[int64]string)
+	rows, err := h.db.QueryContext(ctx, `SELECT id, discord_thread_id, discord_message_id FROM support_tickets WHERE owner_discord_id = $1`, discordID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id int64
+		var threadID, messageID string
+		if err := rows.Scan(&id, &threadID, &messageID); err != nil {
+			rows.Close()
+			return err
+		}
+		ticketIDs = append(ticketIDs, id)
+		if ref := ticketDiscordDeleteRef(threadID, messageID); ref != "" {
+			discordRefs[id] = ref
+		}
+	}
+	rows.Close()
+	applications, err := h.loadRPApplications(ctx, discordID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`DELETE FROM support_tickets WHERE owner_discord_id = $1`,
+		`UPDATE support_ticket_messages SET author_name = '` + deletedAccountName + `', author_discord_id = '' WHERE author_discord_id = $1`,
+		`UPDATE support_ticket_messages SET read_by_staff_id = '' WHERE read_by_staff_id = $1`,
+		`UPDATE support_tickets SET assignee_discord_id = '', assignee_name = '' WHERE assignee_discord_id = $1`,
+		`UPDATE support_macros SET updated_by = '' WHERE updated_by = $1`,
+		`DELETE FROM support_ticket_verifications WHERE discord_id = $1`,
+		`DELETE FROM discord_member_states WHERE discord_id = $1`,
+		`DELETE FROM discord_member_events WHERE discord_id = $1`,
+		// Chat rows are emptied and marked deleted rather than removed, so
+		// the history backfill does not fetch them from Discord again.
+		`UPDATE community_chat_messages
+		 SET author_discord_id = '', author = '` + deletedAccountName + `', avatar_url = '', message = '', image_url = '', gif_url = '',
+		     deleted_at = COALESCE(deleted_at, NOW())
+		 WHERE author_discord_id = $1`,
+		// Keeps the member sync and gateway events from storing the member
+		// again until they sign in anew.
+		`INSERT INTO deleted_accounts (discord_id, deleted_at) VALUES ($1, NOW())
+		 ON CONFLICT (discord_id) DO UPDATE SET deleted_at = EXCLUDED.deleted_at`,
+		// rp_applications, news_likes, news_comments, notifications and push
+		// subscriptions go with the user row through ON DELETE CASCADE.
+		`DELETE FROM discord_users WHERE discord_id = $1`,
+		`DELETE FROM account_deletion_requests WHERE discord_id = $1`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement, discordID); err != nil {
+			return err
+		}
+	}
+	// The ticket threads in Discord hold the same conversation.
+	for ticketID, ref := range discordRefs {
+		if err := h.support.outbox.enqueue(ctx, tx, discordEntitySupportTicket, strconv.FormatInt(ticketID, 10), discordActionDelete, ref); err != nil {
+			return err
+		}
+	}
+	if err := h.support.outbox.commit(tx); err != nil {
+		return err
+	}
+
+	for _, ticketID := range ticketIDs {
+		if err := h.support.removeTicketFiles(ticketID); err != nil {
+			log.Printf("account deletion for %s left ticket %d files: %v", discordID, ticketID, err)
+		}
+	}
+	for _, application := range applications {
+		if name, ok := localSkinFileName(application.SkinURL); ok {
+			// Skin paths can be pasted into someone else's application.
+			var shared bool
+			if err := h.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM rp_applications WHERE skin_url = $1)`, application.SkinURL).Scan(&shared); err != nil || shared {
+				continue
+			}
+			if err := os.Remove(filepath.Join(h.skinStorageDir(), name)); err != nil && !os.IsNotExist(err) {
+				log.Printf("account deletion for %s left skin %s: %v", discordID, name, err)
+			}
+		}
+	}
+	log.Printf("account %s deleted: %d tickets, %d rp applications", discordID, len(ticketIDs), len(applications))
+	return nil
+}
+
+func (h *AccountHandler) loadMemberState(ctx context.Context, discordID string) (map[string]any, error) {
+	var username, globalName, nick, status string
+	var syncedAt time.Time
+	err := h.db.QueryRowContext(
+		ctx,
+		`SELECT username, global_name, nick, discord_status, synced_at FROM discord_member_states WHERE discord_id = $1`,
+		discordID,
+	).Scan(&username, &globalName, &nick, &status, &syncedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{
+		"username":   username,
+		"globalName": globalName,
+		"nick":       nick,
+		"status":     status,
+		"syncedAt":   syncedAt,
+	}, nil
+}
+
+func (h *AccountHandler) loadRPApplications(ctx context.Context, discordID string) ([]rpApplicationExport, error) {
+	rows, err := h.db.QueryContext(ctx, rpApplicationSelectSQL+` WHERE discord_id = $1 ORDER BY created_at`, discordID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applications := make([]rpApplicationExport, 0)
+	for rows.Next() {
+		app, err := scanRPApplication(rows)
+		if err != nil {
+			return nil, err
+		}
+		applications = append(applications, rpApplicationExport{
+			ID:           app.ID,
+			Nickname:     app.Nickname,
+			Source:       app.Source,
+			RPName:       app.RPName,
+			BirthDate:    app.BirthDate,
+			Race:         app.Race,
+			Gender:       app.Gender,
+			HeightCm:     app.HeightCm,
+			Skills:       app.Skills,
+			Plan:         app.Plan,
+			Biography:    app.Biography,
+			PrisonReason: app.PrisonReason,
+			SkinURL:      app.SkinURL,
+			Status:       app.Status,
+			ModeratedAt:  app.ModeratedAt,
+			CreatedAt:    app.CreatedAt,
+			UpdatedAt:    app.UpdatedAt,
+		})
+	}
+	return applications, rows.Err()
+}
+
+func (h *AccountHandler) loadSupportTickets(ctx context.Context, discordID string) ([]supportTicketExport, error) {
+	rows, err := h.db.QueryContext(ctx, supportTicketSelectSQL+` WHERE owner_discord_id = $1 ORDER BY created_at`, discordID)
+	if err != nil {
+		return nil, err
+	}
+	tickets := make([]supportTicketExport, 0)
+	for rows.Next() {
+		ticket, err := scanSupportTicket(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tickets = append(tickets, supportTicketExport{Ticket: ticket})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for index := range tickets {
+		messages, err := h.support.loadTicketMessages(ctx, tickets[index].Ticket.ID)
+		if err != nil {
+			return nil, err
+		}
+		tickets[index].Messages = playerTicketMessages(messages)
+	}
+	return tickets, nil
+}
+
+// queryRows loads a small result set as generic JSON objects keyed by
+// column name.
+func (h *AccountHandler) queryRows(ctx context.Context, query string, args ...any) ([]map[string]any, error) {
+	rows, err := h.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	items := make([]map[string]any, 0)
+	for rows.Next() {
+		values := make([]any, len(columns))
+		targets := make([]any, len(columns))
+		for i := range values {
+			targets[i] = &values[i]
+		}
+		if err := rows.Scan(targets...); err != nil {
+			return nil, err
+		}
+		item := make(map[string]any, len(columns))
+		for i, column := range columns {
+			item[column] = values[i]
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (h *AccountHandler) skinStorageDir() string {
+	if dir := strings.TrimSpace(h.auth.skinStorageDir); dir != "" {
+		return dir
+	}
+	return "data/skins"
+}
+
+func localSkinFileName(skinURL string) (string, bool) {
+	if !isInternalSkinPath(skinURL) {
+		return "", false
+	}
+	return strings.TrimPrefix(strings.TrimSpace(skinURL), "/api/uploads/skins/"), true
+}
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLocalSkinFileName(t *testing.T) {
+	cases := map[string]string{
+		"/api/uploads/skins/abc123.png":   "abc123.png",
+		" /api/uploads/skins/abc123.png ": "abc123.png",
+		"/api/uploads/skins/../../x.png":  "",
+		`/api/uploads/skins/..\x.png`:     "",
+		"/api/uploads/skins/":             "",
+		"/api/uploads/skins/notes.txt":    "",
+		"https://example.org/skin.png":    "",
+		"/api/uploads/support/abc.png":    "",
+	}
+	for skinURL, want := range cases {
+		name, ok := localSkinFileName(skinURL)
+		if name != want || ok != (want != "") {
+			t.Errorf("%q: got %q, %t; want %q", skinURL, name, ok, want)
+		}
+	}
+}
+
+func TestAccountEndpointsRequireSession(t *testing.T) {
+	SetSessionSecret("test-session-secret")
+	h := NewAccountHandler(nil, &DiscordAuthHandler{}, nil)
+	for name, handle := range map[string]http.HandlerFunc{"export": h.Export, "deletion": h.Deletion} {
+		request := httptest.NewRequest(http.MethodGet, "/api/me/"+name, nil)
+		request.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "123456789"})
+		recorder := httptest.NewRecorder()
+		handle(recorder, request)
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("%s with an unsigned cookie: got %d, want 401", name, recorder.Code)
+		}
+	}
+}
@@ -1,43 +1,83 @@
 package handlers
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
+	"log"
 	"net/http"
 	"net/url"
-	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"amy/minecraft-server/internal/discord"
 )
 
-const communityChatChannelID = "1458094528723423338"
+// communityChatPageSize is how many messages Discord returns per history
+// request, and the most a client can ask for at once.
+const communityChatPageSize = 100
+
+// Where a chat message was written. Site and game messages are posted by
+// the bot with the source in the embed footer.
+const (
+	communityChatSourceDiscord   = "Discord"
+	communityChatSourceSite      = "Сайт"
+	communityChatSourceMinecraft = "Minecraft"
+
+	// communityChatRelayMaxAge keeps catch-up after an outage from
+	// flooding the game with old Discord messages.
+	communityChatRelayMaxAge = 2 * time.Minute
+)
 
+// CommunityChatHandler serves the community chat from community_chat_messages.
+// The gateway feeds it new, edited and deleted messages; a catch-up over REST
+// runs at startup, on every new gateway session and every few minutes, and
+// older history is fetched from Discord the first time someone scrolls to it.
 type CommunityChatHandler struct {
-	db         *sql.DB
-	botToken   string
-	httpClient *http.Client
+	db        *sql.DB
+	discord   *discord.Client
+	channelID string
+
+	// catchUpMu keeps the startup, periodic and READY catch-ups from
+	// overlapping.
+	catchUpMu sync.Mutex
+	// historyStart is set once a backfill reached the first message of
+	// the channel, so older pages stop asking Discord.
+	historyMu    sync.Mutex
+	historyStart bool
+
+	stream *communityChatHub
+	game   *MinecraftChatBridge
+	// discordOnline caches how many guild members are online, for the
+	// presence events of the chat stream.
+	discordOnline atomic.Int64
 }
 
 type communityChatMessage struct {
-	ID        string    `json:"id"`
-	Author    string    `json:"author"`
-	AvatarURL string    `json:"avatarUrl,omitempty"`
-	Message   string    `json:"message"`
-	ImageURL  string    `json:"imageUrl,omitempty"`
-	GIFURL    string    `json:"gifUrl,omitempty"`
-	Source    string    `json:"source"`
-	CreatedAt time.Time `json:"createdAt"`
+	ID              string     `json:"id"`
+	Author          string     `json:"author"`
+	AuthorDiscordID string     `json:"-"`
+	AvatarURL       string     `json:"avatarUrl,omitempty"`
+	Message         string     `json:"message"`
+	ImageURL        string     `json:"imageUrl,omitempty"`
+	GIFURL          string     `json:"gifUrl,omitempty"`
+	Source          string     `json:"source"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	EditedAt        *time.Time `json:"editedAt,omitempty"`
 }
 
 type discordChannelMessage struct {
-	ID        string `json:"id"`
-	Content   string `json:"content"`
-	Timestamp string `json:"timestamp"`
-	Author    struct {
+	ID              string `json:"id"`
+	ChannelID       string `json:"channel_id"`
+	Content         string `json:"content"`
+	Timestamp       string `json:"timestamp"`
+	EditedTimestamp string `json:"edited_timestamp"`
+	Author          struct {
 		ID         string `json:"id"`
 		Username   string `json:"username"`
 		GlobalName string `json:"global_name"`
@@ -63,25 +103,57 @@ type discordChannelMessage struct {
 		Image struct {
 			URL string `json:"url"`
 		} `json:"image"`
+		Footer struct {
+			Text string `json:"text"`
+		} `json:"footer"`
 	} `json:"embeds"`
 }
 
-func NewCommunityChatHandler(db *sql.DB, botToken string) *CommunityChatHandler {
+func NewCommunityChatHandler(db *sql.DB, discordClient *discord.Client, channelID string) *CommunityChatHandler {
 	return &CommunityChatHandler{
-		db:       db,
-		botToken: strings.TrimSpace(botToken),
-		httpClient: &http.Client{
-			Timeout: 8 * time.Second,
-		},
+		db:        db,
+		discord:   discordClient,
+		channelID: strings.TrimSpace(channelID),
+		stream:    newCommunityChatHub(),
 	}
 }
 
+// Start catches up on messages sent while the backend was down, then every
+// five minutes in case the gateway missed something.
+func (h *CommunityChatHandler) Start(ctx context.Context) {
+	go h.runPresence(ctx)
+	if !h.bridged() {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(5 * time.Minute)
+		defer ticker.Stop()
+		for {
+			h.catchUp(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// SetMinecraftBridge relays new chat messages to the game.
+func (h *CommunityChatHandler) SetMinecraftBridge(bridge *MinecraftChatBridge) {
+	h.game = bridge
+}
+
+func (h *CommunityChatHandler) bridged() bool {
+	return h.channelID != "" && h.discord.Configured()
+}
+
 func (h *CommunityChatHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet && r.Method != http.MethodPost {
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	if h.botToken == "" {
+	if h.channelID == "" {
 		writeError(w, http.StatusServiceUnavailable, "discord chat is not configured")
 		return
 	}
@@ -105,7 +177,17 @@ func (h *CommunityChatHandler) Handle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	before, limit, ok := parseCommunityChatPage(r.URL.Query())
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid before cursor")
+		return
+	}
+
 	if r.Method == http.MethodPost {
+		if !h.discord.Configured() {
+			writeError(w, http.StatusServiceUnavailable, "discord chat is not configured")
+			return
+		}
 		var payload struct {
 			Message string `json:"message"`
 			GIFURL  string `json:"gifUrl"`
@@ -132,14 +214,35 @@ func (h *CommunityChatHandler) Handle(w http.ResponseWriter, r *http.Request) {
 			writeError(w, http.StatusBadGateway, "failed to send discord message")
 			return
 		}
+		before = 0
 	}
 
-	messages, err := h.fetchDiscordChatMessages(ctx, 50)
+	messages, err := h.listMessages(ctx, before, limit)
 	if err != nil {
-		writeError(w, http.StatusBadGateway, "failed to load discord messages")
+		writeError(w, http.StatusInternalServerError, "failed to load chat messages")
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]any{"messages": messages})
+	if len(messages) < limit && h.needsHistory() {
+		// The store ends here; fetch the page before it from Discord.
+		cursor := before
+		if len(messages) > 0 {
+			cursor, _ = strconv.ParseInt(messages[0].ID, 10, 64)
+		}
+		if fetched, err := h.backfillBefore(ctx, cursor); err != nil {
+			log.Printf("community chat backfill before %d failed: %v", cursor, err)
+		} else if fetched > 0 {
+			if messages, err = h.listMessages(ctx, before, limit); err != nil {
+				writeError(w, http.StatusInternalServerError, "failed to load chat messages")
+				return
+			}
+		}
+	}
+
+	response := map[string]any{"messages": messages}
+	if len(messages) == limit {
+		response["nextBefore"] = messages[0].ID
+	}
+	writeJSON(w, http.StatusOK, response)
 }
 
 func (h *CommunityChatHandler) acceptedChatUser(ctx context.Context, discordID string) (*discordUserDoc, *rpApplicationDoc, error) {
@@ -154,39 +257,302 @@ func (h *CommunityChatHandler) acceptedChatUser(ctx context.Context, discordID s
 	return user, app, nil
 }
 
-func (h *CommunityChatHandler) fetchDiscordChatMessages(ctx context.Context, limit int) ([]communityChatMessage, error) {
-	if limit <= 0 || limit > 50 {
-		limit = 50
-	}
-	requestURL := fmt.Sprintf("https://discord.com/api/v10/channels/%s/messages?limit=%d", url.PathEscape(communityChatChannelID), limit)
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+// parseCommunityChatPage reads the ?before= message id and ?limit= of a
+// history page. A missing cursor means the latest page; an invalid limit
+// falls back to 50.
+func parseCommunityChatPage(query url.Values) (int64, int, bool) {
+	limit := 50
+	if value, err := strconv.Atoi(query.Get("limit")); err == nil && value > 0 && value <= communityChatPageSize {
+		limit = value
+	}
+	raw := strings.TrimSpace(query.Get("before"))
+	if raw == "" {
+		return 0, limit, true
+	}
+	before, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || before <= 0 {
+		return 0, 0, false
+	}
+	return before, limit, true
+}
+
+// listMessages returns up to limit stored messages older than before (or the
+// latest ones when before is 0), oldest first.
+func (h *CommunityChatHandler) listMessages(ctx context.Context, before int64, limit int) ([]communityChatMessage, error) {
+	query := `SELECT id, author_discord_id, author, avatar_url, message, image_url, gif_url, source, created_at, edited_at
+		 FROM community_chat_messages
+		 WHERE channel_id = $1 AND deleted_at IS NULL`
+	args := []any{h.channelID}
+	if before > 0 {
+		query += ` AND id < $2`
+		args = append(args, before)
+	}
+	query += ` ORDER BY id DESC LIMIT ` + strconv.Itoa(limit)
+
+	rows, err := h.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", "Bot "+h.botToken)
-	req.Header.Set("User-Agent", "amy-world-community-chat/1.0")
+	defer rows.Close()
 
-	resp, err := h.httpClient.Do(req)
-	if err != nil {
+	messages := make([]communityChatMessage, 0, limit)
+	for rows.Next() {
+		var message communityChatMessage
+		var id int64
+		var editedAt sql.NullTime
+		if err := rows.Scan(&id, &message.AuthorDiscordID, &message.Author, &message.AvatarURL, &message.Message, &message.ImageURL, &message.GIFURL, &message.Source, &message.CreatedAt, &editedAt); err != nil {
+			return nil, err
+		}
+		message.ID = strconv.FormatInt(id, 10)
+		message.CreatedAt = message.CreatedAt.UTC()
+		if editedAt.Valid {
+			edited := editedAt.Time.UTC()
+			message.EditedAt = &edited
+		}
+		messages = append(messages, message)
+	}
+	if err := rows.Err(); err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return nil, errUnexpectedStatus(resp.StatusCode)
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+func (h *CommunityChatHandler) needsHistory() bool {
+	if !h.bridged() {
+		return false
+	}
+	h.historyMu.Lock()
+	defer h.historyMu.Unlock()
+	return !h.historyStart
+}
+
+// backfillBefore stores the page of Discord messages before the message id
+// (the latest page for 0) and returns how many Discord sent.
+func (h *CommunityChatHandler) backfillBefore(ctx context.Context, before int64) (int, error) {
+	query := url.Values{"limit": {strconv.Itoa(communityChatPageSize)}}
+	if before > 0 {
+		query.Set("before", strconv.FormatInt(before, 10))
+	}
+	raw, err := h.fetchDiscordChatMessages(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	if err := h.storeMessages(ctx, raw, false); err != nil {
+		return 0, err
+	}
+	if len(raw) < communityChatPageSize {
+		h.historyMu.Lock()
+		h.historyStart = true
+		h.historyMu.Unlock()
+	}
+	return len(raw), nil
+}
+
+// catchUp stores the messages sent after the newest stored one. A long
+// outage is capped at 20 pages; the messages in between are fetched later
+// only if nobody reads them before, which is an acceptable gap for a chat.
+func (h *CommunityChatHandler) catchUp(ctx context.Context) {
+	if !h.catchUpMu.TryLock() {
+		return
+	}
+	defer h.catchUpMu.Unlock()
+
+	var latest sql.NullInt64
+	if err := h.db.QueryRowContext(ctx, `SELECT MAX(id) FROM community_chat_messages WHERE channel_id = $1`, h.channelID).Scan(&latest); err != nil {
+		log.Printf("community chat catch-up failed: %v", err)
+		return
+	}
+	if !latest.Valid {
+		if _, err := h.backfillBefore(ctx, 0); err != nil && ctx.Err() == nil {
+			log.Printf("community chat catch-up failed: %v", err)
+		}
+		return
+	}
+
+	after := latest.Int64
+	for page := 0; page < 20; page++ {
+		raw, err := h.fetchDiscordChatMessages(ctx, url.Values{
+			"limit": {strconv.Itoa(communityChatPageSize)},
+			"after": {strconv.FormatInt(after, 10)},
+		})
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("community chat catch-up failed: %v", err)
+			}
+			return
+		}
+		if err := h.storeMessages(ctx, raw, true); err != nil {
+			log.Printf("community chat catch-up failed: %v", err)
+			return
+		}
+		for _, item := range raw {
+			if id, err := strconv.ParseInt(item.ID, 10, 64); err == nil && id > after {
+				after = id
+			}
+		}
+		if len(raw) < communityChatPageSize {
+			return
+		}
 	}
+	log.Printf("community chat catch-up stopped after 20 pages at message %d", after)
+}
 
+func (h *CommunityChatHandler) fetchDiscordChatMessages(ctx context.Context, query url.Values) ([]discordChannelMessage, error) {
 	var raw []discordChannelMessage
-	if err := json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(&raw); err != nil {
+	err := h.discord.Do(ctx, discord.Request{
+		Kind:  "community_chat_fetch",
+		Path:  "/channels/" + url.PathEscape(h.channelID) + "/messages",
+		Query: query,
+	}, &raw)
+	if err != nil {
 		return nil, err
 	}
-	result := make([]communityChatMessage, 0, len(raw))
+	return raw, nil
+}
+
+// storeMessages stores a page of Discord messages; with publish, messages
+// that were not stored yet are pushed to open chat streams.
+func (h *CommunityChatHandler) storeMessages(ctx context.Context, raw []discordChannelMessage, publish bool) error {
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	inserted := make([]communityChatMessage, 0)
 	for _, item := range raw {
-		if mapped := mapDiscordChatMessage(item); mapped.ID != "" {
-			result = append(result, mapped)
+		message, created, err := h.storeMessage(ctx, tx, item)
+		if err != nil {
+			return err
+		}
+		if created {
+			inserted = append(inserted, *message)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if publish {
+		// Discord sends pages newest first.
+		for i := len(inserted) - 1; i >= 0; i-- {
+			h.announce(&inserted[i])
+		}
+	}
+	return nil
+}
+
+type sqlQueryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// storeMessage inserts or refreshes a Discord message and reports whether it
+// is new. Messages without text or images are skipped (nil), deleted ones
+// stay deleted, and messages of deleted accounts are not stored.
+func (h *CommunityChatHandler) storeMessage(ctx context.Context, db sqlQueryRower, item discordChannelMessage) (*communityChatMessage, bool, error) {
+	message := mapDiscordChatMessage(item)
+	id, err := strconv.ParseInt(message.ID, 10, 64)
+	if err != nil {
+		return nil, false, nil
+	}
+	var created bool
+	err = db.QueryRowContext(
+		ctx,
+		`INSERT INTO community_chat_messages (id, channel_id, author_discord_id, author, avatar_url, message, image_url, gif_url, source, created_at, edited_at)
+		 SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11
+		 WHERE NOT EXISTS (SELECT 1 FROM deleted_accounts WHERE discord_id = $3)
+		 ON CONFLICT (id) DO UPDATE SET
+		   author = EXCLUDED.author,
+		   avatar_url = EXCLUDED.avatar_url,
+		   message = EXCLUDED.message,
+		   image_url = EXCLUDED.image_url,
+		   gif_url = EXCLUDED.gif_url,
+		   edited_at = COALESCE(EXCLUDED.edited_at, community_chat_messages.edited_at)
+		 WHERE community_chat_messages.deleted_at IS NULL
+		 RETURNING xmax = 0`,
+		id,
+		h.channelID,
+		message.AuthorDiscordID,
+		message.Author,
+		message.AvatarURL,
+		message.Message,
+		message.ImageURL,
+		message.GIFURL,
+		message.Source,
+		message.CreatedAt,
+		message.EditedAt,
+	).Scan(&created)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Deleted, or written by a deleted account.
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return &message, created, nil
+}
+
+// handleGatewayEvent applies chat channel messages from the gateway. A new
+// session may have missed messages, so READY starts a catch-up.
+func (h *CommunityChatHandler) handleGatewayEvent(ctx context.Context, event string, data json.RawMessage) error {
+	if !h.bridged() {
+		return nil
+	}
+	switch event {
+	case "READY":
+		go func() {
+			catchUpCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+			defer cancel()
+			h.catchUp(catchUpCtx)
+		}()
+	case "MESSAGE_CREATE", "MESSAGE_UPDATE":
+		var item discordChannelMessage
+		if err := json.Unmarshal(data, &item); err != nil {
+			return err
+		}
+		// Updates without an author only carry an embed unfurl.
+		if item.ChannelID != h.channelID || strings.TrimSpace(item.Author.ID) == "" {
+			return nil
+		}
+		message, created, err := h.storeMessage(ctx, h.db, item)
+		if err != nil || message == nil {
+			return err
+		}
+		switch {
+		case created:
+			h.announce(message)
+		case event == "MESSAGE_UPDATE":
+			h.stream.Publish(communityChatEvent{Type: communityChatEventMessageUpdated, Message: message})
+		}
+	case "MESSAGE_DELETE", "MESSAGE_DELETE_BULK":
+		var deleted discordGatewayMessageDelete
+		if err := json.Unmarshal(data, &deleted); err != nil {
+			return err
+		}
+		if deleted.ChannelID != h.channelID {
+			return nil
+		}
+		ids := deleted.IDs
+		if deleted.ID != "" {
+			ids = append(ids, deleted.ID)
+		}
+		now := time.Now().UTC()
+		for _, raw := range ids {
+			id, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				continue
+			}
+			result, err := h.db.ExecContext(ctx, `UPDATE community_chat_messages SET deleted_at = $1 WHERE id = $2 AND deleted_at IS NULL`, now, id)
+			if err != nil {
+				return err
+			}
+			if changed, _ := result.RowsAffected(); changed > 0 {
+				h.stream.Publish(communityChatEvent{Type: communityChatEventMessageDeleted, MessageID: strconv.FormatInt(id, 10)})
+			}
 		}
 	}
-	sort.Slice(result, func(i, j int) bool { return result[i].CreatedAt.Before(result[j].CreatedAt) })
-	return result, nil
+	return nil
 }
 
 func (h *CommunityChatHandler) sendDiscordChatMessage(ctx context.Context, user discordUserDoc, app rpApplicationDoc, message, gifURL string) error {
@@ -197,44 +563,85 @@ func (h *CommunityChatHandler) sendDiscordChatMessage(ctx context.Context, user
 	if authorName == "" {
 		authorName = displayNameFor(user)
 	}
+	stored, err := h.postMessage(ctx, user.DiscordID, authorName, avatarURLFor(user.DiscordID, user.Avatar), message, gifURL, communityChatSourceSite, 16079160)
+	if err != nil {
+		return err
+	}
+	if stored != nil && h.game != nil {
+		h.game.relay(minecraftChatLineFor(*stored, displayNameFor(user), characterName(app)))
+	}
+	return nil
+}
+
+// postMessage posts an embed to the chat channel on behalf of someone who
+// is not in Discord. The footer names where it came from, so the gateway
+// copy of the message keeps its source. The stored copy is credited to
+// authorDiscordID rather than the bot, so the player's export and account
+// deletion find it. It returns the stored message, or nil when storing
+// failed after the post went through.
+func (h *CommunityChatHandler) postMessage(ctx context.Context, authorDiscordID, authorName, iconURL, message, gifURL, source string, color int) (*communityChatMessage, error) {
 	description := strings.TrimSpace(message)
 	if description == "" && gifURL != "" {
 		description = "GIF"
 	}
+	embed := map[string]any{
+		"description": description,
+		"color":       color,
+		"author":      map[string]string{"name": authorName},
+		"footer":      map[string]string{"text": source},
+	}
+	if iconURL != "" {
+		embed["author"].(map[string]string)["icon_url"] = iconURL
+	}
+	if gifURL != "" {
+		embed["image"] = map[string]string{"url": gifURL}
+	}
 	payload := map[string]any{
 		"allowed_mentions": map[string]any{"parse": []string{}},
-		"embeds": []map[string]any{{
-			"description": description,
-			"color":       16079160,
-			"author": map[string]string{
-				"name":     authorName,
-				"icon_url": avatarURLFor(user.DiscordID, user.Avatar),
-			},
-		}},
+		"embeds":           []map[string]any{embed},
+	}
+	var created discordChannelMessage
+	if err := h.discord.Do(ctx, discord.Request{
+		Kind:   "community_chat_send",
+		Method: http.MethodPost,
+		Path:   "/channels/" + url.PathEscape(h.channelID) + "/messages",
+		JSON:   payload,
+	}, &created); err != nil {
+		return nil, err
 	}
-	if gifURL != "" {
-		payload["embeds"].([]map[string]any)[0]["image"] = map[string]string{"url": gifURL}
+	// Store it now so the sender sees it before the gateway event arrives.
+	created.ChannelID = h.channelID
+	stored, inserted, err := h.storeMessage(ctx, h.db, created)
+	if err == nil && stored != nil && authorDiscordID != "" {
+		// The gateway copy may have been stored first; it keeps this author
+		// because updates leave author_discord_id alone.
+		id, _ := strconv.ParseInt(stored.ID, 10, 64)
+		_, err = h.db.ExecContext(ctx, `UPDATE community_chat_messages SET author_discord_id = $1 WHERE id = $2`, authorDiscordID, id)
+		stored.AuthorDiscordID = authorDiscordID
 	}
-	raw, err := json.Marshal(payload)
 	if err != nil {
-		return err
+		log.Printf("community chat store of sent message %s failed: %v", created.ID, err)
+		return nil, nil
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://discord.com/api/v10/channels/"+url.PathEscape(communityChatChannelID)+"/messages", bytes.NewReader(raw))
-	if err != nil {
-		return err
+	if inserted {
+		h.announce(stored)
 	}
-	req.Header.Set("Authorization", "Bot "+h.botToken)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", "amy-world-community-chat/1.0")
-	resp, err := h.httpClient.Do(req)
-	if err != nil {
-		return err
+	return stored, nil
+}
+
+// announce pushes a new message to open chat streams and relays messages
+// written in Discord to the game. Site messages are relayed when they are
+// sent, and game messages never go back to the game.
+func (h *CommunityChatHandler) announce(message *communityChatMessage) {
+	h.stream.Publish(communityChatEvent{Type: communityChatEventMessage, Message: message})
+	if h.game == nil || message.Source != communityChatSourceDiscord {
+		return
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return errUnexpectedStatus(resp.StatusCode)
+	if time.Since(message.CreatedAt) > communityChatRelayMaxAge {
+		// Caught up after an outage; old news in game.
+		return
 	}
-	return nil
+	h.game.relayDiscordMessage(*message)
 }
 
 func mapDiscordChatMessage(item discordChannelMessage) communityChatMessage {
@@ -253,7 +660,12 @@ func mapDiscordChatMessage(item discordChannelMessage) communityChatMessage {
 	text := strings.TrimSpace(item.Content)
 	imageURL := ""
 	gifURL := ""
+	source := communityChatSourceDiscord
 	if len(item.Embeds) > 0 {
+		switch footer := strings.TrimSpace(item.Embeds[0].Footer.Text); footer {
+		case communityChatSourceSite, communityChatSourceMinecraft:
+			source = footer
+		}
 		if strings.TrimSpace(item.Embeds[0].Author.Name) != "" {
 			author = strings.TrimSpace(item.Embeds[0].Author.Name)
 		}
@@ -286,15 +698,21 @@ func mapDiscordChatMessage(item discordChannelMessage) communityChatMessage {
 	if len([]rune(text)) > 1200 {
 		text = string([]rune(text)[:1200]) + "..."
 	}
+	var editedAt *time.Time
+	if edited := parseNewsTime(item.EditedTimestamp); !edited.IsZero() {
+		editedAt = &edited
+	}
 	return communityChatMessage{
-		ID:        item.ID,
-		Author:    author,
-		AvatarURL: avatarURL,
-		Message:   text,
-		ImageURL:  imageURL,
-		GIFURL:    gifURL,
-		Source:    "Discord",
-		CreatedAt: createdAt,
+		ID:              item.ID,
+		Author:          author,
+		AuthorDiscordID: strings.TrimSpace(item.Author.ID),
+		AvatarURL:       avatarURL,
+		Message:         text,
+		ImageURL:        imageURL,
+		GIFURL:          gifURL,
+		Source:          source,
+		CreatedAt:       createdAt,
+		EditedAt:        editedAt,
 	}
 }
 
@@ -0,0 +1,275 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"amy/minecraft-server/internal/observability"
+)
+
+const (
+	communityChatEventMessage        = "message"
+	communityChatEventMessageUpdated = "message_updated"
+	communityChatEventMessageDeleted = "message_deleted"
+	communityChatEventPresence       = "presence"
+	communityChatEventClosed         = "closed"
+
+	communityChatStreamBuffer       = 64
+	communityChatStreamHeartbeat    = 25 * time.Second
+	communityChatStreamAccessCheck  = time.Minute
+	communityChatStreamWriteTimeout = 10 * time.Second
+	communityChatStreamMaxTotal     = 500
+	communityChatStreamMaxPerUser   = 3
+	communityChatPresenceInterval   = 30 * time.Second
+)
+
+var errCommunityChatStreamLimit = errors.New("too many chat streams")
+
+// communityChatEvent is one change pushed to open chat streams.
+type communityChatEvent struct {
+	Type      string                 `json:"type"`
+	Message   *communityChatMessage  `json:"message,omitempty"`
+	MessageID string                 `json:"messageId,omitempty"`
+	Presence  *communityChatPresence `json:"presence,omitempty"`
+	Reason    string                 `json:"reason,omitempty"`
+	At        time.Time              `json:"at"`
+}
+
+// communityChatPresence counts the players reading the chat on the site and
+// the guild members online in Discord.
+type communityChatPresence struct {
+	Site    int `json:"site"`
+	Discord int `json:"discord"`
+}
+
+// communityChatHub fans chat events out to every open stream. Unlike the
+// support hub there is one channel, so streams are capped in total and per
+// player instead of per key.
+type communityChatHub struct {
+	mu          sync.Mutex
+	subscribers map[*communityChatSubscriber]struct{}
+	perUser     map[string]int
+}
+
+type communityChatSubscriber struct {
+	discordID string
+	events    chan communityChatEvent
+	once      sync.Once
+}
+
+func newCommunityChatHub() *communityChatHub {
+	return &communityChatHub{
+		subscribers: make(map[*communityChatSubscriber]struct{}),
+		perUser:     make(map[string]int),
+	}
+}
+
+func (h *communityChatHub) Publish(event communityChatEvent) {
+	if event.At.IsZero() {
+		event.At = time.Now().UTC()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for subscriber := range h.subscribers {
+		select {
+		case subscriber.events <- event:
+		default:
+			// A stream that cannot keep up is dropped; the client reconnects
+			// and reloads the chat instead of missing messages silently.
+			h.removeLocked(subscriber)
+			observability.CommunityChatStreamsDropped.WithLabelValues("slow").Inc()
+		}
+	}
+}
+
+func (h *communityChatHub) Subscribe(discordID string) (*communityChatSubscriber, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subscribers) >= communityChatStreamMaxTotal || h.perUser[discordID] >= communityChatStreamMaxPerUser {
+		observability.CommunityChatStreamsDropped.WithLabelValues("limit").Inc()
+		return nil, errCommunityChatStreamLimit
+	}
+	subscriber := &communityChatSubscriber{discordID: discordID, events: make(chan communityChatEvent, communityChatStreamBuffer)}
+	h.subscribers[subscriber] = struct{}{}
+	h.perUser[discordID]++
+	observability.CommunityChatStreamConnections.Inc()
+	return subscriber, nil
+}
+
+func (h *communityChatHub) Unsubscribe(subscriber *communityChatSubscriber) {
+	h.mu.Lock()
+	h.removeLocked(subscriber)
+	h.mu.Unlock()
+}
+
+func (h *communityChatHub) removeLocked(subscriber *communityChatSubscriber) {
+	subscriber.once.Do(func() {
+		delete(h.subscribers, subscriber)
+		if h.perUser[subscriber.discordID]--; h.perUser[subscriber.discordID] <= 0 {
+			delete(h.perUser, subscriber.discordID)
+		}
+		close(subscriber.events)
+		observability.CommunityChatStreamConnections.Dec()
+	})
+}
+
+// viewers counts distinct players with an open stream.
+func (h *communityChatHub) viewers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.perUser)
+}
+
+// Events streams new, edited and deleted chat messages and presence counts
+// as Server-Sent Events: GET /api/community/chat/events. Access is checked
+// again every minute, so a player whose application is reopened or whose
+// account is deleted loses the stream.
+func (h *CommunityChatHandler) Events(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if h.channelID == "" {
+		writeError(w, http.StatusServiceUnavailable, "discord chat is not configured")
+		return
+	}
+	discordID := currentDiscordIDFromCookie(r)
+	if discordID == "" {
+		writeError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	if err := h.checkStreamAccess(r.Context(), discordID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusForbidden, "accepted rp application required")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to check chat access")
+		return
+	}
+
+	subscriber, err := h.stream.Subscribe(discordID)
+	if err != nil {
+		w.Header().Set("Retry-After", "30")
+		writeError(w, http.StatusTooManyRequests, "too many chat streams")
+		return
+	}
+	defer func() {
+		h.stream.Unsubscribe(subscriber)
+		h.publishPresence()
+	}()
+	h.publishPresence()
+
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprint(w, "retry: 3000\n\n")
+	if err := controller.Flush(); err != nil {
+		return
+	}
+
+	// write gives every event a deadline, so a client that stops reading
+	// ends its stream instead of holding the handler forever.
+	write := func(event communityChatEvent) error {
+		raw, err := json.Marshal(event)
+		if err != nil {
+			return nil
+		}
+		_ = controller.SetWriteDeadline(time.Now().Add(communityChatStreamWriteTimeout))
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, raw); err != nil {
+			return err
+		}
+		return controller.Flush()
+	}
+
+	heartbeat := time.NewTicker(communityChatStreamHeartbeat)
+	defer heartbeat.Stop()
+	accessCheck := time.NewTicker(communityChatStreamAccessCheck)
+	defer accessCheck.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			_ = controller.SetWriteDeadline(time.Now().Add(communityChatStreamWriteTimeout))
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			if err := controller.Flush(); err != nil {
+				return
+			}
+		case <-accessCheck.C:
+			err := h.checkStreamAccess(r.Context(), discordID)
+			if errors.Is(err, sql.ErrNoRows) {
+				observability.CommunityChatStreamsDropped.WithLabelValues("access").Inc()
+				_ = write(communityChatEvent{Type: communityChatEventClosed, Reason: "access_revoked", At: time.Now().UTC()})
+				return
+			}
+			if err != nil && r.Context().Err() == nil {
+				// A database hiccup should not drop every stream at once.
+				log.Printf("community chat stream access check for %s failed: %v", discordID, err)
+			}
+		case event, ok := <-subscriber.events:
+			if !ok {
+				return
+			}
+			if err := write(event); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// checkStreamAccess returns sql.ErrNoRows when the player may not read the
+// chat, like acceptedChatUser.
+func (h *CommunityChatHandler) checkStreamAccess(ctx context.Context, discordID string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, _, err := h.acceptedChatUser(ctx, discordID)
+	return err
+}
+
+// publishPresence sends the current counts to every stream.
+func (h *CommunityChatHandler) publishPresence() {
+	h.stream.Publish(communityChatEvent{
+		Type: communityChatEventPresence,
+		Presence: &communityChatPresence{
+			Site:    h.stream.viewers(),
+			Discord: int(h.discordOnline.Load()),
+		},
+	})
+}
+
+// runPresence refreshes the Discord online count and tells open streams when
+// it changes.
+func (h *CommunityChatHandler) runPresence(ctx context.Context) {
+	ticker := time.NewTicker(communityChatPresenceInterval)
+	defer ticker.Stop()
+	for {
+		queryCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		var online int64
+		err := h.db.QueryRowContext(
+			queryCtx,
+			`SELECT COUNT(*) FROM discord_member_states WHERE left_at IS NULL AND discord_status IN ('online', 'idle', 'dnd')`,
+		).Scan(&online)
+		cancel()
+		if err == nil && h.discordOnline.Swap(online) != online {
+			h.publishPresence()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
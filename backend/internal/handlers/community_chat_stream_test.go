@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCommunityChatHubLimits(t *testing.T) {
+	hub := newCommunityChatHub()
+	var steve []*communityChatSubscriber
+	for i := 0; i < communityChatStreamMaxPerUser; i++ {
+		subscriber, err := hub.Subscribe("steve")
+		if err != nil {
+			t.Fatal(err)
+		}
+		steve = append(steve, subscriber)
+	}
+	if _, err := hub.Subscribe("steve"); err != errCommunityChatStreamLimit {
+		t.Fatalf("stream %d of one player: got %v, want the limit", communityChatStreamMaxPerUser+1, err)
+	}
+	hub.Unsubscribe(steve[0])
+	hub.Unsubscribe(steve[0])
+	if _, err := hub.Subscribe("steve"); err != nil {
+		t.Fatalf("a closed stream should free its slot: %v", err)
+	}
+
+	for i := 0; len(hub.subscribers) < communityChatStreamMaxTotal; i++ {
+		if _, err := hub.Subscribe(fmt.Sprintf("player-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := hub.Subscribe("alex"); err != errCommunityChatStreamLimit {
+		t.Fatalf("got %v, want the total limit", err)
+	}
+	if viewers := hub.viewers(); viewers != communityChatStreamMaxTotal-communityChatStreamMaxPerUser+1 {
+		t.Errorf("got %d viewers", viewers)
+	}
+}
+
+func TestCommunityChatHubDropsSlowStreams(t *testing.T) {
+	hub := newCommunityChatHub()
+	slow, err := hub.Subscribe("steve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fast, err := hub.Subscribe("alex")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i <= communityChatStreamBuffer; i++ {
+		hub.Publish(communityChatEvent{Type: communityChatEventMessageDeleted, MessageID: fmt.Sprint(i)})
+		<-fast.events
+	}
+
+	received := 0
+	for event := range slow.events {
+		if event.At.IsZero() {
+			t.Error("published events should be stamped")
+		}
+		received++
+	}
+	if received != communityChatStreamBuffer {
+		t.Errorf("slow stream got %d events before it was closed, want %d", received, communityChatStreamBuffer)
+	}
+	if hub.viewers() != 1 {
+		t.Errorf("got %d viewers, want only the fast stream", hub.viewers())
+	}
+	// Unsubscribing a dropped stream again must not close its channel twice.
+	hub.Unsubscribe(slow)
+	hub.Publish(communityChatEvent{Type: communityChatEventPresence})
+	if event := <-fast.events; event.Type != communityChatEventPresence {
+		t.Errorf("fast stream got %q", event.Type)
+	}
+}
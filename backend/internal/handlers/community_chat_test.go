@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCommunityChatPage(t *testing.T) {
+	cases := []struct {
+		query  string
+		before int64
+		limit  int
+		ok     bool
+	}{
+		{"", 0, 50, true},
+		{"limit=20", 0, 20, true},
+		{"limit=500", 0, 50, true},
+		{"limit=-1&before=1234", 1234, 50, true},
+		{"before=%201234%20", 1234, 50, true},
+		{"before=abc", 0, 0, false},
+		{"before=0", 0, 0, false},
+		{"before=-5", 0, 0, false},
+		{"before=99999999999999999999", 0, 0, false},
+	}
+	for _, tc := range cases {
+		query, _ := url.ParseQuery(tc.query)
+		before, limit, ok := parseCommunityChatPage(query)
+		if before != tc.before || limit != tc.limit || ok != tc.ok {
+			t.Errorf("%q: got %d, %d, %t; want %d, %d, %t", tc.query, before, limit, ok, tc.before, tc.limit, tc.ok)
+		}
+	}
+}
+
+func TestCommunityChatListMessagesPagesBackwards(t *testing.T) {
+	created := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	db, script := newScriptedDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value) {
+		columns := []string{"id", "author_discord_id", "author", "avatar_url", "message", "image_url", "gif_url", "source", "created_at", "edited_at"}
+		return columns, [][]driver.Value{
+			{int64(30), "1", "Steve", "", "третье", "", "", communityChatSourceDiscord, created.Add(2 * time.Minute), nil},
+			{int64(20), "2", "Alex", "", "второе", "", "", communityChatSourceSite, created.Add(time.Minute), created.Add(3 * time.Minute)},
+		}
+	})
+	h := &CommunityChatHandler{db: db, channelID: "555"}
+
+	messages, err := h.listMessages(context.Background(), 40, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].ID != "20" || messages[1].ID != "30" {
+		t.Fatalf("got %+v, want messages 20 and 30 oldest first", messages)
+	}
+	if messages[0].EditedAt == nil || messages[1].EditedAt != nil {
+		t.Error("edited_at was not carried over")
+	}
+
+	statement := script.find("FROM community_chat_messages")[0]
+	if !strings.Contains(statement.query, "id < $2") || !strings.Contains(statement.query, "LIMIT 2") || statement.args[1] != int64(40) {
+		t.Errorf("page query %q with %v", statement.query, statement.args)
+	}
+	if _, err := h.listMessages(context.Background(), 0, 50); err != nil {
+		t.Fatal(err)
+	}
+	if latest := script.find("FROM community_chat_messages")[1]; strings.Contains(latest.query, "id <") || len(latest.args) != 1 {
+		t.Errorf("the latest page should not filter by id: %q", latest.query)
+	}
+}
+
+func TestMapDiscordChatMessage(t *testing.T) {
+	var item discordChannelMessage
+	item.ID = "42"
+	item.Content = "  привет  "
+	item.Timestamp = "2026-03-01T12:00:00.000000+00:00"
+	item.EditedTimestamp = "2026-03-01T12:05:00.000000+00:00"
+	item.Author.ID = "7"
+	item.Author.Username = "steve"
+	item.Author.GlobalName = "Steve"
+	item.Member = &struct {
+		Nick string `json:"nick"`
+	}{Nick: " Стив "}
+
+	message := mapDiscordChatMessage(item)
+	if message.ID != "42" || message.Author != "Стив" || message.Message != "привет" || message.Source != communityChatSourceDiscord {
+		t.Errorf("unexpected message %+v", message)
+	}
+	if message.EditedAt == nil || !message.CreatedAt.Equal(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("timestamps %s, %v", message.CreatedAt, message.EditedAt)
+	}
+
+	// A site message is posted by the bot as an embed.
+	item.Content = ""
+	item.Member = nil
+	item.Embeds = make([]struct {
+		Description string `json:"description"`
+		URL         string `json:"url"`
+		Author      struct {
+			Name    string `json:"name"`
+			IconURL string `json:"icon_url"`
+		} `json:"author"`
+		Image struct {
+			URL string `json:"url"`
+		} `json:"image"`
+		Footer struct {
+			Text string `json:"text"`
+		} `json:"footer"`
+	}, 1)
+	item.Embeds[0].Description = "с сайта"
+	item.Embeds[0].Author.Name = "Alex"
+	item.Embeds[0].Author.IconURL = "https://cdn.example.org/a.png"
+	item.Embeds[0].Footer.Text = communityChatSourceSite
+	message = mapDiscordChatMessage(item)
+	if message.Author != "Alex" || message.Message != "с сайта" || message.Source != communityChatSourceSite || message.AvatarURL != "https://cdn.example.org/a.png" {
+		t.Errorf("unexpected embed message %+v", message)
+	}
+
+	// Nothing to show: no text, image or gif.
+	item.Embeds = nil
+	if message := mapDiscordChatMessage(item); message.ID != "" {
+		t.Errorf("an empty message was mapped to %+v", message)
+	}
+}
@@ -15,11 +15,13 @@ import (
 	"strings"
 	"time"
 
-	"amy/minecraft-server/internal/observability"
+	"amy/minecraft-server/internal/discord"
 )
 
 type DiscordAuthHandler struct {
 	db               *sql.DB
+	notifier         *Notifier
+	outbox           *DiscordOutbox
 	clientID         string
 	clientSecret     string
 	redirectURL      string
@@ -27,10 +29,13 @@ type DiscordAuthHandler struct {
 	ticketWebhookURL string
 	rpWebhookURL     string
 	rpModeratorIDs   map[string]struct{}
-	discordBotToken  string
+	discord          *discord.Client
 	discordGuildID   string
 	skinStorageDir   string
 	httpClient       *http.Client
+	// interactions switches the moderation buttons from links to
+	// interaction buttons handled by DiscordInteractionsHandler.
+	interactions bool
 }
 
 type discordTokenResponse struct {
@@ -112,6 +117,7 @@ type publicProfile struct {
 	ThemeColor             string              `json:"themeColor,omitempty"`
 	HasAcceptedApplication bool                `json:"hasAcceptedApplication"`
 	JoinedAt               *time.Time          `json:"joinedAt,omitempty"`
+	GuildJoinedAt          *time.Time          `json:"guildJoinedAt,omitempty"`
 	IsOnline               bool                `json:"isOnline"`
 }
 
@@ -136,6 +142,10 @@ type rpApplicationSummaryOut struct {
 	CreatedAt    *time.Time `json:"createdAt,omitempty"`
 	UpdatedAt    *time.Time `json:"updatedAt,omitempty"`
 	ModeratedAt  *time.Time `json:"moderatedAt,omitempty"`
+	// ModerationReason is the moderator's comment on accepting or
+	// declining the application.
+	ModerationReason string `json:"moderationReason,omitempty"`
+	DiscordSync      string `json:"discordSync,omitempty"`
 }
 
 var minecraftNicknameRe = regexp.MustCompile(`^[A-Za-z0-9_]{3,16}$`)
@@ -144,6 +154,9 @@ const presenceOnlineWindow = 75 * time.Second
 
 func NewDiscordAuthHandler(
 	db *sql.DB,
+	notifier *Notifier,
+	outbox *DiscordOutbox,
+	discordClient *discord.Client,
 	clientID,
 	clientSecret,
 	redirectURL,
@@ -151,12 +164,13 @@ func NewDiscordAuthHandler(
 	ticketWebhookURL,
 	rpWebhookURL,
 	rpModeratorIDsRaw,
-	discordBotToken,
 	discordGuildID,
 	skinStorageDir string,
 ) *DiscordAuthHandler {
-	return &DiscordAuthHandler{
+	h := &DiscordAuthHandler{
 		db:               db,
+		notifier:         notifier,
+		outbox:           outbox,
 		clientID:         clientID,
 		clientSecret:     clientSecret,
 		redirectURL:      redirectURL,
@@ -164,11 +178,13 @@ func NewDiscordAuthHandler(
 		ticketWebhookURL: ticketWebhookURL,
 		rpWebhookURL:     rpWebhookURL,
 		rpModeratorIDs:   parseDiscordIDSet(rpModeratorIDsRaw),
-		discordBotToken:  strings.TrimSpace(discordBotToken),
+		discord:          discordClient,
 		discordGuildID:   strings.TrimSpace(discordGuildID),
 		skinStorageDir:   strings.TrimSpace(skinStorageDir),
 		httpClient:       &http.Client{Timeout: 8 * time.Second},
 	}
+	outbox.register(discordEntityRPApplication, h.syncRPApplicationDiscord)
+	return h
 }
 
 func (h *DiscordAuthHandler) Start(w http.ResponseWriter, r *http.Request) {
@@ -211,19 +227,19 @@ func (h *DiscordAuthHandler) Callback(w http.ResponseWriter, r *http.Request) {
 	form.Set("code", code)
 	form.Set("redirect_uri", h.redirectURL)
 
-	startedAt := time.Now()
-	resp, err := http.PostForm("https://discord.com/api/oauth2/token", form)
-	if err != nil {
-		observability.ObserveDiscordOutbound("oauth_token", startedAt, 0, err)
-		writeError(w, http.StatusBadGateway, "discord token exchange failed")
-		return
-	}
-	defer resp.Body.Close()
-	observability.ObserveDiscordOutbound("oauth_token", startedAt, resp.StatusCode, nil)
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
 
 	var token discordTokenResponse
-	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
-		writeError(w, http.StatusBadGateway, "invalid discord token response")
+	err := h.discord.Do(ctx, discord.Request{
+		Kind:      "oauth_token",
+		Method:    http.MethodPost,
+		Path:      "/oauth2/token",
+		Form:      form,
+		Anonymous: true,
+	}, &token)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, "discord token exchange failed")
 		return
 	}
 	if token.AccessToken == "" {
@@ -231,28 +247,12 @@ func (h *DiscordAuthHandler) Callback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userReq, _ := http.NewRequest(http.MethodGet, "https://discord.com/api/users/@me", nil)
-	userReq.Header.Set("Authorization", "Bearer "+token.AccessToken)
-
-	startedAt = time.Now()
-	userResp, err := http.DefaultClient.Do(userReq)
-	if err != nil {
-		observability.ObserveDiscordOutbound("oauth_user", startedAt, 0, err)
-		writeError(w, http.StatusBadGateway, "discord user fetch failed")
-		return
-	}
-	defer userResp.Body.Close()
-	observability.ObserveDiscordOutbound("oauth_user", startedAt, userResp.StatusCode, nil)
-
 	var user discordUser
-	if err := json.NewDecoder(userResp.Body).Decode(&user); err != nil {
-		writeError(w, http.StatusBadGateway, "invalid discord user response")
+	if err := h.discord.Do(ctx, discord.Request{Kind: "oauth_user", Path: "/users/@me", Bearer: token.AccessToken}, &user); err != nil {
+		writeError(w, http.StatusBadGateway, "discord user fetch failed")
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-	defer cancel()
-
 	now := time.Now().UTC()
 	_, err = h.db.ExecContext(
 		ctx,
@@ -276,6 +276,10 @@ func (h *DiscordAuthHandler) Callback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Signing in again after deleting the account starts a new one, so the
+	// member sync may store the member again.
+	_, _ = h.db.ExecContext(ctx, `DELETE FROM deleted_accounts WHERE discord_id = $1`, user.ID)
+
 	setSessionCookie(w, r, h.frontendURL, user.ID)
 
 	redirectTo := h.redirectTargetFromState(r.URL.Query().Get("state"))
@@ -307,8 +311,8 @@ func safeInternalRedirectPath(raw string) string {
 }
 
 func (h *DiscordAuthHandler) Me(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("discord_id")
-	if err != nil || cookie.Value == "" {
+	discordID := currentDiscordIDFromCookie(r)
+	if discordID == "" {
 		writeJSON(w, http.StatusOK, discordMeResponse{Authenticated: false})
 		return
 	}
@@ -316,7 +320,7 @@ func (h *DiscordAuthHandler) Me(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	user, err := h.loadDiscordUser(ctx, cookie.Value)
+	user, err := h.loadDiscordUser(ctx, discordID)
 	if err != nil {
 		writeJSON(w, http.StatusOK, discordMeResponse{Authenticated: false})
 		return
@@ -477,15 +481,15 @@ func (h *DiscordAuthHandler) loadDiscordUser(ctx context.Context, discordID stri
 }
 
 func (h *DiscordAuthHandler) requireAuthenticatedUser(r *http.Request) (*discordUserDoc, error) {
-	cookie, err := r.Cookie("discord_id")
-	if err != nil || strings.TrimSpace(cookie.Value) == "" {
+	discordID := currentDiscordIDFromCookie(r)
+	if discordID == "" {
 		return nil, sql.ErrNoRows
 	}
 
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	return h.loadDiscordUser(ctx, strings.TrimSpace(cookie.Value))
+	return h.loadDiscordUser(ctx, discordID)
 }
 
 func resolveCookieOptions(frontendURL string, r *http.Request) (string, bool) {
@@ -517,17 +521,18 @@ func resolveCookieOptions(frontendURL string, r *http.Request) (string, bool) {
 	return configuredHost, secure
 }
 
-func setSessionCookie(w http.ResponseWriter, r *http.Request, frontendURL, value string) {
+func setSessionCookie(w http.ResponseWriter, r *http.Request, frontendURL, discordID string) {
 	cookieDomain, secureCookie := resolveCookieOptions(frontendURL, r)
+	expiresAt := time.Now().Add(sessionLifetime)
 	cookie := &http.Cookie{
-		Name:     "discord_id",
-		Value:    value,
+		Name:     sessionCookieName,
+		Value:    signSession(discordID, expiresAt),
 		Path:     "/",
 		HttpOnly: true,
 		SameSite: http.SameSiteLaxMode,
 		Secure:   secureCookie,
-		Expires:  time.Now().Add(30 * 24 * time.Hour),
-		MaxAge:   30 * 24 * 60 * 60,
+		Expires:  expiresAt,
+		MaxAge:   int(sessionLifetime / time.Second),
 	}
 	if cookieDomain != "" {
 		cookie.Domain = cookieDomain
@@ -538,7 +543,7 @@ func setSessionCookie(w http.ResponseWriter, r *http.Request, frontendURL, value
 func clearSessionCookie(w http.ResponseWriter, r *http.Request, frontendURL string) {
 	cookieDomain, secureCookie := resolveCookieOptions(frontendURL, r)
 	cookie := &http.Cookie{
-		Name:     "discord_id",
+		Name:     sessionCookieName,
 		Value:    "",
 		Path:     "/",
 		HttpOnly: true,
@@ -586,7 +591,7 @@ func (h *DiscordAuthHandler) isAmyDiscordMember(ctx context.Context, discordID s
 	}
 
 	var exists bool
-	err := h.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM discord_member_states WHERE discord_id = $1)`, discordID).Scan(&exists)
+	err := h.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM discord_member_states WHERE discord_id = $1 AND left_at IS NULL)`, discordID).Scan(&exists)
 	return exists, err
 }
 
@@ -636,8 +641,18 @@ func (h *DiscordAuthHandler) enrichPublicProfile(ctx context.Context, profile *p
 
 	var rawRoles string
 	var rawRoleIDs string
-	err := h.db.QueryRowContext(ctx, `SELECT array_to_string(roles, E'\n'), array_to_string(role_ids, E'\n') FROM discord_member_states WHERE discord_id = $1`, profile.ID).Scan(&rawRoles, &rawRoleIDs)
+	var guildJoinedAt sql.NullTime
+	err := h.db.QueryRowContext(
+		ctx,
+		`SELECT array_to_string(roles, E'\n'), array_to_string(role_ids, E'\n'), CASE WHEN left_at IS NULL THEN guild_joined_at END
+		 FROM discord_member_states WHERE discord_id = $1`,
+		profile.ID,
+	).Scan(&rawRoles, &rawRoleIDs, &guildJoinedAt)
 	if err == nil {
+		if guildJoinedAt.Valid {
+			joinedAt := guildJoinedAt.Time.UTC()
+			profile.GuildJoinedAt = &joinedAt
+		}
 		roles := splitPostgresTextArray(rawRoles)
 		roleIDs := splitPostgresTextArray(rawRoleIDs)
 		profile.DiscordRoles = h.publicDiscordRoles(ctx, roles, roleIDs)
@@ -695,7 +710,7 @@ func (h *DiscordAuthHandler) loadAcceptedApplicationForDiscord(ctx context.Conte
 
 func (h *DiscordAuthHandler) publicDiscordRoles(ctx context.Context, roleNames, roleIDs []string) []publicDiscordRole {
 	meta := map[string]discordGuildRole{}
-	if h.discordBotToken != "" && h.discordGuildID != "" {
+	if h.discord.Configured() && h.discordGuildID != "" {
 		if roles, err := h.fetchGuildRoles(ctx); err == nil {
 			for _, role := range roles {
 				meta[role.ID] = role
@@ -742,22 +757,8 @@ func (h *DiscordAuthHandler) publicDiscordRoles(ctx context.Context, roleNames,
 }
 
 func (h *DiscordAuthHandler) fetchGuildRoles(ctx context.Context) ([]discordGuildRole, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://discord.com/api/v10/guilds/"+url.PathEscape(h.discordGuildID)+"/roles", nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Authorization", "Bot "+h.discordBotToken)
-	req.Header.Set("User-Agent", "amy-world-profile-roles/1.0")
-	resp, err := h.httpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return nil, errUnexpectedStatus(resp.StatusCode)
-	}
 	var roles []discordGuildRole
-	if err := json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(&roles); err != nil {
+	if err := h.discord.Do(ctx, discord.Request{Kind: "guild_roles", Path: "/guilds/" + url.PathEscape(h.discordGuildID) + "/roles"}, &roles); err != nil {
 		return nil, err
 	}
 	return roles, nil
@@ -0,0 +1,587 @@
+package handlers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"amy/minecraft-server/internal/discord"
+	"amy/minecraft-server/internal/observability"
+)
+
+const (
+	discordInteractionPing             = 1
+	discordInteractionCommand          = 2
+	discordInteractionComponent        = 3
+	discordInteractionModalSubmit      = 5
+	discordResponsePong                = 1
+	discordResponseMessage             = 4
+	discordResponseDeferredMessage     = 5
+	discordResponseModal               = 9
+	discordMessageFlagEphemeral        = 1 << 6
+	discordInteractionSignatureMaxSkew = 5 * time.Minute
+)
+
+// DiscordInteractionsHandler answers Discord's interactions endpoint: slash
+// commands, clicks on moderation buttons and the modals they open. Discord
+// signs every request with the application's Ed25519 key, and the member who
+// clicked is checked against the moderator and support staff lists, so the
+// buttons need no moderation token.
+type DiscordInteractionsHandler struct {
+	publicKey     ed25519.PublicKey
+	discord       *discord.Client
+	applicationID string
+	guildID       string
+	auth          *DiscordAuthHandler
+	support       *SupportHandler
+	serverStatus  *ServerStatusHandler
+}
+
+type discordInteraction struct {
+	ID            string `json:"id"`
+	ApplicationID string `json:"application_id"`
+	Type          int    `json:"type"`
+	Token         string `json:"token"`
+	GuildID       string `json:"guild_id"`
+	Member        *struct {
+		User discordInteractionUser `json:"user"`
+	} `json:"member"`
+	User *discordInteractionUser `json:"user"`
+	Data struct {
+		Name    string `json:"name"`
+		Options []struct {
+			Name  string          `json:"name"`
+			Value json.RawMessage `json:"value"`
+		} `json:"options"`
+		CustomID   string `json:"custom_id"`
+		Components []struct {
+			Components []struct {
+				CustomID string `json:"custom_id"`
+				Value    string `json:"value"`
+			} `json:"components"`
+		} `json:"components"`
+	} `json:"data"`
+}
+
+type discordInteractionUser struct {
+	ID string `json:"id"`
+}
+
+// userID is the member who ran the command or clicked the button, in a
+// guild or in a DM.
+func (i discordInteraction) userID() string {
+	if i.Member != nil {
+		return strings.TrimSpace(i.Member.User.ID)
+	}
+	if i.User != nil {
+		return strings.TrimSpace(i.User.ID)
+	}
+	return ""
+}
+
+func (i discordInteraction) option(name string) string {
+	for _, option := range i.Data.Options {
+		if option.Name != name {
+			continue
+		}
+		var text string
+		if json.Unmarshal(option.Value, &text) == nil {
+			return strings.TrimSpace(text)
+		}
+		return strings.TrimSpace(string(option.Value))
+	}
+	return ""
+}
+
+// modalValue returns the text typed into the modal input with customID.
+func (i discordInteraction) modalValue(customID string) string {
+	for _, row := range i.Data.Components {
+		for _, input := range row.Components {
+			if input.CustomID == customID {
+				return strings.TrimSpace(input.Value)
+			}
+		}
+	}
+	return ""
+}
+
+func NewDiscordInteractionsHandler(publicKeyHex string, discordClient *discord.Client, applicationID, guildID string, auth *DiscordAuthHandler, support *SupportHandler, serverStatus *ServerStatusHandler) *DiscordInteractionsHandler {
+	h := &DiscordInteractionsHandler{
+		discord:       discordClient,
+		applicationID: strings.TrimSpace(applicationID),
+		guildID:       strings.TrimSpace(guildID),
+		auth:          auth,
+		support:       support,
+		serverStatus:  serverStatus,
+	}
+	if key, err := hex.DecodeString(strings.TrimSpace(publicKeyHex)); err == nil && len(key) == ed25519.PublicKeySize {
+		h.publicKey = ed25519.PublicKey(key)
+	} else if strings.TrimSpace(publicKeyHex) != "" {
+		log.Printf("discord interactions disabled: DISCORD_PUBLIC_KEY is not a hex Ed25519 key")
+	}
+	return h
+}
+
+// Enabled reports whether the endpoint can verify requests. Without it the
+// moderation buttons stay links to the HTML pages.
+func (h *DiscordInteractionsHandler) Enabled() bool {
+	return len(h.publicKey) == ed25519.PublicKeySize
+}
+
+// SetDiscordInteractions switches RP moderation buttons to interactions.
+func (h *DiscordAuthHandler) SetDiscordInteractions(enabled bool) {
+	h.interactions = enabled
+}
+
+// SetDiscordInteractions switches ticket buttons to interactions.
+func (h *SupportHandler) SetDiscordInteractions(enabled bool) {
+	h.interactions = enabled
+}
+
+// RegisterCommands replaces the guild's slash commands with /ticket,
+// /profile and /status. Guild commands show up at once, unlike global ones.
+func (h *DiscordInteractionsHandler) RegisterCommands(ctx context.Context) error {
+	if !h.Enabled() || !h.discord.Configured() || h.applicationID == "" || h.guildID == "" {
+		return nil
+	}
+	commands := []map[string]any{
+		{
+			"name":        "ticket",
+			"description": "Показать тикет поддержки",
+			"options": []any{map[string]any{
+				"type":        4,
+				"name":        "id",
+				"description": "Номер тикета",
+				"required":    true,
+				"min_value":   1,
+			}},
+		},
+		{
+			"name":        "profile",
+			"description": "Профиль игрока на сайте",
+			"options": []any{map[string]any{
+				"type":        6,
+				"name":        "user",
+				"description": "Игрок; по умолчанию вы",
+			}},
+		},
+		{
+			"name":        "status",
+			"description": "Статус Minecraft-сервера",
+		},
+	}
+	return h.discord.Do(ctx, discord.Request{
+		Kind:   "interaction_commands",
+		Method: http.MethodPut,
+		Path:   "/applications/" + url.PathEscape(h.applicationID) + "/guilds/" + url.PathEscape(h.guildID) + "/commands",
+		JSON:   commands,
+	}, nil)
+}
+
+func (h *DiscordInteractionsHandler) Handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !h.Enabled() {
+		writeError(w, http.StatusServiceUnavailable, "discord interactions are not configured")
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+	if !h.verify(r.Header.Get("X-Signature-Ed25519"), r.Header.Get("X-Signature-Timestamp"), body) {
+		writeError(w, http.StatusUnauthorized, "invalid request signature")
+		return
+	}
+	var interaction discordInteraction
+	if err := json.Unmarshal(body, &interaction); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+
+	switch interaction.Type {
+	case discordInteractionPing:
+		writeJSON(w, http.StatusOK, map[string]int{"type": discordResponsePong})
+	case discordInteractionCommand:
+		observability.DiscordInteractions.WithLabelValues("command", interaction.Data.Name).Inc()
+		h.handleCommand(w, r.Context(), interaction)
+	case discordInteractionComponent, discordInteractionModalSubmit:
+		kind, action, id, ok := parseDiscordCustomID(interaction.Data.CustomID)
+		if !ok {
+			writeInteractionMessage(w, "Кнопка устарела.")
+			return
+		}
+		if interaction.Type == discordInteractionComponent {
+			observability.DiscordInteractions.WithLabelValues("component", kind+"_"+action).Inc()
+		} else {
+			observability.DiscordInteractions.WithLabelValues("modal", kind+"_"+action).Inc()
+		}
+		switch kind {
+		case "rp":
+			h.handleRPAction(w, interaction, action, id)
+		case "ticket":
+			h.handleTicketAction(w, r.Context(), interaction, action, id)
+		default:
+			writeInteractionMessage(w, "Кнопка устарела.")
+		}
+	default:
+		writeError(w, http.StatusBadRequest, "unsupported interaction type")
+	}
+}
+
+// verify checks the Ed25519 signature Discord puts on the timestamp and raw
+// body. Old timestamps are refused so a captured request cannot be replayed
+// later.
+func (h *DiscordInteractionsHandler) verify(signatureHex, timestamp string, body []byte) bool {
+	signature, err := hex.DecodeString(strings.TrimSpace(signatureHex))
+	if err != nil || len(signature) != ed25519.SignatureSize || timestamp == "" {
+		return false
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := time.Since(time.Unix(seconds, 0)); skew > discordInteractionSignatureMaxSkew || skew < -discordInteractionSignatureMaxSkew {
+		return false
+	}
+	message := make([]byte, 0, len(timestamp)+len(body))
+	message = append(message, timestamp...)
+	message = append(message, body...)
+	return ed25519.Verify(h.publicKey, message, signature)
+}
+
+func (h *DiscordInteractionsHandler) handleCommand(w http.ResponseWriter, ctx context.Context, interaction discordInteraction) {
+	switch interaction.Data.Name {
+	case "ticket":
+		if !h.support.isSupportStaff(interaction.userID()) {
+			writeInteractionMessage(w, "Команда доступна только поддержке.")
+			return
+		}
+		ticketID, err := strconv.ParseInt(interaction.option("id"), 10, 64)
+		if err != nil || ticketID <= 0 {
+			writeInteractionMessage(w, "Укажите номер тикета.")
+			return
+		}
+		loadCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		ticket, err := h.support.loadTicket(loadCtx, ticketID)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeInteractionMessage(w, fmt.Sprintf("Тикет #%d не найден.", ticketID))
+			return
+		}
+		if err != nil {
+			writeInteractionMessage(w, "Не удалось загрузить тикет, попробуйте позже.")
+			return
+		}
+		payload := h.support.buildDiscordTicketPayload(ticket)
+		payload["flags"] = discordMessageFlagEphemeral
+		writeJSON(w, http.StatusOK, map[string]any{"type": discordResponseMessage, "data": payload})
+	case "profile":
+		discordID := interaction.option("user")
+		if discordID == "" {
+			discordID = interaction.userID()
+		}
+		h.deferred(w, interaction, false, func(ctx context.Context) map[string]any {
+			return h.profileMessage(ctx, discordID)
+		})
+	case "status":
+		h.deferred(w, interaction, false, func(ctx context.Context) map[string]any {
+			return h.statusMessage(ctx)
+		})
+	default:
+		writeInteractionMessage(w, "Неизвестная команда.")
+	}
+}
+
+func (h *DiscordInteractionsHandler) handleRPAction(w http.ResponseWriter, interaction discordInteraction, action, applicationID string) {
+	moderatorID := interaction.userID()
+	if !h.auth.isRPModerator(moderatorID) {
+		writeInteractionMessage(w, "Модерировать заявки могут только RP-модераторы.")
+		return
+	}
+	action = normalizeModerationAction(action)
+	if action == "" {
+		writeInteractionMessage(w, "Кнопка устарела.")
+		return
+	}
+
+	// Accepting and declining first ask for a comment to the applicant.
+	if interaction.Type == discordInteractionComponent && (action == "accept" || action == "cancel") {
+		title := "Принять заявку"
+		label := "Комментарий для игрока (необязательно)"
+		if action == "cancel" {
+			title = "Отклонить заявку"
+			label = "Причина отказа"
+		}
+		writeInteractionModal(w, discordCustomID("rp", action, applicationID), title, label, action == "cancel", 1000)
+		return
+	}
+
+	reason := interaction.modalValue("text")
+	h.deferred(w, interaction, true, func(ctx context.Context) map[string]any {
+		current, err := h.auth.loadApplicationByID(ctx, applicationID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return discordText("Заявка уже удалена.")
+		}
+		if err != nil {
+			return discordText("Не удалось загрузить заявку, попробуйте позже.")
+		}
+		applied, err := h.auth.moderateRPApplication(ctx, current, action, reason)
+		if err != nil {
+			log.Printf("discord interaction: moderate rp application %s: %v", applicationID, err)
+			return discordText("Не удалось изменить заявку, попробуйте позже.")
+		}
+		if !applied {
+			return discordText(fmt.Sprintf("Заявка %s уже обработана (статус: %s).", safeValue(current.Nickname), normalizedStatus(current.Status)))
+		}
+		done := map[string]string{
+			"accept":     "принята",
+			"cancel":     "отклонена",
+			"call":       "переведена на созвон",
+			"reconsider": "возвращена на рассмотрение",
+		}[action]
+		return discordText(fmt.Sprintf("Заявка %s %s.", safeValue(current.Nickname), done))
+	})
+}
+
+func (h *DiscordInteractionsHandler) handleTicketAction(w http.ResponseWriter, ctx context.Context, interaction discordInteraction, action, rawTicketID string) {
+	staffID := interaction.userID()
+	if !h.support.isSupportStaff(staffID) {
+		writeInteractionMessage(w, "Тикетами может управлять только поддержка.")
+		return
+	}
+	ticketID, err := strconv.ParseInt(rawTicketID, 10, 64)
+	if err != nil || ticketID <= 0 {
+		writeInteractionMessage(w, "Кнопка устарела.")
+		return
+	}
+
+	if interaction.Type == discordInteractionComponent {
+		switch action {
+		case "reply":
+			writeInteractionModal(w, discordCustomID("ticket", "reply", rawTicketID), fmt.Sprintf("Ответ в тикет #%d", ticketID), "Сообщение игроку", true, 2000)
+			return
+		case "delete":
+			writeJSON(w, http.StatusOK, map[string]any{
+				"type": discordResponseMessage,
+				"data": map[string]any{
+					"content": fmt.Sprintf("Удалить тикет #%d вместе с перепиской и файлами? Это нельзя отменить.", ticketID),
+					"flags":   discordMessageFlagEphemeral,
+					"components": []any{map[string]any{"type": 1, "components": []any{
+						map[string]any{"type": 2, "style": discordButtonStyle("delete"), "label": "Удалить навсегда", "custom_id": discordCustomID("ticket", "delete_confirm", rawTicketID)},
+					}}},
+				},
+			})
+			return
+		}
+	}
+
+	message := interaction.modalValue("text")
+	h.deferred(w, interaction, true, func(ctx context.Context) map[string]any {
+		ticket, err := h.support.loadTicket(ctx, ticketID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return discordText(fmt.Sprintf("Тикет #%d уже удалён.", ticketID))
+		}
+		if err != nil {
+			return discordText("Не удалось загрузить тикет, попробуйте позже.")
+		}
+		switch action {
+		case "reply":
+			if message == "" {
+				return discordText("Введите текст ответа.")
+			}
+			if _, err := h.support.saveStaffTicketReply(ctx, ticket, staffID, message, nil, "Discord"); err != nil {
+				log.Printf("discord interaction: reply to ticket %d: %v", ticketID, err)
+				return discordText("Не удалось отправить ответ, попробуйте позже.")
+			}
+			return discordText(fmt.Sprintf("Ответ отправлен в тикет #%d.", ticketID))
+		case "delete_confirm":
+			if err := h.support.deleteTicket(ctx, ticket); err != nil {
+				log.Printf("discord interaction: delete ticket %d: %v", ticketID, err)
+				return discordText("Не удалось удалить тикет, попробуйте позже.")
+			}
+			return discordText(fmt.Sprintf("Тикет #%d удалён.", ticketID))
+		case "resolve", "reconsider", "archive", "unarchive":
+			if err := h.support.setTicketStatus(ctx, &ticket, ticketStatusForAction(action)); err != nil {
+				log.Printf("discord interaction: %s ticket %d: %v", action, ticketID, err)
+				return discordText("Не удалось изменить тикет, попробуйте позже.")
+			}
+			return discordText(fmt.Sprintf("Тикет #%d: %s.", ticketID, map[string]string{
+				"open":     "снова открыт",
+				"resolved": "решён",
+				"archived": "в архиве",
+			}[ticket.Status]))
+		default:
+			return discordText("Кнопка устарела.")
+		}
+	})
+}
+
+func (h *DiscordInteractionsHandler) profileMessage(ctx context.Context, discordID string) map[string]any {
+	user, err := h.auth.loadDiscordUser(ctx, discordID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return discordText(fmt.Sprintf("<@%s> ещё не заходил на сайт.", discordID))
+	}
+	if err != nil {
+		return discordText("Не удалось загрузить профиль, попробуйте позже.")
+	}
+	profile := toPublicProfile(*user, time.Now().UTC())
+	_ = h.auth.enrichPublicProfile(ctx, profile)
+
+	fields := []map[string]any{}
+	if profile.RPName != "" {
+		fields = append(fields, map[string]any{"name": "Персонаж", "value": profile.RPName, "inline": true})
+	}
+	if profile.MinecraftNickname != "" {
+		fields = append(fields, map[string]any{"name": "Ник в игре", "value": profile.MinecraftNickname, "inline": true})
+	}
+	if profile.Race != "" {
+		fields = append(fields, map[string]any{"name": "Раса", "value": profile.Race, "inline": true})
+	}
+	application := "нет принятой анкеты"
+	if profile.HasAcceptedApplication {
+		application = "анкета принята"
+	}
+	fields = append(fields, map[string]any{"name": "RP-анкета", "value": application, "inline": true})
+	if profile.JoinedAt != nil {
+		fields = append(fields, map[string]any{"name": "На сайте с", "value": fmt.Sprintf("<t:%d:D>", profile.JoinedAt.Unix()), "inline": true})
+	}
+	if profile.GuildJoinedAt != nil {
+		fields = append(fields, map[string]any{"name": "В Discord с", "value": fmt.Sprintf("<t:%d:D>", profile.GuildJoinedAt.Unix()), "inline": true})
+	}
+
+	embed := map[string]any{
+		"title":  profile.DisplayName,
+		"url":    buildProfileURL(h.auth.frontendURL, profile.ID),
+		"fields": fields,
+	}
+	if profile.AvatarURL != "" && strings.HasPrefix(profile.AvatarURL, "http") {
+		embed["thumbnail"] = map[string]string{"url": profile.AvatarURL}
+	}
+	if color, err := strconv.ParseInt(strings.TrimPrefix(profile.ThemeColor, "#"), 16, 32); err == nil {
+		embed["color"] = color
+	}
+	return map[string]any{"embeds": []any{embed}}
+}
+
+func (h *DiscordInteractionsHandler) statusMessage(ctx context.Context) map[string]any {
+	address := displayMinecraftAddress(h.serverStatus.address)
+	status, err := queryMinecraftStatus(ctx, h.serverStatus.address)
+	if err != nil || !status.Online {
+		return discordText(fmt.Sprintf("🔴 %s сейчас недоступен.", address))
+	}
+	text := fmt.Sprintf("🟢 %s онлайн: %d/%d игроков", address, status.Players.Online, status.Players.Max)
+	if status.Version != "" {
+		text += ", версия " + status.Version
+	}
+	if len(status.Players.Sample) > 0 {
+		names := make([]string, 0, len(status.Players.Sample))
+		for _, player := range status.Players.Sample {
+			names = append(names, player.Name)
+		}
+		text += "\n" + strings.Join(names, ", ")
+	}
+	return discordText(text)
+}
+
+// deferred acknowledges the interaction at once, since Discord gives three
+// seconds for the first response, and then replaces the "thinking" message
+// with what work returns.
+func (h *DiscordInteractionsHandler) deferred(w http.ResponseWriter, interaction discordInteraction, ephemeral bool, work func(ctx context.Context) map[string]any) {
+	response := map[string]any{"type": discordResponseDeferredMessage}
+	if ephemeral {
+		response["data"] = map[string]any{"flags": discordMessageFlagEphemeral}
+	}
+	writeJSON(w, http.StatusOK, response)
+
+	go func() {
+		// Interaction tokens stay valid for 15 minutes.
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		payload := work(ctx)
+		err := h.discord.Do(ctx, discord.Request{
+			Kind:      "interaction_followup",
+			Method:    http.MethodPatch,
+			Path:      "/webhooks/" + url.PathEscape(interaction.ApplicationID) + "/" + url.PathEscape(interaction.Token) + "/messages/@original",
+			JSON:      payload,
+			Anonymous: true,
+		}, nil)
+		if err != nil {
+			log.Printf("discord interaction %s follow-up failed: %v", interaction.ID, err)
+		}
+	}()
+}
+
+func discordText(content string) map[string]any {
+	return map[string]any{"content": trimForDiscord(content)}
+}
+
+func writeInteractionMessage(w http.ResponseWriter, content string) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"type": discordResponseMessage,
+		"data": map[string]any{"content": content, "flags": discordMessageFlagEphemeral},
+	})
+}
+
+// writeInteractionModal opens a modal with one paragraph input whose value
+// comes back under the custom id "text".
+func writeInteractionModal(w http.ResponseWriter, customID, title, label string, required bool, maxLength int) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"type": discordResponseModal,
+		"data": map[string]any{
+			"custom_id": customID,
+			"title":     title,
+			"components": []any{map[string]any{"type": 1, "components": []any{map[string]any{
+				"type":       4,
+				"custom_id":  "text",
+				"style":      2,
+				"label":      label,
+				"required":   required,
+				"max_length": maxLength,
+			}}}},
+		},
+	})
+}
+
+// discordCustomID builds the custom id of a moderation button, such as
+// "rp:accept:42". Modals opened by a button reuse its custom id.
+func discordCustomID(kind, action, id string) string {
+	return kind + ":" + action + ":" + id
+}
+
+func parseDiscordCustomID(customID string) (string, string, string, bool) {
+	parts := strings.SplitN(customID, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], parts[2], true
+}
+
+// discordButtonStyle colours interaction buttons by what they do: green to
+// accept or close, red to decline or delete, blue for the rest.
+func discordButtonStyle(action string) int {
+	switch action {
+	case "accept", "resolve":
+		return 3
+	case "cancel", "delete":
+		return 4
+	case "reconsider", "archive", "unarchive":
+		return 2
+	default:
+		return 1
+	}
+}
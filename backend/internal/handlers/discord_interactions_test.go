@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestInteractionsHandler(t *testing.T) (*DiscordInteractionsHandler, ed25519.PrivateKey) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &DiscordAuthHandler{rpModeratorIDs: parseDiscordIDSet("100")}
+	support := &SupportHandler{staffIDs: parseDiscordIDSet("200")}
+	return NewDiscordInteractionsHandler(hex.EncodeToString(public), nil, "app", "guild", auth, support, nil), private
+}
+
+func signedInteraction(key ed25519.PrivateKey, at time.Time, body string) *http.Request {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	request := httptest.NewRequest(http.MethodPost, "/api/discord/interactions", strings.NewReader(body))
+	request.Header.Set("X-Signature-Ed25519", hex.EncodeToString(ed25519.Sign(key, []byte(timestamp+body))))
+	request.Header.Set("X-Signature-Timestamp", timestamp)
+	return request
+}
+
+func TestDiscordInteractionsVerifiesSignature(t *testing.T) {
+	h, key := newTestInteractionsHandler(t)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	ping := `{"type":1}`
+	now := time.Now()
+
+	recorder := httptest.NewRecorder()
+	h.Handle(recorder, signedInteraction(key, now, ping))
+	if recorder.Code != http.StatusOK || strings.TrimSpace(recorder.Body.String()) != `{"type":1}` {
+		t.Fatalf("ping: %d %s", recorder.Code, recorder.Body)
+	}
+
+	tampered := signedInteraction(key, now, ping)
+	tampered.Body = io.NopCloser(strings.NewReader(`{"type":2}`))
+	rejected := map[string]*http.Request{
+		"other key":     signedInteraction(otherKey, now, ping),
+		"tampered body": tampered,
+		"replayed":      signedInteraction(key, now.Add(-10*time.Minute), ping),
+		"unsigned":      httptest.NewRequest(http.MethodPost, "/api/discord/interactions", strings.NewReader(ping)),
+	}
+	for name, request := range rejected {
+		recorder := httptest.NewRecorder()
+		h.Handle(recorder, request)
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("%s: got %d, want 401", name, recorder.Code)
+		}
+	}
+
+	disabled := NewDiscordInteractionsHandler("", nil, "app", "guild", nil, nil, nil)
+	recorder = httptest.NewRecorder()
+	disabled.Handle(recorder, signedInteraction(key, now, ping))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("without a public key: got %d, want 503", recorder.Code)
+	}
+}
+
+func TestDiscordInteractionsButtonsNeedTheRightRole(t *testing.T) {
+	h, key := newTestInteractionsHandler(t)
+	cases := []struct {
+		user, customID, want string
+	}{
+		{"200", "rp:accept:7", "Модерировать заявки могут только RP-модераторы."},
+		{"100", "ticket:resolve:7", "Тикетами может управлять только поддержка."},
+		{"100", "rp:bogus:7", "Кнопка устарела."},
+		{"200", "ticket:resolve", "Кнопка устарела."},
+		{"200", "ticket:resolve:abc", "Кнопка устарела."},
+	}
+	for _, tc := range cases {
+		body := `{"type":3,"member":{"user":{"id":"` + tc.user + `"}},"data":{"custom_id":"` + tc.customID + `"}}`
+		recorder := httptest.NewRecorder()
+		h.Handle(recorder, signedInteraction(key, time.Now(), body))
+
+		var response struct {
+			Type int `json:"type"`
+			Data struct {
+				Content string `json:"content"`
+				Flags   int    `json:"flags"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s by %s: %v", tc.customID, tc.user, err)
+		}
+		if response.Type != discordResponseMessage || response.Data.Content != tc.want || response.Data.Flags != discordMessageFlagEphemeral {
+			t.Errorf("%s by %s: got %+v, want %q", tc.customID, tc.user, response, tc.want)
+		}
+	}
+
+	// A moderator clicking accept is asked for a comment first.
+	body := `{"type":3,"member":{"user":{"id":"100"}},"data":{"custom_id":"rp:accept:7"}}`
+	recorder := httptest.NewRecorder()
+	h.Handle(recorder, signedInteraction(key, time.Now(), body))
+	if !strings.Contains(recorder.Body.String(), `"type":9`) || !strings.Contains(recorder.Body.String(), `"custom_id":"rp:accept:7"`) {
+		t.Errorf("accept should open a modal, got %s", recorder.Body)
+	}
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// discord_member_events is an append-only history of guild membership. The
+// member sync and gateway events compare each update with the stored state
+// and record what changed, since discord_member_states only keeps the latest
+// one.
+const (
+	discordMemberJoined      = "joined"
+	discordMemberLeft        = "left"
+	discordMemberNickChanged = "nick_changed"
+	discordMemberRoleAdded   = "role_added"
+	discordMemberRoleRemoved = "role_removed"
+
+	discordMemberSourceSync    = "sync"
+	discordMemberSourceGateway = "gateway"
+)
+
+type discordMemberEvent struct {
+	ID         int64     `json:"id"`
+	Type       string    `json:"type"`
+	RoleID     string    `json:"roleId,omitempty"`
+	OldValue   string    `json:"oldValue,omitempty"`
+	NewValue   string    `json:"newValue,omitempty"`
+	Source     string    `json:"source"`
+	OccurredAt time.Time `json:"occurredAt"`
+}
+
+type discordMemberTimelineMember struct {
+	Username      string     `json:"username,omitempty"`
+	GlobalName    string     `json:"globalName,omitempty"`
+	Nick          string     `json:"nick,omitempty"`
+	Roles         []string   `json:"roles"`
+	GuildJoinedAt *time.Time `json:"guildJoinedAt,omitempty"`
+	LeftAt        *time.Time `json:"leftAt,omitempty"`
+	SyncedAt      time.Time  `json:"syncedAt"`
+}
+
+func recordDiscordMemberEvent(ctx context.Context, exec sqlExecer, discordID, eventType, roleID, oldValue, newValue, source string, occurredAt time.Time) error {
+	_, err := exec.ExecContext(
+		ctx,
+		`INSERT INTO discord_member_events (discord_id, event_type, role_id, old_value, new_value, source, occurred_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		discordID,
+		eventType,
+		roleID,
+		oldValue,
+		newValue,
+		source,
+		occurredAt,
+	)
+	return err
+}
+
+// loadDiscordMemberEvents returns a member's events, newest first. beforeID
+// pages back from an earlier response; 0 starts from the latest event.
+func loadDiscordMemberEvents(ctx context.Context, db *sql.DB, discordID string, beforeID int64, limit int) ([]discordMemberEvent, error) {
+	query := `SELECT id, event_type, role_id, old_value, new_value, source, occurred_at
+		 FROM discord_member_events
+		 WHERE discord_id = $1`
+	args := []any{discordID}
+	if beforeID > 0 {
+		query += ` AND (occurred_at, id) < (SELECT occurred_at, id FROM discord_member_events WHERE id = $2)`
+		args = append(args, beforeID)
+	}
+	query += ` ORDER BY occurred_at DESC, id DESC LIMIT ` + strconv.Itoa(limit)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]discordMemberEvent, 0)
+	for rows.Next() {
+		var event discordMemberEvent
+		if err := rows.Scan(&event.ID, &event.Type, &event.RoleID, &event.OldValue, &event.NewValue, &event.Source, &event.OccurredAt); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// staffMemberEvents serves GET /api/support/staff/members/{discordId}/events:
+// the member's current guild state and their membership timeline.
+func (h *SupportHandler) staffMemberEvents(w http.ResponseWriter, r *http.Request, discordID string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	discordID = strings.TrimSpace(discordID)
+	if _, err := strconv.ParseUint(discordID, 10, 64); err != nil {
+		writeError(w, http.StatusNotFound, "member not found")
+		return
+	}
+
+	query := r.URL.Query()
+	limit := 100
+	if value, err := strconv.Atoi(query.Get("limit")); err == nil && value > 0 && value <= 500 {
+		limit = value
+	}
+	var beforeID int64
+	if value, err := strconv.ParseInt(query.Get("before"), 10, 64); err == nil && value > 0 {
+		beforeID = value
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var member discordMemberTimelineMember
+	var rawRoles string
+	var guildJoinedAt, leftAt sql.NullTime
+	err := h.db.QueryRowContext(
+		ctx,
+		`SELECT username, global_name, nick, array_to_string(roles, E'\n'), guild_joined_at, left_at, synced_at
+		 FROM discord_member_states WHERE discord_id = $1`,
+		discordID,
+	).Scan(&member.Username, &member.GlobalName, &member.Nick, &rawRoles, &guildJoinedAt, &leftAt, &member.SyncedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusInternalServerError, "failed to load member")
+		return
+	}
+	events, eventsErr := loadDiscordMemberEvents(ctx, h.db, discordID, beforeID, limit)
+	if eventsErr != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load member events")
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) && len(events) == 0 && beforeID == 0 {
+		writeError(w, http.StatusNotFound, "member not found")
+		return
+	}
+
+	response := map[string]any{
+		"discordId": discordID,
+		"events":    events,
+	}
+	if err == nil {
+		member.Roles = splitPostgresTextArray(rawRoles)
+		if guildJoinedAt.Valid {
+			joinedAt := guildJoinedAt.Time.UTC()
+			member.GuildJoinedAt = &joinedAt
+		}
+		if leftAt.Valid {
+			left := leftAt.Time.UTC()
+			member.LeftAt = &left
+		}
+		response["member"] = member
+	}
+	if len(events) == limit {
+		response["nextBefore"] = events[len(events)-1].ID
+	}
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpsertMemberRecordsChanges(t *testing.T) {
+	stateColumns := []string{"username", "nick", "roles", "role_ids", "left"}
+	cases := []struct {
+		name     string
+		previous []driver.Value
+		want     []string
+	}{
+		{
+			name:     "known member",
+			previous: []driver.Value{"steve", "Old", "Builder\nHelper", "1\n2", false},
+			want: []string{
+				"nick_changed  Old New",
+				"role_added 3  Mod",
+				"role_removed 1 Builder ",
+			},
+		},
+		{
+			name:     "same state",
+			previous: []driver.Value{"steve", "New", "Helper\nMod", "2\n3", false},
+		},
+		{
+			name:     "came back",
+			previous: []driver.Value{"steve", "Old", "", "", true},
+			want: []string{
+				"joined   New",
+				"role_added 2  Helper",
+				"role_added 3  Mod",
+			},
+		},
+		{
+			name:     "presence only",
+			previous: []driver.Value{"", "", "", "", false},
+			want:     []string{"joined   New"},
+		},
+		{
+			name: "never stored",
+			want: []string{"joined   New"},
+		},
+	}
+
+	for _, tc := range cases {
+		db, script := newScriptedDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value) {
+			switch {
+			case strings.Contains(query, "FROM deleted_accounts"):
+				return []string{"exists"}, [][]driver.Value{{false}}
+			case strings.Contains(query, "FROM discord_member_states") && tc.previous != nil:
+				return stateColumns, [][]driver.Value{tc.previous}
+			}
+			return stateColumns, nil
+		})
+		s := &DiscordMemberSync{db: db}
+		s.setRoles(map[string]string{"0": "@everyone", "1": "Builder", "2": "Helper", "3": "Mod"})
+
+		var member discordGuildMember
+		member.User.ID = "100"
+		member.User.Username = "steve"
+		member.Nick = " New "
+		member.Roles = []string{"0", "2", "3", "99"}
+
+		ctx := context.Background()
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.upsertMember(ctx, tx, member, discordMemberSourceGateway, time.Now().UTC()); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		_ = tx.Commit()
+
+		var got []string
+		for _, event := range script.find("INSERT INTO discord_member_events") {
+			got = append(got, fmt.Sprintf("%s %s %s %s", event.args[1], event.args[2], event.args[3], event.args[4]))
+		}
+		sort.Strings(got)
+		if strings.Join(got, "|") != strings.Join(tc.want, "|") {
+			t.Errorf("%s: got events %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
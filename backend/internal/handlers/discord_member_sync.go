@@ -4,26 +4,32 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
-	"io"
+	"errors"
+	"fmt"
 	"log"
-	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"amy/minecraft-server/internal/discord"
 )
 
 type DiscordMemberSync struct {
-	db                 *sql.DB
-	botToken           string
-	guildID            string
-	ticketChannelID    string
-	notifySupportReply func(context.Context, int64, string, string)
-	httpClient         *http.Client
+	db              *sql.DB
+	botToken        string
+	guildID         string
+	ticketChannelID string
+	support         SupportGatewayHooks
+	discord         *discord.Client
+	gateway         *discord.Gateway
+	chat            *CommunityChatHandler
+
+	// roles maps role ids to names. It is filled by the full sync and
+	// GUILD_CREATE and kept current by GUILD_ROLE_* events.
+	rolesMu sync.Mutex
+	roles   map[string]string
 }
 
 type discordGuildRole struct {
@@ -39,19 +45,9 @@ type discordGuildMember struct {
 		Username   string `json:"username"`
 		GlobalName string `json:"global_name"`
 	} `json:"user"`
-	Nick  string   `json:"nick"`
-	Roles []string `json:"roles"`
-}
-
-type discordGatewayMessage struct {
-	Op int             `json:"op"`
-	D  json.RawMessage `json:"d"`
-	S  *int64          `json:"s"`
-	T  string          `json:"t"`
-}
-
-type discordGatewayHello struct {
-	HeartbeatInterval int `json:"heartbeat_interval"`
+	Nick     string   `json:"nick"`
+	Roles    []string `json:"roles"`
+	JoinedAt string   `json:"joined_at"`
 }
 
 type discordGatewayPresence struct {
@@ -64,9 +60,23 @@ type discordGatewayPresence struct {
 
 type discordGatewayGuildCreate struct {
 	ID        string                   `json:"id"`
+	Roles     []discordGuildRole       `json:"roles"`
 	Presences []discordGatewayPresence `json:"presences"`
 }
 
+// discordGatewayGuildMember is the payload of GUILD_MEMBER_ADD, _UPDATE and
+// _REMOVE; the remove event only carries the guild and user.
+type discordGatewayGuildMember struct {
+	discordGuildMember
+	GuildID string `json:"guild_id"`
+}
+
+type discordGatewayGuildRole struct {
+	GuildID string           `json:"guild_id"`
+	Role    discordGuildRole `json:"role"`
+	RoleID  string           `json:"role_id"`
+}
+
 type discordGatewayMessageCreate struct {
 	ID        string `json:"id"`
 	ChannelID string `json:"channel_id"`
@@ -84,33 +94,92 @@ type discordGatewayMessageCreate struct {
 		MessageID string `json:"message_id"`
 		ChannelID string `json:"channel_id"`
 	} `json:"message_reference"`
+	Attachments []DiscordAttachment `json:"attachments"`
 }
 
-const (
-	discordGatewayOpDispatch     = 0
-	discordGatewayOpHeartbeat    = 1
-	discordGatewayOpIdentify     = 2
-	discordGatewayOpHello        = 10
-	discordGatewayOpHeartbeatACK = 11
+type discordGatewayMessageUpdate struct {
+	ID              string     `json:"id"`
+	ChannelID       string     `json:"channel_id"`
+	Content         *string    `json:"content"`
+	EditedTimestamp *time.Time `json:"edited_timestamp"`
+}
 
+type discordGatewayTypingStart struct {
+	ChannelID string `json:"channel_id"`
+	Member    *struct {
+		Nick string `json:"nick"`
+		User struct {
+			Username   string `json:"username"`
+			GlobalName string `json:"global_name"`
+			Bot        bool   `json:"bot"`
+		} `json:"user"`
+	} `json:"member"`
+}
+
+type discordGatewayMessageDelete struct {
+	ID        string   `json:"id"`
+	IDs       []string `json:"ids"`
+	ChannelID string   `json:"channel_id"`
+}
+
+const (
 	discordGatewayIntentGuilds         = 1 << 0
 	discordGatewayIntentGuildMembers   = 1 << 1
 	discordGatewayIntentGuildPresences = 1 << 8
 	discordGatewayIntentGuildMessages  = 1 << 9
+	discordGatewayIntentMessageTyping  = 1 << 11
 	discordGatewayIntentMessageContent = 1 << 15
 )
 
-func NewDiscordMemberSync(db *sql.DB, botToken, guildID, ticketChannelID string, notifySupportReply func(context.Context, int64, string, string)) *DiscordMemberSync {
-	return &DiscordMemberSync{
-		db:                 db,
-		botToken:           strings.TrimSpace(botToken),
-		guildID:            strings.TrimSpace(guildID),
-		ticketChannelID:    strings.TrimSpace(ticketChannelID),
-		notifySupportReply: notifySupportReply,
-		httpClient: &http.Client{
-			Timeout: 15 * time.Second,
-		},
-	}
+// SupportGatewayHooks lets the gateway listener hand ticket activity it sees
+// in Discord to the support handler. Nil hooks are skipped.
+type SupportGatewayHooks struct {
+	// Reply runs after a staff reply was stored as messageID.
+	Reply func(ctx context.Context, ticketID, messageID int64, authorName, message string)
+	// MessagesChanged runs after stored replies were edited or deleted.
+	MessagesChanged func(ctx context.Context, ticketID int64, messageIDs []int64)
+	// ImportAttachments stores the files of a reply and returns how many were saved.
+	ImportAttachments func(ctx context.Context, ticketID, messageID int64, attachments []DiscordAttachment) int
+	// Typing runs when a staff member starts typing in a ticket thread.
+	Typing func(ctx context.Context, ticketID int64, authorName string)
+	// Macro expands a "!macro name" command sent by staffID instead of
+	// storing it as a reply.
+	Macro func(ctx context.Context, ticketID int64, staffID, command string) error
+}
+
+// NewDiscordMemberSync takes the shard id and count as raw environment
+// values; empty or invalid values mean shard 0 of 1.
+func NewDiscordMemberSync(db *sql.DB, discordClient *discord.Client, botToken, guildID, ticketChannelID, shardIDRaw, shardCountRaw string, support SupportGatewayHooks) *DiscordMemberSync {
+	s := &DiscordMemberSync{
+		db:              db,
+		botToken:        strings.TrimSpace(botToken),
+		guildID:         strings.TrimSpace(guildID),
+		ticketChannelID: strings.TrimSpace(ticketChannelID),
+		support:         support,
+		discord:         discordClient,
+	}
+	if s.botToken != "" && s.guildID != "" && strings.Contains(s.botToken, ".") {
+		shardID, _ := strconv.Atoi(strings.TrimSpace(shardIDRaw))
+		shardCount, _ := strconv.Atoi(strings.TrimSpace(shardCountRaw))
+		s.gateway = discord.NewGateway(
+			discordClient,
+			discordGatewayIntentGuilds|discordGatewayIntentGuildMembers|discordGatewayIntentGuildPresences|discordGatewayIntentGuildMessages|discordGatewayIntentMessageTyping|discordGatewayIntentMessageContent,
+			s.handleGatewayEvent,
+			discord.WithShard(shardID, shardCount),
+		)
+	}
+	return s
+}
+
+// SetCommunityChat hands community chat channel messages from the gateway to
+// the chat store.
+func (s *DiscordMemberSync) SetCommunityChat(chat *CommunityChatHandler) {
+	s.chat = chat
+}
+
+// Gateway is nil when the bot token or guild is not configured.
+func (s *DiscordMemberSync) Gateway() *discord.Gateway {
+	return s.gateway
 }
 
 func (s *DiscordMemberSync) Start(ctx context.Context) {
@@ -127,7 +196,9 @@ func (s *DiscordMemberSync) Start(ctx context.Context) {
 			log.Printf("discord member sync failed: %v", err)
 		}
 
-		ticker := time.NewTicker(10 * time.Minute)
+		// Member changes arrive over the gateway; the full sync only
+		// reconciles what was missed while it was down.
+		ticker := time.NewTicker(6 * time.Hour)
 		defer ticker.Stop()
 
 		for {
@@ -142,246 +213,295 @@ func (s *DiscordMemberSync) Start(ctx context.Context) {
 		}
 	}()
 
-	go s.runPresenceGateway(ctx)
+	status := s.gateway.Status()
+	if shard := discord.ShardForGuild(s.guildID, status.Shard[1]); shard != status.Shard[0] {
+		log.Printf("discord gateway runs shard %d of %d, but guild %s is on shard %d; presence and ticket replies will not arrive", status.Shard[0], status.Shard[1], s.guildID, shard)
+	}
+	go s.gateway.Run(ctx)
 }
 
+// Sync pages through every guild member and marks members who are no longer
+// in the guild as left.
 func (s *DiscordMemberSync) Sync(ctx context.Context) error {
 	roles, err := s.fetchRoles(ctx)
 	if err != nil {
 		return err
 	}
+	s.setRoles(roles)
 
 	after := "0"
-	now := time.Now().UTC()
+	startedAt := time.Now().UTC()
+	seen := 0
 	for {
 		members, err := s.fetchMembers(ctx, after)
 		if err != nil {
 			return err
 		}
-		if len(members) == 0 {
-			return nil
-		}
 
 		tx, err := s.db.BeginTx(ctx, nil)
 		if err != nil {
 			return err
 		}
-
 		for _, member := range members {
-			discordID := strings.TrimSpace(member.User.ID)
-			if discordID == "" {
-				continue
-			}
-
-			roleNames := make([]string, 0, len(member.Roles))
-			roleIDs := make([]string, 0, len(member.Roles))
-			for _, roleID := range member.Roles {
-				if name := roles[roleID]; name != "" && name != "@everyone" {
-					roleNames = append(roleNames, name)
-					roleIDs = append(roleIDs, roleID)
-				}
-			}
-
-			if _, err := tx.ExecContext(
-				ctx,
-				`INSERT INTO discord_member_states (discord_id, username, global_name, nick, roles, role_ids, discord_status, synced_at)
-				 VALUES ($1, $2, $3, $4, $5, $6, 'offline', $7)
-				 ON CONFLICT (discord_id) DO UPDATE SET
-				   username = EXCLUDED.username,
-				   global_name = EXCLUDED.global_name,
-				   nick = EXCLUDED.nick,
-				   roles = EXCLUDED.roles,
-				   role_ids = EXCLUDED.role_ids,
-				   synced_at = EXCLUDED.synced_at`,
-				discordID,
-				strings.TrimSpace(member.User.Username),
-				strings.TrimSpace(member.User.GlobalName),
-				strings.TrimSpace(member.Nick),
-				roleNames,
-				roleIDs,
-				now,
-			); err != nil {
+			if err := s.upsertMember(ctx, tx, member, discordMemberSourceSync, time.Now().UTC()); err != nil {
 				_ = tx.Rollback()
 				return err
 			}
-
-			after = discordID
+			if discordID := strings.TrimSpace(member.User.ID); discordID != "" {
+				after = discordID
+				seen++
+			}
 		}
-
 		if err := tx.Commit(); err != nil {
 			return err
 		}
 		if len(members) < 1000 {
-			return nil
+			break
 		}
 	}
-}
-
-func (s *DiscordMemberSync) fetchRoles(ctx context.Context) (map[string]string, error) {
-	var roles []discordGuildRole
-	if err := s.fetchDiscord(ctx, "/guilds/"+url.PathEscape(s.guildID)+"/roles", &roles); err != nil {
-		return nil, err
+	if seen == 0 {
+		// An empty member list is more likely a permissions problem than
+		// an empty guild; don't mark everyone as left.
+		return nil
 	}
 
-	result := make(map[string]string, len(roles))
-	for _, role := range roles {
-		result[role.ID] = role.Name
+	// Anyone the pass did not touch left while the gateway was down. Rows
+	// written by gateway events during the pass have a newer synced_at.
+	result, err := s.db.ExecContext(
+		ctx,
+		`WITH left_members AS (
+		   UPDATE discord_member_states
+		   SET left_at = $1, roles = '{}', role_ids = '{}', discord_status = 'offline'
+		   WHERE left_at IS NULL AND synced_at < $1
+		   RETURNING discord_id
+		 )
+		 INSERT INTO discord_member_events (discord_id, event_type, source, occurred_at)
+		 SELECT discord_id, $2, $3, $1 FROM left_members`,
+		startedAt,
+		discordMemberLeft,
+		discordMemberSourceSync,
+	)
+	if err != nil {
+		return err
 	}
-	return result, nil
-}
-
-func (s *DiscordMemberSync) fetchMembers(ctx context.Context, after string) ([]discordGuildMember, error) {
-	var members []discordGuildMember
-	path := "/guilds/" + url.PathEscape(s.guildID) + "/members?limit=1000&after=" + url.QueryEscape(after)
-	if err := s.fetchDiscord(ctx, path, &members); err != nil {
-		return nil, err
+	if left, _ := result.RowsAffected(); left > 0 {
+		log.Printf("discord member sync marked %d members as left", left)
 	}
-	return members, nil
+	return nil
 }
 
-func (s *DiscordMemberSync) fetchDiscord(ctx context.Context, path string, target any) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://discord.com/api/v10"+path, nil)
-	if err != nil {
+// upsertMember stores a member with the names of the roles the backend
+// knows, clears left_at for a member who came back and records how the
+// member changed since the stored state.
+func (s *DiscordMemberSync) upsertMember(ctx context.Context, tx *sql.Tx, member discordGuildMember, source string, now time.Time) error {
+	discordID := strings.TrimSpace(member.User.ID)
+	if discordID == "" {
+		return nil
+	}
+	var deleted bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM deleted_accounts WHERE discord_id = $1)`, discordID).Scan(&deleted); err != nil {
 		return err
 	}
-	req.Header.Set("Authorization", "Bot "+s.botToken)
-	req.Header.Set("User-Agent", "amy-world-discord-sync/1.0")
+	if deleted {
+		return nil
+	}
+	roleNames, roleIDs := s.memberRoles(member.Roles)
+	nick := strings.TrimSpace(member.Nick)
+	var guildJoinedAt *time.Time
+	if joinedAt, err := time.Parse(time.RFC3339Nano, member.JoinedAt); err == nil {
+		joinedAt = joinedAt.UTC()
+		guildJoinedAt = &joinedAt
+	}
 
-	resp, err := s.httpClient.Do(req)
-	if err != nil {
+	// Rows created by a presence update alone have no username yet; the
+	// member was never stored, so there is nothing to compare against.
+	var previousUsername, previousNick, rawPreviousRoles, rawPreviousRoleIDs string
+	var previouslyLeft bool
+	err := tx.QueryRowContext(
+		ctx,
+		`SELECT username, nick, array_to_string(roles, E'\n'), array_to_string(role_ids, E'\n'), left_at IS NOT NULL
+		 FROM discord_member_states WHERE discord_id = $1 FOR UPDATE`,
+		discordID,
+	).Scan(&previousUsername, &previousNick, &rawPreviousRoles, &rawPreviousRoleIDs, &previouslyLeft)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return err
 	}
-	defer resp.Body.Close()
+	known := err == nil && previousUsername != ""
 
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
-		return &discordSyncStatusError{status: resp.StatusCode, body: strings.TrimSpace(string(body))}
+	if _, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO discord_member_states (discord_id, username, global_name, nick, roles, role_ids, discord_status, guild_joined_at, synced_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, 'offline', $7, $8)
+		 ON CONFLICT (discord_id) DO UPDATE SET
+		   username = EXCLUDED.username,
+		   global_name = EXCLUDED.global_name,
+		   nick = EXCLUDED.nick,
+		   roles = EXCLUDED.roles,
+		   role_ids = EXCLUDED.role_ids,
+		   guild_joined_at = COALESCE(EXCLUDED.guild_joined_at, discord_member_states.guild_joined_at),
+		   left_at = NULL,
+		   synced_at = EXCLUDED.synced_at`,
+		discordID,
+		strings.TrimSpace(member.User.Username),
+		strings.TrimSpace(member.User.GlobalName),
+		nick,
+		roleNames,
+		roleIDs,
+		guildJoinedAt,
+		now,
+	); err != nil {
+		return err
 	}
 
-	return json.NewDecoder(io.LimitReader(resp.Body, 8*1024*1024)).Decode(target)
-}
-
-func (s *DiscordMemberSync) runPresenceGateway(ctx context.Context) {
-	for {
-		if err := s.listenPresenceGateway(ctx); err != nil && ctx.Err() == nil {
-			log.Printf("discord presence gateway failed: %v", err)
+	if !known || previouslyLeft {
+		joinedAt := now
+		if guildJoinedAt != nil {
+			joinedAt = *guildJoinedAt
 		}
-
-		select {
-		case <-ctx.Done():
-			return
-		case <-time.After(15 * time.Second):
+		if err := recordDiscordMemberEvent(ctx, tx, discordID, discordMemberJoined, "", "", nick, source, joinedAt); err != nil {
+			return err
 		}
 	}
-}
-
-func (s *DiscordMemberSync) listenPresenceGateway(ctx context.Context) error {
-	dialer := websocket.Dialer{
-		HandshakeTimeout: 10 * time.Second,
+	if !known {
+		return nil
 	}
-	conn, _, err := dialer.DialContext(ctx, "wss://gateway.discord.gg/?v=10&encoding=json", http.Header{
-		"User-Agent": []string{"amy-world-discord-presence/1.0"},
-	})
-	if err != nil {
-		return err
+	if !previouslyLeft && previousNick != nick {
+		if err := recordDiscordMemberEvent(ctx, tx, discordID, discordMemberNickChanged, "", previousNick, nick, source, now); err != nil {
+			return err
+		}
 	}
-	defer conn.Close()
 
-	var lastSequence atomic.Int64
-	heartbeatDone := make(chan struct{})
-	defer close(heartbeatDone)
-	var writeMu sync.Mutex
-
-	for {
-		var message discordGatewayMessage
-		if err := conn.ReadJSON(&message); err != nil {
+	previousRoles := make(map[string]string)
+	previousRoleNames := splitPostgresTextArray(rawPreviousRoles)
+	for index, roleID := range splitPostgresTextArray(rawPreviousRoleIDs) {
+		if index < len(previousRoleNames) {
+			previousRoles[roleID] = previousRoleNames[index]
+		}
+	}
+	for index, roleID := range roleIDs {
+		if _, ok := previousRoles[roleID]; ok {
+			delete(previousRoles, roleID)
+			continue
+		}
+		if err := recordDiscordMemberEvent(ctx, tx, discordID, discordMemberRoleAdded, roleID, "", roleNames[index], source, now); err != nil {
 			return err
 		}
-		if message.S != nil {
-			lastSequence.Store(*message.S)
+	}
+	for roleID, roleName := range previousRoles {
+		if err := recordDiscordMemberEvent(ctx, tx, discordID, discordMemberRoleRemoved, roleID, roleName, "", source, now); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		switch message.Op {
-		case discordGatewayOpHello:
-			var hello discordGatewayHello
-			if err := json.Unmarshal(message.D, &hello); err != nil {
-				return err
-			}
-			if hello.HeartbeatInterval <= 0 {
-				return nil
-			}
-			if err := s.identifyGateway(conn, &writeMu); err != nil {
-				return err
-			}
-			go heartbeatGateway(conn, &writeMu, time.Duration(hello.HeartbeatInterval)*time.Millisecond, &lastSequence, heartbeatDone)
-		case discordGatewayOpDispatch:
-			if message.T == "PRESENCE_UPDATE" {
-				if err := s.handlePresenceUpdate(ctx, message.D); err != nil && ctx.Err() == nil {
-					log.Printf("discord presence update failed: %v", err)
-				}
-			}
-			if message.T == "GUILD_CREATE" {
-				if err := s.handleGuildCreate(ctx, message.D); err != nil && ctx.Err() == nil {
-					log.Printf("discord guild presence snapshot failed: %v", err)
-				}
-			}
-			if message.T == "MESSAGE_CREATE" {
-				if err := s.handleSupportTicketReply(ctx, message.D); err != nil && ctx.Err() == nil {
-					log.Printf("discord support reply sync failed: %v", err)
-				}
-			}
-		case discordGatewayOpHeartbeat:
-			if err := writeGatewayHeartbeat(conn, &writeMu, lastSequence.Load()); err != nil {
-				return err
-			}
-		case discordGatewayOpHeartbeatACK:
+// memberRoles keeps the roles with a known name, other than @everyone, and
+// returns their names and ids in the same order.
+func (s *DiscordMemberSync) memberRoles(memberRoleIDs []string) ([]string, []string) {
+	s.rolesMu.Lock()
+	defer s.rolesMu.Unlock()
+	roleNames := make([]string, 0, len(memberRoleIDs))
+	roleIDs := make([]string, 0, len(memberRoleIDs))
+	for _, roleID := range memberRoleIDs {
+		if name := s.roles[roleID]; name != "" && name != "@everyone" {
+			roleNames = append(roleNames, name)
+			roleIDs = append(roleIDs, roleID)
 		}
 	}
+	return roleNames, roleIDs
 }
 
-func (s *DiscordMemberSync) identifyGateway(conn *websocket.Conn, writeMu *sync.Mutex) error {
-	payload := map[string]any{
-		"op": discordGatewayOpIdentify,
-		"d": map[string]any{
-			"token":   s.botToken,
-			"intents": discordGatewayIntentGuilds | discordGatewayIntentGuildMembers | discordGatewayIntentGuildPresences | discordGatewayIntentGuildMessages | discordGatewayIntentMessageContent,
-			"properties": map[string]string{
-				"os":      "linux",
-				"browser": "amy-world",
-				"device":  "amy-world",
-			},
-		},
+func (s *DiscordMemberSync) setRoles(roles map[string]string) {
+	s.rolesMu.Lock()
+	defer s.rolesMu.Unlock()
+	s.roles = roles
+}
+
+// ensureRoles loads the guild roles before the first member event when
+// neither the full sync nor GUILD_CREATE has yet, so the event does not
+// strip the member's roles.
+func (s *DiscordMemberSync) ensureRoles(ctx context.Context) error {
+	s.rolesMu.Lock()
+	loaded := s.roles != nil
+	s.rolesMu.Unlock()
+	if loaded {
+		return nil
 	}
-	writeMu.Lock()
-	defer writeMu.Unlock()
-	return conn.WriteJSON(payload)
+	roles, err := s.fetchRoles(ctx)
+	if err != nil {
+		return err
+	}
+	s.setRoles(roles)
+	return nil
 }
 
-func heartbeatGateway(conn *websocket.Conn, writeMu *sync.Mutex, interval time.Duration, lastSequence *atomic.Int64, done <-chan struct{}) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+func (s *DiscordMemberSync) fetchRoles(ctx context.Context) (map[string]string, error) {
+	var roles []discordGuildRole
+	if err := s.discord.Do(ctx, discord.Request{Kind: "member_sync", Path: "/guilds/" + url.PathEscape(s.guildID) + "/roles"}, &roles); err != nil {
+		return nil, err
+	}
 
-	for {
-		select {
-		case <-done:
-			return
-		case <-ticker.C:
-			_ = writeGatewayHeartbeat(conn, writeMu, lastSequence.Load())
-		}
+	result := make(map[string]string, len(roles))
+	for _, role := range roles {
+		result[role.ID] = role.Name
 	}
+	return result, nil
 }
 
-func writeGatewayHeartbeat(conn *websocket.Conn, writeMu *sync.Mutex, sequence int64) error {
-	var d any
-	if sequence > 0 {
-		d = sequence
+func (s *DiscordMemberSync) fetchMembers(ctx context.Context, after string) ([]discordGuildMember, error) {
+	var members []discordGuildMember
+	err := s.discord.Do(ctx, discord.Request{
+		Kind:  "member_sync",
+		Path:  "/guilds/" + url.PathEscape(s.guildID) + "/members",
+		Query: url.Values{"limit": {"1000"}, "after": {after}},
+	}, &members)
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// handleGatewayEvent routes the dispatch events the backend cares about.
+func (s *DiscordMemberSync) handleGatewayEvent(ctx context.Context, event string, data json.RawMessage) {
+	if s.chat != nil {
+		if err := s.chat.handleGatewayEvent(ctx, event, data); err != nil && ctx.Err() == nil {
+			log.Printf("discord community chat sync failed: %v", err)
+		}
+	}
+	var what string
+	var err error
+	switch event {
+	case "PRESENCE_UPDATE":
+		what = "presence update"
+		err = s.handlePresenceUpdate(ctx, data)
+	case "GUILD_MEMBER_ADD", "GUILD_MEMBER_UPDATE":
+		what = "member update"
+		err = s.handleGuildMemberUpdate(ctx, data)
+	case "GUILD_MEMBER_REMOVE":
+		what = "member leave"
+		err = s.handleGuildMemberRemove(ctx, data)
+	case "GUILD_ROLE_CREATE", "GUILD_ROLE_UPDATE", "GUILD_ROLE_DELETE":
+		what = "role update"
+		err = s.handleGuildRoleChange(ctx, event, data)
+	case "GUILD_CREATE":
+		what = "guild presence snapshot"
+		err = s.handleGuildCreate(ctx, data)
+	case "MESSAGE_CREATE":
+		what = "support reply sync"
+		err = s.handleSupportTicketReply(ctx, data)
+	case "MESSAGE_UPDATE":
+		what = "support edit sync"
+		err = s.handleSupportTicketEdit(ctx, data)
+	case "TYPING_START":
+		what = "support typing sync"
+		err = s.handleSupportTicketTyping(ctx, data)
+	case "MESSAGE_DELETE", "MESSAGE_DELETE_BULK":
+		what = "support delete sync"
+		err = s.handleSupportTicketDelete(ctx, data)
+	}
+	if err != nil && ctx.Err() == nil {
+		log.Printf("discord %s failed: %v", what, err)
 	}
-	writeMu.Lock()
-	defer writeMu.Unlock()
-	return conn.WriteJSON(map[string]any{
-		"op": discordGatewayOpHeartbeat,
-		"d":  d,
-	})
 }
 
 func (s *DiscordMemberSync) handlePresenceUpdate(ctx context.Context, raw json.RawMessage) error {
@@ -394,13 +514,16 @@ func (s *DiscordMemberSync) handlePresenceUpdate(ctx context.Context, raw json.R
 	}
 
 	status := normalizeDiscordStatus(presence.Status)
+	// Presence says nothing about membership, so an existing row keeps its
+	// synced_at; otherwise Sync would never mark a member with a chatty
+	// presence as left.
 	_, err := s.db.ExecContext(
 		ctx,
 		`INSERT INTO discord_member_states (discord_id, roles, discord_status, synced_at)
-		 VALUES ($1, '{}', $2, $3)
+		 SELECT $1, '{}', $2, $3
+		 WHERE NOT EXISTS (SELECT 1 FROM deleted_accounts WHERE discord_id = $1)
 		 ON CONFLICT (discord_id) DO UPDATE SET
-		   discord_status = EXCLUDED.discord_status,
-		   synced_at = EXCLUDED.synced_at`,
+		   discord_status = EXCLUDED.discord_status`,
 		presence.User.ID,
 		status,
 		time.Now().UTC(),
@@ -416,6 +539,13 @@ func (s *DiscordMemberSync) handleGuildCreate(ctx context.Context, raw json.RawM
 	if guild.ID != s.guildID {
 		return nil
 	}
+	if len(guild.Roles) > 0 {
+		roles := make(map[string]string, len(guild.Roles))
+		for _, role := range guild.Roles {
+			roles[role.ID] = role.Name
+		}
+		s.setRoles(roles)
+	}
 	for _, presence := range guild.Presences {
 		presence.GuildID = guild.ID
 		payload, err := json.Marshal(presence)
@@ -429,23 +559,162 @@ func (s *DiscordMemberSync) handleGuildCreate(ctx context.Context, raw json.RawM
 	return nil
 }
 
+func (s *DiscordMemberSync) handleGuildMemberUpdate(ctx context.Context, raw json.RawMessage) error {
+	var member discordGatewayGuildMember
+	if err := json.Unmarshal(raw, &member); err != nil {
+		return err
+	}
+	if member.GuildID != s.guildID {
+		return nil
+	}
+	if err := s.ensureRoles(ctx); err != nil {
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := s.upsertMember(ctx, tx, member.discordGuildMember, discordMemberSourceGateway, time.Now().UTC()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// handleGuildMemberRemove keeps the row, so names in ticket history still
+// resolve, but drops the roles and marks the member as left.
+func (s *DiscordMemberSync) handleGuildMemberRemove(ctx context.Context, raw json.RawMessage) error {
+	var member discordGatewayGuildMember
+	if err := json.Unmarshal(raw, &member); err != nil {
+		return err
+	}
+	if member.GuildID != s.guildID || strings.TrimSpace(member.User.ID) == "" {
+		return nil
+	}
+	discordID := strings.TrimSpace(member.User.ID)
+	now := time.Now().UTC()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(
+		ctx,
+		`UPDATE discord_member_states
+		 SET left_at = $1, roles = '{}', role_ids = '{}', discord_status = 'offline', synced_at = $1
+		 WHERE discord_id = $2 AND left_at IS NULL`,
+		now,
+		discordID,
+	)
+	if err != nil {
+		return err
+	}
+	if changed, _ := result.RowsAffected(); changed > 0 {
+		if err := recordDiscordMemberEvent(ctx, tx, discordID, discordMemberLeft, "", "", "", discordMemberSourceGateway, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// handleGuildRoleChange updates the role names and rewrites the stored roles
+// of the members who have the role.
+func (s *DiscordMemberSync) handleGuildRoleChange(ctx context.Context, event string, raw json.RawMessage) error {
+	var change discordGatewayGuildRole
+	if err := json.Unmarshal(raw, &change); err != nil {
+		return err
+	}
+	if change.GuildID != s.guildID {
+		return nil
+	}
+	if err := s.ensureRoles(ctx); err != nil {
+		return err
+	}
+	roleID := change.Role.ID
+	var deletedName string
+	s.rolesMu.Lock()
+	if event == "GUILD_ROLE_DELETE" {
+		roleID = change.RoleID
+		deletedName = s.roles[roleID]
+		delete(s.roles, roleID)
+	} else {
+		s.roles[roleID] = change.Role.Name
+	}
+	s.rolesMu.Unlock()
+	if event == "GUILD_ROLE_CREATE" || strings.TrimSpace(roleID) == "" {
+		return nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT discord_id, array_to_string(role_ids, E'\n') FROM discord_member_states WHERE $1 = ANY(role_ids)`, roleID)
+	if err != nil {
+		return err
+	}
+	members := make(map[string][]string)
+	for rows.Next() {
+		var discordID, rawRoleIDs string
+		if err := rows.Scan(&discordID, &rawRoleIDs); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		members[discordID] = splitPostgresTextArray(rawRoleIDs)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC()
+	for discordID, memberRoleIDs := range members {
+		roleNames, roleIDs := s.memberRoles(memberRoleIDs)
+		if _, err := tx.ExecContext(ctx, `UPDATE discord_member_states SET roles = $1, role_ids = $2 WHERE discord_id = $3`, roleNames, roleIDs, discordID); err != nil {
+			return err
+		}
+		if event == "GUILD_ROLE_DELETE" {
+			if err := recordDiscordMemberEvent(ctx, tx, discordID, discordMemberRoleRemoved, roleID, deletedName, "", discordMemberSourceGateway, now); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
 func (s *DiscordMemberSync) handleSupportTicketReply(ctx context.Context, raw json.RawMessage) error {
 	var message discordGatewayMessageCreate
 	if err := json.Unmarshal(raw, &message); err != nil {
 		return err
 	}
-	if message.Author.Bot || strings.TrimSpace(message.Author.ID) == "" || strings.TrimSpace(message.Content) == "" {
+	if message.Author.Bot || strings.TrimSpace(message.Author.ID) == "" {
 		return nil
 	}
-	if s.ticketChannelID != "" && message.ChannelID != s.ticketChannelID {
+	if strings.TrimSpace(message.Content) == "" && len(message.Attachments) == 0 {
 		return nil
 	}
 	var ticketID int64
 	var ticketOwner string
 	content := strings.TrimSpace(message.Content)
 	adminMessage := content
-	var err error
-	if message.MessageReference != nil && strings.TrimSpace(message.MessageReference.MessageID) != "" {
+
+	// Every message in a ticket thread belongs to that ticket. Older tickets
+	// posted through the webhook still rely on replies or a "#123:" prefix in
+	// the ticket channel.
+	err := s.db.QueryRowContext(
+		ctx,
+		`SELECT id, owner_discord_id FROM support_tickets WHERE discord_thread_id = $1 LIMIT 1`,
+		strings.TrimSpace(message.ChannelID),
+	).Scan(&ticketID, &ticketOwner)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	switch {
+	case err == nil:
+	case s.ticketChannelID != "" && message.ChannelID != s.ticketChannelID:
+		return nil
+	case message.MessageReference != nil && strings.TrimSpace(message.MessageReference.MessageID) != "":
 		err = s.db.QueryRowContext(
 			ctx,
 			`SELECT id, owner_discord_id
@@ -454,12 +723,14 @@ func (s *DiscordMemberSync) handleSupportTicketReply(ctx context.Context, raw js
 			 LIMIT 1`,
 			strings.TrimSpace(message.MessageReference.MessageID),
 		).Scan(&ticketID, &ticketOwner)
-	} else if matched := supportTicketPrefix.FindStringSubmatch(content); len(matched) == 3 {
+	default:
+		matched := supportTicketPrefix.FindStringSubmatch(content)
+		if len(matched) != 3 {
+			return nil
+		}
 		ticketID, _ = strconv.ParseInt(matched[1], 10, 64)
 		adminMessage = strings.TrimSpace(matched[2])
 		err = s.db.QueryRowContext(ctx, `SELECT owner_discord_id FROM support_tickets WHERE id = $1`, ticketID).Scan(&ticketOwner)
-	} else {
-		return nil
 	}
 	if err == sql.ErrNoRows {
 		return nil
@@ -467,38 +738,197 @@ func (s *DiscordMemberSync) handleSupportTicketReply(ctx context.Context, raw js
 	if err != nil {
 		return err
 	}
-	if adminMessage == "" {
+	if adminMessage == "" && len(message.Attachments) == 0 {
 		return nil
 	}
+	if s.support.Macro != nil && isSupportMacroCommand(adminMessage) {
+		return s.support.Macro(ctx, ticketID, message.Author.ID, adminMessage)
+	}
 
 	authorName := strings.TrimSpace(message.MemberNick())
 	status := "unknown"
 	_ = s.db.QueryRowContext(ctx, `SELECT COALESCE(NULLIF(discord_status, ''), 'unknown') FROM discord_member_states WHERE discord_id = $1`, message.Author.ID).Scan(&status)
 
-	result, err := s.db.ExecContext(
+	now := time.Now().UTC()
+	var messageID int64
+	err = s.db.QueryRowContext(
 		ctx,
 		`INSERT INTO support_ticket_messages
 		 (ticket_id, author_type, author_name, author_discord_id, author_discord_status, message, discord_message_id, read_by_user, created_at)
 		 VALUES ($1, 'admin', $2, $3, $4, $5, $6, FALSE, $7)
-		 ON CONFLICT (discord_message_id) WHERE discord_message_id <> '' DO NOTHING`,
+		 ON CONFLICT (discord_message_id) WHERE discord_message_id <> '' DO NOTHING
+		 RETURNING id`,
 		ticketID,
 		authorName,
 		message.Author.ID,
 		status,
 		adminMessage,
 		strings.TrimSpace(message.ID),
+		now,
+	).Scan(&messageID)
+	_ = ticketOwner
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	saved := 0
+	if len(message.Attachments) > 0 && s.support.ImportAttachments != nil {
+		saved = s.support.ImportAttachments(ctx, ticketID, messageID, message.Attachments)
+	}
+	if adminMessage == "" && saved == 0 {
+		// Nothing usable came with the message, so don't leave an empty reply.
+		_, err := s.db.ExecContext(ctx, `DELETE FROM support_ticket_messages WHERE id = $1`, messageID)
+		return err
+	}
+
+	recordSupportFirstResponse(ctx, s.db, ticketID, now)
+	notifyText := adminMessage
+	if notifyText == "" {
+		notifyText = fmt.Sprintf("[вложений: %d]", saved)
+	}
+	if s.support.Reply != nil {
+		s.support.Reply(ctx, ticketID, messageID, authorName, notifyText)
+	}
+	return nil
+}
+
+// handleSupportTicketEdit mirrors an edited staff reply into the ticket and
+// keeps the previous text in support_ticket_message_edits.
+func (s *DiscordMemberSync) handleSupportTicketEdit(ctx context.Context, raw json.RawMessage) error {
+	var update discordGatewayMessageUpdate
+	if err := json.Unmarshal(raw, &update); err != nil {
+		return err
+	}
+	// Updates without content are embed unfurls and similar, not edits.
+	if update.Content == nil || strings.TrimSpace(update.ID) == "" {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var messageID, ticketID int64
+	var previous string
+	err = tx.QueryRowContext(
+		ctx,
+		`SELECT id, ticket_id, message
+		 FROM support_ticket_messages
+		 WHERE discord_message_id = $1 AND author_type = 'admin' AND deleted_at IS NULL
+		 FOR UPDATE`,
+		strings.TrimSpace(update.ID),
+	).Scan(&messageID, &ticketID, &previous)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	next := strings.TrimSpace(*update.Content)
+	if matched := supportTicketPrefix.FindStringSubmatch(next); len(matched) == 3 && matched[1] == strconv.FormatInt(ticketID, 10) {
+		next = strings.TrimSpace(matched[2])
+	}
+	if next == "" || next == previous {
+		return nil
+	}
+
+	editedAt := time.Now().UTC()
+	if update.EditedTimestamp != nil {
+		editedAt = update.EditedTimestamp.UTC()
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO support_ticket_message_edits (message_id, previous_message, edited_at) VALUES ($1, $2, $3)`, messageID, previous, editedAt); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE support_ticket_messages SET message = $1, edited_at = $2 WHERE id = $3`, next, editedAt, messageID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if s.support.MessagesChanged != nil {
+		s.support.MessagesChanged(ctx, ticketID, []int64{messageID})
+	}
+	return nil
+}
+
+// handleSupportTicketDelete soft-deletes staff replies removed in Discord so
+// the original stays in the ticket history.
+func (s *DiscordMemberSync) handleSupportTicketDelete(ctx context.Context, raw json.RawMessage) error {
+	var deleted discordGatewayMessageDelete
+	if err := json.Unmarshal(raw, &deleted); err != nil {
+		return err
+	}
+	ids := deleted.IDs
+	if strings.TrimSpace(deleted.ID) != "" {
+		ids = append(ids, strings.TrimSpace(deleted.ID))
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	rows, err := s.db.QueryContext(
+		ctx,
+		`UPDATE support_ticket_messages SET deleted_at = $1
+		 WHERE discord_message_id = ANY($2) AND author_type = 'admin' AND deleted_at IS NULL
+		 RETURNING ticket_id, id`,
 		time.Now().UTC(),
+		ids,
 	)
-	_ = ticketOwner
 	if err != nil {
 		return err
 	}
-	if affected, _ := result.RowsAffected(); affected > 0 && s.notifySupportReply != nil {
-		s.notifySupportReply(ctx, ticketID, authorName, adminMessage)
+	tickets := make(map[int64][]int64)
+	for rows.Next() {
+		var ticketID, messageID int64
+		if err := rows.Scan(&ticketID, &messageID); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		tickets[ticketID] = append(tickets[ticketID], messageID)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if s.support.MessagesChanged != nil {
+		for ticketID, messageIDs := range tickets {
+			s.support.MessagesChanged(ctx, ticketID, messageIDs)
+		}
 	}
 	return nil
 }
 
+// handleSupportTicketTyping forwards typing in a ticket thread so the player
+// sees that staff is answering.
+func (s *DiscordMemberSync) handleSupportTicketTyping(ctx context.Context, raw json.RawMessage) error {
+	if s.support.Typing == nil {
+		return nil
+	}
+	var typing discordGatewayTypingStart
+	if err := json.Unmarshal(raw, &typing); err != nil {
+		return err
+	}
+	if strings.TrimSpace(typing.ChannelID) == "" || typing.Member == nil || typing.Member.User.Bot {
+		return nil
+	}
+	var ticketID int64
+	err := s.db.QueryRowContext(ctx, `SELECT id FROM support_tickets WHERE discord_thread_id = $1 LIMIT 1`, strings.TrimSpace(typing.ChannelID)).Scan(&ticketID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.support.Typing(ctx, ticketID, bestDiscordDisplayName(typing.Member.Nick, typing.Member.User.GlobalName, typing.Member.User.Username))
+	return nil
+}
+
 func (m discordGatewayMessageCreate) MemberNick() string {
 	if m.Member != nil && strings.TrimSpace(m.Member.Nick) != "" {
 		return strings.TrimSpace(m.Member.Nick)
@@ -517,15 +947,3 @@ func normalizeDiscordStatus(status string) string {
 		return "unknown"
 	}
 }
-
-type discordSyncStatusError struct {
-	status int
-	body   string
-}
-
-func (e *discordSyncStatusError) Error() string {
-	if e.body == "" {
-		return "discord api status " + http.StatusText(e.status)
-	}
-	return "discord api status " + http.StatusText(e.status) + ": " + e.body
-}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestHandleSupportTicketEdit(t *testing.T) {
+	db, script := newScriptedDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value) {
+		if args[0].Value == "900" {
+			return []string{"id", "ticket_id", "message"}, [][]driver.Value{{int64(7), int64(42), "Перезайдите"}}
+		}
+		return []string{"id", "ticket_id", "message"}, nil
+	})
+	var changed []int64
+	s := &DiscordMemberSync{db: db, support: SupportGatewayHooks{
+		MessagesChanged: func(ctx context.Context, ticketID int64, messageIDs []int64) {
+			if ticketID == 42 {
+				changed = append(changed, messageIDs...)
+			}
+		},
+	}}
+	ctx := context.Background()
+
+	edits := []string{
+		`{"id":"900","embeds":[]}`,
+		`{"id":"901","content":"чужое сообщение"}`,
+		`{"id":"900","content":"#42 Перезайдите"}`,
+		`{"id":"900","content":"#42 Перезайдите на сервер","edited_timestamp":"2026-03-01T12:05:00+00:00"}`,
+	}
+	for _, edit := range edits {
+		if err := s.handleSupportTicketEdit(ctx, json.RawMessage(edit)); err != nil {
+			t.Fatalf("%s: %v", edit, err)
+		}
+	}
+
+	history := script.find("INSERT INTO support_ticket_message_edits")
+	if len(history) != 1 || history[0].args[1] != "Перезайдите" {
+		t.Fatalf("want one edit keeping the old text, got %v", history)
+	}
+	updates := script.find("UPDATE support_ticket_messages SET message")
+	if len(updates) != 1 || updates[0].args[0] != "Перезайдите на сервер" || updates[0].args[2] != int64(7) {
+		t.Fatalf("want the reply updated without the ticket prefix, got %v", updates)
+	}
+	if len(changed) != 1 || changed[0] != 7 {
+		t.Errorf("MessagesChanged got %v, want [7]", changed)
+	}
+}
+
+func TestHandleSupportTicketDelete(t *testing.T) {
+	db, script := newScriptedDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value) {
+		return []string{"ticket_id", "id"}, [][]driver.Value{{int64(42), int64(7)}, {int64(43), int64(9)}, {int64(42), int64(8)}}
+	})
+	changed := make(map[int64][]int64)
+	s := &DiscordMemberSync{db: db, support: SupportGatewayHooks{
+		MessagesChanged: func(ctx context.Context, ticketID int64, messageIDs []int64) {
+			changed[ticketID] = append(changed[ticketID], messageIDs...)
+		},
+	}}
+
+	if err := s.handleSupportTicketDelete(context.Background(), json.RawMessage(`{"ids":["900","901","902"],"channel_id":"1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	deletes := script.find("SET deleted_at")
+	if len(deletes) != 1 || !strings.Contains(deletes[0].query, "author_type = 'admin'") {
+		t.Fatalf("want one soft delete of staff replies, got %v", deletes)
+	}
+	sort.Slice(changed[42], func(i, j int) bool { return changed[42][i] < changed[42][j] })
+	if len(changed) != 2 || len(changed[42]) != 2 || changed[42][0] != 7 || changed[42][1] != 8 || changed[43][0] != 9 {
+		t.Errorf("MessagesChanged got %v, want one call per ticket", changed)
+	}
+
+	if err := s.handleSupportTicketDelete(context.Background(), json.RawMessage(`{"channel_id":"1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if len(script.find("SET deleted_at")) != 1 {
+		t.Error("a delete without ids should not touch the database")
+	}
+}
+
+func TestHandlePresenceUpdateLeavesSyncState(t *testing.T) {
+	db, script := newScriptedDB(t, nil)
+	s := &DiscordMemberSync{db: db, guildID: "1"}
+	ctx := context.Background()
+
+	for _, presence := range []string{
+		`{"guild_id":"2","user":{"id":"100"},"status":"online"}`,
+		`{"guild_id":"1","user":{"id":""},"status":"online"}`,
+		`{"guild_id":"1","user":{"id":"100"},"status":"dnd"}`,
+	} {
+		if err := s.handlePresenceUpdate(ctx, json.RawMessage(presence)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	upserts := script.find("INSERT INTO discord_member_states")
+	if len(upserts) != 1 || upserts[0].args[0] != "100" || upserts[0].args[1] != "dnd" {
+		t.Fatalf("want one upsert for the guild member, got %v", upserts)
+	}
+	// Sync marks members it did not see as left by synced_at, so presence
+	// must not refresh it for an existing row.
+	_, conflict, _ := strings.Cut(upserts[0].query, "ON CONFLICT")
+	if strings.Contains(conflict, "synced_at") || strings.Contains(conflict, "left_at") {
+		t.Errorf("presence update touches membership columns: %s", conflict)
+	}
+}
+
+func TestHandleGuildMemberRemove(t *testing.T) {
+	db, script := newScriptedDB(t, nil)
+	s := &DiscordMemberSync{db: db, guildID: "1"}
+
+	if err := s.handleGuildMemberRemove(context.Background(), json.RawMessage(`{"guild_id":"1","user":{"id":"100"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if left := script.find("SET left_at"); len(left) != 1 || left[0].args[1] != "100" {
+		t.Fatalf("want the member marked as left, got %v", left)
+	}
+	if events := script.find("INSERT INTO discord_member_events"); len(events) != 1 || events[0].args[1] != discordMemberLeft {
+		t.Errorf("want a left event, got %v", events)
+	}
+}
+
+func TestHandleGuildRoleChange(t *testing.T) {
+	db, script := newScriptedDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value) {
+		return []string{"discord_id", "role_ids"}, [][]driver.Value{{"100", "2\n3"}}
+	})
+	s := &DiscordMemberSync{db: db, guildID: "1"}
+	s.setRoles(map[string]string{"2": "Helper", "3": "Mod"})
+	ctx := context.Background()
+
+	if err := s.handleGuildRoleChange(ctx, "GUILD_ROLE_UPDATE", json.RawMessage(`{"guild_id":"1","role":{"id":"3","name":"Moderator"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	updates := script.find("UPDATE discord_member_states SET roles")
+	if len(updates) != 1 || strings.Join(updates[0].args[0].([]string), ",") != "Helper,Moderator" {
+		t.Fatalf("want the renamed role stored on the member, got %v", updates)
+	}
+
+	if err := s.handleGuildRoleChange(ctx, "GUILD_ROLE_DELETE", json.RawMessage(`{"guild_id":"1","role_id":"3"}`)); err != nil {
+		t.Fatal(err)
+	}
+	updates = script.find("UPDATE discord_member_states SET roles")
+	if len(updates) != 2 || strings.Join(updates[1].args[1].([]string), ",") != "2" {
+		t.Fatalf("want the deleted role dropped from the member, got %v", updates)
+	}
+	events := script.find("INSERT INTO discord_member_events")
+	if len(events) != 1 || events[0].args[1] != discordMemberRoleRemoved || events[0].args[3] != "Moderator" {
+		t.Errorf("want a role_removed event with the old name, got %v", events)
+	}
+
+	if err := s.handleGuildRoleChange(ctx, "GUILD_ROLE_CREATE", json.RawMessage(`{"guild_id":"1","role":{"id":"4","name":"New"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if len(script.find("UPDATE discord_member_states SET roles")) != 2 {
+		t.Error("a new role has no members to rewrite")
+	}
+}
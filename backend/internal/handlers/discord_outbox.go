@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strconv"
+	"time"
+
+	"amy/minecraft-server/internal/observability"
+)
+
+const (
+	discordEntityRPApplication = "rp_application"
+	discordEntitySupportTicket = "support_ticket"
+
+	discordActionPost    = "post"
+	discordActionUpdate  = "update"
+	discordActionDelete  = "delete"
+	discordActionMessage = "message"
+
+	discordSyncPending = "pending"
+	discordSyncSynced  = "synced"
+	discordSyncFailed  = "failed"
+
+	discordOutboxMaxAttempts = 10
+	discordOutboxBatchSize   = 20
+	discordOutboxRetention   = 7 * 24 * time.Hour
+)
+
+// sqlExecer is satisfied by both *sql.DB and *sql.Tx, so outbox rows can be
+// written in the same transaction as the change they mirror.
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+type discordOutboxItem struct {
+	ID         int64
+	EntityType string
+	EntityID   string
+	Action     string
+	// Ref is the action argument: the chat message id for "message" and
+	// the Discord message id for "delete".
+	Ref      string
+	Attempts int
+}
+
+type discordOutboxPerformer func(ctx context.Context, item discordOutboxItem) error
+
+// DiscordOutbox performs Discord side effects (webhook posts, message edits,
+// deletes) after the database change that caused them has committed. Rows
+// describe what to sync, not the payload: the worker rebuilds the message from
+// the current state, so a burst of edits costs one request and a retried
+// edit never overwrites a newer one. Rows of one entity run strictly in
+// order, which keeps an edit from racing the post that creates the message.
+type DiscordOutbox struct {
+	db         *sql.DB
+	performers map[string]discordOutboxPerformer
+	wake       chan struct{}
+}
+
+func NewDiscordOutbox(db *sql.DB) *DiscordOutbox {
+	return &DiscordOutbox{
+		db:         db,
+		performers: make(map[string]discordOutboxPerformer),
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+func (o *DiscordOutbox) register(entityType string, perform discordOutboxPerformer) {
+	o.performers[entityType] = perform
+}
+
+// enqueue records a side effect and marks the entity as waiting for Discord.
+// Pending edits of the same entity are merged. With a *sql.Tx the worker is
+// woken by commit instead.
+func (o *DiscordOutbox) enqueue(ctx context.Context, exec sqlExecer, entityType, entityID, action, ref string) error {
+	query := `INSERT INTO discord_outbox (entity_type, entity_id, action, ref, next_attempt_at, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $5)`
+	if action == discordActionUpdate {
+		query = `INSERT INTO discord_outbox (entity_type, entity_id, action, ref, next_attempt_at, created_at)
+		 SELECT $1, $2, $3, $4, $5, $5
+		 WHERE NOT EXISTS (
+		   SELECT 1 FROM discord_outbox
+		   WHERE entity_type = $1 AND entity_id = $2 AND action = $3
+		     AND done_at IS NULL AND failed_at IS NULL AND attempts = 0 AND next_attempt_at <= $5
+		 )`
+	}
+	if _, err := exec.ExecContext(ctx, query, entityType, entityID, action, ref, time.Now().UTC()); err != nil {
+		return err
+	}
+	if action != discordActionDelete {
+		if err := setDiscordSyncStatus(ctx, exec, entityType, entityID, discordSyncPending, ""); err != nil {
+			return err
+		}
+	}
+	if _, ok := exec.(*sql.DB); ok {
+		o.wakeUp()
+	}
+	return nil
+}
+
+// commit commits a transaction that enqueued outbox rows and wakes the worker.
+func (o *DiscordOutbox) commit(tx *sql.Tx) error {
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	o.wakeUp()
+	return nil
+}
+
+func (o *DiscordOutbox) wakeUp() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start runs the outbox worker until ctx is done.
+func (o *DiscordOutbox) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+
+		var lastCleanup time.Time
+		for {
+			for {
+				leased, err := o.deliverDue(ctx)
+				if err != nil && ctx.Err() == nil {
+					log.Printf("discord outbox delivery failed: %v", err)
+				}
+				if err != nil || leased < discordOutboxBatchSize {
+					break
+				}
+			}
+			if time.Since(lastCleanup) > time.Hour {
+				lastCleanup = time.Now()
+				_, _ = o.db.ExecContext(ctx, `DELETE FROM discord_outbox WHERE done_at < $1 OR failed_at < $1`, time.Now().UTC().Add(-discordOutboxRetention))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-o.wake:
+			}
+		}
+	}()
+}
+
+func (o *DiscordOutbox) deliverDue(ctx context.Context) (int, error) {
+	queryCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	// Only the oldest unfinished row of each entity is due; a leased or
+	// backing-off row holds back everything queued after it.
+	rows, err := o.db.QueryContext(
+		queryCtx,
+		`UPDATE discord_outbox SET next_attempt_at = NOW() + INTERVAL '5 minutes'
+		 WHERE id IN (
+		   SELECT o.id FROM discord_outbox o
+		   WHERE o.done_at IS NULL AND o.failed_at IS NULL AND o.next_attempt_at <= NOW()
+		     AND NOT EXISTS (
+		       SELECT 1 FROM discord_outbox p
+		       WHERE p.entity_type = o.entity_type AND p.entity_id = o.entity_id
+		         AND p.done_at IS NULL AND p.failed_at IS NULL AND p.id < o.id
+		     )
+		   ORDER BY o.id
+		   LIMIT $1
+		   FOR UPDATE SKIP LOCKED
+		 )
+		 RETURNING id, entity_type, entity_id, action, ref, attempts`,
+		discordOutboxBatchSize,
+	)
+	if err != nil {
+		return 0, err
+	}
+	batch := make([]discordOutboxItem, 0, discordOutboxBatchSize)
+	for rows.Next() {
+		var item discordOutboxItem
+		if err := rows.Scan(&item.ID, &item.EntityType, &item.EntityID, &item.Action, &item.Ref, &item.Attempts); err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+		batch = append(batch, item)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, item := range batch {
+		if ctx.Err() != nil {
+			return len(batch), nil
+		}
+		o.deliver(ctx, item)
+	}
+	return len(batch), nil
+}
+
+func (o *DiscordOutbox) deliver(ctx context.Context, item discordOutboxItem) {
+	perform, ok := o.performers[item.EntityType]
+	if !ok {
+		return
+	}
+	performCtx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	err := perform(performCtx, item)
+	cancel()
+
+	now := time.Now().UTC()
+	if err == nil {
+		_, _ = o.db.ExecContext(ctx, `UPDATE discord_outbox SET done_at = $1, attempts = attempts + 1, last_error = '' WHERE id = $2`, now, item.ID)
+		var pending bool
+		_ = o.db.QueryRowContext(
+			ctx,
+			`SELECT EXISTS (SELECT 1 FROM discord_outbox WHERE entity_type = $1 AND entity_id = $2 AND done_at IS NULL AND failed_at IS NULL)`,
+			item.EntityType,
+			item.EntityID,
+		).Scan(&pending)
+		if !pending {
+			_ = setDiscordSyncStatus(ctx, o.db, item.EntityType, item.EntityID, discordSyncSynced, "")
+		}
+		observability.DiscordOutboxDeliveries.WithLabelValues(item.EntityType, item.Action, "done").Inc()
+		return
+	}
+
+	attempts := item.Attempts + 1
+	reason := truncateRunes(err.Error(), 500)
+	if attempts >= discordOutboxMaxAttempts {
+		log.Printf("discord outbox %s %s %s failed after %d attempts: %v", item.EntityType, item.EntityID, item.Action, attempts, err)
+		_, _ = o.db.ExecContext(ctx, `UPDATE discord_outbox SET attempts = $1, last_error = $2, failed_at = $3 WHERE id = $4`, attempts, reason, now, item.ID)
+		_ = setDiscordSyncStatus(ctx, o.db, item.EntityType, item.EntityID, discordSyncFailed, reason)
+		observability.DiscordOutboxDeliveries.WithLabelValues(item.EntityType, item.Action, "failed").Inc()
+		return
+	}
+	_, _ = o.db.ExecContext(
+		ctx,
+		`UPDATE discord_outbox SET attempts = $1, last_error = $2, next_attempt_at = $3 WHERE id = $4`,
+		attempts,
+		reason,
+		now.Add(discordOutboxBackoff(attempts)),
+		item.ID,
+	)
+	observability.DiscordOutboxDeliveries.WithLabelValues(item.EntityType, item.Action, "retry").Inc()
+}
+
+func discordOutboxBackoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := 10 * time.Second << uint(attempts-1)
+	if delay > time.Hour {
+		delay = time.Hour
+	}
+	return delay
+}
+
+func setDiscordSyncStatus(ctx context.Context, exec sqlExecer, entityType, entityID, status, syncError string) error {
+	var err error
+	switch entityType {
+	case discordEntityRPApplication:
+		_, err = exec.ExecContext(ctx, `UPDATE rp_applications SET discord_sync_status = $1, discord_sync_error = $2 WHERE id = $3`, status, syncError, entityID)
+	case discordEntitySupportTicket:
+		ticketID, parseErr := strconv.ParseInt(entityID, 10, 64)
+		if parseErr != nil {
+			return parseErr
+		}
+		_, err = exec.ExecContext(ctx, `UPDATE support_tickets SET discord_sync_status = $1, discord_sync_error = $2 WHERE id = $3`, status, syncError, ticketID)
+	}
+	return err
+}
@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scriptedDB is a database/sql driver that records every statement and
+// answers queries through respond, which returns column names and rows.
+type scriptedDB struct {
+	mu         sync.Mutex
+	statements []scriptedStatement
+	respond    func(query string, args []driver.NamedValue) ([]string, [][]driver.Value)
+}
+
+type scriptedStatement struct {
+	query string
+	args  []any
+}
+
+func (s *scriptedDB) Connect(context.Context) (driver.Conn, error) { return scriptedConn{s}, nil }
+func (s *scriptedDB) Driver() driver.Driver                        { return nil }
+
+func (s *scriptedDB) record(query string, args []driver.NamedValue) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := make([]any, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	s.statements = append(s.statements, scriptedStatement{query: query, args: values})
+}
+
+// find returns the recorded statements containing fragment.
+func (s *scriptedDB) find(fragment string) []scriptedStatement {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found []scriptedStatement
+	for _, statement := range s.statements {
+		if strings.Contains(statement.query, fragment) {
+			found = append(found, statement)
+		}
+	}
+	return found
+}
+
+type scriptedConn struct{ db *scriptedDB }
+
+func (c scriptedConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c scriptedConn) Close() error                        { return nil }
+func (c scriptedConn) Begin() (driver.Tx, error)           { return scriptedTx{}, nil }
+
+// CheckNamedValue passes values the default converter rejects, such as the
+// []string arrays pgx accepts, through unchanged.
+func (c scriptedConn) CheckNamedValue(value *driver.NamedValue) error {
+	if converted, err := driver.DefaultParameterConverter.ConvertValue(value.Value); err == nil {
+		value.Value = converted
+	}
+	return nil
+}
+
+func (c scriptedConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.db.record(query, args)
+	return driver.RowsAffected(1), nil
+}
+
+func (c scriptedConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.db.record(query, args)
+	var columns []string
+	var rows [][]driver.Value
+	if c.db.respond != nil {
+		columns, rows = c.db.respond(query, args)
+	}
+	return &scriptedRows{columns: columns, rows: rows}, nil
+}
+
+type scriptedTx struct{}
+
+func (scriptedTx) Commit() error   { return nil }
+func (scriptedTx) Rollback() error { return nil }
+
+type scriptedRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *scriptedRows) Columns() []string { return r.columns }
+func (r *scriptedRows) Close() error      { return nil }
+
+func (r *scriptedRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func newScriptedDB(t *testing.T, respond func(query string, args []driver.NamedValue) ([]string, [][]driver.Value)) (*sql.DB, *scriptedDB) {
+	t.Helper()
+	script := &scriptedDB{respond: respond}
+	db := sql.OpenDB(script)
+	t.Cleanup(func() { _ = db.Close() })
+	return db, script
+}
+
+func TestDiscordOutboxBackoff(t *testing.T) {
+	cases := map[int]time.Duration{
+		0:  10 * time.Second,
+		1:  10 * time.Second,
+		2:  20 * time.Second,
+		3:  40 * time.Second,
+		8:  21*time.Minute + 20*time.Second,
+		9:  42*time.Minute + 40*time.Second,
+		10: time.Hour,
+	}
+	for attempts, want := range cases {
+		if got := discordOutboxBackoff(attempts); got != want {
+			t.Errorf("attempt %d: got %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestDiscordOutboxEnqueue(t *testing.T) {
+	db, script := newScriptedDB(t, nil)
+	outbox := NewDiscordOutbox(db)
+	ctx := context.Background()
+
+	if err := outbox.enqueue(ctx, db, discordEntitySupportTicket, "42", discordActionUpdate, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := outbox.enqueue(ctx, db, discordEntitySupportTicket, "42", discordActionDelete, "thread:7"); err != nil {
+		t.Fatal(err)
+	}
+
+	inserts := script.find("INSERT INTO discord_outbox")
+	if len(inserts) != 2 {
+		t.Fatalf("got %d outbox inserts, want 2", len(inserts))
+	}
+	if !strings.Contains(inserts[0].query, "NOT EXISTS") {
+		t.Error("a pending update should be merged with the next one")
+	}
+	if strings.Contains(inserts[1].query, "NOT EXISTS") || inserts[1].args[3] != "thread:7" {
+		t.Errorf("delete should always be queued with its ref, got %v", inserts[1].args)
+	}
+	// Only the update marks the ticket pending; the deleted ticket has no row.
+	if statuses := script.find("SET discord_sync_status"); len(statuses) != 1 || statuses[0].args[0] != discordSyncPending {
+		t.Errorf("got %d sync status updates, want one pending", len(statuses))
+	}
+	select {
+	case <-outbox.wake:
+	default:
+		t.Error("enqueue outside a transaction should wake the worker")
+	}
+}
+
+func TestDiscordOutboxDeliversInLeaseOrder(t *testing.T) {
+	db, script := newScriptedDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value) {
+		switch {
+		case strings.Contains(query, "RETURNING id, entity_type"):
+			return []string{"id", "entity_type", "entity_id", "action", "ref", "attempts"}, [][]driver.Value{
+				{int64(3), discordEntitySupportTicket, "1", discordActionPost, "", int64(0)},
+				{int64(5), discordEntitySupportTicket, "2", discordActionUpdate, "", int64(0)},
+				{int64(8), discordEntitySupportTicket, "3", discordActionUpdate, "", int64(discordOutboxMaxAttempts - 1)},
+			}
+		case strings.Contains(query, "SELECT EXISTS"):
+			return []string{"exists"}, [][]driver.Value{{false}}
+		}
+		return nil, nil
+	})
+	outbox := NewDiscordOutbox(db)
+	var performed []int64
+	outbox.register(discordEntitySupportTicket, func(ctx context.Context, item discordOutboxItem) error {
+		performed = append(performed, item.ID)
+		if item.ID == 3 {
+			return nil
+		}
+		return errors.New("discord is down")
+	})
+
+	before := time.Now().UTC()
+	leased, err := outbox.deliverDue(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leased != 3 || len(performed) != 3 || performed[0] != 3 || performed[1] != 5 || performed[2] != 8 {
+		t.Fatalf("leased %d, performed %v, want rows 3, 5, 8 in order", leased, performed)
+	}
+
+	if done := script.find("SET done_at"); len(done) != 1 || done[0].args[1] != int64(3) {
+		t.Errorf("got %d done updates, want row 3 only", len(done))
+	}
+	retries := script.find("next_attempt_at = $3")
+	if len(retries) != 1 || retries[0].args[0] != int64(1) || retries[0].args[3] != int64(5) {
+		t.Fatalf("want row 5 rescheduled after its first attempt, got %v", retries)
+	}
+	if next := retries[0].args[2].(time.Time); next.Before(before.Add(discordOutboxBackoff(1))) {
+		t.Errorf("row 5 retries at %s, want at least %s later", next, discordOutboxBackoff(1))
+	}
+	failed := script.find("failed_at = $3")
+	if len(failed) != 1 || failed[0].args[0] != int64(discordOutboxMaxAttempts) || failed[0].args[3] != int64(8) {
+		t.Errorf("want row 8 to fail after %d attempts, got %v", discordOutboxMaxAttempts, failed)
+	}
+}
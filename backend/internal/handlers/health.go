@@ -5,16 +5,26 @@ import (
 	"database/sql"
 	"net/http"
 	"time"
+
+	"amy/minecraft-server/internal/discord"
 )
 
 type HealthHandler struct {
-	db *sql.DB
+	db      *sql.DB
+	gateway *discord.Gateway
 }
 
 func NewHealthHandler(db *sql.DB) *HealthHandler {
 	return &HealthHandler{db: db}
 }
 
+// SetDiscordGateway adds the gateway connection state to the health response.
+// A disconnected gateway does not fail the check, since the site works
+// without it.
+func (h *HealthHandler) SetDiscordGateway(gateway *discord.Gateway) {
+	h.gateway = gateway
+}
+
 func (h *HealthHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
@@ -29,5 +39,9 @@ func (h *HealthHandler) Handle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	response := map[string]any{"status": "ok"}
+	if h.gateway != nil {
+		response["discordGateway"] = h.gateway.Status()
+	}
+	writeJSON(w, http.StatusOK, response)
 }
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"amy/minecraft-server/internal/minecraft"
+	"amy/minecraft-server/internal/observability"
+)
+
+const (
+	minecraftChatQueueSize = 128
+	// Minecraft's own chat input stops at 256 characters.
+	minecraftChatMaxRunes = 256
+	minecraftChatColor    = 5763719
+)
+
+var minecraftNicknamePattern = regexp.MustCompile(`^[A-Za-z0-9_]{3,16}$`)
+
+// MinecraftChatBridge links the community chat with the in-game chat.
+// Messages written on the site or in Discord are shown in game with tellraw
+// over RCON; the server posts in-game chat to POST /api/minecraft/chat (from
+// a chat plugin or a log tailer), and it is sent to the Discord channel as
+// the player's character.
+type MinecraftChatBridge struct {
+	db    *sql.DB
+	rcon  *minecraft.RCON
+	token string
+	chat  *CommunityChatHandler
+	queue chan minecraftChatLine
+}
+
+// minecraftChatLine is one chat message to show in game.
+type minecraftChatLine struct {
+	Source string
+	// Author is the Discord or site display name, shown on hover.
+	Author string
+	// Character is the RP character the message is attributed to; empty
+	// when the author has no accepted application.
+	Character string
+	// DiscordID is set for Discord messages; the character is looked up
+	// when the line is sent, off the gateway's event loop.
+	DiscordID string
+	Text      string
+	MediaURL  string
+}
+
+func NewMinecraftChatBridge(db *sql.DB, rcon *minecraft.RCON, token string, chat *CommunityChatHandler) *MinecraftChatBridge {
+	return &MinecraftChatBridge{
+		db:    db,
+		rcon:  rcon,
+		token: strings.TrimSpace(token),
+		chat:  chat,
+		queue: make(chan minecraftChatLine, minecraftChatQueueSize),
+	}
+}
+
+// Start sends queued lines to the game one at a time, so a slow or
+// restarting server delays the chat instead of blocking the gateway.
+func (b *MinecraftChatBridge) Start(ctx context.Context) {
+	if !b.rcon.Configured() {
+		return
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				_ = b.rcon.Close()
+				return
+			case line := <-b.queue:
+				b.send(ctx, line)
+			}
+		}
+	}()
+}
+
+// relay queues a line for the game. When the server has been unreachable
+// long enough to fill the queue, new lines are dropped.
+func (b *MinecraftChatBridge) relay(line minecraftChatLine) {
+	if !b.rcon.Configured() {
+		return
+	}
+	select {
+	case b.queue <- line:
+	default:
+		observability.MinecraftChatRelayed.WithLabelValues("to_game", "dropped").Inc()
+	}
+}
+
+// relayDiscordMessage shows a message written in Discord under the
+// author's character when their Discord account has an accepted application.
+func (b *MinecraftChatBridge) relayDiscordMessage(message communityChatMessage) {
+	line := minecraftChatLineFor(message, message.Author, "")
+	line.DiscordID = message.AuthorDiscordID
+	b.relay(line)
+}
+
+func (b *MinecraftChatBridge) send(ctx context.Context, line minecraftChatLine) {
+	if line.Character == "" && line.DiscordID != "" {
+		lookupCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		app, err := (&DiscordAuthHandler{db: b.db}).loadAcceptedApplicationForDiscord(lookupCtx, line.DiscordID)
+		cancel()
+		if err == nil {
+			line.Character = characterName(*app)
+		}
+	}
+	prefix := minecraft.TextComponent{Text: "[Discord] ", Color: "blue"}
+	if line.Source == communityChatSourceSite {
+		prefix = minecraft.TextComponent{Text: "[Сайт] ", Color: "gold"}
+	}
+	name := line.Character
+	if name == "" {
+		name = line.Author
+	}
+	components := []minecraft.TextComponent{
+		prefix,
+		{
+			Text:       name,
+			Color:      "yellow",
+			HoverEvent: &minecraft.HoverEvent{Action: "show_text", Contents: line.Source + ": " + line.Author},
+		},
+		{Text: ": ", Color: "gray"},
+	}
+	if line.Text != "" {
+		components = append(components, minecraft.TextComponent{Text: minecraft.Truncate(line.Text, minecraftChatMaxRunes), Color: "white"})
+	}
+	if line.MediaURL != "" {
+		components = append(components, minecraft.TextComponent{
+			Text:       " [картинка]",
+			Color:      "aqua",
+			HoverEvent: &minecraft.HoverEvent{Action: "show_text", Contents: "Открыть в браузере"},
+			ClickEvent: &minecraft.ClickEvent{Action: "open_url", Value: line.MediaURL},
+		})
+	}
+	command, err := minecraft.Tellraw("@a", components...)
+	if err != nil {
+		return
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if _, err := b.rcon.Command(sendCtx, command); err != nil {
+		observability.MinecraftChatRelayed.WithLabelValues("to_game", "failed").Inc()
+		if ctx.Err() == nil {
+			log.Printf("minecraft chat relay failed: %v", err)
+		}
+		return
+	}
+	observability.MinecraftChatRelayed.WithLabelValues("to_game", "sent").Inc()
+}
+
+// Handle receives in-game chat from the server:
+// POST /api/minecraft/chat with {"player": "Nick", "message": "..."} and the
+// MINECRAFT_CHAT_TOKEN bearer token.
+func (b *MinecraftChatBridge) Handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if b.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(b.token)) != 1 {
+		writeError(w, http.StatusUnauthorized, "invalid chat token")
+		return
+	}
+	if !b.chat.bridged() {
+		writeError(w, http.StatusServiceUnavailable, "discord chat is not configured")
+		return
+	}
+
+	var payload struct {
+		Player  string `json:"player"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 8*1024)).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	player := strings.TrimSpace(payload.Player)
+	if !minecraftNicknamePattern.MatchString(player) {
+		writeError(w, http.StatusBadRequest, "invalid player name")
+		return
+	}
+	message := minecraft.Truncate(minecraft.StripFormatting(payload.Message), minecraftChatMaxRunes)
+	if message == "" {
+		writeError(w, http.StatusBadRequest, "message required")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	authorName := player
+	iconURL := ""
+	authorDiscordID := ""
+	app, err := scanRPApplication(b.db.QueryRowContext(
+		ctx,
+		rpApplicationSelectSQL+` WHERE LOWER(nickname) = LOWER($1) AND status IN ('accepted', 'approved') ORDER BY updated_at DESC, created_at DESC LIMIT 1`,
+		player,
+	))
+	switch {
+	case err == nil:
+		authorDiscordID = app.DiscordID
+		if character := strings.TrimSpace(app.RPName); character != "" {
+			authorName = character + " (" + player + ")"
+		}
+		if user, err := (&DiscordAuthHandler{db: b.db}).loadDiscordUser(ctx, app.DiscordID); err == nil {
+			iconURL = avatarURLFor(user.DiscordID, user.Avatar)
+		}
+	case !errors.Is(err, sql.ErrNoRows):
+		writeError(w, http.StatusInternalServerError, "failed to load character")
+		return
+	}
+
+	if _, err := b.chat.postMessage(ctx, authorDiscordID, authorName, iconURL, message, "", communityChatSourceMinecraft, minecraftChatColor); err != nil {
+		observability.MinecraftChatRelayed.WithLabelValues("from_game", "failed").Inc()
+		writeError(w, http.StatusBadGateway, "failed to send discord message")
+		return
+	}
+	observability.MinecraftChatRelayed.WithLabelValues("from_game", "sent").Inc()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func minecraftChatLineFor(message communityChatMessage, author, character string) minecraftChatLine {
+	mediaURL := message.GIFURL
+	if mediaURL == "" {
+		mediaURL = message.ImageURL
+	}
+	return minecraftChatLine{
+		Source:    message.Source,
+		Author:    author,
+		Character: character,
+		Text:      message.Message,
+		MediaURL:  mediaURL,
+	}
+}
+
+// characterName is the RP name of an accepted application, or the Minecraft
+// nickname when the application has none.
+func characterName(app rpApplicationDoc) string {
+	if name := strings.TrimSpace(app.RPName); name != "" {
+		return name
+	}
+	return strings.TrimSpace(app.Nickname)
+}
@@ -3,7 +3,6 @@ package handlers
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"html"
 	"io"
 	"net/http"
@@ -14,14 +13,16 @@ import (
 	"strings"
 	"time"
 
+	"amy/minecraft-server/internal/discord"
 	"amy/minecraft-server/internal/models"
 	"amy/minecraft-server/internal/observability"
 )
 
 type NewsHandler struct {
 	db               *sql.DB
+	notifier         *Notifier
 	telegramChannel  string
-	discordBotToken  string
+	discord          *discord.Client
 	discordChannelID string
 	discordGuildID   string
 	httpClient       *http.Client
@@ -66,11 +67,12 @@ var (
 	systemNewsChannelID = "1460666647273799842"
 )
 
-func NewNewsHandler(db *sql.DB, telegramChannel, discordBotToken, discordChannelID, discordGuildID string) *NewsHandler {
+func NewNewsHandler(db *sql.DB, notifier *Notifier, discordClient *discord.Client, telegramChannel, discordChannelID, discordGuildID string) *NewsHandler {
 	return &NewsHandler{
 		db:               db,
+		notifier:         notifier,
 		telegramChannel:  strings.TrimSpace(telegramChannel),
-		discordBotToken:  strings.TrimSpace(discordBotToken),
+		discord:          discordClient,
 		discordChannelID: strings.TrimSpace(discordChannelID),
 		discordGuildID:   strings.TrimSpace(discordGuildID),
 		httpClient: &http.Client{
@@ -100,7 +102,7 @@ func (h *NewsHandler) List(w http.ResponseWriter, r *http.Request) {
 	var items []models.News
 	var err error
 
-	if h.discordBotToken != "" && (category == "" || category == "all" || category == "user" || category == "users" || category == "system") {
+	if h.discord.Configured() && (category == "" || category == "all" || category == "user" || category == "users" || category == "system") {
 		if items, err = h.fetchCategorizedDiscordNews(ctx, category, limit, authorID); err == nil && (len(items) > 0 || category != "") {
 			_ = h.enrichNewsInteractions(ctx, items, currentDiscordID)
 			writeJSON(w, http.StatusOK, items)
@@ -116,7 +118,7 @@ func (h *NewsHandler) List(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if h.discordBotToken != "" && h.discordChannelID != "" {
+	if h.discord.Configured() && h.discordChannelID != "" {
 		if items, err = h.fetchDiscordNews(ctx, limit); err == nil && len(items) > 0 {
 			_ = h.enrichNewsInteractions(ctx, items, currentDiscordID)
 			writeJSON(w, http.StatusOK, items)
@@ -258,28 +260,10 @@ func (h *NewsHandler) fetchTelegramNews(ctx context.Context, limit int64) ([]mod
 }
 
 func (h *NewsHandler) fetchDiscordNews(ctx context.Context, limit int64) ([]models.News, error) {
-	requestURL := "https://discord.com/api/v10/channels/" + url.PathEscape(h.discordChannelID) + "/messages?limit=" + strconv.FormatInt(limit, 10)
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	messages, err := h.fetchDiscordChannelMessages(ctx, h.discordChannelID, limit)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", "Bot "+h.discordBotToken)
-	req.Header.Set("User-Agent", "amy-world-news/1.0")
-
-	resp, err := h.httpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return nil, errUnexpectedStatus(resp.StatusCode)
-	}
-
-	var messages []discordNewsMessage
-	if err := json.NewDecoder(io.LimitReader(resp.Body, 2*1024*1024)).Decode(&messages); err != nil {
-		return nil, err
-	}
 
 	items := make([]models.News, 0, len(messages))
 	for index, message := range messages {
@@ -310,6 +294,16 @@ func (h *NewsHandler) fetchDiscordNews(ctx context.Context, limit int64) ([]mode
 	return limitNews(items, limit), nil
 }
 
+func (h *NewsHandler) fetchDiscordChannelMessages(ctx context.Context, channelID string, limit int64) ([]discordNewsMessage, error) {
+	var messages []discordNewsMessage
+	err := h.discord.Do(ctx, discord.Request{
+		Kind:  "news_discord",
+		Path:  "/channels/" + url.PathEscape(channelID) + "/messages",
+		Query: url.Values{"limit": {strconv.FormatInt(limit, 10)}},
+	}, &messages)
+	return messages, err
+}
+
 func (h *NewsHandler) fetchDiscordNewsFromChannels(ctx context.Context, channelIDs []string, source, category string, limit int64, imagesOnly bool, authorID string) ([]models.News, error) {
 	perChannelLimit := limit
 	if perChannelLimit < 10 {
@@ -320,25 +314,7 @@ func (h *NewsHandler) fetchDiscordNewsFromChannels(ctx context.Context, channelI
 	}
 	items := make([]models.News, 0, limit)
 	for _, channelID := range channelIDs {
-		requestURL := "https://discord.com/api/v10/channels/" + url.PathEscape(channelID) + "/messages?limit=" + strconv.FormatInt(perChannelLimit, 10)
-		req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
-		if err != nil {
-			return nil, err
-		}
-		req.Header.Set("Authorization", "Bot "+h.discordBotToken)
-		req.Header.Set("User-Agent", "amy-world-news/1.0")
-
-		resp, err := h.httpClient.Do(req)
-		if err != nil {
-			return nil, err
-		}
-		if resp.StatusCode < 200 || resp.StatusCode > 299 {
-			_ = resp.Body.Close()
-			return nil, errUnexpectedStatus(resp.StatusCode)
-		}
-		var messages []discordNewsMessage
-		err = json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(&messages)
-		_ = resp.Body.Close()
+		messages, err := h.fetchDiscordChannelMessages(ctx, channelID, perChannelLimit)
 		if err != nil {
 			return nil, err
 		}
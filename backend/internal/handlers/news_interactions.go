@@ -4,8 +4,10 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -16,6 +18,7 @@ type newsCommentOut struct {
 	Author       string    `json:"author"`
 	AuthorID     string    `json:"authorId,omitempty"`
 	AuthorAvatar string    `json:"authorAvatar,omitempty"`
+	ReplyToID    *int64    `json:"replyToId,omitempty"`
 	Message      string    `json:"message"`
 	CreatedAt    time.Time `json:"createdAt"`
 }
@@ -88,7 +91,7 @@ func (h *NewsHandler) listComments(w http.ResponseWriter, r *http.Request) {
 	defer cancel()
 	rows, err := h.db.QueryContext(
 		ctx,
-		`SELECT c.id, c.news_id, c.author_name, c.discord_id, COALESCE(u.avatar, ''), c.message, c.created_at
+		`SELECT c.id, c.news_id, c.author_name, c.discord_id, COALESCE(u.avatar, ''), c.reply_to_id, c.message, c.created_at
 		 FROM news_comments c
 		 LEFT JOIN discord_users u ON u.discord_id = c.discord_id
 		 WHERE c.news_id = $1
@@ -105,10 +108,14 @@ func (h *NewsHandler) listComments(w http.ResponseWriter, r *http.Request) {
 	for rows.Next() {
 		var item newsCommentOut
 		var avatarHash string
-		if err := rows.Scan(&item.ID, &item.NewsID, &item.Author, &item.AuthorID, &avatarHash, &item.Message, &item.CreatedAt); err != nil {
+		var replyToID sql.NullInt64
+		if err := rows.Scan(&item.ID, &item.NewsID, &item.Author, &item.AuthorID, &avatarHash, &replyToID, &item.Message, &item.CreatedAt); err != nil {
 			writeError(w, http.StatusInternalServerError, "failed to read comments")
 			return
 		}
+		if replyToID.Valid {
+			item.ReplyToID = &replyToID.Int64
+		}
 		item.AuthorAvatar = avatarURLFor(item.AuthorID, avatarHash)
 		items = append(items, item)
 	}
@@ -122,8 +129,9 @@ func (h *NewsHandler) createComment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var payload struct {
-		NewsID  string `json:"newsId"`
-		Message string `json:"message"`
+		NewsID    string `json:"newsId"`
+		Message   string `json:"message"`
+		ReplyToID int64  `json:"replyToId"`
 	}
 	if err := json.NewDecoder(io.LimitReader(r.Body, 16*1024)).Decode(&payload); err != nil {
 		writeError(w, http.StatusBadRequest, "invalid json")
@@ -150,22 +158,51 @@ func (h *NewsHandler) createComment(w http.ResponseWriter, r *http.Request) {
 	if user != nil {
 		author = displayNameFor(*user)
 	}
+
+	var replyTo any
+	var parentAuthorID string
+	if payload.ReplyToID > 0 {
+		err := h.db.QueryRowContext(ctx, `SELECT discord_id FROM news_comments WHERE id = $1 AND news_id = $2`, payload.ReplyToID, newsID).Scan(&parentAuthorID)
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusBadRequest, "reply target not found")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to load comment")
+			return
+		}
+		replyTo = payload.ReplyToID
+	}
+
 	var out newsCommentOut
 	var avatarHash string
 	err = h.db.QueryRowContext(
 		ctx,
-		`INSERT INTO news_comments (news_id, discord_id, author_name, message)
-		 VALUES ($1, $2, $3, $4)
+		`INSERT INTO news_comments (news_id, discord_id, author_name, reply_to_id, message)
+		 VALUES ($1, $2, $3, $4, $5)
 		 RETURNING id, news_id, author_name, discord_id, message, created_at`,
 		newsID,
 		discordID,
 		author,
+		replyTo,
 		message,
 	).Scan(&out.ID, &out.NewsID, &out.Author, &out.AuthorID, &out.Message, &out.CreatedAt)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to save comment")
 		return
 	}
+	if payload.ReplyToID > 0 {
+		out.ReplyToID = &payload.ReplyToID
+		if parentAuthorID != discordID {
+			h.notifier.Notify(ctx, parentAuthorID, Notification{
+				Kind:  NotificationNewsReply,
+				Title: "Ответ на ваш комментарий",
+				Body:  fmt.Sprintf("%s: %s", author, message),
+				URL:   "/news",
+				Tag:   "news-comment-" + strconv.FormatInt(payload.ReplyToID, 10),
+			})
+		}
+	}
 	if user != nil {
 		avatarHash = user.Avatar
 	}
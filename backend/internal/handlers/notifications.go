@@ -0,0 +1,451 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"amy/minecraft-server/internal/observability"
+	webpush "github.com/SherClockHolmes/webpush-go"
+)
+
+const (
+	NotificationSupportReply  = "support_reply"
+	NotificationRPApplication = "rp_application"
+	NotificationNewsReply     = "news_reply"
+	NotificationServerOnline  = "server_online"
+
+	maxStoredNotifications = 200
+)
+
+// notificationKind describes one event type players can subscribe to. Events
+// sent to everyone at once are opt-in; personal ones are on by default.
+type notificationKind struct {
+	Kind  string `json:"kind"`
+	Label string `json:"label"`
+	Inbox bool   `json:"inbox"`
+	Push  bool   `json:"push"`
+}
+
+var notificationKinds = []notificationKind{
+	{Kind: NotificationSupportReply, Label: "Ответы поддержки", Inbox: true, Push: true},
+	{Kind: NotificationRPApplication, Label: "Решения по RP-анкете", Inbox: true, Push: true},
+	{Kind: NotificationNewsReply, Label: "Ответы на комментарии", Inbox: true, Push: true},
+	{Kind: NotificationServerOnline, Label: "Сервер снова онлайн", Inbox: false, Push: false},
+}
+
+func defaultNotificationKind(kind string) (notificationKind, bool) {
+	for _, item := range notificationKinds {
+		if item.Kind == kind {
+			return item, true
+		}
+	}
+	return notificationKind{}, false
+}
+
+// Notification is one entry of a player's inbox and the payload of its push.
+type Notification struct {
+	ID        int64      `json:"id"`
+	Kind      string     `json:"kind"`
+	Title     string     `json:"title"`
+	Body      string     `json:"body"`
+	URL       string     `json:"url,omitempty"`
+	Tag       string     `json:"tag,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ReadAt    *time.Time `json:"readAt,omitempty"`
+}
+
+// Notifier stores notifications in the player's inbox and queues them for Web
+// Push in push_outbox, honouring the per-event preferences.
+type Notifier struct {
+	db              *sql.DB
+	vapidPublicKey  string
+	vapidPrivateKey string
+	pushSubject     string
+	pushClient      *http.Client
+	pushWake        chan struct{}
+	sendPush        func(ctx context.Context, message []byte, subscription *webpush.Subscription, options *webpush.Options) (*http.Response, error)
+}
+
+func NewNotifier(db *sql.DB, vapidPublicKey, vapidPrivateKey, pushSubject string) *Notifier {
+	pushSubject = strings.TrimSpace(pushSubject)
+	if pushSubject == "" {
+		pushSubject = "mailto:support@amyworld.ru"
+	}
+	return &Notifier{
+		db:              db,
+		vapidPublicKey:  strings.TrimSpace(vapidPublicKey),
+		vapidPrivateKey: strings.TrimSpace(vapidPrivateKey),
+		pushSubject:     pushSubject,
+		pushClient:      newPushHTTPClient(),
+		pushWake:        make(chan struct{}, 1),
+		sendPush:        webpush.SendNotificationWithContext,
+	}
+}
+
+func (n *Notifier) pushConfigured() bool {
+	return n.vapidPublicKey != "" && n.vapidPrivateKey != ""
+}
+
+func (n *Notifier) preferences(ctx context.Context, discordID string) (map[string]notificationKind, error) {
+	prefs := make(map[string]notificationKind, len(notificationKinds))
+	for _, kind := range notificationKinds {
+		prefs[kind.Kind] = kind
+	}
+	rows, err := n.db.QueryContext(ctx, `SELECT kind, inbox, push FROM notification_preferences WHERE discord_id = $1`, discordID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind string
+		var inbox, push bool
+		if err := rows.Scan(&kind, &inbox, &push); err != nil {
+			return nil, err
+		}
+		if pref, ok := prefs[kind]; ok {
+			pref.Inbox = inbox
+			pref.Push = push
+			prefs[kind] = pref
+		}
+	}
+	return prefs, rows.Err()
+}
+
+// Notify delivers a notification to one player. Failures are logged, never
+// returned: a missed notification must not fail the action that caused it.
+func (n *Notifier) Notify(ctx context.Context, discordID string, notification Notification) {
+	discordID = strings.TrimSpace(discordID)
+	if n == nil || discordID == "" {
+		return
+	}
+	prefs, err := n.preferences(ctx, discordID)
+	if err != nil {
+		log.Printf("notification %s for %s skipped: %v", notification.Kind, discordID, err)
+		return
+	}
+	pref := prefs[notification.Kind]
+	n.deliver(ctx, discordID, notification, pref.Inbox, pref.Push)
+}
+
+// Broadcast delivers a notification to every player who switched its kind on.
+func (n *Notifier) Broadcast(ctx context.Context, notification Notification) {
+	if n == nil {
+		return
+	}
+	rows, err := n.db.QueryContext(
+		ctx,
+		`SELECT discord_id, inbox, push FROM notification_preferences WHERE kind = $1 AND (inbox OR push)`,
+		notification.Kind,
+	)
+	if err != nil {
+		log.Printf("notification %s broadcast failed: %v", notification.Kind, err)
+		return
+	}
+	type recipient struct {
+		discordID   string
+		inbox, push bool
+	}
+	recipients := make([]recipient, 0)
+	for rows.Next() {
+		var item recipient
+		if err := rows.Scan(&item.discordID, &item.inbox, &item.push); err == nil {
+			recipients = append(recipients, item)
+		}
+	}
+	rows.Close()
+	for _, item := range recipients {
+		n.deliver(ctx, item.discordID, notification, item.inbox, item.push)
+	}
+}
+
+func (n *Notifier) deliver(ctx context.Context, discordID string, notification Notification, inbox, push bool) {
+	if !inbox && !push {
+		return
+	}
+	if inbox {
+		err := n.db.QueryRowContext(
+			ctx,
+			`INSERT INTO notifications (discord_id, kind, title, body, url, created_at)
+			 SELECT $1, $2, $3, $4, $5, $6
+			 WHERE EXISTS (SELECT 1 FROM discord_users WHERE discord_id = $1)
+			 RETURNING id`,
+			discordID,
+			notification.Kind,
+			notification.Title,
+			truncateRunes(notification.Body, 500),
+			notification.URL,
+			time.Now().UTC(),
+		).Scan(&notification.ID)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("notification %s for %s not stored: %v", notification.Kind, discordID, err)
+		}
+		_, _ = n.db.ExecContext(
+			ctx,
+			`DELETE FROM notifications
+			 WHERE discord_id = $1 AND id NOT IN (
+			   SELECT id FROM notifications WHERE discord_id = $1 ORDER BY created_at DESC, id DESC LIMIT $2
+			 )`,
+			discordID,
+			maxStoredNotifications,
+		)
+	}
+	observability.NotificationsSent.WithLabelValues(notification.Kind).Inc()
+	if push && n.pushConfigured() {
+		n.enqueuePush(ctx, discordID, notification)
+	}
+}
+
+// List returns the inbox: GET /api/notifications?before={id}&limit={n}.
+func (n *Notifier) List(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	discordID := currentDiscordIDFromCookie(r)
+	if discordID == "" {
+		writeError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 30
+	}
+	before, _ := strconv.ParseInt(r.URL.Query().Get("before"), 10, 64)
+	if before <= 0 {
+		before = 1<<63 - 1
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	rows, err := n.db.QueryContext(
+		ctx,
+		`SELECT id, kind, title, body, url, created_at, read_at
+		 FROM notifications
+		 WHERE discord_id = $1 AND id < $2
+		 ORDER BY id DESC
+		 LIMIT $3`,
+		discordID,
+		before,
+		limit,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load notifications")
+		return
+	}
+	defer rows.Close()
+	items := make([]Notification, 0)
+	for rows.Next() {
+		var item Notification
+		var readAt sql.NullTime
+		if err := rows.Scan(&item.ID, &item.Kind, &item.Title, &item.Body, &item.URL, &item.CreatedAt, &readAt); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to read notifications")
+			return
+		}
+		item.ReadAt = scanNullableTime(readAt)
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to read notifications")
+		return
+	}
+	unread := 0
+	_ = n.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM notifications WHERE discord_id = $1 AND read_at IS NULL`, discordID).Scan(&unread)
+	writeJSON(w, http.StatusOK, map[string]any{"notifications": items, "unread": unread})
+}
+
+// Read marks notifications as read: POST /api/notifications/read with
+// {"ids": [...]} or {"all": true}.
+func (n *Notifier) Read(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	discordID := currentDiscordIDFromCookie(r)
+	if discordID == "" {
+		writeError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	var payload struct {
+		IDs []int64 `json:"ids"`
+		All bool    `json:"all"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if !payload.All && len(payload.IDs) == 0 {
+		writeError(w, http.StatusBadRequest, "ids or all required")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	now := time.Now().UTC()
+	var err error
+	if payload.All {
+		_, err = n.db.ExecContext(ctx, `UPDATE notifications SET read_at = $1 WHERE discord_id = $2 AND read_at IS NULL`, now, discordID)
+	} else {
+		for _, id := range payload.IDs {
+			if _, err = n.db.ExecContext(ctx, `UPDATE notifications SET read_at = $1 WHERE id = $2 AND discord_id = $3 AND read_at IS NULL`, now, id, discordID); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to update notifications")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Preferences reads or updates which events reach the inbox and which are
+// pushed: GET|PUT /api/notifications/preferences.
+func (n *Notifier) Preferences(w http.ResponseWriter, r *http.Request) {
+	discordID := currentDiscordIDFromCookie(r)
+	if discordID == "" {
+		writeError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var payload struct {
+			Preferences []notificationKind `json:"preferences"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 16*1024)).Decode(&payload); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+		now := time.Now().UTC()
+		for _, pref := range payload.Preferences {
+			if _, ok := defaultNotificationKind(pref.Kind); !ok {
+				writeError(w, http.StatusBadRequest, "unknown notification kind")
+				return
+			}
+			_, err := n.db.ExecContext(
+				ctx,
+				`INSERT INTO notification_preferences (discord_id, kind, inbox, push, updated_at)
+				 VALUES ($1, $2, $3, $4, $5)
+				 ON CONFLICT (discord_id, kind) DO UPDATE SET
+				   inbox = EXCLUDED.inbox,
+				   push = EXCLUDED.push,
+				   updated_at = EXCLUDED.updated_at`,
+				discordID,
+				pref.Kind,
+				pref.Inbox,
+				pref.Push,
+				now,
+			)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "failed to save preferences")
+				return
+			}
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	prefs, err := n.preferences(ctx, discordID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load preferences")
+		return
+	}
+	items := make([]notificationKind, 0, len(notificationKinds))
+	for _, kind := range notificationKinds {
+		items = append(items, prefs[kind.Kind])
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"preferences": items})
+}
+
+// Push manages the browser's Web Push subscription:
+// GET (VAPID public key) | POST (subscribe) | DELETE ?endpoint= (unsubscribe).
+func (n *Notifier) Push(w http.ResponseWriter, r *http.Request) {
+	discordID := currentDiscordIDFromCookie(r)
+	if discordID == "" {
+		writeError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"configured": n.pushConfigured(),
+			"publicKey":  n.vapidPublicKey,
+		})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if r.Method == http.MethodDelete {
+		endpoint := strings.TrimSpace(r.URL.Query().Get("endpoint"))
+		if endpoint == "" {
+			_, _ = n.db.ExecContext(ctx, `DELETE FROM support_push_subscriptions WHERE discord_id = $1`, discordID)
+		} else {
+			_, _ = n.db.ExecContext(ctx, `DELETE FROM support_push_subscriptions WHERE discord_id = $1 AND endpoint = $2`, discordID, endpoint)
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var payload struct {
+		Endpoint string `json:"endpoint"`
+		Keys     struct {
+			P256DH string `json:"p256dh"`
+			Auth   string `json:"auth"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	payload.Endpoint = strings.TrimSpace(payload.Endpoint)
+	payload.Keys.P256DH = strings.TrimSpace(payload.Keys.P256DH)
+	payload.Keys.Auth = strings.TrimSpace(payload.Keys.Auth)
+	if payload.Endpoint == "" || payload.Keys.P256DH == "" || payload.Keys.Auth == "" {
+		writeError(w, http.StatusBadRequest, "subscription keys required")
+		return
+	}
+	if !validPushEndpoint(payload.Endpoint) {
+		writeError(w, http.StatusBadRequest, "invalid push endpoint")
+		return
+	}
+
+	_, err := n.db.ExecContext(
+		ctx,
+		`INSERT INTO support_push_subscriptions (discord_id, endpoint, p256dh, auth, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $5)
+		 ON CONFLICT (discord_id, endpoint) DO UPDATE SET
+		   p256dh = EXCLUDED.p256dh,
+		   auth = EXCLUDED.auth,
+		   failure_count = 0,
+		   last_error = '',
+		   updated_at = EXCLUDED.updated_at`,
+		discordID,
+		payload.Endpoint,
+		payload.Keys.P256DH,
+		payload.Keys.Auth,
+		time.Now().UTC(),
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to save subscription")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,428 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"amy/minecraft-server/internal/observability"
+	webpush "github.com/SherClockHolmes/webpush-go"
+)
+
+const (
+	pushWorkers             = 4
+	pushBatchSize           = 50
+	pushMaxAttempts         = 8
+	pushMaxEndpointFailures = 10
+	pushRetention           = 7 * 24 * time.Hour
+)
+
+// pushDelivery is how urgently a kind of notification reaches the device and
+// how long the push service may hold it for an offline browser.
+type pushDelivery struct {
+	Urgency webpush.Urgency
+	TTL     time.Duration
+}
+
+var pushDeliveries = map[string]pushDelivery{
+	NotificationSupportReply:  {Urgency: webpush.UrgencyHigh, TTL: 24 * time.Hour},
+	NotificationRPApplication: {Urgency: webpush.UrgencyNormal, TTL: 3 * 24 * time.Hour},
+	NotificationNewsReply:     {Urgency: webpush.UrgencyLow, TTL: 24 * time.Hour},
+	NotificationServerOnline:  {Urgency: webpush.UrgencyNormal, TTL: 30 * time.Minute},
+}
+
+var pushTopicRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// pushTopic turns a notification tag into a Topic header. Push services
+// replace a pending message with a newer one on the same topic, so a player
+// who was offline gets one "new reply" instead of ten. Topics are limited to
+// 32 URL-safe base64 characters; longer tags are hashed.
+func pushTopic(tag string) string {
+	if tag == "" || pushTopicRe.MatchString(tag) {
+		return tag
+	}
+	sum := sha256.Sum256([]byte(tag))
+	return base64.RawURLEncoding.EncodeToString(sum[:])[:32]
+}
+
+// enqueuePush queues a notification for every browser the player subscribed.
+func (n *Notifier) enqueuePush(ctx context.Context, discordID string, notification Notification) {
+	delivery, ok := pushDeliveries[notification.Kind]
+	if !ok {
+		delivery = pushDelivery{Urgency: webpush.UrgencyNormal, TTL: 24 * time.Hour}
+	}
+	payload, _ := json.Marshal(map[string]any{
+		"kind":  notification.Kind,
+		"title": notification.Title,
+		"body":  truncateRunes(notification.Body, 180),
+		"url":   notification.URL,
+		"tag":   notification.Tag,
+	})
+	now := time.Now().UTC()
+	result, err := n.db.ExecContext(
+		ctx,
+		`INSERT INTO push_outbox (subscription_id, kind, payload, topic, urgency, next_attempt_at, expires_at, created_at)
+		 SELECT id, $2, $3, $4, $5, $6, $7, $6 FROM support_push_subscriptions WHERE discord_id = $1`,
+		discordID,
+		notification.Kind,
+		string(payload),
+		pushTopic(notification.Tag),
+		string(delivery.Urgency),
+		now,
+		now.Add(delivery.TTL),
+	)
+	if err != nil {
+		log.Printf("push %s for %s not queued: %v", notification.Kind, discordID, err)
+		return
+	}
+	if queued, _ := result.RowsAffected(); queued > 0 {
+		select {
+		case n.pushWake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Start runs the push outbox workers until ctx is done.
+func (n *Notifier) Start(ctx context.Context) {
+	if !n.pushConfigured() {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+
+		var lastCleanup time.Time
+		for {
+			for {
+				leased, err := n.deliverDuePush(ctx)
+				if err != nil && ctx.Err() == nil {
+					log.Printf("push delivery failed: %v", err)
+				}
+				if err != nil || leased < pushBatchSize {
+					break
+				}
+			}
+			if time.Since(lastCleanup) > time.Hour {
+				lastCleanup = time.Now()
+				n.cleanupPushOutbox(ctx)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-n.pushWake:
+			}
+		}
+	}()
+}
+
+type outboxPush struct {
+	id, subscriptionID int64
+	endpoint           string
+	p256dh, auth       string
+	kind, payload      string
+	topic, urgency     string
+	expiresAt          time.Time
+	attempts           int
+}
+
+// deliverDuePush leases one batch and sends it with a small worker pool. It
+// returns the number of leased messages so the caller can drain a backlog
+// without waiting for the next tick.
+func (n *Notifier) deliverDuePush(ctx context.Context) (int, error) {
+	queryCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	// Same leasing scheme as the e-mail outbox: pushing next_attempt_at
+	// forward hides the batch from other replicas while it is in flight.
+	rows, err := n.db.QueryContext(
+		queryCtx,
+		`UPDATE push_outbox o SET next_attempt_at = NOW() + INTERVAL '5 minutes'
+		 FROM support_push_subscriptions s
+		 WHERE s.id = o.subscription_id AND o.id IN (
+		   SELECT id FROM push_outbox
+		   WHERE sent_at IS NULL AND failed_at IS NULL AND next_attempt_at <= NOW()
+		   ORDER BY id
+		   LIMIT $1
+		   FOR UPDATE SKIP LOCKED
+		 )
+		 RETURNING o.id, o.subscription_id, s.endpoint, s.p256dh, s.auth, o.kind, o.payload, o.topic, o.urgency, o.expires_at, o.attempts`,
+		pushBatchSize,
+	)
+	if err != nil {
+		return 0, err
+	}
+	batch := make([]outboxPush, 0, pushBatchSize)
+	for rows.Next() {
+		var item outboxPush
+		if err := rows.Scan(&item.id, &item.subscriptionID, &item.endpoint, &item.p256dh, &item.auth, &item.kind, &item.payload, &item.topic, &item.urgency, &item.expiresAt, &item.attempts); err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+		batch = append(batch, item)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	jobs := make(chan outboxPush)
+	var wg sync.WaitGroup
+	for i := 0; i < min(pushWorkers, len(batch)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range jobs {
+				n.deliverPush(ctx, item)
+			}
+		}()
+	}
+	for _, item := range batch {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- item
+	}
+	close(jobs)
+	wg.Wait()
+	return len(batch), nil
+}
+
+func (n *Notifier) deliverPush(ctx context.Context, item outboxPush) {
+	now := time.Now().UTC()
+	ttl := int(item.expiresAt.Sub(now).Seconds())
+	if ttl <= 0 {
+		n.failPush(ctx, item, "expired before delivery", now)
+		observability.PushDeliveries.WithLabelValues(item.kind, "expired").Inc()
+		return
+	}
+
+	started := time.Now()
+	resp, err := n.sendPush(ctx, []byte(item.payload), &webpush.Subscription{
+		Endpoint: item.endpoint,
+		Keys:     webpush.Keys{P256dh: item.p256dh, Auth: item.auth},
+	}, &webpush.Options{
+		HTTPClient:      n.pushClient,
+		Subscriber:      n.pushSubject,
+		VAPIDPublicKey:  n.vapidPublicKey,
+		VAPIDPrivateKey: n.vapidPrivateKey,
+		TTL:             ttl,
+		Urgency:         webpush.Urgency(item.urgency),
+		Topic:           item.topic,
+	})
+	status := 0
+	var retryAfter time.Duration
+	if resp != nil {
+		status = resp.StatusCode
+		retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+		_ = resp.Body.Close()
+	}
+	result := pushResult(status, err)
+	observability.PushDeliveryDuration.WithLabelValues(result).Observe(time.Since(started).Seconds())
+	now = time.Now().UTC()
+
+	switch result {
+	case "sent":
+		_, _ = n.db.ExecContext(ctx, `UPDATE push_outbox SET sent_at = $1, attempts = attempts + 1, last_error = '' WHERE id = $2`, now, item.id)
+		_, _ = n.db.ExecContext(ctx, `UPDATE support_push_subscriptions SET failure_count = 0, last_success_at = $1, last_error = '' WHERE id = $2`, now, item.subscriptionID)
+		observability.PushDeliveries.WithLabelValues(item.kind, "sent").Inc()
+		return
+	case "gone":
+		// The browser unsubscribed or the subscription expired; its queued
+		// messages go with it.
+		_, _ = n.db.ExecContext(ctx, `DELETE FROM support_push_subscriptions WHERE id = $1`, item.subscriptionID)
+		observability.PushDeliveries.WithLabelValues(item.kind, "gone").Inc()
+		return
+	}
+
+	reason := "push service returned " + strconv.Itoa(status)
+	if err != nil {
+		reason = err.Error()
+	}
+	if n.recordPushFailure(ctx, item, reason, now) {
+		return
+	}
+	attempts := item.attempts + 1
+	next := now.Add(max(pushBackoff(attempts), retryAfter))
+	if result == "failed" || attempts >= pushMaxAttempts || next.After(item.expiresAt) {
+		n.failPush(ctx, item, reason, now)
+		observability.PushDeliveries.WithLabelValues(item.kind, "failed").Inc()
+		return
+	}
+	_, _ = n.db.ExecContext(
+		ctx,
+		`UPDATE push_outbox SET attempts = $1, last_error = $2, next_attempt_at = $3 WHERE id = $4`,
+		attempts,
+		truncateRunes(reason, 500),
+		next,
+		item.id,
+	)
+	observability.PushDeliveries.WithLabelValues(item.kind, "retry").Inc()
+}
+
+// pushResult sorts a push service reply into sent, gone (drop the
+// subscription), retry (429 and 5xx, network errors) or failed (any other
+// rejection, which will not get better by sending the same request again).
+func pushResult(status int, err error) string {
+	switch {
+	case err != nil:
+		return "retry"
+	case status >= 200 && status < 300:
+		return "sent"
+	case status == http.StatusNotFound || status == http.StatusGone:
+		return "gone"
+	case status == http.StatusTooManyRequests || status >= 500:
+		return "retry"
+	default:
+		return "failed"
+	}
+}
+
+func (n *Notifier) failPush(ctx context.Context, item outboxPush, reason string, now time.Time) {
+	_, _ = n.db.ExecContext(
+		ctx,
+		`UPDATE push_outbox SET attempts = attempts + 1, last_error = $1, failed_at = $2 WHERE id = $3`,
+		truncateRunes(reason, 500),
+		now,
+		item.id,
+	)
+}
+
+// recordPushFailure counts consecutive failures per subscription and drops
+// endpoints that keep failing, such as browsers whose keys no longer match
+// the VAPID key. It reports whether the subscription was removed.
+func (n *Notifier) recordPushFailure(ctx context.Context, item outboxPush, reason string, now time.Time) bool {
+	var failures int
+	err := n.db.QueryRowContext(
+		ctx,
+		`UPDATE support_push_subscriptions
+		 SET failure_count = failure_count + 1, last_failure_at = $1, last_error = $2
+		 WHERE id = $3
+		 RETURNING failure_count`,
+		now,
+		truncateRunes(reason, 500),
+		item.subscriptionID,
+	).Scan(&failures)
+	if err == sql.ErrNoRows {
+		return true
+	}
+	if err != nil || failures < pushMaxEndpointFailures {
+		return false
+	}
+	_, _ = n.db.ExecContext(ctx, `DELETE FROM support_push_subscriptions WHERE id = $1`, item.subscriptionID)
+	log.Printf("push subscription %d removed after %d failed deliveries: %s", item.subscriptionID, failures, reason)
+	observability.PushDeliveries.WithLabelValues(item.kind, "pruned").Inc()
+	return true
+}
+
+func (n *Notifier) cleanupPushOutbox(ctx context.Context) {
+	cutoff := time.Now().UTC().Add(-pushRetention)
+	_, _ = n.db.ExecContext(ctx, `DELETE FROM push_outbox WHERE sent_at < $1 OR failed_at < $1`, cutoff)
+}
+
+func pushBackoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := 15 * time.Second << uint(attempts-1)
+	if delay > time.Hour {
+		delay = time.Hour
+	}
+	return delay
+}
+
+// parseRetryAfter reads the delay-seconds or HTTP-date form of Retry-After.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return min(time.Duration(seconds)*time.Second, 6*time.Hour)
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return min(max(time.Until(at), 0), 6*time.Hour)
+	}
+	return 0
+}
+
+// validPushEndpoint accepts the https URL a browser's push service hands out.
+// Hosts given as IP addresses must be public; names are checked again when
+// the push client dials, since DNS can change after subscribing.
+func validPushEndpoint(raw string) bool {
+	if len(raw) > 2048 {
+		return false
+	}
+	endpoint, err := url.Parse(raw)
+	if err != nil || endpoint.Scheme != "https" || endpoint.User != nil || endpoint.Hostname() == "" {
+		return false
+	}
+	if port := endpoint.Port(); port != "" && port != "443" {
+		return false
+	}
+	host := strings.ToLower(endpoint.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") || strings.HasSuffix(host, ".internal") || strings.HasSuffix(host, ".local") {
+		return false
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return publicPushAddress(addr)
+	}
+	return strings.Contains(host, ".")
+}
+
+// publicPushAddress rejects loopback, private, link-local (cloud metadata),
+// CGNAT, multicast and unspecified addresses.
+func publicPushAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return false
+	}
+	return !netip.MustParsePrefix("100.64.0.0/10").Contains(addr) && !netip.MustParsePrefix("0.0.0.0/8").Contains(addr)
+}
+
+var errPushAddressBlocked = errors.New("push endpoint resolves to a non-public address")
+
+// newPushHTTPClient only connects to public addresses on port 443 and does
+// not follow redirects, so a subscription cannot point the backend at an
+// internal service.
+func newPushHTTPClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if addrPort.Port() != 443 || !publicPushAddress(addrPort.Addr()) {
+				return fmt.Errorf("%w: %s", errPushAddressBlocked, address)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   15 * time.Second,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
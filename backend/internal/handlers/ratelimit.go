@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter allows up to limit events per key within a sliding window. It
+// lives in process memory, which is enough for a single backend replica.
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	hits   map[string][]time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, hits: make(map[string][]time.Time)}
+}
+
+// Allow records an event for key and reports whether it is within the limit.
+func (l *rateLimiter) Allow(key string) bool {
+	now := time.Now()
+	cutoff := now.Add(-l.window)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.hits) > 10000 {
+		for otherKey, hits := range l.hits {
+			if len(hits) == 0 || hits[len(hits)-1].Before(cutoff) {
+				delete(l.hits, otherKey)
+			}
+		}
+	}
+	hits := l.hits[key]
+	kept := hits[:0]
+	for _, hit := range hits {
+		if hit.After(cutoff) {
+			kept = append(kept, hit)
+		}
+	}
+	if len(kept) >= l.limit {
+		l.hits[key] = kept
+		return false
+	}
+	l.hits[key] = append(kept, now)
+	return true
+}
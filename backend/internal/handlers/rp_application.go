@@ -1,7 +1,6 @@
 package handlers
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
 	"database/sql"
@@ -19,7 +18,7 @@ import (
 	"strings"
 	"time"
 
-	"amy/minecraft-server/internal/observability"
+	"amy/minecraft-server/internal/discord"
 )
 
 type rpApplicationDoc struct {
@@ -40,6 +39,8 @@ type rpApplicationDoc struct {
 	Status           string
 	ModerationToken  string
 	DiscordMessageID string
+	DiscordSync      string
+	ModerationReason string
 	ModeratedAt      *time.Time
 	CreatedAt        time.Time
 	UpdatedAt        time.Time
@@ -145,7 +146,14 @@ func (h *DiscordAuthHandler) SubmitRPApplication(w http.ResponseWriter, r *http.
 		UpdatedAt:       now,
 	}
 
-	_, err = h.db.ExecContext(
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to create rp application")
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(
 		ctx,
 		`INSERT INTO rp_applications
 		 (id, discord_id, nickname, source, rp_name, birth_date, race, gender, height_cm,
@@ -174,26 +182,25 @@ func (h *DiscordAuthHandler) SubmitRPApplication(w http.ResponseWriter, r *http.
 		writeError(w, http.StatusInternalServerError, "failed to create rp application")
 		return
 	}
-
-	_, _ = h.db.ExecContext(ctx, `UPDATE discord_users SET acceptance_status = 'pending', updated_at = $1 WHERE discord_id = $2`, now, user.DiscordID)
-
-	if h.rpWebhookURL != "" {
-		messageID, webhookErr := h.sendRPApplicationWebhook(doc, user)
-		if webhookErr != nil {
-			_, _ = h.db.ExecContext(ctx, `DELETE FROM rp_applications WHERE id = $1`, doc.ID)
-			writeError(w, http.StatusBadGateway, "failed to send rp ticket to discord")
-			return
-		}
-
-		if messageID != "" {
-			doc.DiscordMessageID = messageID
-			_, _ = h.db.ExecContext(ctx, `UPDATE rp_applications SET discord_message_id = $1, updated_at = $2 WHERE id = $3`, messageID, time.Now().UTC(), doc.ID)
-		}
+	if _, err := tx.ExecContext(ctx, `UPDATE discord_users SET acceptance_status = 'pending', updated_at = $1 WHERE discord_id = $2`, now, user.DiscordID); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to create rp application")
+		return
+	}
+	// The Discord ticket is posted by the outbox worker, so a Discord outage
+	// delays it instead of losing the application.
+	if err := h.outbox.enqueue(ctx, tx, discordEntityRPApplication, doc.ID, discordActionPost, ""); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to create rp application")
+		return
+	}
+	if err := h.outbox.commit(tx); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to create rp application")
+		return
 	}
 
 	writeJSON(w, http.StatusCreated, map[string]any{
 		"status":        "ok",
 		"applicationId": doc.ID,
+		"discordSync":   discordSyncPending,
 	})
 }
 
@@ -254,52 +261,89 @@ func (h *DiscordAuthHandler) ModerateRPApplication(w http.ResponseWriter, r *htt
 		return
 	}
 
-	currentStatus := normalizedStatus(current.Status)
-	nextStatus, allowed := nextStatusByAction(currentStatus, action)
-	if !allowed {
+	applied, err := h.moderateRPApplication(ctx, current, action, "")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to moderate application")
+		return
+	}
+	if !applied {
 		h.writeModerationHTML(w, *current, "already-processed")
 		return
 	}
 
+	h.writeModerationHTML(w, *current, action)
+}
+
+// moderateRPApplication applies a moderation action with an optional reason
+// for the applicant, queues the Discord message update and notifies the
+// applicant. It returns false when the action does not fit the current
+// status, for example a second click on an already accepted application.
+func (h *DiscordAuthHandler) moderateRPApplication(ctx context.Context, current *rpApplicationDoc, action, reason string) (bool, error) {
+	nextStatus, allowed := nextStatusByAction(normalizedStatus(current.Status), action)
+	if !allowed {
+		return false, nil
+	}
+
 	now := time.Now().UTC()
 	newToken := current.ModerationToken
 	var moderatedAt any = now
 	if nextStatus == "pending" {
 		newToken = randomHex(20)
 		moderatedAt = nil
-		current.ModeratedAt = nil
-	} else {
-		current.ModeratedAt = &now
+		reason = ""
+	}
+	reason = strings.TrimSpace(reason)
+
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
 	}
+	defer tx.Rollback()
 
-	_, err = h.db.ExecContext(
+	// The status check keeps two moderators clicking at once from both
+	// applying their action.
+	result, err := tx.ExecContext(
 		ctx,
 		`UPDATE rp_applications
-		 SET status = $1, moderation_token = $2, moderated_at = $3, updated_at = $4
-		 WHERE id = $5`,
+		 SET status = $1, moderation_token = $2, moderated_at = $3, moderation_reason = $4, updated_at = $5
+		 WHERE id = $6 AND status = $7`,
 		nextStatus,
 		newToken,
 		moderatedAt,
+		reason,
 		now,
-		applicationID,
+		current.ID,
+		current.Status,
 	)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to moderate application")
-		return
+		return false, err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE discord_users SET acceptance_status = $1, updated_at = $2 WHERE discord_id = $3`, nextStatus, now, current.DiscordID); err != nil {
+		return false, err
+	}
+	if err := h.outbox.enqueue(ctx, tx, discordEntityRPApplication, current.ID, discordActionUpdate, ""); err != nil {
+		return false, err
+	}
+	if err := h.outbox.commit(tx); err != nil {
+		return false, err
 	}
-
-	_, _ = h.db.ExecContext(ctx, `UPDATE discord_users SET acceptance_status = $1, updated_at = $2 WHERE discord_id = $3`, nextStatus, now, current.DiscordID)
 
 	current.Status = nextStatus
 	current.UpdatedAt = now
 	current.ModerationToken = newToken
-
-	if updateErr := h.updateRPApplicationDiscordMessage(*current); updateErr != nil {
-		writeError(w, http.StatusBadGateway, "failed to update discord ticket")
-		return
+	current.ModerationReason = reason
+	current.DiscordSync = discordSyncPending
+	if nextStatus == "pending" {
+		current.ModeratedAt = nil
+	} else {
+		current.ModeratedAt = &now
 	}
 
-	h.writeModerationHTML(w, *current, action)
+	h.notifyRPApplicationStatus(ctx, *current)
+	return true, nil
 }
 
 func (h *DiscordAuthHandler) DeleteRPApplication(w http.ResponseWriter, r *http.Request) {
@@ -338,18 +382,34 @@ func (h *DiscordAuthHandler) DeleteRPApplication(w http.ResponseWriter, r *http.
 		return
 	}
 
-	if err := h.deleteRPApplicationDiscordMessage(application.DiscordMessageID); err != nil {
-		writeError(w, http.StatusBadGateway, "failed to delete ticket message in discord")
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to delete application")
 		return
 	}
+	defer tx.Rollback()
 
-	_, err = h.db.ExecContext(ctx, `DELETE FROM rp_applications WHERE id = $1 AND discord_id = $2`, applicationID, user.DiscordID)
+	_, err = tx.ExecContext(ctx, `DELETE FROM rp_applications WHERE id = $1 AND discord_id = $2`, applicationID, user.DiscordID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to delete application")
 		return
 	}
-
-	_, _ = h.db.ExecContext(ctx, `UPDATE discord_users SET acceptance_status = 'pending', updated_at = $1 WHERE discord_id = $2 AND acceptance_status <> 'accepted'`, time.Now().UTC(), user.DiscordID)
+	if _, err := tx.ExecContext(ctx, `UPDATE discord_users SET acceptance_status = 'pending', updated_at = $1 WHERE discord_id = $2 AND acceptance_status <> 'accepted'`, time.Now().UTC(), user.DiscordID); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to delete application")
+		return
+	}
+	// A ticket that is still being posted has no message id yet; the post
+	// removes its own message when it finds the application gone.
+	if application.DiscordMessageID != "" {
+		if err := h.outbox.enqueue(ctx, tx, discordEntityRPApplication, applicationID, discordActionDelete, application.DiscordMessageID); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to delete application")
+			return
+		}
+	}
+	if err := h.outbox.commit(tx); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to delete application")
+		return
+	}
 
 	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
@@ -565,19 +625,21 @@ func (h *DiscordAuthHandler) latestApplicationSummary(ctx context.Context, disco
 	}
 
 	return &rpApplicationSummaryOut{
-		ID:           doc.ID,
-		Status:       doc.Status,
-		Nickname:     doc.Nickname,
-		RPName:       doc.RPName,
-		Race:         doc.Race,
-		Gender:       doc.Gender,
-		HeightCm:     doc.HeightCm,
-		BirthDate:    doc.BirthDate,
-		PrisonReason: doc.PrisonReason,
-		SkinURL:      proxiedMediaURL(doc.SkinURL),
-		CreatedAt:    &doc.CreatedAt,
-		UpdatedAt:    &doc.UpdatedAt,
-		ModeratedAt:  doc.ModeratedAt,
+		ID:               doc.ID,
+		Status:           doc.Status,
+		Nickname:         doc.Nickname,
+		RPName:           doc.RPName,
+		Race:             doc.Race,
+		Gender:           doc.Gender,
+		HeightCm:         doc.HeightCm,
+		BirthDate:        doc.BirthDate,
+		PrisonReason:     doc.PrisonReason,
+		SkinURL:          proxiedMediaURL(doc.SkinURL),
+		CreatedAt:        &doc.CreatedAt,
+		UpdatedAt:        &doc.UpdatedAt,
+		ModeratedAt:      doc.ModeratedAt,
+		ModerationReason: doc.ModerationReason,
+		DiscordSync:      doc.DiscordSync,
 	}, nil
 }
 
@@ -591,7 +653,7 @@ func (h *DiscordAuthHandler) loadLatestApplicationForDiscord(ctx context.Context
 
 const rpApplicationSelectSQL = `SELECT id, discord_id, nickname, source, rp_name, birth_date, race, gender, height_cm,
        skills, plan, biography, prison_reason, skin_url, status, moderation_token,
-       discord_message_id, moderated_at, created_at, updated_at
+       discord_message_id, discord_sync_status, moderation_reason, moderated_at, created_at, updated_at
 FROM rp_applications`
 
 func scanRPApplication(scanner sqlScanner) (*rpApplicationDoc, error) {
@@ -615,6 +677,8 @@ func scanRPApplication(scanner sqlScanner) (*rpApplicationDoc, error) {
 		&app.Status,
 		&app.ModerationToken,
 		&app.DiscordMessageID,
+		&app.DiscordSync,
+		&app.ModerationReason,
 		&moderatedAt,
 		&app.CreatedAt,
 		&app.UpdatedAt,
@@ -628,48 +692,49 @@ func scanRPApplication(scanner sqlScanner) (*rpApplicationDoc, error) {
 	return &app, nil
 }
 
-func (h *DiscordAuthHandler) sendRPApplicationWebhook(doc rpApplicationDoc, user *discordUserDoc) (string, error) {
-	if h.rpWebhookURL == "" {
-		return "", nil
+// syncRPApplicationDiscord performs an outbox row for an RP application.
+func (h *DiscordAuthHandler) syncRPApplicationDiscord(ctx context.Context, item discordOutboxItem) error {
+	if item.Action == discordActionDelete {
+		return h.deleteRPApplicationDiscordMessage(item.Ref)
 	}
-
-	payload := h.buildRPApplicationDiscordPayload(doc, user)
-	raw, err := json.Marshal(payload)
-	if err != nil {
-		return "", err
+	app, err := h.loadApplicationByID(ctx, item.EntityID)
+	if err == sql.ErrNoRows {
+		return nil
 	}
-
-	requestURL, err := webhookURLWithWait(h.rpWebhookURL)
 	if err != nil {
-		return "", err
+		return err
 	}
-
-	req, err := http.NewRequest(http.MethodPost, requestURL, bytes.NewReader(raw))
-	if err != nil {
-		return "", err
+	if item.Action == discordActionUpdate || app.DiscordMessageID != "" {
+		return h.updateRPApplicationDiscordMessage(*app)
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	startedAt := time.Now()
-	resp, err := http.DefaultClient.Do(req)
+	owner, _ := h.loadDiscordUser(ctx, app.DiscordID)
+	messageID, err := h.sendRPApplicationWebhook(*app, owner)
+	if err != nil || messageID == "" {
+		return err
+	}
+	result, err := h.db.ExecContext(ctx, `UPDATE rp_applications SET discord_message_id = $1 WHERE id = $2`, messageID, app.ID)
 	if err != nil {
-		observability.ObserveDiscordOutbound("rp_application", startedAt, 0, err)
-		return "", err
+		return err
 	}
-	defer resp.Body.Close()
-	observability.ObserveDiscordOutbound("rp_application", startedAt, resp.StatusCode, nil)
-
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		bodyRaw, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		return "", fmt.Errorf("discord webhook error: status=%d body=%s", resp.StatusCode, strings.TrimSpace(string(bodyRaw)))
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		// Deleted while the ticket was being posted.
+		return h.deleteRPApplicationDiscordMessage(messageID)
 	}
+	return nil
+}
 
-	var message discordWebhookMessage
-	if err := json.NewDecoder(resp.Body).Decode(&message); err != nil {
+func (h *DiscordAuthHandler) sendRPApplicationWebhook(doc rpApplicationDoc, user *discordUserDoc) (string, error) {
+	if h.rpWebhookURL == "" {
 		return "", nil
 	}
-
-	return strings.TrimSpace(message.ID), nil
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	message, err := h.discord.ExecuteWebhook(ctx, "rp_application", h.rpWebhookURL, h.buildRPApplicationDiscordPayload(doc, user), nil)
+	if err != nil {
+		return "", err
+	}
+	return message.ID, nil
 }
 
 func (h *DiscordAuthHandler) deleteRPApplicationDiscordMessage(messageID string) error {
@@ -677,54 +742,14 @@ func (h *DiscordAuthHandler) deleteRPApplicationDiscordMessage(messageID string)
 	if h.rpWebhookURL == "" || messageID == "" {
 		return nil
 	}
-
-	parsed, err := url.Parse(h.rpWebhookURL)
-	if err != nil {
-		return err
-	}
-	parsed.RawQuery = ""
-
-	base := strings.TrimRight(parsed.String(), "/")
-	deleteURL := base + "/messages/" + url.PathEscape(messageID)
-
-	req, err := http.NewRequest(http.MethodDelete, deleteURL, nil)
-	if err != nil {
-		return err
-	}
-
-	startedAt := time.Now()
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		observability.ObserveDiscordOutbound("rp_application_delete", startedAt, 0, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := h.discord.DeleteWebhookMessage(ctx, "rp_application_delete", h.rpWebhookURL, messageID); err != nil && !discord.IsNotFound(err) {
 		return err
 	}
-	defer resp.Body.Close()
-	observability.ObserveDiscordOutbound("rp_application_delete", startedAt, resp.StatusCode, nil)
-
-	if resp.StatusCode == http.StatusNotFound {
-		return nil
-	}
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		bodyRaw, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		return fmt.Errorf("discord webhook delete error: status=%d body=%s", resp.StatusCode, strings.TrimSpace(string(bodyRaw)))
-	}
-
 	return nil
 }
 
-func webhookURLWithWait(raw string) (string, error) {
-	parsed, err := url.Parse(raw)
-	if err != nil {
-		return "", err
-	}
-
-	query := parsed.Query()
-	query.Set("wait", "true")
-	query.Set("with_components", "true")
-	parsed.RawQuery = query.Encode()
-	return parsed.String(), nil
-}
-
 func (h *DiscordAuthHandler) moderationURL(applicationID, action, token string) string {
 	base := strings.TrimRight(h.frontendURL, "/")
 	if base == "" {
@@ -770,6 +795,38 @@ func normalizeModerationAction(raw string) string {
 	}
 }
 
+// notifyRPApplicationStatus tells the applicant that their application was
+// accepted or declined, or that they are called for an interview.
+func (h *DiscordAuthHandler) notifyRPApplicationStatus(ctx context.Context, app rpApplicationDoc) {
+	notification := Notification{
+		Kind: NotificationRPApplication,
+		URL:  "/profile",
+		Tag:  "rp-application-" + app.ID,
+	}
+	switch normalizedStatus(app.Status) {
+	case "accepted":
+		notification.Title = "RP-анкета принята"
+		notification.Body = fmt.Sprintf("Анкета персонажа %s принята. Добро пожаловать на Amy World!", safeValue(app.RPName))
+	case "call":
+		notification.Title = "Вас вызывают на собеседование"
+		notification.Body = fmt.Sprintf("По анкете персонажа %s назначено собеседование. Загляните в Discord.", safeValue(app.RPName))
+	case "canceled":
+		// Only declines with a reason are worth a notification; without one
+		// the applicant learns nothing new from it.
+		if app.ModerationReason == "" {
+			return
+		}
+		notification.Title = "RP-анкета отклонена"
+		notification.Body = fmt.Sprintf("Анкета персонажа %s отклонена.", safeValue(app.RPName))
+	default:
+		return
+	}
+	if app.ModerationReason != "" {
+		notification.Body += " Комментарий модератора: " + app.ModerationReason
+	}
+	h.notifier.Notify(ctx, app.DiscordID, notification)
+}
+
 func nextStatusByAction(currentStatus, action string) (string, bool) {
 	switch action {
 	case "accept":
@@ -830,6 +887,9 @@ func (h *DiscordAuthHandler) buildRPApplicationDiscordPayload(doc rpApplicationD
 		{"name": "Ссылка на скин", "value": safeValue(h.publicSkinURL(doc.SkinURL))},
 	}
 
+	if doc.ModerationReason != "" {
+		fields = append(fields, map[string]string{"name": "Комментарий модератора", "value": trimForDiscord(doc.ModerationReason)})
+	}
 	if links := h.rpModerationLinks(doc); links != "" {
 		fields = append(fields, map[string]string{"name": "Модерация", "value": links})
 	}
@@ -883,6 +943,9 @@ func (h *DiscordAuthHandler) rpModerationLinks(doc rpApplicationDoc) string {
 func (h *DiscordAuthHandler) rpDiscordComponents(doc rpApplicationDoc) []any {
 	status := normalizedStatus(doc.Status)
 	button := func(label, action string) map[string]any {
+		if h.interactions {
+			return map[string]any{"type": 2, "style": discordButtonStyle(action), "label": label, "custom_id": discordCustomID("rp", action, doc.ID)}
+		}
 		return map[string]any{"type": 2, "style": 5, "label": label, "url": h.moderationURL(doc.ID, action, doc.ModerationToken)}
 	}
 
@@ -911,58 +974,17 @@ func (h *DiscordAuthHandler) updateRPApplicationDiscordMessage(app rpApplication
 		return nil
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 6*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
 	owner, _ := h.loadDiscordUser(ctx, app.DiscordID)
 	payload := h.buildRPApplicationDiscordPayload(app, owner)
-
-	raw, err := json.Marshal(payload)
-	if err != nil {
-		return err
-	}
-
-	base, err := webhookBaseURL(h.rpWebhookURL)
-	if err != nil {
-		return err
-	}
-
-	editURL := base + "/messages/" + url.PathEscape(app.DiscordMessageID) + "?with_components=true"
-	req, err := http.NewRequest(http.MethodPatch, editURL, bytes.NewReader(raw))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	startedAt := time.Now()
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		observability.ObserveDiscordOutbound("rp_moderation_update", startedAt, 0, err)
+	if err := h.discord.EditWebhookMessage(ctx, "rp_moderation_update", h.rpWebhookURL, app.DiscordMessageID, payload); err != nil && !discord.IsNotFound(err) {
 		return err
 	}
-	defer resp.Body.Close()
-	observability.ObserveDiscordOutbound("rp_moderation_update", startedAt, resp.StatusCode, nil)
-
-	if resp.StatusCode == http.StatusNotFound {
-		return nil
-	}
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		bodyRaw, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		return fmt.Errorf("discord webhook edit error: status=%d body=%s", resp.StatusCode, strings.TrimSpace(string(bodyRaw)))
-	}
-
 	return nil
 }
 
-func webhookBaseURL(raw string) (string, error) {
-	parsed, err := url.Parse(raw)
-	if err != nil {
-		return "", err
-	}
-	parsed.RawQuery = ""
-	return strings.TrimRight(parsed.String(), "/"), nil
-}
-
 func parseApplicationModerationIDFromPath(path string) (string, bool) {
 	trimmed := strings.Trim(path, "/")
 	parts := strings.Split(trimmed, "/")
@@ -1180,7 +1202,7 @@ func (h *DiscordAuthHandler) syncRPDiscordMessages(ctx context.Context) error {
 		if err != nil {
 			return err
 		}
-		if err := h.updateRPApplicationDiscordMessage(*app); err != nil {
+		if err := h.outbox.enqueue(ctx, h.db, discordEntityRPApplication, app.ID, discordActionUpdate, ""); err != nil {
 			return err
 		}
 	}
@@ -16,7 +16,8 @@ import (
 )
 
 type ServerStatusHandler struct {
-	address string
+	address  string
+	notifier *Notifier
 }
 
 type serverStatusResponse struct {
@@ -49,12 +50,54 @@ type minecraftStatusPayload struct {
 	} `json:"players"`
 }
 
-func NewServerStatusHandler(address string) *ServerStatusHandler {
+func NewServerStatusHandler(address string, notifier *Notifier) *ServerStatusHandler {
 	address = strings.TrimSpace(address)
 	if address == "" {
 		address = "amyworld.ru"
 	}
-	return &ServerStatusHandler{address: address}
+	return &ServerStatusHandler{address: address, notifier: notifier}
+}
+
+// serverOfflineChecks is how many failed pings in a row count as downtime, so
+// a single lost packet does not announce a restart.
+const serverOfflineChecks = 3
+
+// StartMonitor pings the server every minute and notifies subscribed players
+// when it comes back after being down.
+func (h *ServerStatusHandler) StartMonitor(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		failures := 0
+		for {
+			checkCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			status, err := queryMinecraftStatus(checkCtx, h.address)
+			cancel()
+			switch {
+			case err != nil || !status.Online:
+				failures++
+			case failures >= serverOfflineChecks:
+				failures = 0
+				notifyCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+				h.notifier.Broadcast(notifyCtx, Notification{
+					Kind:  NotificationServerOnline,
+					Title: "Сервер снова онлайн",
+					Body:  fmt.Sprintf("%s снова доступен, можно заходить.", displayMinecraftAddress(h.address)),
+					URL:   "/",
+					Tag:   "server-online",
+				})
+				cancel()
+			default:
+				failures = 0
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
 }
 
 func (h *ServerStatusHandler) Handle(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookieName = "discord_id"
+	sessionLifetime   = 30 * 24 * time.Hour
+)
+
+var (
+	sessionKeyMu sync.RWMutex
+	sessionKey   []byte
+)
+
+// SetSessionSecret sets the HMAC key session cookies are signed with. Without
+// one a random key is used, so sessions end when the backend restarts.
+func SetSessionSecret(secret string) {
+	sessionKeyMu.Lock()
+	defer sessionKeyMu.Unlock()
+	sessionKey = []byte(strings.TrimSpace(secret))
+	if len(sessionKey) == 0 {
+		sessionKey = randomSessionKey()
+		log.Printf("SESSION_SECRET is not set; sessions will not survive a restart")
+	}
+}
+
+func currentSessionKey() []byte {
+	sessionKeyMu.RLock()
+	key := sessionKey
+	sessionKeyMu.RUnlock()
+	if key != nil {
+		return key
+	}
+	sessionKeyMu.Lock()
+	defer sessionKeyMu.Unlock()
+	if sessionKey == nil {
+		sessionKey = randomSessionKey()
+	}
+	return sessionKey
+}
+
+func randomSessionKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("failed to generate session key: %v", err)
+	}
+	return key
+}
+
+// signSession returns "<discordId>.<expiresUnix>.<signature>".
+func signSession(discordID string, expiresAt time.Time) string {
+	payload := discordID + "." + strconv.FormatInt(expiresAt.Unix(), 10)
+	return payload + "." + sessionSignature(payload)
+}
+
+func sessionSignature(payload string) string {
+	mac := hmac.New(sha256.New, currentSessionKey())
+	mac.Write([]byte("session:" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifySession returns the Discord ID of a session cookie value, or "" when
+// the signature does not match or the session expired.
+func verifySession(value string, now time.Time) string {
+	parts := strings.Split(strings.TrimSpace(value), ".")
+	if len(parts) != 3 || parts[0] == "" {
+		return ""
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(sessionSignature(payload))) {
+		return ""
+	}
+	expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || now.Unix() >= expiresAt {
+		return ""
+	}
+	return parts[0]
+}
+
+// currentDiscordIDFromCookie returns the signed-in user of the request, or ""
+// when the session cookie is missing, forged or expired.
+func currentDiscordIDFromCookie(r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return ""
+	}
+	return verifySession(cookie.Value, time.Now())
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifySession(t *testing.T) {
+	SetSessionSecret("test-session-secret")
+	now := time.Now()
+	value := signSession("123456789", now.Add(time.Hour))
+	if got := verifySession(value, now); got != "123456789" {
+		t.Fatalf("got %q for a valid session", got)
+	}
+
+	parts := strings.Split(value, ".")
+	forged := map[string]string{
+		"bare discord id":    "123456789",
+		"other discord id":   "987654321." + parts[1] + "." + parts[2],
+		"extended expiry":    parts[0] + "." + "99999999999" + "." + parts[2],
+		"empty signature":    parts[0] + "." + parts[1] + ".",
+		"expired":            signSession("123456789", now.Add(-time.Second)),
+		"missing discord id": "." + parts[1] + "." + sessionSignature("."+parts[1]),
+	}
+	for name, cookie := range forged {
+		if got := verifySession(cookie, now); got != "" {
+			t.Errorf("%s: accepted as %q", name, got)
+		}
+	}
+
+	SetSessionSecret("rotated-secret")
+	if got := verifySession(value, now); got != "" {
+		t.Errorf("a session signed with the old secret was accepted as %q", got)
+	}
+}
+
+func TestCurrentDiscordIDFromCookie(t *testing.T) {
+	SetSessionSecret("test-session-secret")
+	recorder := httptest.NewRecorder()
+	setSessionCookie(recorder, httptest.NewRequest(http.MethodGet, "/", nil), "", "123456789")
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly {
+		t.Fatalf("unexpected session cookies %+v", cookies)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/api/support/staff/queue", nil)
+	request.AddCookie(cookies[0])
+	if got := currentDiscordIDFromCookie(request); got != "123456789" {
+		t.Fatalf("got %q from the issued cookie", got)
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "/api/support/staff/queue", nil)
+	request.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "123456789"})
+	if got := currentDiscordIDFromCookie(request); got != "" {
+		t.Fatalf("an unsigned cookie was accepted as %q", got)
+	}
+}
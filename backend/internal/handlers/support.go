@@ -1,15 +1,14 @@
 package handlers
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"html"
 	"io"
+	"log"
 	"mime"
-	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
@@ -17,21 +16,35 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"amy/minecraft-server/internal/discord"
 	"amy/minecraft-server/internal/models"
 	"amy/minecraft-server/internal/observability"
-	webpush "github.com/SherClockHolmes/webpush-go"
 )
 
 type SupportHandler struct {
 	db              *sql.DB
 	webhookURL      string
 	frontendURL     string
-	vapidPublicKey  string
-	vapidPrivateKey string
-	pushSubject     string
+	notifier        *Notifier
 	storageDir      string
+	staffIDs        map[string]struct{}
+	discord         *discord.Client
+	ticketChannelID string
+	mailer          *SupportMailer
+	outbox          *DiscordOutbox
+	events          supportEventBus
+	captcha         supportCaptcha
+	scanner         AttachmentScanner
+	interactions    bool
+
+	ticketIPLimiter   *rateLimiter
+	ticketUserLimiter *rateLimiter
+
+	threadMu          sync.Mutex
+	ticketChannelKind *int
 }
 
 type ticketRequest struct {
@@ -41,22 +54,34 @@ type ticketRequest struct {
 	Subject     string `json:"subject"`
 	Category    string `json:"category"`
 	Message     string `json:"message"`
+	// CaptchaToken is only checked for tickets sent without a session.
+	CaptchaToken string `json:"captchaToken"`
 }
 
-func NewSupportHandler(db *sql.DB, webhookURL, frontendURL, vapidPublicKey, vapidPrivateKey, pushSubject, storageDir string) *SupportHandler {
+func NewSupportHandler(db *sql.DB, notifier *Notifier, outbox *DiscordOutbox, discordClient *discord.Client, webhookURL, frontendURL, storageDir, staffIDsRaw, ticketChannelID, captchaSecret, captchaVerifyURL string, mailer *SupportMailer) *SupportHandler {
 	storageDir = strings.TrimSpace(storageDir)
 	if storageDir == "" {
 		storageDir = "data/support"
 	}
-	return &SupportHandler{
+	h := &SupportHandler{
 		db:              db,
 		webhookURL:      webhookURL,
 		frontendURL:     frontendURL,
-		vapidPublicKey:  strings.TrimSpace(vapidPublicKey),
-		vapidPrivateKey: strings.TrimSpace(vapidPrivateKey),
-		pushSubject:     strings.TrimSpace(pushSubject),
+		notifier:        notifier,
 		storageDir:      storageDir,
-	}
+		staffIDs:        parseDiscordIDSet(staffIDsRaw),
+		discord:         discordClient,
+		ticketChannelID: strings.TrimSpace(ticketChannelID),
+		mailer:          mailer,
+		outbox:          outbox,
+		events:          newSupportHub(),
+		captcha:         newSupportCaptcha(captchaSecret, captchaVerifyURL),
+
+		ticketIPLimiter:   newRateLimiter(supportTicketsPerIPHour, time.Hour),
+		ticketUserLimiter: newRateLimiter(supportTicketsPerUserHour, time.Hour),
+	}
+	outbox.register(discordEntitySupportTicket, h.syncTicketDiscord)
+	return h
 }
 
 func (h *SupportHandler) Create(w http.ResponseWriter, r *http.Request) {
@@ -87,18 +112,38 @@ func (h *SupportHandler) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
 	defer cancel()
 
-	ownerDiscordID := currentDiscordIDFromCookie(r)
+	clientIP := observability.ProxyClientIP(r)
+	if !h.ticketIPLimiter.Allow(clientIP) {
+		observability.SupportTicketsRejected.WithLabelValues("ip_limit").Inc()
+		writeError(w, http.StatusTooManyRequests, "too many tickets, try again later")
+		return
+	}
+	ownerDiscordID := h.sessionDiscordID(ctx, r)
+	anonymous := ownerDiscordID == ""
+	if anonymous {
+		if err := h.captcha.Verify(ctx, payload.CaptchaToken, clientIP); err != nil {
+			observability.SupportTicketsRejected.WithLabelValues("captcha").Inc()
+			writeError(w, http.StatusBadRequest, "captcha verification failed")
+			return
+		}
+	}
+
 	discordID, displayName, err := h.resolveDiscordNick(ctx, payload.DiscordNick, ownerDiscordID)
 	if err != nil {
 		writeError(w, http.StatusBadRequest, "discord nick is not found on server")
 		return
 	}
-	if ownerDiscordID == "" {
+	if anonymous {
 		ownerDiscordID = discordID
 	}
+	if !h.ticketUserLimiter.Allow(ownerDiscordID) {
+		observability.SupportTicketsRejected.WithLabelValues("user_limit").Inc()
+		writeError(w, http.StatusTooManyRequests, "too many tickets, try again later")
+		return
+	}
 	if payload.Name == "" {
 		payload.Name = displayName
 	}
@@ -113,11 +158,46 @@ func (h *SupportHandler) Create(w http.ResponseWriter, r *http.Request) {
 		Category:        payload.Category,
 		Message:         payload.Message,
 		Status:          "open",
+		Priority:        "normal",
 		ModerationToken: randomHex(20),
 		CreatedAt:       time.Now().UTC(),
 	}
+	if duplicateID, err := h.findDuplicateTicket(ctx, ticket); err == nil && duplicateID > 0 {
+		observability.SupportTicketsRejected.WithLabelValues("duplicate").Inc()
+		writeJSON(w, http.StatusConflict, map[string]any{"error": "duplicate ticket", "ticketId": duplicateID})
+		return
+	}
+
+	// Without a session anyone could type another member's nick, so the
+	// member confirms the ticket through a Discord DM first.
+	if anonymous {
+		if err := h.requestTicketVerification(ctx, ticket, clientIP); err != nil {
+			log.Printf("support ticket verification for %s failed: %v", ownerDiscordID, err)
+			writeError(w, http.StatusUnauthorized, "sign in with discord to create a ticket")
+			return
+		}
+		observability.SupportTicketVerifications.WithLabelValues("requested").Inc()
+		writeJSON(w, http.StatusAccepted, map[string]any{"status": "verification_required"})
+		return
+	}
 
-	err = h.db.QueryRowContext(
+	if err := h.createTicket(ctx, &ticket); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to create ticket")
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{"status": "ok", "ticket": ticket})
+}
+
+// createTicket stores a new ticket with its first message and posts it to
+// Discord.
+func (h *SupportHandler) createTicket(ctx context.Context, ticket *models.Ticket) error {
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(
 		ctx,
 		`INSERT INTO support_tickets (name, email, discord_nick, owner_discord_id, subject, category, message, status, moderation_token, created_at)
          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
@@ -134,11 +214,9 @@ func (h *SupportHandler) Create(w http.ResponseWriter, r *http.Request) {
 		ticket.CreatedAt,
 	).Scan(&ticket.ID)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to create ticket")
-		return
+		return err
 	}
-
-	_, _ = h.db.ExecContext(
+	if _, err := tx.ExecContext(
 		ctx,
 		`INSERT INTO support_ticket_messages (ticket_id, author_type, author_name, author_discord_id, message, read_by_user, created_at)
 		 VALUES ($1, 'user', $2, $3, $4, TRUE, $5)`,
@@ -147,15 +225,22 @@ func (h *SupportHandler) Create(w http.ResponseWriter, r *http.Request) {
 		ticket.OwnerDiscordID,
 		ticket.Message,
 		ticket.CreatedAt,
-	)
-	_ = h.writeTicketHistoryHTML(ctx, ticket)
+	); err != nil {
+		return err
+	}
+	if err := h.outbox.enqueue(ctx, tx, discordEntitySupportTicket, strconv.FormatInt(ticket.ID, 10), discordActionPost, ""); err != nil {
+		return err
+	}
+	if err := h.outbox.commit(tx); err != nil {
+		return err
+	}
+	ticket.DiscordSync = discordSyncPending
 
-	if messageID, channelID, err := h.sendDiscordWebhook(ticket); err == nil && messageID != "" {
-		ticket.DiscordMessageID = messageID
-		ticket.DiscordChannelID = channelID
-		_, _ = h.db.ExecContext(ctx, `UPDATE support_tickets SET discord_message_id = $1, discord_channel_id = $2 WHERE id = $3`, messageID, ticket.DiscordChannelID, ticket.ID)
+	if policies, err := loadSupportSLAPolicies(ctx, h.db); err == nil {
+		observability.SupportTicketsCreated.WithLabelValues(supportMetricCategory(policies, ticket.Category)).Inc()
 	}
-	writeJSON(w, http.StatusCreated, map[string]any{"status": "ok", "ticket": ticket})
+	_ = h.writeTicketHistoryHTML(ctx, *ticket)
+	return nil
 }
 
 func (h *SupportHandler) Moderate(w http.ResponseWriter, r *http.Request) {
@@ -164,13 +249,25 @@ func (h *SupportHandler) Moderate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if strings.HasSuffix(strings.TrimRight(r.URL.Path, "/"), "/notifications") {
-		h.Notifications(w, r)
+		h.notifier.Push(w, r)
+		return
+	}
+	if strings.TrimRight(r.URL.Path, "/") == "/api/support/tickets/verify" {
+		h.VerifyTicket(w, r)
 		return
 	}
 	if strings.HasSuffix(strings.TrimRight(r.URL.Path, "/"), "/messages") {
 		h.Messages(w, r)
 		return
 	}
+	if strings.HasSuffix(strings.TrimRight(r.URL.Path, "/"), "/events") {
+		h.Events(w, r)
+		return
+	}
+	if strings.HasSuffix(strings.TrimRight(r.URL.Path, "/"), "/rating") {
+		h.Rating(w, r)
+		return
+	}
 
 	ticketID, ok := parseSupportModerationIDFromPath(r.URL.Path)
 	if !ok {
@@ -194,6 +291,16 @@ func (h *SupportHandler) Moderate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	staffID := currentDiscordIDFromCookie(r)
+	if staffID == "" {
+		http.Redirect(w, r, "/api/auth/discord/start?redirect="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+		return
+	}
+	if !h.isSupportStaff(staffID) {
+		writeError(w, http.StatusForbidden, "support staff access required")
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
 	defer cancel()
 
@@ -229,7 +336,7 @@ func (h *SupportHandler) Moderate(w http.ResponseWriter, r *http.Request) {
 			h.writeTicketReplyHTML(w, ticket, "Ответ слишком длинный, максимум 2000 символов.")
 			return
 		}
-		if err := h.saveAdminTicketReply(ctx, ticket, "Техподдержка", message, ""); err != nil {
+		if _, err := h.saveStaffTicketReply(ctx, ticket, staffID, message, nil, "сайт"); err != nil {
 			writeError(w, http.StatusInternalServerError, "failed to save reply")
 			return
 		}
@@ -249,101 +356,105 @@ func (h *SupportHandler) Moderate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := h.setTicketStatus(ctx, &ticket, ticketStatusForAction(action)); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to update ticket")
+		return
+	}
+
+	h.writeTicketModerationHTML(w, ticket, action)
+}
+
+// ticketStatusForAction maps the resolve, reconsider, archive and unarchive
+// moderation actions to the ticket status they lead to.
+func ticketStatusForAction(action string) string {
+	switch action {
+	case "reconsider":
+		return "open"
+	case "archive":
+		return "archived"
+	default:
+		return "resolved"
+	}
+}
+
+// setTicketStatus moves a ticket to open, resolved or archived and keeps the
+// resolution timestamps consistent with the new status.
+func (h *SupportHandler) setTicketStatus(ctx context.Context, ticket *models.Ticket, nextStatus string) error {
 	now := time.Now().UTC()
-	nextStatus := "resolved"
-	var resolvedAt any = now
-	var archivedAt any = nil
-	if action == "reconsider" {
-		nextStatus = "open"
+	previousStatus := normalizedTicketStatus(ticket.Status)
+	resolvedAt := ticket.ResolvedAt
+	archivedAt := ticket.ArchivedAt
+	switch nextStatus {
+	case "open":
 		resolvedAt = nil
 		archivedAt = nil
-		ticket.ResolvedAt = nil
-		ticket.ArchivedAt = nil
-	} else if action == "archive" {
-		nextStatus = "archived"
-		if ticket.ResolvedAt == nil {
-			ticket.ResolvedAt = &now
+	case "archived":
+		if resolvedAt == nil {
+			resolvedAt = &now
 		}
-		resolvedAt = ticket.ResolvedAt
-		archivedAt = now
-		ticket.ArchivedAt = &now
-	} else if action == "unarchive" {
+		archivedAt = &now
+	default:
 		nextStatus = "resolved"
-		if ticket.ResolvedAt == nil {
-			ticket.ResolvedAt = &now
+		if previousStatus != "archived" || resolvedAt == nil {
+			resolvedAt = &now
 		}
-		resolvedAt = ticket.ResolvedAt
 		archivedAt = nil
-		ticket.ArchivedAt = nil
-	} else {
-		ticket.ResolvedAt = &now
 	}
 
-	_, err = h.db.ExecContext(
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(
 		ctx,
 		`UPDATE support_tickets SET status = $1, resolved_at = $2, archived_at = $3 WHERE id = $4`,
 		nextStatus,
-		resolvedAt,
-		archivedAt,
+		nullableTime(resolvedAt),
+		nullableTime(archivedAt),
 		ticket.ID,
 	)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to update ticket")
-		return
+		return err
+	}
+	if err := h.enqueueTicketUpdate(ctx, tx, ticket.ID); err != nil {
+		return err
+	}
+	if err := h.outbox.commit(tx); err != nil {
+		return err
 	}
+	ticket.DiscordSync = discordSyncPending
 
+	if nextStatus == "resolved" && previousStatus == "open" {
+		observeSupportResolution(ctx, h.db, *ticket, now)
+	}
 	ticket.Status = nextStatus
-	_ = h.writeTicketHistoryHTML(ctx, ticket)
-	if err := h.updateDiscordTicketMessage(ticket); err != nil {
-		writeError(w, http.StatusBadGateway, "failed to update discord ticket")
-		return
+	ticket.ResolvedAt = resolvedAt
+	ticket.ArchivedAt = archivedAt
+	_ = h.writeTicketHistoryHTML(ctx, *ticket)
+	if nextStatus != previousStatus {
+		h.events.Publish(supportEvent{Type: supportEventStatus, TicketID: ticket.ID, Status: nextStatus})
+		h.emailTicketUpdate(ctx, *ticket, supportEmailKindStatus, "", "")
 	}
+	return nil
+}
 
-	h.writeTicketModerationHTML(w, ticket, action)
+func nullableTime(value *time.Time) any {
+	if value == nil {
+		return nil
+	}
+	return *value
 }
 
-func (h *SupportHandler) sendDiscordWebhook(ticket models.Ticket) (string, string, error) {
+func (h *SupportHandler) sendDiscordWebhook(ctx context.Context, ticket models.Ticket) (string, string, error) {
 	if h.webhookURL == "" {
 		return "", "", nil
 	}
-
-	body := h.buildDiscordTicketPayload(ticket)
-	raw, err := json.Marshal(body)
+	message, err := h.discord.ExecuteWebhook(ctx, "support_ticket", h.webhookURL, h.buildDiscordTicketPayload(ticket), nil)
 	if err != nil {
 		return "", "", err
 	}
-
-	requestURL, err := webhookURLWithWait(h.webhookURL)
-	if err != nil {
-		return "", "", err
-	}
-
-	req, err := http.NewRequest(http.MethodPost, requestURL, bytes.NewReader(raw))
-	if err != nil {
-		return "", "", err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	startedAt := time.Now()
-	resp, err := http.DefaultClient.Do(req)
-	statusCode := 0
-	if resp != nil {
-		statusCode = resp.StatusCode
-		defer resp.Body.Close()
-	}
-	observability.ObserveDiscordOutbound("support_ticket", startedAt, statusCode, err)
-	if err != nil {
-		return "", "", err
-	}
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		bodyRaw, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		return "", "", fmt.Errorf("discord webhook error: status=%d body=%s", resp.StatusCode, strings.TrimSpace(string(bodyRaw)))
-	}
-
-	var message discordWebhookMessage
-	if err := json.NewDecoder(resp.Body).Decode(&message); err != nil {
-		return "", "", nil
-	}
-	return strings.TrimSpace(message.ID), strings.TrimSpace(message.ChannelID), nil
+	return message.ID, message.ChannelID, nil
 }
 
 func (h *SupportHandler) buildDiscordTicketPayload(ticket models.Ticket) map[string]any {
@@ -355,14 +466,21 @@ func (h *SupportHandler) buildDiscordTicketPayload(ticket models.Ticket) map[str
 		statusText = "Архив"
 	}
 
+	fields := []map[string]string{
+		{"name": "Discord", "value": safeValue(ticket.DiscordNick)},
+		{"name": "Category", "value": safeValue(ticket.Category)},
+		{"name": "Priority", "value": normalizedTicketPriority(ticket.Priority)},
+		{"name": "Assignee", "value": safeValue(ticket.AssigneeName)},
+		{"name": "Seen", "value": ticketSeenText(ticket)},
+	}
+	if ticket.Rating != nil {
+		fields = append(fields, map[string]string{"name": "Rating", "value": ticketRatingText(*ticket.Rating)})
+	}
+	fields = append(fields, map[string]string{"name": "Message", "value": trimForDiscord(ticket.Message)})
 	embed := map[string]any{
 		"title":       ticket.Subject,
 		"description": "Статус тикета: " + statusText + "\nОтветить пользователю можно кнопкой ниже.",
-		"fields": []map[string]string{
-			{"name": "Discord", "value": safeValue(ticket.DiscordNick)},
-			{"name": "Category", "value": safeValue(ticket.Category)},
-			{"name": "Message", "value": trimForDiscord(ticket.Message)},
-		},
+		"fields":      fields,
 	}
 
 	body := map[string]any{
@@ -375,58 +493,45 @@ func (h *SupportHandler) buildDiscordTicketPayload(ticket models.Ticket) map[str
 	return body
 }
 
-func (h *SupportHandler) updateDiscordTicketMessage(ticket models.Ticket) error {
+func (h *SupportHandler) updateDiscordTicketMessage(ctx context.Context, ticket models.Ticket) error {
+	if ticket.DiscordThreadID != "" && h.supportThreadsEnabled() {
+		return h.updateDiscordTicketThread(ctx, ticket)
+	}
 	if h.webhookURL == "" || strings.TrimSpace(ticket.DiscordMessageID) == "" {
 		return nil
 	}
-
-	payload := h.buildDiscordTicketPayload(ticket)
-	raw, err := json.Marshal(payload)
-	if err != nil {
-		return err
-	}
-
-	base, err := webhookBaseURL(h.webhookURL)
-	if err != nil {
+	err := h.discord.EditWebhookMessage(ctx, "support_ticket_update", h.webhookURL, ticket.DiscordMessageID, h.buildDiscordTicketPayload(ticket))
+	if err != nil && !discord.IsNotFound(err) {
 		return err
 	}
+	return nil
+}
 
-	req, err := http.NewRequest(http.MethodPatch, base+"/messages/"+url.PathEscape(ticket.DiscordMessageID)+"?with_components=true", bytes.NewReader(raw))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	startedAt := time.Now()
-	resp, err := http.DefaultClient.Do(req)
-	statusCode := 0
-	if resp != nil {
-		statusCode = resp.StatusCode
-		_ = resp.Body.Close()
-	}
-	observability.ObserveDiscordOutbound("support_ticket_update", startedAt, statusCode, err)
-	if err != nil {
-		return err
+// updateDiscordTicketThread edits the first message of a ticket thread. An
+// archived thread rejects edits of its messages, so the thread is reopened
+// first, and the thread of a closed ticket is archived and locked again
+// after the edit.
+func (h *SupportHandler) updateDiscordTicketThread(ctx context.Context, ticket models.Ticket) error {
+	open := normalizedTicketStatus(ticket.Status) == "open"
+	if open || ticket.DiscordMessageID != "" {
+		if err := h.setDiscordTicketThreadArchived(ctx, ticket, false); err != nil {
+			return err
+		}
 	}
-	if resp.StatusCode == http.StatusNotFound {
-		return nil
+	if ticket.DiscordMessageID != "" {
+		path := "/channels/" + url.PathEscape(ticket.DiscordThreadID) + "/messages/" + url.PathEscape(ticket.DiscordMessageID)
+		if err := h.discordBotJSON(ctx, "support_ticket_update", http.MethodPatch, path, h.buildDiscordTicketPayload(ticket), nil); err != nil {
+			return err
+		}
 	}
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return fmt.Errorf("discord webhook edit error: status=%d", resp.StatusCode)
+	if !open {
+		return h.setDiscordTicketThreadArchived(ctx, ticket, true)
 	}
 	return nil
 }
 
 func (h *SupportHandler) loadTicket(ctx context.Context, ticketID int64) (models.Ticket, error) {
-	return scanSupportTicket(h.db.QueryRowContext(
-		ctx,
-		`SELECT id, name, email, discord_nick, owner_discord_id, subject, category, message, status,
-		        moderation_token, discord_message_id, discord_channel_id,
-		        (SELECT COUNT(*) FROM support_ticket_messages m WHERE m.ticket_id = support_tickets.id AND m.author_type = 'admin' AND m.read_by_user = FALSE) AS unread_admin_count,
-		        resolved_at, archived_at, created_at
-		 FROM support_tickets
-		 WHERE id = $1`,
-		ticketID,
-	))
+	return scanSupportTicket(h.db.QueryRowContext(ctx, supportTicketSelectSQL+` WHERE id = $1`, ticketID))
 }
 
 func (h *SupportHandler) List(w http.ResponseWriter, r *http.Request) {
@@ -439,18 +544,7 @@ func (h *SupportHandler) List(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	rows, err := h.db.QueryContext(
-		ctx,
-		`SELECT id, name, email, discord_nick, owner_discord_id, subject, category, message, status,
-		        moderation_token, discord_message_id, discord_channel_id,
-		        (SELECT COUNT(*) FROM support_ticket_messages m WHERE m.ticket_id = support_tickets.id AND m.author_type = 'admin' AND m.read_by_user = FALSE) AS unread_admin_count,
-		        resolved_at, archived_at, created_at
-		 FROM support_tickets
-		 WHERE owner_discord_id = $1
-		 ORDER BY created_at DESC
-		 LIMIT 50`,
-		ownerDiscordID,
-	)
+	rows, err := h.db.QueryContext(ctx, supportTicketSelectSQL+` WHERE owner_discord_id = $1 ORDER BY created_at DESC LIMIT 50`, ownerDiscordID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to load tickets")
 		return
@@ -514,8 +608,14 @@ func (h *SupportHandler) Messages(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		tx, err := h.db.BeginTx(ctx, nil)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to save message")
+			return
+		}
+		defer tx.Rollback()
 		var messageID int64
-		err = h.db.QueryRowContext(
+		err = tx.QueryRowContext(
 			ctx,
 			`INSERT INTO support_ticket_messages (ticket_id, author_type, author_name, author_discord_id, message, read_by_user, created_at)
 			 VALUES ($1, 'user', $2, $3, $4, TRUE, $5)
@@ -531,20 +631,22 @@ func (h *SupportHandler) Messages(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		for _, file := range files {
-			if err := h.saveTicketAttachment(ctx, ticket.ID, messageID, file); err != nil {
+			if err := h.saveTicketAttachment(ctx, tx, ticket.ID, messageID, file); err != nil {
 				writeError(w, http.StatusBadRequest, err.Error())
 				return
 			}
 		}
-		_ = h.writeTicketHistoryHTML(ctx, ticket)
-		discordMessageID, err := h.sendDiscordTicketChatMessage(ticket, message, files)
-		if err != nil {
-			writeError(w, http.StatusBadGateway, "failed to send message to discord")
+		if err := h.enqueueTicketMessage(ctx, tx, ticket.ID, messageID); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to save message")
 			return
 		}
-		if discordMessageID != "" {
-			_, _ = h.db.ExecContext(ctx, `UPDATE support_ticket_messages SET discord_message_id = $1 WHERE id = $2`, discordMessageID, messageID)
+		if err := h.outbox.commit(tx); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to save message")
+			return
 		}
+		ticket.DiscordSync = discordSyncPending
+		_ = h.writeTicketHistoryHTML(ctx, ticket)
+		h.publishTicketMessage(ctx, ticket.ID, messageID, supportEventMessage)
 	}
 
 	messages, err := h.loadTicketMessages(ctx, ticket.ID)
@@ -552,193 +654,39 @@ func (h *SupportHandler) Messages(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, "failed to load messages")
 		return
 	}
-	_, _ = h.db.ExecContext(ctx, `UPDATE support_ticket_messages SET read_by_user = TRUE WHERE ticket_id = $1 AND author_type = 'admin'`, ticket.ID)
-	writeJSON(w, http.StatusOK, map[string]any{"ticket": ticket, "messages": messages})
-}
-
-func (h *SupportHandler) Notifications(w http.ResponseWriter, r *http.Request) {
-	ownerDiscordID := currentDiscordIDFromCookie(r)
-	if ownerDiscordID == "" {
-		writeError(w, http.StatusUnauthorized, "not authenticated")
-		return
-	}
-
-	if r.Method == http.MethodGet {
-		writeJSON(w, http.StatusOK, map[string]any{
-			"configured": h.vapidPublicKey != "" && h.vapidPrivateKey != "",
-			"publicKey":  h.vapidPublicKey,
-		})
-		return
-	}
-
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-	defer cancel()
-
-	if r.Method == http.MethodDelete {
-		endpoint := strings.TrimSpace(r.URL.Query().Get("endpoint"))
-		if endpoint == "" {
-			_, _ = h.db.ExecContext(ctx, `DELETE FROM support_push_subscriptions WHERE discord_id = $1`, ownerDiscordID)
-		} else {
-			_, _ = h.db.ExecContext(ctx, `DELETE FROM support_push_subscriptions WHERE discord_id = $1 AND endpoint = $2`, ownerDiscordID, endpoint)
-		}
-		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
-		return
-	}
-
-	if r.Method != http.MethodPost {
-		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
-		return
-	}
-
-	var payload struct {
-		Endpoint string `json:"endpoint"`
-		Keys     struct {
-			P256DH string `json:"p256dh"`
-			Auth   string `json:"auth"`
-		} `json:"keys"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		writeError(w, http.StatusBadRequest, "invalid json")
-		return
-	}
-	payload.Endpoint = strings.TrimSpace(payload.Endpoint)
-	payload.Keys.P256DH = strings.TrimSpace(payload.Keys.P256DH)
-	payload.Keys.Auth = strings.TrimSpace(payload.Keys.Auth)
-	if payload.Endpoint == "" || payload.Keys.P256DH == "" || payload.Keys.Auth == "" {
-		writeError(w, http.StatusBadRequest, "subscription keys required")
-		return
+	if h.markTicketReadByUser(ctx, ticket) > 0 {
+		ticket.UnreadAdminCount = 0
 	}
-
-	_, err := h.db.ExecContext(
-		ctx,
-		`INSERT INTO support_push_subscriptions (discord_id, endpoint, p256dh, auth, created_at, updated_at)
-		 VALUES ($1, $2, $3, $4, $5, $5)
-		 ON CONFLICT (discord_id, endpoint) DO UPDATE SET
-		   p256dh = EXCLUDED.p256dh,
-		   auth = EXCLUDED.auth,
-		   updated_at = EXCLUDED.updated_at`,
-		ownerDiscordID,
-		payload.Endpoint,
-		payload.Keys.P256DH,
-		payload.Keys.Auth,
-		time.Now().UTC(),
-	)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to save subscription")
-		return
-	}
-	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	writeJSON(w, http.StatusOK, map[string]any{"ticket": ticket, "messages": playerTicketMessages(messages)})
 }
 
-func (h *SupportHandler) sendDiscordTicketChatMessage(ticket models.Ticket, message string, files []supportUpload) (string, error) {
-	if h.webhookURL == "" {
-		return "", nil
-	}
+func (h *SupportHandler) sendDiscordTicketChatMessage(ctx context.Context, ticket models.Ticket, message string, files []supportUpload) (string, error) {
 	discordText := strings.TrimSpace(message)
 	if discordText == "" && len(files) > 0 {
 		discordText = fmt.Sprintf("[изображений: %d]", len(files))
 	}
+	files = deliverableSupportUploads(files)
+	if ticket.DiscordThreadID != "" && h.supportThreadsEnabled() {
+		return h.postDiscordThreadMessage(ctx, ticket, fmt.Sprintf("**%s:**\n%s", safeValue(ticket.DiscordNick), trimForDiscord(discordText)), files)
+	}
+	if h.webhookURL == "" {
+		return "", nil
+	}
 	payload := map[string]any{
 		"content":          fmt.Sprintf("Ответ пользователя по тикету #%d (%s):\n%s", ticket.ID, ticket.Subject, trimForDiscord(discordText)),
 		"allowed_mentions": map[string]any{"parse": []string{}},
 	}
-	raw, err := json.Marshal(payload)
+	sent, err := h.discord.ExecuteWebhook(ctx, "support_ticket_message", h.webhookURL, payload, discordFiles(files))
 	if err != nil {
 		return "", err
 	}
-	requestURL, err := webhookURLWithWait(h.webhookURL)
-	if err != nil {
-		return "", err
-	}
-
-	var body io.Reader
-	contentType := "application/json"
-	if len(files) == 0 {
-		body = bytes.NewReader(raw)
-	} else {
-		var form bytes.Buffer
-		writer := multipart.NewWriter(&form)
-		payloadField, err := writer.CreateFormField("payload_json")
-		if err != nil {
-			return "", err
-		}
-		if _, err := payloadField.Write(raw); err != nil {
-			return "", err
-		}
-		for index, file := range files {
-			part, err := writer.CreateFormFile(fmt.Sprintf("files[%d]", index), file.Name)
-			if err != nil {
-				return "", err
-			}
-			if _, err := part.Write(file.Bytes); err != nil {
-				return "", err
-			}
-		}
-		if err := writer.Close(); err != nil {
-			return "", err
-		}
-		body = &form
-		contentType = writer.FormDataContentType()
-	}
-
-	req, err := http.NewRequest(http.MethodPost, requestURL, body)
-	if err != nil {
-		return "", err
-	}
-	req.Header.Set("Content-Type", contentType)
-	resp, err := http.DefaultClient.Do(req)
-	if resp != nil {
-		defer resp.Body.Close()
-	}
-	if err != nil {
-		return "", err
-	}
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		bodyRaw, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		return "", fmt.Errorf("discord webhook error: status=%d body=%s", resp.StatusCode, strings.TrimSpace(string(bodyRaw)))
-	}
-	var webhookMessage discordWebhookMessage
-	if err := json.NewDecoder(resp.Body).Decode(&webhookMessage); err != nil {
-		return "", nil
-	}
-	return strings.TrimSpace(webhookMessage.ID), nil
-}
-
-func (h *SupportHandler) saveAdminTicketReply(ctx context.Context, ticket models.Ticket, authorName, message, discordMessageID string) error {
-	authorName = strings.TrimSpace(authorName)
-	if authorName == "" {
-		authorName = "Техподдержка"
-	}
-	message = strings.TrimSpace(message)
-	if message == "" {
-		return fmt.Errorf("empty reply")
-	}
-	_, err := h.db.ExecContext(
-		ctx,
-		`INSERT INTO support_ticket_messages
-		 (ticket_id, author_type, author_name, author_discord_id, author_discord_status, message, discord_message_id, read_by_user, created_at)
-		 VALUES ($1, 'admin', $2, '', 'unknown', $3, $4, FALSE, $5)
-		 ON CONFLICT (discord_message_id) WHERE discord_message_id <> '' DO NOTHING`,
-		ticket.ID,
-		authorName,
-		message,
-		strings.TrimSpace(discordMessageID),
-		time.Now().UTC(),
-	)
-	if err != nil {
-		return err
-	}
-	_ = h.writeTicketHistoryHTML(ctx, ticket)
-	if h.vapidPublicKey != "" && h.vapidPrivateKey != "" {
-		h.sendTicketReplyPush(ctx, ticket, authorName, message)
-	}
-	return nil
+	return sent.ID, nil
 }
 
 func (h *SupportHandler) loadTicketMessages(ctx context.Context, ticketID int64) ([]models.TicketMessage, error) {
 	rows, err := h.db.QueryContext(
 		ctx,
-		`SELECT id, ticket_id, author_type, author_name, author_discord_id, author_discord_status, message, read_by_user, created_at
+		`SELECT id, ticket_id, author_type, author_name, author_discord_id, author_discord_status, message, read_by_user, read_by_user_at, read_by_staff_at, edited_at, deleted_at, created_at
 		 FROM support_ticket_messages
 		 WHERE ticket_id = $1
 		 ORDER BY created_at ASC`,
@@ -752,6 +700,10 @@ func (h *SupportHandler) loadTicketMessages(ctx context.Context, ticketID int64)
 	messages := make([]models.TicketMessage, 0)
 	for rows.Next() {
 		var message models.TicketMessage
+		var readByUserAt sql.NullTime
+		var readByStaffAt sql.NullTime
+		var editedAt sql.NullTime
+		var deletedAt sql.NullTime
 		if err := rows.Scan(
 			&message.ID,
 			&message.TicketID,
@@ -761,10 +713,20 @@ func (h *SupportHandler) loadTicketMessages(ctx context.Context, ticketID int64)
 			&message.AuthorDiscordStatus,
 			&message.Message,
 			&message.ReadByUser,
+			&readByUserAt,
+			&readByStaffAt,
+			&editedAt,
+			&deletedAt,
 			&message.CreatedAt,
 		); err != nil {
 			return nil, err
 		}
+		message.ReadByUserAt = scanNullableTime(readByUserAt)
+		message.ReadByStaffAt = scanNullableTime(readByStaffAt)
+		if editedAt.Valid {
+			message.EditedAt = &editedAt.Time
+		}
+		message.Deleted = deletedAt.Valid
 		messages = append(messages, message)
 	}
 	if err := rows.Err(); err != nil {
@@ -781,14 +743,87 @@ func (h *SupportHandler) loadTicketMessages(ctx context.Context, ticketID int64)
 	for _, attachment := range attachments {
 		byMessage[attachment.MessageID] = append(byMessage[attachment.MessageID], attachment)
 	}
+	edits, err := h.loadTicketMessageEdits(ctx, ticketID)
+	if err != nil {
+		return nil, err
+	}
 	for i := range messages {
 		messages[i].Attachments = byMessage[messages[i].ID]
+		messages[i].Edits = edits[messages[i].ID]
 	}
 	return messages, nil
 }
 
+func (h *SupportHandler) loadTicketMessageEdits(ctx context.Context, ticketID int64) (map[int64][]models.TicketMessageEdit, error) {
+	rows, err := h.db.QueryContext(
+		ctx,
+		`SELECT e.message_id, e.previous_message, e.edited_at
+		 FROM support_ticket_message_edits e
+		 JOIN support_ticket_messages m ON m.id = e.message_id
+		 WHERE m.ticket_id = $1
+		 ORDER BY e.edited_at ASC`,
+		ticketID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	edits := make(map[int64][]models.TicketMessageEdit)
+	for rows.Next() {
+		var messageID int64
+		var edit models.TicketMessageEdit
+		if err := rows.Scan(&messageID, &edit.Message, &edit.EditedAt); err != nil {
+			return nil, err
+		}
+		edits[messageID] = append(edits[messageID], edit)
+	}
+	return edits, rows.Err()
+}
+
+// playerTicketMessages hides what a player should not see: the text and
+// images of deleted staff replies and the edit history.
+func playerTicketMessages(messages []models.TicketMessage) []models.TicketMessage {
+	for i := range messages {
+		messages[i].Edits = nil
+		if messages[i].Deleted {
+			messages[i].Message = ""
+			messages[i].Attachments = nil
+		}
+		for j := range messages[i].Attachments {
+			messages[i].Attachments[j].QuarantineReason = ""
+		}
+	}
+	return messages
+}
+
 func (h *SupportHandler) ticketDiscordComponents(ticket models.Ticket) []any {
 	status := normalizedTicketStatus(ticket.Status)
+	if h.interactions {
+		button := func(label, action string) map[string]any {
+			return map[string]any{"type": 2, "style": discordButtonStyle(action), "label": label, "custom_id": discordCustomID("ticket", action, strconv.FormatInt(ticket.ID, 10))}
+		}
+		switch status {
+		case "resolved":
+			return []any{map[string]any{"type": 1, "components": []any{
+				button("Ответить пользователю", "reply"),
+				button("На пересмотр", "reconsider"),
+				button("Архивировать", "archive"),
+				button("Удалить", "delete"),
+			}}}
+		case "archived":
+			return []any{map[string]any{"type": 1, "components": []any{
+				button("Ответить пользователю", "reply"),
+				button("Разархивировать", "unarchive"),
+				button("Удалить", "delete"),
+			}}}
+		default:
+			return []any{map[string]any{"type": 1, "components": []any{
+				button("Ответить пользователю", "reply"),
+				button("Решён", "resolve"),
+			}}}
+		}
+	}
 	if status == "resolved" {
 		return []any{map[string]any{"type": 1, "components": []any{
 			map[string]any{"type": 2, "style": 5, "label": "Ответить пользователю", "url": h.ticketModerationURL(ticket.ID, "reply_prompt", ticket.ModerationToken)},
@@ -869,18 +904,28 @@ func parseSupportAttachmentIDFromPath(path string) (int64, bool) {
 	return id, err == nil && id > 0
 }
 
-func currentDiscordIDFromCookie(r *http.Request) string {
-	cookie, err := r.Cookie("discord_id")
-	if err != nil {
-		return ""
-	}
-	return strings.TrimSpace(cookie.Value)
-}
+const supportTicketSelectSQL = `SELECT id, name, email, discord_nick, owner_discord_id, subject, category, message, status,
+       moderation_token, discord_message_id, discord_channel_id, discord_thread_id, discord_sync_status,
+       (SELECT COUNT(*) FROM support_ticket_messages m WHERE m.ticket_id = support_tickets.id AND m.author_type = 'admin' AND m.read_by_user = FALSE AND m.deleted_at IS NULL) AS unread_admin_count,
+       (SELECT COUNT(*) FROM support_ticket_messages m WHERE m.ticket_id = support_tickets.id AND m.author_type = 'user' AND m.read_by_staff_at IS NULL) AS unread_user_count,
+       (SELECT MAX(m.read_by_user_at) FROM support_ticket_messages m WHERE m.ticket_id = support_tickets.id AND m.author_type = 'admin') AS user_seen_at,
+       priority, assignee_discord_id, assignee_name, assigned_at, first_response_at,
+       resolved_at, archived_at, created_at,
+       (SELECT r.score FROM support_ticket_ratings r WHERE r.ticket_id = support_tickets.id) AS rating_score,
+       (SELECT r.comment FROM support_ticket_ratings r WHERE r.ticket_id = support_tickets.id) AS rating_comment,
+       (SELECT r.updated_at FROM support_ticket_ratings r WHERE r.ticket_id = support_tickets.id) AS rated_at
+FROM support_tickets`
 
 func scanSupportTicket(scanner sqlScanner) (models.Ticket, error) {
 	var ticket models.Ticket
+	var userSeenAt sql.NullTime
+	var assignedAt sql.NullTime
+	var firstResponseAt sql.NullTime
 	var resolvedAt sql.NullTime
 	var archivedAt sql.NullTime
+	var ratingScore sql.NullInt32
+	var ratingComment sql.NullString
+	var ratedAt sql.NullTime
 	err := scanner.Scan(
 		&ticket.ID,
 		&ticket.Name,
@@ -894,24 +939,50 @@ func scanSupportTicket(scanner sqlScanner) (models.Ticket, error) {
 		&ticket.ModerationToken,
 		&ticket.DiscordMessageID,
 		&ticket.DiscordChannelID,
+		&ticket.DiscordThreadID,
+		&ticket.DiscordSync,
 		&ticket.UnreadAdminCount,
+		&ticket.UnreadUserCount,
+		&userSeenAt,
+		&ticket.Priority,
+		&ticket.AssigneeDiscordID,
+		&ticket.AssigneeName,
+		&assignedAt,
+		&firstResponseAt,
 		&resolvedAt,
 		&archivedAt,
 		&ticket.CreatedAt,
+		&ratingScore,
+		&ratingComment,
+		&ratedAt,
 	)
+	ticket.UserSeenAt = scanNullableTime(userSeenAt)
+	if assignedAt.Valid {
+		ticket.AssignedAt = &assignedAt.Time
+	}
+	if firstResponseAt.Valid {
+		ticket.FirstResponseAt = &firstResponseAt.Time
+	}
 	if resolvedAt.Valid {
 		ticket.ResolvedAt = &resolvedAt.Time
 	}
 	if archivedAt.Valid {
 		ticket.ArchivedAt = &archivedAt.Time
 	}
+	if ratingScore.Valid {
+		ticket.Rating = &models.TicketRating{Score: int(ratingScore.Int32), Comment: ratingComment.String, RatedAt: ratedAt.Time}
+	}
 	return ticket, err
 }
 
 type supportUpload struct {
-	Name     string
-	MimeType string
-	Bytes    []byte
+	Name          string
+	MimeType      string
+	Bytes         []byte
+	Thumbnail     []byte
+	ThumbnailType string
+	// Quarantine holds the scanner verdict for files kept away from the chat.
+	Quarantine string
 }
 
 const maxSupportImageBytes = 10 * 1024 * 1024
@@ -931,6 +1002,7 @@ func (h *SupportHandler) resolveDiscordNick(ctx context.Context, nick, ownerDisc
 			`SELECT discord_id, username, global_name, nick
 			 FROM discord_member_states
 			 WHERE discord_id = $1
+			   AND left_at IS NULL
 			   AND (LOWER(username) = LOWER($2) OR LOWER(global_name) = LOWER($2) OR LOWER(nick) = LOWER($2))
 			 LIMIT 1`,
 			ownerDiscordID,
@@ -946,7 +1018,8 @@ func (h *SupportHandler) resolveDiscordNick(ctx context.Context, nick, ownerDisc
 		ctx,
 		`SELECT discord_id, username, global_name, nick
 		 FROM discord_member_states
-		 WHERE LOWER(username) = LOWER($1) OR LOWER(global_name) = LOWER($1) OR LOWER(nick) = LOWER($1)
+		 WHERE left_at IS NULL
+		   AND (LOWER(username) = LOWER($1) OR LOWER(global_name) = LOWER($1) OR LOWER(nick) = LOWER($1))
 		 ORDER BY synced_at DESC
 		 LIMIT 1`,
 		nick,
@@ -995,7 +1068,11 @@ func (h *SupportHandler) readMessagePayload(r *http.Request) (string, []supportU
 				if !strings.HasPrefix(mimeType, "image/") {
 					return "", nil, fmt.Errorf("only images are allowed")
 				}
-				files = append(files, supportUpload{Name: sanitizeSupportFileName(header.Filename, mimeType), MimeType: mimeType, Bytes: raw})
+				upload, err := h.prepareSupportUpload(r.Context(), supportUpload{Name: sanitizeSupportFileName(header.Filename, mimeType), MimeType: mimeType, Bytes: raw})
+				if err != nil {
+					return "", nil, err
+				}
+				files = append(files, upload)
 			}
 		}
 		return message, files, nil
@@ -1029,27 +1106,46 @@ func sanitizeSupportFileName(name, mimeType string) string {
 	return name
 }
 
-func (h *SupportHandler) saveTicketAttachment(ctx context.Context, ticketID, messageID int64, upload supportUpload) error {
+func (h *SupportHandler) saveTicketAttachment(ctx context.Context, exec sqlExecer, ticketID, messageID int64, upload supportUpload) error {
 	dir := filepath.Join(h.storageDir, "tickets", strconv.FormatInt(ticketID, 10), "attachments")
+	if upload.Quarantine != "" {
+		dir = filepath.Join(h.storageDir, "quarantine", strconv.FormatInt(ticketID, 10))
+	}
 	if err := os.MkdirAll(dir, 0750); err != nil {
 		return fmt.Errorf("failed to prepare attachment storage")
 	}
-	fileName := fmt.Sprintf("%d_%s", time.Now().UnixNano(), upload.Name)
+	now := time.Now().UTC()
+	fileName := fmt.Sprintf("%d_%s", now.UnixNano(), upload.Name)
 	path := filepath.Join(dir, fileName)
 	if err := os.WriteFile(path, upload.Bytes, 0640); err != nil {
 		return fmt.Errorf("failed to save image")
 	}
-	_, err := h.db.ExecContext(
+	thumbnailPath := ""
+	if len(upload.Thumbnail) > 0 {
+		thumbnailPath = supportThumbnailPath(path, upload.ThumbnailType)
+		if err := os.WriteFile(thumbnailPath, upload.Thumbnail, 0640); err != nil {
+			thumbnailPath = ""
+		}
+	}
+	var quarantinedAt *time.Time
+	if upload.Quarantine != "" {
+		quarantinedAt = &now
+		log.Printf("support ticket %d attachment %s quarantined: %s", ticketID, upload.Name, upload.Quarantine)
+	}
+	_, err := exec.ExecContext(
 		ctx,
-		`INSERT INTO support_ticket_attachments (ticket_id, message_id, file_name, mime_type, size_bytes, storage_path, created_at)
-		 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		`INSERT INTO support_ticket_attachments (ticket_id, message_id, file_name, mime_type, size_bytes, storage_path, thumbnail_path, quarantine_reason, quarantined_at, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
 		ticketID,
 		messageID,
 		upload.Name,
 		upload.MimeType,
 		len(upload.Bytes),
 		path,
-		time.Now().UTC(),
+		thumbnailPath,
+		upload.Quarantine,
+		quarantinedAt,
+		now,
 	)
 	return err
 }
@@ -1057,7 +1153,7 @@ func (h *SupportHandler) saveTicketAttachment(ctx context.Context, ticketID, mes
 func (h *SupportHandler) loadTicketAttachments(ctx context.Context, ticketID int64) ([]models.TicketAttachment, error) {
 	rows, err := h.db.QueryContext(
 		ctx,
-		`SELECT id, ticket_id, message_id, file_name, mime_type, size_bytes, storage_path, created_at
+		`SELECT id, ticket_id, message_id, file_name, mime_type, size_bytes, storage_path, thumbnail_path, quarantine_reason, quarantined_at IS NOT NULL, created_at
 		 FROM support_ticket_attachments
 		 WHERE ticket_id = $1
 		 ORDER BY created_at ASC`,
@@ -1071,10 +1167,15 @@ func (h *SupportHandler) loadTicketAttachments(ctx context.Context, ticketID int
 	attachments := make([]models.TicketAttachment, 0)
 	for rows.Next() {
 		var attachment models.TicketAttachment
-		if err := rows.Scan(&attachment.ID, &attachment.TicketID, &attachment.MessageID, &attachment.FileName, &attachment.MimeType, &attachment.SizeBytes, &attachment.StoragePath, &attachment.CreatedAt); err != nil {
+		if err := rows.Scan(&attachment.ID, &attachment.TicketID, &attachment.MessageID, &attachment.FileName, &attachment.MimeType, &attachment.SizeBytes, &attachment.StoragePath, &attachment.ThumbnailPath, &attachment.QuarantineReason, &attachment.Quarantined, &attachment.CreatedAt); err != nil {
 			return nil, err
 		}
-		attachment.URL = fmt.Sprintf("/support/tickets/%d/attachments/%d", attachment.TicketID, attachment.ID)
+		if !attachment.Quarantined {
+			attachment.URL = fmt.Sprintf("/support/tickets/%d/attachments/%d", attachment.TicketID, attachment.ID)
+			if attachment.ThumbnailPath != "" {
+				attachment.ThumbnailURL = attachment.URL + "?size=thumb"
+			}
+		}
 		attachments = append(attachments, attachment)
 	}
 	return attachments, rows.Err()
@@ -1094,16 +1195,16 @@ func (h *SupportHandler) Attachment(w http.ResponseWriter, r *http.Request, atta
 	defer cancel()
 
 	var ticketID int64
-	var mimeType, path string
+	var fileName, mimeType, path, thumbnailPath string
 	err := h.db.QueryRowContext(
 		ctx,
-		`SELECT a.ticket_id, a.mime_type, a.storage_path
+		`SELECT a.ticket_id, a.file_name, a.mime_type, a.storage_path, a.thumbnail_path
 		 FROM support_ticket_attachments a
 		 JOIN support_tickets t ON t.id = a.ticket_id
-		 WHERE a.id = $1 AND t.owner_discord_id = $2`,
+		 WHERE a.id = $1 AND t.owner_discord_id = $2 AND a.quarantined_at IS NULL`,
 		attachmentID,
 		ownerDiscordID,
-	).Scan(&ticketID, &mimeType, &path)
+	).Scan(&ticketID, &fileName, &mimeType, &path, &thumbnailPath)
 	_ = ticketID
 	if err == sql.ErrNoRows {
 		writeError(w, http.StatusNotFound, "attachment not found")
@@ -1113,7 +1214,17 @@ func (h *SupportHandler) Attachment(w http.ResponseWriter, r *http.Request, atta
 		writeError(w, http.StatusInternalServerError, "failed to load attachment")
 		return
 	}
+	serveSupportAttachmentVariant(w, r, fileName, mimeType, path, thumbnailPath)
+}
+
+// serveSupportAttachment shows images inline and makes every other file a
+// download, so an uploaded document can never render as a page on our origin.
+func serveSupportAttachment(w http.ResponseWriter, r *http.Request, fileName, mimeType, path string) {
 	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if !strings.HasPrefix(mimeType, "image/") {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+	}
 	http.ServeFile(w, r, path)
 }
 
@@ -1126,10 +1237,16 @@ func (h *SupportHandler) writeTicketHistoryHTML(ctx context.Context, ticket mode
 	if err := os.MkdirAll(dir, 0750); err != nil {
 		return err
 	}
+	return os.WriteFile(filepath.Join(dir, "history.html"), []byte(renderTicketHistoryHTML(ticket, messages)), 0640)
+}
+
+// renderTicketHistoryHTML renders a ticket conversation as a standalone page.
+// Attachment links are relative to the ticket directory.
+func renderTicketHistoryHTML(ticket models.Ticket, messages []models.TicketMessage) string {
 	var b strings.Builder
 	b.WriteString("<!doctype html><html><head><meta charset=\"utf-8\"><title>Support ticket ")
 	b.WriteString(strconv.FormatInt(ticket.ID, 10))
-	b.WriteString("</title><style>body{font-family:Arial,sans-serif;background:#f4f4f4;color:#111}.message{background:#fff;margin:12px 0;padding:12px;border-radius:8px}.meta{color:#666;font-size:12px}.mine{border-left:4px solid #f7c948}.admin{border-left:4px solid #5865f2}img{max-width:420px;border-radius:6px;display:block;margin-top:8px}</style></head><body>")
+	b.WriteString("</title><style>body{font-family:Arial,sans-serif;background:#f4f4f4;color:#111}.message{background:#fff;margin:12px 0;padding:12px;border-radius:8px}.meta{color:#666;font-size:12px}.mine{border-left:4px solid #f7c948}.admin{border-left:4px solid #5865f2}.deleted p{text-decoration:line-through;color:#888}.edits{color:#666;font-size:12px}img{max-width:420px;border-radius:6px;display:block;margin-top:8px}</style></head><body>")
 	b.WriteString("<h1>Ticket #")
 	b.WriteString(strconv.FormatInt(ticket.ID, 10))
 	b.WriteString(": ")
@@ -1140,14 +1257,41 @@ func (h *SupportHandler) writeTicketHistoryHTML(ctx context.Context, ticket mode
 		if message.AuthorType == "user" {
 			className = "message mine"
 		}
+		if message.Deleted {
+			className += " deleted"
+		}
 		b.WriteString("<div class=\"" + className + "\"><div class=\"meta\">")
 		b.WriteString(html.EscapeString(message.AuthorName))
 		b.WriteString(" · ")
 		b.WriteString(html.EscapeString(message.CreatedAt.Format(time.RFC3339)))
+		if message.EditedAt != nil {
+			b.WriteString(" · изменено ")
+			b.WriteString(html.EscapeString(message.EditedAt.Format(time.RFC3339)))
+		}
+		if message.Deleted {
+			b.WriteString(" · удалено")
+		}
 		b.WriteString("</div><p>")
 		b.WriteString(html.EscapeString(message.Message))
 		b.WriteString("</p>")
+		if len(message.Edits) > 0 {
+			b.WriteString("<details class=\"edits\"><summary>История правок</summary>")
+			for _, edit := range message.Edits {
+				b.WriteString("<p>")
+				b.WriteString(html.EscapeString(edit.EditedAt.Format(time.RFC3339)))
+				b.WriteString(": ")
+				b.WriteString(html.EscapeString(edit.Message))
+				b.WriteString("</p>")
+			}
+			b.WriteString("</details>")
+		}
 		for _, attachment := range message.Attachments {
+			if attachment.Quarantined {
+				b.WriteString("<p class=\"meta\">")
+				b.WriteString(html.EscapeString(attachment.FileName))
+				b.WriteString(": файл на проверке</p>")
+				continue
+			}
 			b.WriteString("<a href=\"attachments/")
 			b.WriteString(html.EscapeString(filepath.Base(attachment.StoragePath)))
 			b.WriteString("\">")
@@ -1157,72 +1301,49 @@ func (h *SupportHandler) writeTicketHistoryHTML(ctx context.Context, ticket mode
 		b.WriteString("</div>")
 	}
 	b.WriteString("</body></html>")
-	return os.WriteFile(filepath.Join(dir, "history.html"), []byte(b.String()), 0640)
+	return b.String()
 }
 
+// deleteTicket removes the ticket with its messages and files, and its
+// thread or webhook message from Discord so no buttons are left pointing at
+// it.
 func (h *SupportHandler) deleteTicket(ctx context.Context, ticket models.Ticket) error {
-	_, err := h.db.ExecContext(ctx, `DELETE FROM support_tickets WHERE id = $1`, ticket.ID)
+	tx, err := h.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	return os.RemoveAll(filepath.Join(h.storageDir, "tickets", strconv.FormatInt(ticket.ID, 10)))
-}
+	defer tx.Rollback()
 
-func (h *SupportHandler) NotifyTicketReply(ctx context.Context, ticketID int64, authorName, message string) {
-	if h.vapidPublicKey == "" || h.vapidPrivateKey == "" {
-		return
+	if _, err := tx.ExecContext(ctx, `DELETE FROM support_tickets WHERE id = $1`, ticket.ID); err != nil {
+		return err
 	}
-	ticket, err := h.loadTicket(ctx, ticketID)
-	if err != nil || strings.TrimSpace(ticket.OwnerDiscordID) == "" {
-		return
+	if ref := ticketDiscordDeleteRef(ticket.DiscordThreadID, ticket.DiscordMessageID); ref != "" {
+		if err := h.outbox.enqueue(ctx, tx, discordEntitySupportTicket, strconv.FormatInt(ticket.ID, 10), discordActionDelete, ref); err != nil {
+			return err
+		}
+	}
+	if err := h.outbox.commit(tx); err != nil {
+		return err
 	}
-	h.sendTicketReplyPush(ctx, ticket, authorName, message)
+	return h.removeTicketFiles(ticket.ID)
 }
 
-func (h *SupportHandler) sendTicketReplyPush(ctx context.Context, ticket models.Ticket, authorName, message string) {
-	rows, err := h.db.QueryContext(ctx, `SELECT endpoint, p256dh, auth FROM support_push_subscriptions WHERE discord_id = $1`, ticket.OwnerDiscordID)
-	if err != nil {
-		return
+func (h *SupportHandler) removeTicketFiles(ticketID int64) error {
+	id := strconv.FormatInt(ticketID, 10)
+	if err := os.RemoveAll(filepath.Join(h.storageDir, "quarantine", id)); err != nil {
+		return err
 	}
-	defer rows.Close()
+	return os.RemoveAll(filepath.Join(h.storageDir, "tickets", id))
+}
 
-	subject := h.pushSubject
-	if subject == "" {
-		subject = "mailto:support@amyworld.ru"
-	}
-	payload, _ := json.Marshal(map[string]any{
-		"title":    "Ответ поддержки",
-		"body":     fmt.Sprintf("%s: %s", safeValue(authorName), trimForDiscord(message)),
-		"url":      fmt.Sprintf("/support?ticket=%d", ticket.ID),
-		"ticketId": ticket.ID,
+func (h *SupportHandler) sendTicketReplyPush(ctx context.Context, ticket models.Ticket, authorName, message string) {
+	h.notifier.Notify(ctx, ticket.OwnerDiscordID, Notification{
+		Kind:  NotificationSupportReply,
+		Title: "Ответ поддержки",
+		Body:  fmt.Sprintf("%s: %s", safeValue(authorName), trimForDiscord(message)),
+		URL:   fmt.Sprintf("/support?ticket=%d", ticket.ID),
+		Tag:   fmt.Sprintf("support-ticket-%d", ticket.ID),
 	})
-
-	for rows.Next() {
-		var endpoint, p256dh, auth string
-		if err := rows.Scan(&endpoint, &p256dh, &auth); err != nil {
-			continue
-		}
-		subscription := &webpush.Subscription{
-			Endpoint: endpoint,
-			Keys: webpush.Keys{
-				P256dh: p256dh,
-				Auth:   auth,
-			},
-		}
-		resp, err := webpush.SendNotification(payload, subscription, &webpush.Options{
-			Subscriber:      subject,
-			VAPIDPublicKey:  h.vapidPublicKey,
-			VAPIDPrivateKey: h.vapidPrivateKey,
-			TTL:             60,
-		})
-		if resp != nil {
-			_ = resp.Body.Close()
-			if resp.StatusCode == http.StatusGone || resp.StatusCode == http.StatusNotFound {
-				_, _ = h.db.ExecContext(ctx, `DELETE FROM support_push_subscriptions WHERE endpoint = $1`, endpoint)
-			}
-		}
-		_ = err
-	}
 }
 
 func (h *SupportHandler) writeTicketDeleteConfirmHTML(w http.ResponseWriter, ticket models.Ticket) {
@@ -0,0 +1,335 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"amy/minecraft-server/internal/models"
+)
+
+const supportSystemAuthorName = "Amy World"
+
+// supportAutoClosePolicy decides what happens to tickets waiting on the
+// player. Open tickets whose last message came from staff get a warning after
+// WarnAfterHours and are resolved after ResolveAfterHours; resolved tickets
+// are archived ArchiveAfterHours after resolution. Zero turns a step off.
+type supportAutoClosePolicy struct {
+	Category          string `json:"category"`
+	WarnAfterHours    int    `json:"warnAfterHours"`
+	ResolveAfterHours int    `json:"resolveAfterHours"`
+	ArchiveAfterHours int    `json:"archiveAfterHours"`
+}
+
+func loadSupportAutoClosePolicies(ctx context.Context, db *sql.DB) (map[string]supportAutoClosePolicy, error) {
+	rows, err := db.QueryContext(ctx, `SELECT category, warn_after_hours, resolve_after_hours, archive_after_hours FROM support_autoclose_policies`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := make(map[string]supportAutoClosePolicy)
+	for rows.Next() {
+		var policy supportAutoClosePolicy
+		if err := rows.Scan(&policy.Category, &policy.WarnAfterHours, &policy.ResolveAfterHours, &policy.ArchiveAfterHours); err != nil {
+			return nil, err
+		}
+		policies[strings.ToLower(policy.Category)] = policy
+	}
+	return policies, rows.Err()
+}
+
+func supportAutoClosePolicyFor(policies map[string]supportAutoClosePolicy, category string) supportAutoClosePolicy {
+	if policy, ok := policies[strings.ToLower(strings.TrimSpace(category))]; ok {
+		return policy
+	}
+	return policies[""]
+}
+
+func (h *SupportHandler) staffAutoClosePolicies(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if r.Method == http.MethodPut || r.Method == http.MethodPost {
+		var payload supportAutoClosePolicy
+		if err := json.NewDecoder(io.LimitReader(r.Body, 8*1024)).Decode(&payload); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+		payload.Category = strings.TrimSpace(payload.Category)
+		if payload.WarnAfterHours < 0 || payload.ResolveAfterHours < 0 || payload.ArchiveAfterHours < 0 {
+			writeError(w, http.StatusBadRequest, "hours must not be negative")
+			return
+		}
+		if payload.WarnAfterHours > 0 && payload.ResolveAfterHours > 0 && payload.WarnAfterHours >= payload.ResolveAfterHours {
+			writeError(w, http.StatusBadRequest, "warnAfterHours must be less than resolveAfterHours")
+			return
+		}
+		_, err := h.db.ExecContext(
+			ctx,
+			`INSERT INTO support_autoclose_policies (category, warn_after_hours, resolve_after_hours, archive_after_hours, updated_at)
+			 VALUES ($1, $2, $3, $4, $5)
+			 ON CONFLICT (category) DO UPDATE SET
+			   warn_after_hours = EXCLUDED.warn_after_hours,
+			   resolve_after_hours = EXCLUDED.resolve_after_hours,
+			   archive_after_hours = EXCLUDED.archive_after_hours,
+			   updated_at = EXCLUDED.updated_at`,
+			payload.Category,
+			payload.WarnAfterHours,
+			payload.ResolveAfterHours,
+			payload.ArchiveAfterHours,
+			time.Now().UTC(),
+		)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to save auto-close policy")
+			return
+		}
+	} else if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	policies, err := loadSupportAutoClosePolicies(ctx, h.db)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load auto-close policies")
+		return
+	}
+	items := make([]supportAutoClosePolicy, 0, len(policies))
+	for _, policy := range policies {
+		items = append(items, policy)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Category < items[j].Category })
+	writeJSON(w, http.StatusOK, map[string]any{"policies": items})
+}
+
+// StartAutoClose warns, resolves and archives stale tickets according to
+// support_autoclose_policies.
+func (h *SupportHandler) StartAutoClose(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(10 * time.Minute)
+		defer ticker.Stop()
+
+		for {
+			if err := h.runAutoClose(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("support auto-close failed: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+type staleSupportTicket struct {
+	ID            int64
+	Category      string
+	Status        string
+	LastAuthor    string
+	LastMessageAt time.Time
+	WarnedAt      *time.Time
+	ResolvedAt    *time.Time
+}
+
+func (h *SupportHandler) runAutoClose(ctx context.Context) error {
+	queryCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	policies, err := loadSupportAutoClosePolicies(queryCtx, h.db)
+	if err != nil {
+		cancel()
+		return err
+	}
+	// System messages don't count as activity, otherwise the warning itself
+	// would restart the clock.
+	rows, err := h.db.QueryContext(
+		queryCtx,
+		`SELECT t.id, t.category, t.status, last.author_type, last.created_at, t.autoclose_warned_at, t.resolved_at
+		 FROM support_tickets t
+		 JOIN LATERAL (
+		   SELECT m.author_type, m.created_at
+		   FROM support_ticket_messages m
+		   WHERE m.ticket_id = t.id AND m.deleted_at IS NULL AND m.author_type <> 'system'
+		   ORDER BY m.created_at DESC, m.id DESC
+		   LIMIT 1
+		 ) last ON TRUE
+		 WHERE t.status IN ('open', 'resolved')`,
+	)
+	if err != nil {
+		cancel()
+		return err
+	}
+	tickets := make([]staleSupportTicket, 0)
+	for rows.Next() {
+		var ticket staleSupportTicket
+		var warnedAt, resolvedAt sql.NullTime
+		if err := rows.Scan(&ticket.ID, &ticket.Category, &ticket.Status, &ticket.LastAuthor, &ticket.LastMessageAt, &warnedAt, &resolvedAt); err != nil {
+			rows.Close()
+			cancel()
+			return err
+		}
+		ticket.WarnedAt = scanNullableTime(warnedAt)
+		ticket.ResolvedAt = scanNullableTime(resolvedAt)
+		tickets = append(tickets, ticket)
+	}
+	rows.Close()
+	cancel()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, stale := range tickets {
+		policy := supportAutoClosePolicyFor(policies, stale.Category)
+		step := supportAutoCloseStep(stale, policy, now)
+		if step == "" {
+			continue
+		}
+		stepCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		if err := h.applyAutoCloseStep(stepCtx, stale.ID, step, policy); err != nil {
+			log.Printf("support ticket %d auto-close %s failed: %v", stale.ID, step, err)
+		}
+		cancel()
+	}
+	return nil
+}
+
+// supportAutoCloseStep returns "warn", "resolve", "archive" or "" for a ticket.
+func supportAutoCloseStep(ticket staleSupportTicket, policy supportAutoClosePolicy, now time.Time) string {
+	hours := func(value int) time.Duration { return time.Duration(value) * time.Hour }
+
+	if ticket.Status == "resolved" {
+		if policy.ArchiveAfterHours > 0 && ticket.ResolvedAt != nil && now.Sub(*ticket.ResolvedAt) >= hours(policy.ArchiveAfterHours) {
+			return "archive"
+		}
+		return ""
+	}
+	// Only tickets where the player owes an answer go stale.
+	if ticket.LastAuthor != "admin" {
+		return ""
+	}
+	idle := now.Sub(ticket.LastMessageAt)
+	warned := ticket.WarnedAt != nil && ticket.WarnedAt.After(ticket.LastMessageAt)
+	if policy.ResolveAfterHours > 0 && idle >= hours(policy.ResolveAfterHours) {
+		// The player always gets the warning, and the full time it promises,
+		// before the ticket is closed.
+		if policy.WarnAfterHours == 0 {
+			return "resolve"
+		}
+		if !warned {
+			return "warn"
+		}
+		if now.Sub(*ticket.WarnedAt) >= hours(policy.ResolveAfterHours-policy.WarnAfterHours) {
+			return "resolve"
+		}
+		return ""
+	}
+	if policy.WarnAfterHours > 0 && idle >= hours(policy.WarnAfterHours) && !warned {
+		return "warn"
+	}
+	return ""
+}
+
+func (h *SupportHandler) applyAutoCloseStep(ctx context.Context, ticketID int64, step string, policy supportAutoClosePolicy) error {
+	ticket, err := h.loadTicket(ctx, ticketID)
+	if err != nil {
+		return err
+	}
+
+	switch step {
+	case "warn":
+		text := "Мы давно не получали от вас ответа. Если вопрос ещё актуален, напишите в этот тикет, иначе он будет закрыт автоматически."
+		if policy.ResolveAfterHours > 0 && policy.ResolveAfterHours > policy.WarnAfterHours {
+			text = fmt.Sprintf("Мы давно не получали от вас ответа. Если вопрос ещё актуален, напишите в этот тикет — иначе он будет закрыт примерно через %s.", supportHoursText(policy.ResolveAfterHours-policy.WarnAfterHours))
+		}
+		// The warning and its timestamp are stored together, so it is never
+		// lost or posted twice.
+		tx, err := h.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := tx.ExecContext(ctx, `UPDATE support_tickets SET autoclose_warned_at = $1 WHERE id = $2`, time.Now().UTC(), ticket.ID); err != nil {
+			return err
+		}
+		messageID, err := h.insertTicketSystemMessage(ctx, tx, ticket.ID, text)
+		if err != nil {
+			return err
+		}
+		if err := h.outbox.commit(tx); err != nil {
+			return err
+		}
+		h.announceTicketSystemMessage(ctx, ticket, messageID, text)
+		return nil
+	case "resolve":
+		// The status changes before the notice is posted: the other way
+		// round, a failed status change would repeat the notice every run.
+		if err := h.setTicketStatus(ctx, &ticket, "resolved"); err != nil {
+			return err
+		}
+		return h.postTicketSystemMessage(ctx, ticket, "Тикет закрыт автоматически, потому что мы не получили ответа. Если проблема осталась, создайте новый тикет.")
+	case "archive":
+		if err := h.setTicketStatus(ctx, &ticket, "archived"); err != nil {
+			return err
+		}
+		return h.postTicketSystemMessage(ctx, ticket, "Тикет перенесён в архив.")
+	}
+	return nil
+}
+
+// postTicketSystemMessage adds an automatic notice to the ticket chat and
+// tells the player about it.
+func (h *SupportHandler) postTicketSystemMessage(ctx context.Context, ticket models.Ticket, text string) error {
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	messageID, err := h.insertTicketSystemMessage(ctx, tx, ticket.ID, text)
+	if err != nil {
+		return err
+	}
+	if err := h.outbox.commit(tx); err != nil {
+		return err
+	}
+	h.announceTicketSystemMessage(ctx, ticket, messageID, text)
+	return nil
+}
+
+// insertTicketSystemMessage stores a notice and queues it for Discord in tx.
+func (h *SupportHandler) insertTicketSystemMessage(ctx context.Context, tx *sql.Tx, ticketID int64, text string) (int64, error) {
+	var messageID int64
+	err := tx.QueryRowContext(
+		ctx,
+		`INSERT INTO support_ticket_messages (ticket_id, author_type, author_name, message, read_by_user, created_at)
+		 VALUES ($1, 'system', $2, $3, FALSE, $4)
+		 RETURNING id`,
+		ticketID,
+		supportSystemAuthorName,
+		text,
+		time.Now().UTC(),
+	).Scan(&messageID)
+	if err != nil {
+		return 0, err
+	}
+	return messageID, h.enqueueTicketMessage(ctx, tx, ticketID, messageID)
+}
+
+func (h *SupportHandler) announceTicketSystemMessage(ctx context.Context, ticket models.Ticket, messageID int64, text string) {
+	_ = h.writeTicketHistoryHTML(ctx, ticket)
+	h.publishTicketMessage(ctx, ticket.ID, messageID, supportEventMessage)
+	h.sendTicketReplyPush(ctx, ticket, supportSystemAuthorName, text)
+}
+
+func supportHoursText(hours int) string {
+	if hours%24 == 0 {
+		return fmt.Sprintf("%d дн.", hours/24)
+	}
+	return fmt.Sprintf("%d ч.", hours)
+}
@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSupportAutoCloseStep(t *testing.T) {
+	last := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(hours int) *time.Time {
+		value := last.Add(time.Duration(hours) * time.Hour)
+		return &value
+	}
+	policy := supportAutoClosePolicy{WarnAfterHours: 48, ResolveAfterHours: 72, ArchiveAfterHours: 24}
+
+	cases := []struct {
+		name   string
+		ticket staleSupportTicket
+		policy supportAutoClosePolicy
+		now    int
+		want   string
+	}{
+		{"fresh staff reply", staleSupportTicket{Status: "open", LastAuthor: "admin"}, policy, 47, ""},
+		{"warn after the idle time", staleSupportTicket{Status: "open", LastAuthor: "admin"}, policy, 48, "warn"},
+		{"warn only once", staleSupportTicket{Status: "open", LastAuthor: "admin", WarnedAt: at(48)}, policy, 60, ""},
+		{"player owes nothing", staleSupportTicket{Status: "open", LastAuthor: "user"}, policy, 100, ""},
+		{"warned before the last reply", staleSupportTicket{Status: "open", LastAuthor: "admin", WarnedAt: at(-1)}, policy, 50, "warn"},
+		{"missed warning is sent before resolving", staleSupportTicket{Status: "open", LastAuthor: "admin"}, policy, 100, "warn"},
+		{"late warning gets its full time", staleSupportTicket{Status: "open", LastAuthor: "admin", WarnedAt: at(100)}, policy, 110, ""},
+		{"resolve after the promised time", staleSupportTicket{Status: "open", LastAuthor: "admin", WarnedAt: at(100)}, policy, 124, "resolve"},
+		{"resolve on time", staleSupportTicket{Status: "open", LastAuthor: "admin", WarnedAt: at(48)}, policy, 72, "resolve"},
+		{"no warning configured", staleSupportTicket{Status: "open", LastAuthor: "admin"}, supportAutoClosePolicy{ResolveAfterHours: 72}, 72, "resolve"},
+		{"archive after resolution", staleSupportTicket{Status: "resolved", ResolvedAt: at(0)}, policy, 24, "archive"},
+		{"archive waits", staleSupportTicket{Status: "resolved", ResolvedAt: at(0)}, policy, 23, ""},
+		{"archive off", staleSupportTicket{Status: "resolved", ResolvedAt: at(0)}, supportAutoClosePolicy{}, 1000, ""},
+	}
+	for _, tc := range cases {
+		tc.ticket.LastMessageAt = last
+		now := last.Add(time.Duration(tc.now) * time.Hour)
+		if got := supportAutoCloseStep(tc.ticket, tc.policy, now); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
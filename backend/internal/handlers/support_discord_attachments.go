@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DiscordAttachment is a file attached to a Discord message.
+type DiscordAttachment struct {
+	ID          string `json:"id"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	URL         string `json:"url"`
+}
+
+// Besides images staff often send logs and documents, so a few plain file
+// types are accepted from Discord. Anything else is skipped.
+var supportDiscordFileTypes = map[string]struct{}{
+	"application/pdf": {},
+	"application/zip": {},
+	"text/plain":      {},
+}
+
+var supportDiscordAttachmentHosts = map[string]struct{}{
+	"cdn.discordapp.com":   {},
+	"media.discordapp.net": {},
+}
+
+// importDiscordAttachments downloads the files of a staff reply sent from
+// Discord and stores them on the ticket message. It returns how many files
+// were saved.
+func (h *SupportHandler) importDiscordAttachments(ctx context.Context, ticketID, messageID int64, attachments []DiscordAttachment) int {
+	saved := 0
+	for _, attachment := range attachments {
+		upload, err := downloadDiscordAttachment(ctx, attachment)
+		if err == nil {
+			upload, err = h.prepareSupportUpload(ctx, upload)
+		}
+		if err != nil {
+			log.Printf("support ticket %d discord attachment %s skipped: %v", ticketID, attachment.ID, err)
+			continue
+		}
+		if err := h.saveTicketAttachment(ctx, h.db, ticketID, messageID, upload); err != nil {
+			log.Printf("support ticket %d discord attachment %s not saved: %v", ticketID, attachment.ID, err)
+			continue
+		}
+		saved++
+	}
+	return saved
+}
+
+func downloadDiscordAttachment(ctx context.Context, attachment DiscordAttachment) (supportUpload, error) {
+	if attachment.Size > maxSupportImageBytes {
+		return supportUpload{}, fmt.Errorf("file is larger than %d bytes", maxSupportImageBytes)
+	}
+	parsed, err := url.Parse(strings.TrimSpace(attachment.URL))
+	if err != nil || parsed.Scheme != "https" {
+		return supportUpload{}, fmt.Errorf("invalid attachment url")
+	}
+	if _, ok := supportDiscordAttachmentHosts[strings.ToLower(parsed.Hostname())]; !ok {
+		return supportUpload{}, fmt.Errorf("unexpected attachment host %q", parsed.Hostname())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, parsed.String(), nil)
+	if err != nil {
+		return supportUpload{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return supportUpload{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return supportUpload{}, errUnexpectedStatus(resp.StatusCode)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxSupportImageBytes+1))
+	if err != nil {
+		return supportUpload{}, err
+	}
+	if len(raw) == 0 || len(raw) > maxSupportImageBytes {
+		return supportUpload{}, fmt.Errorf("file must be between 1 byte and 10mb")
+	}
+
+	// Trust the bytes rather than the content type Discord reports.
+	mimeType := strings.TrimSpace(strings.SplitN(http.DetectContentType(raw), ";", 2)[0])
+	if !supportDiscordFileAllowed(mimeType) {
+		return supportUpload{}, fmt.Errorf("file type %q is not allowed", mimeType)
+	}
+	return supportUpload{
+		Name:     sanitizeSupportFileName(attachment.Filename, mimeType),
+		MimeType: mimeType,
+		Bytes:    raw,
+	}, nil
+}
+
+func supportDiscordFileAllowed(mimeType string) bool {
+	if strings.HasPrefix(mimeType, "image/") {
+		return true
+	}
+	_, ok := supportDiscordFileTypes[mimeType]
+	return ok
+}
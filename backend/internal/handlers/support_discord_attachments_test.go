@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDownloadDiscordAttachmentRefusesForeignFiles(t *testing.T) {
+	cases := map[string]DiscordAttachment{
+		"other host":     {URL: "https://example.org/attachments/1/2/log.txt", Size: 10},
+		"lookalike host": {URL: "https://cdn.discordapp.com.example.org/attachments/1/2/log.txt", Size: 10},
+		"plain http":     {URL: "http://cdn.discordapp.com/attachments/1/2/log.txt", Size: 10},
+		"internal":       {URL: "https://169.254.169.254/latest/meta-data/", Size: 10},
+		"too large":      {URL: "https://cdn.discordapp.com/attachments/1/2/big.zip", Size: maxSupportImageBytes + 1},
+		"no url":         {Size: 10},
+	}
+	for name, attachment := range cases {
+		if _, err := downloadDiscordAttachment(context.Background(), attachment); err == nil {
+			t.Errorf("%s: downloaded %q", name, attachment.URL)
+		}
+	}
+}
+
+func TestSupportDiscordFileAllowed(t *testing.T) {
+	for mimeType, want := range map[string]bool{
+		"image/png":                true,
+		"image/webp":               true,
+		"application/pdf":          true,
+		"application/zip":          true,
+		"text/plain":               true,
+		"text/html":                false,
+		"application/octet-stream": false,
+		"application/x-msdownload": false,
+	} {
+		if got := supportDiscordFileAllowed(mimeType); got != want {
+			t.Errorf("%s: got %t, want %t", mimeType, got, want)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"amy/minecraft-server/internal/discord"
+	"amy/minecraft-server/internal/models"
+)
+
+// enqueueTicketUpdate queues an edit of the ticket's Discord message or
+// thread starter after a change of status, assignee, rating or read state.
+func (h *SupportHandler) enqueueTicketUpdate(ctx context.Context, exec sqlExecer, ticketID int64) error {
+	return h.outbox.enqueue(ctx, exec, discordEntitySupportTicket, strconv.FormatInt(ticketID, 10), discordActionUpdate, "")
+}
+
+// changeTicket runs a statement that changes what the Discord ticket message
+// shows and queues the matching edit in the same transaction.
+func (h *SupportHandler) changeTicket(ctx context.Context, ticketID int64, query string, args ...any) error {
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return err
+	}
+	if err := h.enqueueTicketUpdate(ctx, tx, ticketID); err != nil {
+		return err
+	}
+	return h.outbox.commit(tx)
+}
+
+// enqueueTicketMessage queues forwarding a chat message, with the attachments
+// already saved for it, to the ticket's Discord thread or channel.
+func (h *SupportHandler) enqueueTicketMessage(ctx context.Context, exec sqlExecer, ticketID, messageID int64) error {
+	return h.outbox.enqueue(ctx, exec, discordEntitySupportTicket, strconv.FormatInt(ticketID, 10), discordActionMessage, strconv.FormatInt(messageID, 10))
+}
+
+// syncTicketDiscord is the outbox performer for support tickets.
+func (h *SupportHandler) syncTicketDiscord(ctx context.Context, item discordOutboxItem) error {
+	if item.Action == discordActionDelete {
+		return h.deleteTicketDiscord(ctx, item.Ref)
+	}
+	ticketID, err := strconv.ParseInt(item.EntityID, 10, 64)
+	if err != nil {
+		return nil
+	}
+	ticket, err := h.loadTicket(ctx, ticketID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch item.Action {
+	case discordActionPost:
+		if ticket.DiscordMessageID != "" || ticket.DiscordThreadID != "" {
+			return h.updateDiscordTicketMessage(ctx, ticket)
+		}
+		return h.postTicketDiscord(ctx, ticket)
+	case discordActionMessage:
+		messageID, err := strconv.ParseInt(item.Ref, 10, 64)
+		if err != nil {
+			return nil
+		}
+		return h.forwardTicketMessageDiscord(ctx, ticket, messageID)
+	default:
+		return h.updateDiscordTicketMessage(ctx, ticket)
+	}
+}
+
+// postTicketDiscord opens the ticket thread, or posts the ticket through the
+// webhook when threads are off or the thread cannot be created. A thread
+// whose starter message failed is kept rather than retried, so a retry never
+// opens a second thread for the same ticket.
+func (h *SupportHandler) postTicketDiscord(ctx context.Context, ticket models.Ticket) error {
+	if h.supportThreadsEnabled() {
+		threadID, messageID, err := h.createDiscordTicketThread(ctx, ticket)
+		if threadID != "" {
+			if err != nil {
+				log.Printf("support ticket %d discord thread starter failed: %v", ticket.ID, err)
+			}
+			_, err = h.db.ExecContext(ctx, `UPDATE support_tickets SET discord_thread_id = $1, discord_channel_id = $1, discord_message_id = $2 WHERE id = $3`, threadID, messageID, ticket.ID)
+			return err
+		}
+		if h.webhookURL == "" {
+			return err
+		}
+		log.Printf("support ticket %d discord thread failed, falling back to webhook: %v", ticket.ID, err)
+	}
+
+	messageID, channelID, err := h.sendDiscordWebhook(ctx, ticket)
+	if err != nil || messageID == "" {
+		return err
+	}
+	_, err = h.db.ExecContext(ctx, `UPDATE support_tickets SET discord_message_id = $1, discord_channel_id = $2 WHERE id = $3`, messageID, channelID, ticket.ID)
+	return err
+}
+
+// forwardTicketMessageDiscord sends one chat message to Discord. Messages
+// that already carry a Discord id were written there in the first place or
+// were forwarded by an earlier attempt.
+func (h *SupportHandler) forwardTicketMessageDiscord(ctx context.Context, ticket models.Ticket, messageID int64) error {
+	var authorType, authorName, text, replySource, discordMessageID string
+	var deleted bool
+	err := h.db.QueryRowContext(
+		ctx,
+		`SELECT author_type, author_name, message, reply_source, discord_message_id, deleted_at IS NOT NULL
+		 FROM support_ticket_messages WHERE id = $1 AND ticket_id = $2`,
+		messageID,
+		ticket.ID,
+	).Scan(&authorType, &authorName, &text, &replySource, &discordMessageID, &deleted)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if discordMessageID != "" || deleted {
+		return nil
+	}
+
+	files, total, err := h.loadTicketMessageUploads(ctx, messageID)
+	if err != nil {
+		return err
+	}
+	if text == "" && total > 0 {
+		text = fmt.Sprintf("[изображений: %d]", total)
+	}
+	threaded := ticket.DiscordThreadID != "" && h.supportThreadsEnabled()
+
+	switch authorType {
+	case "user":
+		discordMessageID, err = h.sendDiscordTicketChatMessage(ctx, ticket, text, files)
+	case "admin":
+		if !threaded {
+			return nil
+		}
+		if replySource == "" {
+			replySource = "сайт"
+		}
+		discordMessageID, err = h.postDiscordThreadMessage(ctx, ticket, fmt.Sprintf("**%s** (%s):\n%s", authorName, replySource, trimForDiscord(text)), files)
+	case "system":
+		if !threaded || normalizedTicketStatus(ticket.Status) != "open" {
+			return nil
+		}
+		discordMessageID, err = h.postDiscordThreadMessage(ctx, ticket, "_"+trimForDiscord(text)+"_", nil)
+	default:
+		return nil
+	}
+	if err != nil || discordMessageID == "" {
+		return err
+	}
+	_, err = h.db.ExecContext(ctx, `UPDATE support_ticket_messages SET discord_message_id = $1 WHERE id = $2`, discordMessageID, messageID)
+	return err
+}
+
+// loadTicketMessageUploads reads the deliverable files of a message back
+// from disk. total counts quarantined files as well, for the placeholder text
+// of a message without words.
+func (h *SupportHandler) loadTicketMessageUploads(ctx context.Context, messageID int64) ([]supportUpload, int, error) {
+	rows, err := h.db.QueryContext(
+		ctx,
+		`SELECT file_name, mime_type, storage_path, quarantined_at IS NOT NULL
+		 FROM support_ticket_attachments WHERE message_id = $1 ORDER BY id`,
+		messageID,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	files := make([]supportUpload, 0)
+	total := 0
+	for rows.Next() {
+		var upload supportUpload
+		var path string
+		var quarantined bool
+		if err := rows.Scan(&upload.Name, &upload.MimeType, &path, &quarantined); err != nil {
+			return nil, 0, err
+		}
+		total++
+		if quarantined {
+			continue
+		}
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("support message %d attachment %s not readable: %v", messageID, strings.TrimSpace(upload.Name), err)
+			continue
+		}
+		upload.Bytes = raw
+		files = append(files, upload)
+	}
+	return files, total, rows.Err()
+}
+
+// ticketDiscordDeleteRef is the outbox ref that removes a ticket from
+// Discord: its whole thread, or the webhook message for tickets without one.
+func ticketDiscordDeleteRef(threadID, messageID string) string {
+	if threadID = strings.TrimSpace(threadID); threadID != "" {
+		return "thread:" + threadID
+	}
+	if messageID = strings.TrimSpace(messageID); messageID != "" {
+		return "message:" + messageID
+	}
+	return ""
+}
+
+// deleteTicketDiscord performs a ticketDiscordDeleteRef. Deleting a thread
+// also deletes every message in it.
+func (h *SupportHandler) deleteTicketDiscord(ctx context.Context, ref string) error {
+	kind, id, _ := strings.Cut(ref, ":")
+	var err error
+	switch {
+	case id == "":
+		return nil
+	case kind == "thread":
+		if !h.discord.Configured() {
+			return nil
+		}
+		err = h.discordBotJSON(ctx, "support_ticket_delete", http.MethodDelete, "/channels/"+url.PathEscape(id), nil, nil)
+	case kind == "message":
+		if h.webhookURL == "" {
+			return nil
+		}
+		err = h.discord.DeleteWebhookMessage(ctx, "support_ticket_delete", h.webhookURL, id)
+	}
+	if err != nil && !discord.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
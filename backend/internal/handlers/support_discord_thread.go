@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"amy/minecraft-server/internal/discord"
+	"amy/minecraft-server/internal/models"
+)
+
+const (
+	discordChannelTypePrivateThread = 12
+	discordChannelTypeGuildForum    = 15
+
+	maxDiscordThreadNameLength = 100
+)
+
+type discordChannel struct {
+	ID      string                 `json:"id"`
+	Type    int                    `json:"type"`
+	Message *discordWebhookMessage `json:"message"`
+}
+
+// supportThreadsEnabled reports whether tickets get their own Discord thread
+// under DISCORD_TICKET_CHANNEL_ID instead of a webhook message.
+func (h *SupportHandler) supportThreadsEnabled() bool {
+	return h.discord.Configured() && h.ticketChannelID != ""
+}
+
+// createDiscordTicketThread opens a forum post or a private thread for the
+// ticket and posts the ticket embed as its first message. It returns the
+// thread ID and the ID of that first message.
+func (h *SupportHandler) createDiscordTicketThread(ctx context.Context, ticket models.Ticket) (string, string, error) {
+	channelType, err := h.ticketChannelType(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	name := truncateRunes(fmt.Sprintf("#%d %s", ticket.ID, strings.TrimSpace(ticket.Subject)), maxDiscordThreadNameLength)
+	starter := h.buildDiscordTicketPayload(ticket)
+	starter["allowed_mentions"] = map[string]any{"parse": []string{}}
+
+	var thread discordChannel
+	if channelType == discordChannelTypeGuildForum {
+		err = h.discordBotJSON(ctx, "support_thread_create", http.MethodPost, "/channels/"+url.PathEscape(h.ticketChannelID)+"/threads", map[string]any{
+			"name":                  name,
+			"auto_archive_duration": 10080,
+			"message":               starter,
+		}, &thread)
+		if err != nil {
+			return "", "", err
+		}
+		messageID := thread.ID
+		if thread.Message != nil && thread.Message.ID != "" {
+			messageID = thread.Message.ID
+		}
+		h.addStaffToDiscordThread(ctx, thread.ID)
+		return thread.ID, messageID, nil
+	}
+
+	err = h.discordBotJSON(ctx, "support_thread_create", http.MethodPost, "/channels/"+url.PathEscape(h.ticketChannelID)+"/threads", map[string]any{
+		"name":                  name,
+		"type":                  discordChannelTypePrivateThread,
+		"invitable":             false,
+		"auto_archive_duration": 10080,
+	}, &thread)
+	if err != nil {
+		return "", "", err
+	}
+	h.addStaffToDiscordThread(ctx, thread.ID)
+
+	var message discordWebhookMessage
+	if err := h.discordBotJSON(ctx, "support_thread_message", http.MethodPost, "/channels/"+url.PathEscape(thread.ID)+"/messages", starter, &message); err != nil {
+		return thread.ID, "", err
+	}
+	return thread.ID, message.ID, nil
+}
+
+func (h *SupportHandler) ticketChannelType(ctx context.Context) (int, error) {
+	h.threadMu.Lock()
+	defer h.threadMu.Unlock()
+	if h.ticketChannelKind != nil {
+		return *h.ticketChannelKind, nil
+	}
+	var channel discordChannel
+	if err := h.discordBotJSON(ctx, "support_thread_channel", http.MethodGet, "/channels/"+url.PathEscape(h.ticketChannelID), nil, &channel); err != nil {
+		return 0, err
+	}
+	h.ticketChannelKind = &channel.Type
+	return channel.Type, nil
+}
+
+// addStaffToDiscordThread makes private threads visible to support staff who
+// lack the Manage Threads permission.
+func (h *SupportHandler) addStaffToDiscordThread(ctx context.Context, threadID string) {
+	for staffID := range h.staffIDs {
+		_ = h.discordBotJSON(ctx, "support_thread_member", http.MethodPut, "/channels/"+url.PathEscape(threadID)+"/thread-members/"+url.PathEscape(staffID), nil, nil)
+	}
+}
+
+// setDiscordTicketThreadArchived archives and locks the thread of a ticket,
+// or reopens it.
+func (h *SupportHandler) setDiscordTicketThreadArchived(ctx context.Context, ticket models.Ticket, archived bool) error {
+	if !h.supportThreadsEnabled() || ticket.DiscordThreadID == "" {
+		return nil
+	}
+	return h.discordBotJSON(ctx, "support_thread_state", http.MethodPatch, "/channels/"+url.PathEscape(ticket.DiscordThreadID), map[string]any{
+		"archived": archived,
+		"locked":   archived,
+	}, nil)
+}
+
+func (h *SupportHandler) postDiscordThreadMessage(ctx context.Context, ticket models.Ticket, content string, files []supportUpload) (string, error) {
+	var message discordWebhookMessage
+	err := h.discord.Do(ctx, discord.Request{
+		Kind:   "support_thread_message",
+		Method: http.MethodPost,
+		Path:   "/channels/" + url.PathEscape(ticket.DiscordThreadID) + "/messages",
+		JSON: map[string]any{
+			"content":          content,
+			"allowed_mentions": map[string]any{"parse": []string{}},
+		},
+		Files: discordFiles(deliverableSupportUploads(files)),
+	}, &message)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(message.ID), nil
+}
+
+func (h *SupportHandler) discordBotJSON(ctx context.Context, operation, method, path string, payload any, target any) error {
+	return h.discord.Do(ctx, discord.Request{Kind: operation, Method: method, Path: path, JSON: payload}, target)
+}
+
+func discordFiles(files []supportUpload) []discord.File {
+	converted := make([]discord.File, 0, len(files))
+	for _, file := range files {
+		converted = append(converted, discord.File{Name: file.Name, ContentType: file.MimeType, Data: file.Bytes})
+	}
+	return converted
+}
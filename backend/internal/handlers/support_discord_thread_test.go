@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"amy/minecraft-server/internal/discord"
+	"amy/minecraft-server/internal/models"
+)
+
+type recordedDiscordCall struct {
+	method, path string
+	body         map[string]any
+}
+
+// fakeDiscord records the calls a handler makes and answers them with an
+// empty JSON object.
+func fakeDiscord(t *testing.T) (*discord.Client, func() []recordedDiscordCall) {
+	t.Helper()
+	var mu sync.Mutex
+	var calls []recordedDiscordCall
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := recordedDiscordCall{method: r.Method, path: r.URL.Path}
+		_ = json.NewDecoder(r.Body).Decode(&call.body)
+		mu.Lock()
+		calls = append(calls, call)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(server.Close)
+	return discord.New("token", discord.WithBaseURL(server.URL)), func() []recordedDiscordCall {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]recordedDiscordCall(nil), calls...)
+	}
+}
+
+func TestUpdateDiscordTicketThreadReopensArchivedThread(t *testing.T) {
+	client, calls := fakeDiscord(t)
+	h := &SupportHandler{discord: client, ticketChannelID: "100"}
+	ticket := models.Ticket{ID: 7, Subject: "Не могу зайти", Status: "resolved", DiscordThreadID: "200", DiscordMessageID: "300"}
+
+	if err := h.updateDiscordTicketThread(context.Background(), ticket); err != nil {
+		t.Fatal(err)
+	}
+	got := calls()
+	want := []struct {
+		path     string
+		archived any
+	}{
+		{"/channels/200", false},
+		{"/channels/200/messages/300", nil},
+		{"/channels/200", true},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d calls, want %d: %+v", len(got), len(want), got)
+	}
+	for i, call := range got {
+		if call.method != http.MethodPatch || call.path != want[i].path || call.body["archived"] != want[i].archived {
+			t.Errorf("call %d: %s %s archived=%v, want PATCH %s archived=%v", i, call.method, call.path, call.body["archived"], want[i].path, want[i].archived)
+		}
+	}
+	if got[2].body["locked"] != true {
+		t.Errorf("the closed ticket's thread was not locked again")
+	}
+
+	ticket.Status = "open"
+	if err := h.updateDiscordTicketThread(context.Background(), ticket); err != nil {
+		t.Fatal(err)
+	}
+	if got := calls()[3:]; len(got) != 2 || got[0].body["archived"] != false || got[1].path != "/channels/200/messages/300" {
+		t.Errorf("open ticket: unexpected calls %+v", got)
+	}
+}
@@ -0,0 +1,761 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html"
+	htmltemplate "html/template"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"amy/minecraft-server/internal/models"
+)
+
+// SupportMailer delivers ticket updates to the e-mail address a player left
+// on the ticket form. Messages go through support_email_outbox so a flaky
+// SMTP server only delays them.
+type SupportMailer struct {
+	db           *sql.DB
+	smtpAddr     string
+	smtpHost     string
+	username     string
+	password     string
+	from         string
+	replyTo      string
+	publicURL    string
+	secret       []byte
+	inboundToken string
+	sendMail     func(addr string, auth smtp.Auth, from string, to []string, msg []byte) error
+}
+
+type supportEmailTemplateData struct {
+	TicketID       int64
+	Subject        string
+	Name           string
+	AuthorName     string
+	Message        string
+	StatusText     string
+	TicketURL      string
+	UnsubscribeURL string
+}
+
+type supportEmailTemplate struct {
+	subject *template.Template
+	text    *template.Template
+	html    *htmltemplate.Template
+}
+
+const (
+	supportEmailKindReply  = "reply"
+	supportEmailKindStatus = "status"
+
+	supportEmailMaxAttempts = 8
+	supportEmailBatchSize   = 20
+	maxSupportInboundBytes  = 15 * 1024 * 1024
+)
+
+var supportEmailTemplates = map[string]supportEmailTemplate{
+	supportEmailKindReply: {
+		subject: template.Must(template.New("reply_subject").Parse(`[Тикет #{{.TicketID}}] Новый ответ поддержки`)),
+		text: template.Must(template.New("reply_text").Parse(`Здравствуйте, {{.Name}}!
+
+{{.AuthorName}} ответил(а) на ваш тикет #{{.TicketID}} «{{.Subject}}»:
+
+{{.Message}}
+
+Открыть переписку: {{.TicketURL}}
+Можно ответить прямо на это письмо.
+
+Отписаться от писем поддержки: {{.UnsubscribeURL}}
+`)),
+		html: htmltemplate.Must(htmltemplate.New("reply_html").Parse(`<!doctype html>
+<html><body style="font-family:Arial,sans-serif;color:#111">
+<p>Здравствуйте, {{.Name}}!</p>
+<p>{{.AuthorName}} ответил(а) на ваш тикет #{{.TicketID}} «{{.Subject}}»:</p>
+<blockquote style="border-left:4px solid #5865f2;margin:0;padding:8px 12px;white-space:pre-wrap">{{.Message}}</blockquote>
+<p><a href="{{.TicketURL}}">Открыть переписку</a>. Можно ответить прямо на это письмо.</p>
+<p style="color:#666;font-size:12px"><a href="{{.UnsubscribeURL}}">Отписаться от писем поддержки</a></p>
+</body></html>`)),
+	},
+	supportEmailKindStatus: {
+		subject: template.Must(template.New("status_subject").Parse(`[Тикет #{{.TicketID}}] Статус: {{.StatusText}}`)),
+		text: template.Must(template.New("status_text").Parse(`Здравствуйте, {{.Name}}!
+
+Статус вашего тикета #{{.TicketID}} «{{.Subject}}» изменён: {{.StatusText}}.
+
+Открыть переписку: {{.TicketURL}}
+
+Отписаться от писем поддержки: {{.UnsubscribeURL}}
+`)),
+		html: htmltemplate.Must(htmltemplate.New("status_html").Parse(`<!doctype html>
+<html><body style="font-family:Arial,sans-serif;color:#111">
+<p>Здравствуйте, {{.Name}}!</p>
+<p>Статус вашего тикета #{{.TicketID}} «{{.Subject}}» изменён: <strong>{{.StatusText}}</strong>.</p>
+<p><a href="{{.TicketURL}}">Открыть переписку</a></p>
+<p style="color:#666;font-size:12px"><a href="{{.UnsubscribeURL}}">Отписаться от писем поддержки</a></p>
+</body></html>`)),
+	},
+}
+
+var (
+	supportEmailPlusTagRe     = regexp.MustCompile(`(?i)\+t(\d+)-([0-9a-f]{16})@`)
+	supportEmailQuoteHeaderRe = regexp.MustCompile(`(?im)^(?:on .+ wrote:|.+ написал(?:\(а\))?:|-{2,}\s*original message\s*-{2,}|-{2,}\s*исходное сообщение\s*-{2,})\s*$`)
+)
+
+func NewSupportMailer(db *sql.DB, smtpHost, smtpPort, username, password, from, replyTo, publicURL, secret, inboundToken string) *SupportMailer {
+	smtpHost = strings.TrimSpace(smtpHost)
+	smtpPort = strings.TrimSpace(smtpPort)
+	if smtpPort == "" {
+		smtpPort = "587"
+	}
+	return &SupportMailer{
+		db:           db,
+		smtpAddr:     net.JoinHostPort(smtpHost, smtpPort),
+		smtpHost:     smtpHost,
+		username:     strings.TrimSpace(username),
+		password:     password,
+		from:         strings.TrimSpace(from),
+		replyTo:      strings.TrimSpace(replyTo),
+		publicURL:    strings.TrimRight(strings.TrimSpace(publicURL), "/"),
+		secret:       []byte(strings.TrimSpace(secret)),
+		inboundToken: strings.TrimSpace(inboundToken),
+		sendMail:     smtp.SendMail,
+	}
+}
+
+func (m *SupportMailer) Enabled() bool {
+	return m != nil && m.smtpHost != "" && m.from != "" && len(m.secret) > 0
+}
+
+// Start runs the outbox worker until ctx is done.
+func (m *SupportMailer) Start(ctx context.Context) {
+	if !m.Enabled() {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(15 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			if err := m.deliverDue(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("support email delivery failed: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (m *SupportMailer) Enqueue(ctx context.Context, ticket models.Ticket, kind, authorName, message string) error {
+	if !m.Enabled() {
+		return nil
+	}
+	address, err := mail.ParseAddress(strings.TrimSpace(ticket.Email))
+	if err != nil {
+		return nil
+	}
+	recipient := strings.ToLower(address.Address)
+
+	var unsubscribed bool
+	if err := m.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM support_email_unsubscribes WHERE email = $1)`, recipient).Scan(&unsubscribed); err != nil {
+		return err
+	}
+	if unsubscribed {
+		return nil
+	}
+
+	tmpl, ok := supportEmailTemplates[kind]
+	if !ok {
+		return fmt.Errorf("unknown support email template %q", kind)
+	}
+	data := supportEmailTemplateData{
+		TicketID:       ticket.ID,
+		Subject:        ticket.Subject,
+		Name:           safeValue(ticket.Name),
+		AuthorName:     safeValue(authorName),
+		Message:        strings.TrimSpace(message),
+		StatusText:     supportStatusText(ticket.Status),
+		TicketURL:      m.ticketURL(ticket.ID),
+		UnsubscribeURL: m.unsubscribeURL(recipient),
+	}
+	var subject, textBody, htmlBody bytes.Buffer
+	if err := tmpl.subject.Execute(&subject, data); err != nil {
+		return err
+	}
+	if err := tmpl.text.Execute(&textBody, data); err != nil {
+		return err
+	}
+	if err := tmpl.html.Execute(&htmlBody, data); err != nil {
+		return err
+	}
+
+	_, err = m.db.ExecContext(
+		ctx,
+		`INSERT INTO support_email_outbox (ticket_id, kind, to_email, subject, text_body, html_body, next_attempt_at, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $7)`,
+		ticket.ID,
+		kind,
+		recipient,
+		subject.String(),
+		textBody.String(),
+		htmlBody.String(),
+		time.Now().UTC(),
+	)
+	return err
+}
+
+func (m *SupportMailer) deliverDue(ctx context.Context) error {
+	queryCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	// Leasing rows by pushing next_attempt_at forward keeps a slow SMTP
+	// server from holding a transaction open and lets several replicas share
+	// the outbox.
+	rows, err := m.db.QueryContext(
+		queryCtx,
+		`UPDATE support_email_outbox SET next_attempt_at = NOW() + INTERVAL '5 minutes'
+		 WHERE id IN (
+		   SELECT id FROM support_email_outbox
+		   WHERE sent_at IS NULL AND failed_at IS NULL AND next_attempt_at <= NOW()
+		   ORDER BY id
+		   LIMIT $1
+		   FOR UPDATE SKIP LOCKED
+		 )
+		 RETURNING id, ticket_id, to_email, subject, text_body, html_body, attempts`,
+		supportEmailBatchSize,
+	)
+	if err != nil {
+		return err
+	}
+	type outboxEmail struct {
+		id, ticketID                    int64
+		to, subject, textBody, htmlBody string
+		attempts                        int
+	}
+	batch := make([]outboxEmail, 0, supportEmailBatchSize)
+	for rows.Next() {
+		var item outboxEmail
+		if err := rows.Scan(&item.id, &item.ticketID, &item.to, &item.subject, &item.textBody, &item.htmlBody, &item.attempts); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		batch = append(batch, item)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, item := range batch {
+		if ctx.Err() != nil {
+			return nil
+		}
+		raw, err := m.buildMessage(item.ticketID, item.to, item.subject, item.textBody, item.htmlBody)
+		if err == nil {
+			err = m.sendMail(m.smtpAddr, m.auth(), m.fromAddress(), []string{item.to}, raw)
+		}
+		now := time.Now().UTC()
+		if err == nil {
+			_, _ = m.db.ExecContext(ctx, `UPDATE support_email_outbox SET sent_at = $1, attempts = attempts + 1, last_error = '' WHERE id = $2`, now, item.id)
+			continue
+		}
+
+		attempts := item.attempts + 1
+		var failedAt any
+		if attempts >= supportEmailMaxAttempts {
+			failedAt = now
+		}
+		_, _ = m.db.ExecContext(
+			ctx,
+			`UPDATE support_email_outbox SET attempts = $1, last_error = $2, next_attempt_at = $3, failed_at = $4 WHERE id = $5`,
+			attempts,
+			truncateRunes(err.Error(), 500),
+			now.Add(supportEmailBackoff(attempts)),
+			failedAt,
+			item.id,
+		)
+	}
+	return nil
+}
+
+func supportEmailBackoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := time.Minute << uint(attempts-1)
+	if delay > 6*time.Hour {
+		delay = 6 * time.Hour
+	}
+	return delay
+}
+
+func (m *SupportMailer) auth() smtp.Auth {
+	if m.username == "" {
+		return nil
+	}
+	return smtp.PlainAuth("", m.username, m.password, m.smtpHost)
+}
+
+func (m *SupportMailer) fromAddress() string {
+	if address, err := mail.ParseAddress(m.from); err == nil {
+		return address.Address
+	}
+	return m.from
+}
+
+func (m *SupportMailer) buildMessage(ticketID int64, to, subject, textBody, htmlBody string) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := multipart.NewWriter(&buffer)
+
+	headers := []string{
+		"From: " + m.from,
+		"To: " + to,
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject),
+		"Date: " + time.Now().UTC().Format(time.RFC1123Z),
+		"Message-ID: <" + randomHex(16) + "@" + m.messageIDDomain() + ">",
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/alternative; boundary=" + writer.Boundary(),
+		"List-Unsubscribe: <" + m.unsubscribeURL(to) + ">",
+		"List-Unsubscribe-Post: List-Unsubscribe=One-Click",
+	}
+	if replyTo := m.ticketReplyAddress(ticketID); replyTo != "" {
+		headers = append(headers, "Reply-To: "+replyTo)
+	}
+	for _, header := range headers {
+		buffer.WriteString(header + "\r\n")
+	}
+	buffer.WriteString("\r\n")
+
+	for _, part := range []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=utf-8", textBody},
+		{"text/html; charset=utf-8", htmlBody},
+	} {
+		partWriter, err := writer.CreatePart(map[string][]string{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoder := quotedprintable.NewWriter(partWriter)
+		if _, err := encoder.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+		if err := encoder.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (m *SupportMailer) messageIDDomain() string {
+	address := m.fromAddress()
+	if at := strings.LastIndex(address, "@"); at >= 0 && at < len(address)-1 {
+		return address[at+1:]
+	}
+	return "localhost"
+}
+
+func (m *SupportMailer) sign(value string) string {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (m *SupportMailer) ticketTag(ticketID int64) string {
+	return m.sign("ticket:" + strconv.FormatInt(ticketID, 10))[:16]
+}
+
+// ticketReplyAddress turns support@example.org into
+// support+t42-<signature>@example.org so inbound replies map to a ticket.
+func (m *SupportMailer) ticketReplyAddress(ticketID int64) string {
+	if m.replyTo == "" {
+		return ""
+	}
+	address, err := mail.ParseAddress(m.replyTo)
+	if err != nil {
+		return ""
+	}
+	at := strings.LastIndex(address.Address, "@")
+	if at <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s+t%d-%s%s", address.Address[:at], ticketID, m.ticketTag(ticketID), address.Address[at:])
+}
+
+func (m *SupportMailer) ticketURL(ticketID int64) string {
+	return fmt.Sprintf("%s/support?ticket=%d", m.publicURL, ticketID)
+}
+
+func (m *SupportMailer) unsubscribeURL(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	return m.publicURL + "/api/support/email/unsubscribe?" + url.Values{
+		"email": {email},
+		"sig":   {m.sign("unsubscribe:" + email)},
+	}.Encode()
+}
+
+func (m *SupportMailer) validUnsubscribe(email, signature string) bool {
+	expected := m.sign("unsubscribe:" + strings.ToLower(strings.TrimSpace(email)))
+	return hmac.Equal([]byte(expected), []byte(strings.TrimSpace(signature)))
+}
+
+// emailTicketUpdate queues an e-mail for the ticket owner when the mail
+// channel is configured.
+func (h *SupportHandler) emailTicketUpdate(ctx context.Context, ticket models.Ticket, kind, authorName, message string) {
+	if !h.mailer.Enabled() {
+		return
+	}
+	if err := h.mailer.Enqueue(ctx, ticket, kind, authorName, message); err != nil {
+		log.Printf("support email enqueue failed for ticket %d: %v", ticket.ID, err)
+	}
+}
+
+// Email routes /api/support/email/unsubscribe and /api/support/email/inbound.
+func (h *SupportHandler) Email(w http.ResponseWriter, r *http.Request) {
+	if !h.mailer.Enabled() {
+		writeError(w, http.StatusServiceUnavailable, "support email is not configured")
+		return
+	}
+	switch strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/support/email/"), "/") {
+	case "unsubscribe":
+		h.emailUnsubscribe(w, r)
+	case "inbound":
+		h.emailInbound(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// emailUnsubscribe shows a confirmation form on GET, so mail scanners that
+// prefetch the link do not unsubscribe anyone, and unsubscribes on POST: from
+// that form or as an RFC 8058 one-click List-Unsubscribe request.
+func (h *SupportHandler) emailUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	email := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("email")))
+	if email == "" || !h.mailer.validUnsubscribe(email, r.URL.Query().Get("sig")) {
+		writeError(w, http.StatusBadRequest, "invalid unsubscribe link")
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeUnsubscribeHTML(w, false, r.URL.RequestURI())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	_, err := h.db.ExecContext(ctx, `INSERT INTO support_email_unsubscribes (email, created_at) VALUES ($1, $2) ON CONFLICT (email) DO NOTHING`, email, time.Now().UTC())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to unsubscribe")
+		return
+	}
+	_, _ = h.db.ExecContext(ctx, `UPDATE support_email_outbox SET failed_at = $1, last_error = 'unsubscribed' WHERE to_email = $2 AND sent_at IS NULL AND failed_at IS NULL`, time.Now().UTC(), email)
+
+	if r.PostFormValue("List-Unsubscribe") == "One-Click" {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+		return
+	}
+	writeUnsubscribeHTML(w, true, "")
+}
+
+func writeUnsubscribeHTML(w http.ResponseWriter, done bool, action string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	title := "Отписаться от писем поддержки?"
+	body := `<p class="muted">Письма о тикетах больше не будут приходить на этот адрес. Ответы по-прежнему будут видны на сайте.</p>
+      <form method="post" action="` + html.EscapeString(action) + `"><button type="submit">Отписаться</button></form>`
+	if done {
+		title = "Вы отписались"
+		body = `<p class="muted">Письма поддержки больше не будут приходить на этот адрес. Ответы по-прежнему видны на сайте.</p>`
+	}
+	_, _ = w.Write([]byte(fmt.Sprintf(`<!doctype html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <title>%s</title>
+    <style>
+      body{font-family:system-ui;background:#0f1118;color:#fff;margin:0;padding:40px}
+      .card{max-width:760px;margin:0 auto;padding:24px;border-radius:14px;background:#171a26;border:1px solid rgba(255,255,255,.12)}
+      .muted{color:#b4b6c7}
+      button{display:inline-flex;margin-top:12px;padding:10px 14px;border-radius:10px;border:0;background:#f7c948;color:#0b0b0f;font:inherit;font-weight:700;cursor:pointer}
+    </style>
+  </head>
+  <body>
+    <div class="card">
+      <h1>%s</h1>
+      %s
+    </div>
+  </body>
+</html>`, title, title, body)))
+}
+
+func (h *SupportHandler) emailInbound(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if h.mailer.inboundToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.mailer.inboundToken)) != 1 {
+		writeError(w, http.StatusUnauthorized, "invalid inbound token")
+		return
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(r.Body, maxSupportInboundBytes+1))
+	if err != nil || len(raw) > maxSupportInboundBytes {
+		writeError(w, http.StatusRequestEntityTooLarge, "email is too large")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 20*time.Second)
+	defer cancel()
+
+	ticketID, err := h.IngestInboundEmail(ctx, raw)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok", "ticketId": ticketID})
+}
+
+// IngestInboundEmail stores a player's e-mail reply as a ticket message.
+// The ticket is found through the signed plus-address in the recipients, and
+// the sender must also match the ticket e-mail.
+func (h *SupportHandler) IngestInboundEmail(ctx context.Context, raw []byte) (int64, error) {
+	message, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return 0, fmt.Errorf("invalid email")
+	}
+	sender, err := mail.ParseAddress(message.Header.Get("From"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid sender")
+	}
+
+	// Only the signed reply address identifies the ticket: From and Subject
+	// are trivial to forge.
+	ticketID := h.inboundTicketFromRecipients(message.Header)
+	if ticketID <= 0 {
+		return 0, fmt.Errorf("ticket reference not found")
+	}
+
+	ticket, err := h.loadTicket(ctx, ticketID)
+	if err != nil {
+		return 0, fmt.Errorf("ticket not found")
+	}
+	if !strings.EqualFold(strings.TrimSpace(ticket.Email), sender.Address) {
+		return 0, fmt.Errorf("sender does not match ticket email")
+	}
+	if normalizedTicketStatus(ticket.Status) == "archived" {
+		return 0, fmt.Errorf("ticket is archived")
+	}
+
+	text, files, err := parseInboundEmailBody(message.Header, message.Body)
+	if err != nil {
+		return 0, err
+	}
+	text = stripQuotedEmailReply(text)
+	prepared := files[:0]
+	for _, file := range files {
+		upload, err := h.prepareSupportUpload(ctx, file)
+		if err != nil {
+			log.Printf("support e-mail attachment %s skipped: %v", file.Name, err)
+			continue
+		}
+		prepared = append(prepared, upload)
+	}
+	files = prepared
+	if len([]rune(text)) > 2000 {
+		text = string([]rune(text)[:2000])
+	}
+	if text == "" && len(files) == 0 {
+		return 0, fmt.Errorf("empty reply")
+	}
+
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var messageID int64
+	err = tx.QueryRowContext(
+		ctx,
+		`INSERT INTO support_ticket_messages (ticket_id, author_type, author_name, author_discord_id, message, read_by_user, created_at)
+		 VALUES ($1, 'user', $2, $3, $4, TRUE, $5)
+		 RETURNING id`,
+		ticket.ID,
+		ticket.Name,
+		ticket.OwnerDiscordID,
+		text,
+		time.Now().UTC(),
+	).Scan(&messageID)
+	if err != nil {
+		return 0, err
+	}
+	for _, file := range files {
+		if err := h.saveTicketAttachment(ctx, tx, ticket.ID, messageID, file); err != nil {
+			return ticket.ID, err
+		}
+	}
+	if err := h.enqueueTicketMessage(ctx, tx, ticket.ID, messageID); err != nil {
+		return 0, err
+	}
+	if err := h.outbox.commit(tx); err != nil {
+		return 0, err
+	}
+	_ = h.writeTicketHistoryHTML(ctx, ticket)
+	h.publishTicketMessage(ctx, ticket.ID, messageID, supportEventMessage)
+	return ticket.ID, nil
+}
+
+func (h *SupportHandler) inboundTicketFromRecipients(header mail.Header) int64 {
+	for _, key := range []string{"To", "Cc", "Delivered-To", "X-Original-To"} {
+		for _, matched := range supportEmailPlusTagRe.FindAllStringSubmatch(header.Get(key), -1) {
+			ticketID, err := strconv.ParseInt(matched[1], 10, 64)
+			if err != nil || ticketID <= 0 {
+				continue
+			}
+			if hmac.Equal([]byte(h.mailer.ticketTag(ticketID)), []byte(strings.ToLower(matched[2]))) {
+				return ticketID
+			}
+		}
+	}
+	return 0
+}
+
+func parseInboundEmailBody(header interface{ Get(string) string }, body io.Reader) (string, []supportUpload, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	decoded := decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body)
+
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		raw, err := io.ReadAll(io.LimitReader(decoded, maxSupportInboundBytes))
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to read email body")
+		}
+		if mediaType == "text/html" {
+			return cleanNewsHTML(string(raw)), nil, nil
+		}
+		return strings.TrimSpace(string(raw)), nil, nil
+	}
+
+	reader := multipart.NewReader(decoded, params["boundary"])
+	var plainText, htmlText string
+	files := make([]supportUpload, 0)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid multipart email")
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch {
+		case strings.HasPrefix(partType, "multipart/"):
+			text, nested, err := parseInboundEmailBody(part.Header, part)
+			if err != nil {
+				return "", nil, err
+			}
+			if plainText == "" {
+				plainText = text
+			}
+			files = append(files, nested...)
+		case strings.HasPrefix(partType, "image/"):
+			raw, err := io.ReadAll(io.LimitReader(decodeTransferEncoding(part.Header.Get("Content-Transfer-Encoding"), part), maxSupportImageBytes+1))
+			if err != nil || len(raw) == 0 || len(raw) > maxSupportImageBytes {
+				continue
+			}
+			mimeType := http.DetectContentType(raw)
+			if !strings.HasPrefix(mimeType, "image/") {
+				continue
+			}
+			files = append(files, supportUpload{Name: sanitizeSupportFileName(part.FileName(), mimeType), MimeType: mimeType, Bytes: raw})
+		case partType == "text/plain" && part.FileName() == "":
+			raw, _ := io.ReadAll(io.LimitReader(decodeTransferEncoding(part.Header.Get("Content-Transfer-Encoding"), part), 256*1024))
+			if plainText == "" {
+				plainText = strings.TrimSpace(string(raw))
+			}
+		case partType == "text/html" && part.FileName() == "":
+			raw, _ := io.ReadAll(io.LimitReader(decodeTransferEncoding(part.Header.Get("Content-Transfer-Encoding"), part), 512*1024))
+			if htmlText == "" {
+				htmlText = cleanNewsHTML(string(raw))
+			}
+		}
+	}
+	if plainText == "" {
+		plainText = htmlText
+	}
+	return plainText, files, nil
+}
+
+func decodeTransferEncoding(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	default:
+		return body
+	}
+}
+
+// stripQuotedEmailReply drops the quoted original that mail clients append
+// below a reply.
+func stripQuotedEmailReply(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	if location := supportEmailQuoteHeaderRe.FindStringIndex(text); location != nil {
+		text = text[:location[0]]
+	}
+	lines := strings.Split(text, "\n")
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), ">") {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.TrimSpace(strings.Join(kept, "\n"))
+}
+
+func supportStatusText(status string) string {
+	switch normalizedTicketStatus(status) {
+	case "resolved":
+		return "Решён"
+	case "archived":
+		return "Архив"
+	default:
+		return "Открыт"
+	}
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSupportMailer() *SupportMailer {
+	return NewSupportMailer(nil, "smtp.example.org", "25", "", "", "AmyWorld <support@example.org>", "support@example.org", "https://example.org", "test-secret", "inbound-token")
+}
+
+type smtpSinkMessage struct {
+	from string
+	to   []string
+	data []byte
+}
+
+// smtpSink runs a minimal SMTP server that accepts every message and hands
+// the envelope and data to the test.
+func smtpSink(t *testing.T) (string, <-chan smtpSinkMessage) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	messages := make(chan smtpSinkMessage, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTPSink(conn, messages)
+		}
+	}()
+	return listener.Addr().String(), messages
+}
+
+func serveSMTPSink(conn net.Conn, messages chan<- smtpSinkMessage) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	var message smtpSinkMessage
+	_ = text.PrintfLine("220 sink ESMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, argument, _ := strings.Cut(line, " ")
+		address := ""
+		if start, end := strings.Index(argument, "<"), strings.Index(argument, ">"); start >= 0 && end > start {
+			address = argument[start+1 : end]
+		}
+		switch strings.ToUpper(verb) {
+		case "MAIL":
+			message.from = address
+		case "RCPT":
+			message.to = append(message.to, address)
+		case "DATA":
+			_ = text.PrintfLine("354 go ahead")
+			if message.data, err = text.ReadDotBytes(); err != nil {
+				return
+			}
+			messages <- message
+			message = smtpSinkMessage{}
+		case "QUIT":
+			_ = text.PrintfLine("221 bye")
+			return
+		}
+		_ = text.PrintfLine("250 ok")
+	}
+}
+
+func TestSupportMailerDeliversToSMTPSink(t *testing.T) {
+	address, messages := smtpSink(t)
+	m := newTestSupportMailer()
+	m.smtpAddr = address
+
+	subject := "[Тикет #42] Новый ответ поддержки"
+	raw, err := m.buildMessage(42, "player@example.com", subject, "Проверьте настройки лаунчера.", "<p>Проверьте настройки лаунчера.</p>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.sendMail(m.smtpAddr, m.auth(), m.fromAddress(), []string{"player@example.com"}, raw); err != nil {
+		t.Fatal(err)
+	}
+
+	var got smtpSinkMessage
+	select {
+	case got = <-messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the sink received no message")
+	}
+	if got.from != "support@example.org" || len(got.to) != 1 || got.to[0] != "player@example.com" {
+		t.Fatalf("unexpected envelope %q -> %q", got.from, got.to)
+	}
+	message, err := mail.ReadMessage(bytes.NewReader(got.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(message.Header.Get("Subject")); err != nil || decoded != subject {
+		t.Errorf("subject %q, %v", decoded, err)
+	}
+	if replyTo := message.Header.Get("Reply-To"); replyTo != m.ticketReplyAddress(42) {
+		t.Errorf("Reply-To %q, want the signed ticket address", replyTo)
+	}
+	if unsubscribe := message.Header.Get("List-Unsubscribe"); unsubscribe != "<"+m.unsubscribeURL("player@example.com")+">" {
+		t.Errorf("List-Unsubscribe %q", unsubscribe)
+	}
+	text, files, err := parseInboundEmailBody(message.Header, message.Body)
+	if err != nil || text != "Проверьте настройки лаунчера." || len(files) != 0 {
+		t.Errorf("body %q with %d files, %v", text, len(files), err)
+	}
+}
+
+func TestTicketReplyAddressRoundTrip(t *testing.T) {
+	h := &SupportHandler{mailer: newTestSupportMailer()}
+	address := h.mailer.ticketReplyAddress(42)
+	if !strings.HasPrefix(address, "support+t42-") || !strings.HasSuffix(address, "@example.org") {
+		t.Fatalf("unexpected reply address %q", address)
+	}
+
+	for _, key := range []string{"To", "Cc", "Delivered-To", "X-Original-To"} {
+		header := mail.Header{key: {"Player <player@example.com>, " + address}}
+		if got := h.inboundTicketFromRecipients(header); got != 42 {
+			t.Errorf("%s: got ticket %d, want 42", key, got)
+		}
+	}
+}
+
+func TestInboundTicketFromRecipientsRejectsForgedTags(t *testing.T) {
+	h := &SupportHandler{mailer: newTestSupportMailer()}
+	valid := h.mailer.ticketTag(42)
+	other := NewSupportMailer(nil, "smtp.example.org", "25", "", "", "support@example.org", "support@example.org", "", "other-secret", "")
+
+	cases := map[string]string{
+		"wrong signature":    "support+t42-0000000000000000@example.org",
+		"tag of other id":    "support+t43-" + valid + "@example.org",
+		"tag of other key":   "support+t42-" + other.ticketTag(42) + "@example.org",
+		"plain mailbox":      "support@example.org",
+		"subject style only": "[Тикет #42] <support@example.org>",
+	}
+	for name, to := range cases {
+		if got := h.inboundTicketFromRecipients(mail.Header{"To": {to}}); got != 0 {
+			t.Errorf("%s: got ticket %d, want 0", name, got)
+		}
+	}
+}
+
+func TestIngestInboundEmailIgnoresSubjectTag(t *testing.T) {
+	// The handler has no database: a message without a signed reply address
+	// must be rejected before any ticket is looked up.
+	h := &SupportHandler{mailer: newTestSupportMailer()}
+	raw := "From: player@example.com\r\n" +
+		"To: support@example.org\r\n" +
+		"Subject: Re: [Тикет #42] Не могу зайти\r\n" +
+		"\r\n" +
+		"Ответ\r\n"
+	_, err := h.IngestInboundEmail(context.Background(), []byte(raw))
+	if err == nil || err.Error() != "ticket reference not found" {
+		t.Fatalf("got error %v, want ticket reference not found", err)
+	}
+}
+
+func TestEmailUnsubscribeGetOnlyConfirms(t *testing.T) {
+	// No database either: GET must not write anything.
+	h := &SupportHandler{mailer: newTestSupportMailer()}
+	link, err := url.Parse(h.mailer.unsubscribeURL("Player@Example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	h.Email(recorder, httptest.NewRequest(http.MethodGet, link.RequestURI(), nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", recorder.Code)
+	}
+	body := recorder.Body.String()
+	if !strings.Contains(body, `<form method="post"`) || strings.Contains(body, "Вы отписались") {
+		t.Fatalf("GET should render the confirmation form, got %q", body)
+	}
+
+	query := link.Query()
+	query.Set("sig", strings.Repeat("0", 64))
+	recorder = httptest.NewRecorder()
+	h.Email(recorder, httptest.NewRequest(http.MethodPost, link.Path+"?"+query.Encode(), nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("forged signature: got status %d, want 400", recorder.Code)
+	}
+}
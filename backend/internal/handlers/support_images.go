@@ -0,0 +1,334 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Decoding is bounded by pixel count, not file size: a few kilobytes of
+	// PNG can describe an image that needs gigabytes of memory. For GIFs the
+	// budget is frames times canvas, counted before any frame is decoded.
+	maxSupportImagePixels       = 40_000_000
+	maxSupportGIFFramePixels    = 200_000_000
+	supportThumbnailSize        = 320
+	supportImageJPEGQuality     = 90
+	supportThumbnailJPEGQuality = 80
+)
+
+// sanitizedSupportImage is an uploaded image decoded and written again from
+// pixels only, which drops EXIF/GPS blocks, comments and anything appended to
+// the file.
+type sanitizedSupportImage struct {
+	Bytes         []byte
+	MimeType      string
+	Thumbnail     []byte
+	ThumbnailType string
+}
+
+func sanitizeSupportImage(raw []byte) (sanitizedSupportImage, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		return sanitizedSupportImage{}, fmt.Errorf("only png, jpeg and gif images are allowed")
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxSupportImagePixels {
+		return sanitizedSupportImage{}, fmt.Errorf("image is too large")
+	}
+
+	var result sanitizedSupportImage
+	var first image.Image
+	var out bytes.Buffer
+	switch format {
+	case "jpeg":
+		img, err := jpeg.Decode(bytes.NewReader(raw))
+		if err != nil {
+			return sanitizedSupportImage{}, fmt.Errorf("invalid image")
+		}
+		// The orientation lives in the EXIF block we are about to drop, so
+		// it is applied to the pixels instead.
+		img = orientSupportImage(img, jpegOrientation(raw))
+		if err := jpeg.Encode(&out, img, &jpeg.Options{Quality: supportImageJPEGQuality}); err != nil {
+			return sanitizedSupportImage{}, err
+		}
+		result.MimeType = "image/jpeg"
+		first = img
+	case "png":
+		img, err := png.Decode(bytes.NewReader(raw))
+		if err != nil {
+			return sanitizedSupportImage{}, fmt.Errorf("invalid image")
+		}
+		encoder := png.Encoder{CompressionLevel: png.BestCompression}
+		if err := encoder.Encode(&out, img); err != nil {
+			return sanitizedSupportImage{}, err
+		}
+		result.MimeType = "image/png"
+		first = img
+	case "gif":
+		// DecodeAll allocates every frame up front, and LZW packs a blank
+		// frame into a few bytes, so the frames are counted first.
+		frames, err := countGIFFrames(raw, maxSupportGIFFramePixels/(config.Width*config.Height))
+		if err != nil {
+			return sanitizedSupportImage{}, err
+		}
+		if frames == 0 {
+			return sanitizedSupportImage{}, fmt.Errorf("invalid image")
+		}
+		animation, err := gif.DecodeAll(bytes.NewReader(raw))
+		if err != nil || len(animation.Image) == 0 {
+			return sanitizedSupportImage{}, fmt.Errorf("invalid image")
+		}
+		// EncodeAll only writes frames, palettes, delays and the loop count.
+		if err := gif.EncodeAll(&out, animation); err != nil {
+			return sanitizedSupportImage{}, err
+		}
+		result.MimeType = "image/gif"
+		first = animation.Image[0]
+	default:
+		return sanitizedSupportImage{}, fmt.Errorf("only png, jpeg and gif images are allowed")
+	}
+	result.Bytes = out.Bytes()
+
+	thumbnail := supportThumbnail(first, supportThumbnailSize)
+	var thumb bytes.Buffer
+	if supportImageOpaque(thumbnail) {
+		err = jpeg.Encode(&thumb, thumbnail, &jpeg.Options{Quality: supportThumbnailJPEGQuality})
+		result.ThumbnailType = "image/jpeg"
+	} else {
+		err = png.Encode(&thumb, thumbnail)
+		result.ThumbnailType = "image/png"
+	}
+	if err != nil {
+		return sanitizedSupportImage{}, err
+	}
+	result.Thumbnail = thumb.Bytes()
+	return result, nil
+}
+
+// countGIFFrames walks the GIF blocks without decoding them and returns the
+// number of image descriptors, or an error once there are more than limit.
+func countGIFFrames(raw []byte, limit int) (int, error) {
+	invalid := fmt.Errorf("invalid image")
+	// Header and logical screen descriptor.
+	if len(raw) < 13 {
+		return 0, invalid
+	}
+	pos := 13
+	if raw[10]&0x80 != 0 {
+		pos += 3 << (uint(raw[10]&0x07) + 1)
+	}
+	skipSubBlocks := func() bool {
+		for pos < len(raw) {
+			size := int(raw[pos])
+			pos++
+			if size == 0 {
+				return true
+			}
+			pos += size
+		}
+		return false
+	}
+
+	frames := 0
+	for pos < len(raw) {
+		introducer := raw[pos]
+		pos++
+		switch introducer {
+		case 0x21: // extension: label, then data sub-blocks
+			pos++
+			if !skipSubBlocks() {
+				return 0, invalid
+			}
+		case 0x2C: // image descriptor
+			if pos+9 > len(raw) {
+				return 0, invalid
+			}
+			packed := raw[pos+8]
+			pos += 9
+			if packed&0x80 != 0 {
+				pos += 3 << (uint(packed&0x07) + 1)
+			}
+			pos++ // LZW minimum code size
+			if !skipSubBlocks() {
+				return 0, invalid
+			}
+			frames++
+			if frames > limit {
+				return frames, fmt.Errorf("image is too large")
+			}
+		case 0x3B: // trailer
+			return frames, nil
+		default:
+			return 0, invalid
+		}
+	}
+	// A missing trailer is left for the decoder to judge.
+	return frames, nil
+}
+
+// supportImageFileName swaps the extension for the format the image was
+// re-encoded to.
+func supportImageFileName(name, mimeType string) string {
+	ext := map[string]string{"image/jpeg": ".jpg", "image/png": ".png", "image/gif": ".gif"}[mimeType]
+	if ext == "" {
+		return name
+	}
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	if base == "" {
+		base = "image"
+	}
+	return base + ext
+}
+
+// supportThumbnail scales img down to fit a size x size box by averaging the
+// source pixels under each target pixel. Smaller images are only copied.
+func supportThumbnail(img image.Image, size int) *image.NRGBA {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	dstW, dstH := srcW, srcH
+	if srcW > size || srcH > size {
+		if srcW >= srcH {
+			dstW, dstH = size, max(1, srcH*size/srcW)
+		} else {
+			dstW, dstH = max(1, srcW*size/srcH), size
+		}
+	}
+
+	src := image.NewNRGBA(image.Rect(0, 0, srcW, srcH))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	if dstW == srcW && dstH == srcH {
+		return src
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0, y1 := y*srcH/dstH, max((y+1)*srcH/dstH, y*srcH/dstH+1)
+		for x := 0; x < dstW; x++ {
+			x0, x1 := x*srcW/dstW, max((x+1)*srcW/dstW, x*srcW/dstW+1)
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					pixel := row[sx*4 : sx*4+4]
+					r += int(pixel[0])
+					g += int(pixel[1])
+					b += int(pixel[2])
+					a += int(pixel[3])
+					n++
+				}
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: uint8(a / n)})
+		}
+	}
+	return dst
+}
+
+func supportImageOpaque(img *image.NRGBA) bool {
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// jpegOrientation reads the EXIF orientation tag (1-8) of a JPEG, or returns
+// 1 when there is none.
+func jpegOrientation(raw []byte) int {
+	if len(raw) < 4 || raw[0] != 0xff || raw[1] != 0xd8 {
+		return 1
+	}
+	for offset := 2; offset+4 <= len(raw); {
+		if raw[offset] != 0xff {
+			return 1
+		}
+		marker := raw[offset+1]
+		length := int(binary.BigEndian.Uint16(raw[offset+2:]))
+		if marker == 0xda || length < 2 || offset+2+length > len(raw) {
+			return 1
+		}
+		segment := raw[offset+4 : offset+2+length]
+		if marker == 0xe1 && len(segment) > 14 && string(segment[:6]) == "Exif\x00\x00" {
+			return exifOrientation(segment[6:])
+		}
+		offset += 2 + length
+	}
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			value := int(order.Uint16(tiff[entry+8:]))
+			if value >= 1 && value <= 8 {
+				return value
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// orientSupportImage turns an image stored with the given EXIF orientation
+// upright.
+func orientSupportImage(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"runtime"
+	"testing"
+)
+
+// blankGIF builds a GIF with a width x height canvas and the given number of
+// full-canvas frames without ever allocating the pixels: each frame is a
+// single clear code followed by end-of-information, which the decoder would
+// expand to a whole blank frame.
+func blankGIF(width, height, frames int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("GIF89a")
+	_ = binary.Write(&buf, binary.LittleEndian, uint16(width))
+	_ = binary.Write(&buf, binary.LittleEndian, uint16(height))
+	buf.Write([]byte{0x80, 0, 0}) // global colour table of 2 entries
+	buf.Write([]byte{0, 0, 0, 255, 255, 255})
+	buf.Write([]byte{0x21, 0xFE, 2, 'h', 'i', 0}) // comment extension
+	for i := 0; i < frames; i++ {
+		buf.WriteByte(0x2C)
+		_ = binary.Write(&buf, binary.LittleEndian, [4]uint16{0, 0, uint16(width), uint16(height)})
+		buf.WriteByte(0)
+		buf.Write([]byte{2, 1, 0x44, 0}) // LZW min code size 2: clear, end
+	}
+	buf.WriteByte(0x3B)
+	return buf.Bytes()
+}
+
+func TestCountGIFFrames(t *testing.T) {
+	raw := blankGIF(10, 10, 3)
+	frames, err := countGIFFrames(raw, 100)
+	if err != nil || frames != 3 {
+		t.Fatalf("got %d frames, %v; want 3", frames, err)
+	}
+	if _, err := countGIFFrames(raw, 2); err == nil {
+		t.Fatal("expected the frame limit to be enforced")
+	}
+	if _, err := countGIFFrames(raw[:len(raw)-6], 100); err == nil {
+		t.Fatal("expected a truncated frame to be rejected")
+	}
+	if _, err := countGIFFrames([]byte("GIF89a"), 100); err == nil {
+		t.Fatal("expected a truncated header to be rejected")
+	}
+}
+
+func TestSanitizeSupportImageRejectsGIFBombBeforeDecoding(t *testing.T) {
+	// 6000x6000 fits the single-image budget, but ten of those frames
+	// would need 360M pixels of paletted images.
+	raw := blankGIF(6000, 6000, 10)
+	if len(raw) > 1024 {
+		t.Fatalf("test GIF is %d bytes, expected a tiny file", len(raw))
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := sanitizeSupportImage(raw)
+	runtime.ReadMemStats(&after)
+	if err == nil || err.Error() != "image is too large" {
+		t.Fatalf("got %v, want image is too large", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Fatalf("rejecting the GIF allocated %d bytes; frames were decoded", allocated)
+	}
+}
+
+func TestSanitizeSupportImageKeepsSmallAnimation(t *testing.T) {
+	palette := color.Palette{color.Black, color.White}
+	animation := &gif.GIF{LoopCount: 0}
+	for i := 0; i < 3; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 40, 20), palette)
+		frame.SetColorIndex(i, i, 1)
+		animation.Image = append(animation.Image, frame)
+		animation.Delay = append(animation.Delay, 10)
+	}
+	var raw bytes.Buffer
+	if err := gif.EncodeAll(&raw, animation); err != nil {
+		t.Fatal(err)
+	}
+	raw.WriteString("trailing data")
+
+	result, err := sanitizeSupportImage(raw.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.MimeType != "image/gif" || len(result.Thumbnail) == 0 {
+		t.Fatalf("unexpected result %q with %d byte thumbnail", result.MimeType, len(result.Thumbnail))
+	}
+	decoded, err := gif.DecodeAll(bytes.NewReader(result.Bytes))
+	if err != nil || len(decoded.Image) != 3 {
+		t.Fatalf("re-encoded GIF: %v", err)
+	}
+	if bytes.Contains(result.Bytes, []byte("trailing data")) {
+		t.Fatal("data after the trailer survived re-encoding")
+	}
+}
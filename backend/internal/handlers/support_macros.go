@@ -0,0 +1,327 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"amy/minecraft-server/internal/models"
+)
+
+const maxSupportMacroBodyRunes = 2000
+
+var (
+	supportMacroName    = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,39}$`)
+	supportMacroCommand = regexp.MustCompile(`(?is)^!macro\s+(\S+)\s*(.*)$`)
+
+	errSupportMacroNotFound = errors.New("macro not found")
+)
+
+// supportMacro is a saved staff reply. Body may use the placeholders
+// {player}, {nick}, {ticket}, {subject}, {category} and {staff}. SetStatus
+// and SetCategory, when present, are applied together with the reply.
+type supportMacro struct {
+	Name        string    `json:"name"`
+	Title       string    `json:"title"`
+	Body        string    `json:"body"`
+	SetStatus   string    `json:"setStatus,omitempty"`
+	SetCategory *string   `json:"setCategory,omitempty"`
+	UpdatedBy   string    `json:"updatedBy"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+type supportMacroApplyRequest struct {
+	Name   string `json:"name"`
+	Extra  string `json:"extra"`
+	DryRun bool   `json:"dryRun"`
+}
+
+// renderSupportMacro fills the placeholders of a macro body for a ticket.
+func renderSupportMacro(body string, ticket models.Ticket, staffName string) string {
+	player := strings.TrimSpace(ticket.Name)
+	if player == "" {
+		player = strings.TrimSpace(ticket.DiscordNick)
+	}
+	return strings.TrimSpace(strings.NewReplacer(
+		"{player}", player,
+		"{nick}", strings.TrimSpace(ticket.DiscordNick),
+		"{ticket}", fmt.Sprintf("#%d", ticket.ID),
+		"{subject}", strings.TrimSpace(ticket.Subject),
+		"{category}", strings.TrimSpace(ticket.Category),
+		"{staff}", strings.TrimSpace(staffName),
+	).Replace(body))
+}
+
+func (h *SupportHandler) loadSupportMacro(ctx context.Context, name string) (supportMacro, error) {
+	var macro supportMacro
+	var category sql.NullString
+	err := h.db.QueryRowContext(
+		ctx,
+		`SELECT name, title, body, set_status, set_category, updated_by, updated_at FROM support_macros WHERE name = $1`,
+		strings.ToLower(strings.TrimSpace(name)),
+	).Scan(&macro.Name, &macro.Title, &macro.Body, &macro.SetStatus, &category, &macro.UpdatedBy, &macro.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return supportMacro{}, errSupportMacroNotFound
+	}
+	if err != nil {
+		return supportMacro{}, err
+	}
+	if category.Valid {
+		macro.SetCategory = &category.String
+	}
+	return macro, nil
+}
+
+func (h *SupportHandler) loadSupportMacros(ctx context.Context) ([]supportMacro, error) {
+	rows, err := h.db.QueryContext(ctx, `SELECT name, title, body, set_status, set_category, updated_by, updated_at FROM support_macros ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	macros := make([]supportMacro, 0)
+	for rows.Next() {
+		var macro supportMacro
+		var category sql.NullString
+		if err := rows.Scan(&macro.Name, &macro.Title, &macro.Body, &macro.SetStatus, &category, &macro.UpdatedBy, &macro.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if category.Valid {
+			macro.SetCategory = &category.String
+		}
+		macros = append(macros, macro)
+	}
+	return macros, rows.Err()
+}
+
+// applySupportMacro posts the rendered macro as a staff reply and then
+// applies its status and category changes. extra is appended to the reply.
+func (h *SupportHandler) applySupportMacro(ctx context.Context, ticket models.Ticket, staffID string, macro supportMacro, extra string) (models.Ticket, int64, error) {
+	message := renderSupportMacro(macro.Body, ticket, h.staffDisplayName(ctx, staffID))
+	if extra = strings.TrimSpace(extra); extra != "" {
+		message += "\n\n" + extra
+	}
+	messageID, err := h.saveStaffTicketReply(ctx, ticket, staffID, message, nil, "макрос "+macro.Name)
+	if err != nil {
+		return ticket, 0, err
+	}
+
+	if macro.SetCategory != nil && strings.TrimSpace(*macro.SetCategory) != ticket.Category {
+		category := strings.TrimSpace(*macro.SetCategory)
+		if err := h.changeTicket(ctx, ticket.ID, `UPDATE support_tickets SET category = $1 WHERE id = $2`, category, ticket.ID); err != nil {
+			return ticket, messageID, err
+		}
+		ticket.Category = category
+	}
+	if macro.SetStatus != "" && normalizedTicketStatus(ticket.Status) != macro.SetStatus {
+		if err := h.setTicketStatus(ctx, &ticket, macro.SetStatus); err != nil {
+			return ticket, messageID, err
+		}
+	}
+	return ticket, messageID, nil
+}
+
+// staffMacros handles GET and POST /api/support/staff/macros.
+func (h *SupportHandler) staffMacros(w http.ResponseWriter, r *http.Request, staffID string) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodGet:
+		macros, err := h.loadSupportMacros(ctx)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to load macros")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"macros": macros})
+	case http.MethodPost:
+		var payload supportMacro
+		if err := json.NewDecoder(io.LimitReader(r.Body, 16*1024)).Decode(&payload); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+		h.saveSupportMacro(ctx, w, staffID, payload)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// staffMacro handles GET, PUT and DELETE /api/support/staff/macros/{name}.
+func (h *SupportHandler) staffMacro(w http.ResponseWriter, r *http.Request, staffID, name string) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodGet:
+		macro, err := h.loadSupportMacro(ctx, name)
+		if err == errSupportMacroNotFound {
+			writeError(w, http.StatusNotFound, "macro not found")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to load macro")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"macro": macro})
+	case http.MethodPut, http.MethodPatch:
+		var payload supportMacro
+		if err := json.NewDecoder(io.LimitReader(r.Body, 16*1024)).Decode(&payload); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+		payload.Name = name
+		h.saveSupportMacro(ctx, w, staffID, payload)
+	case http.MethodDelete:
+		result, err := h.db.ExecContext(ctx, `DELETE FROM support_macros WHERE name = $1`, strings.ToLower(strings.TrimSpace(name)))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to delete macro")
+			return
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			writeError(w, http.StatusNotFound, "macro not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (h *SupportHandler) saveSupportMacro(ctx context.Context, w http.ResponseWriter, staffID string, payload supportMacro) {
+	payload.Name = strings.ToLower(strings.TrimSpace(payload.Name))
+	payload.Title = strings.TrimSpace(payload.Title)
+	payload.Body = strings.TrimSpace(payload.Body)
+	payload.SetStatus = strings.ToLower(strings.TrimSpace(payload.SetStatus))
+	if !supportMacroName.MatchString(payload.Name) {
+		writeError(w, http.StatusBadRequest, "name must be 1-40 latin letters, digits, dashes or underscores")
+		return
+	}
+	if payload.Body == "" || len([]rune(payload.Body)) > maxSupportMacroBodyRunes {
+		writeError(w, http.StatusBadRequest, "body must be between 1 and 2000 characters")
+		return
+	}
+	if payload.SetStatus != "" && payload.SetStatus != "open" && payload.SetStatus != "resolved" && payload.SetStatus != "archived" {
+		writeError(w, http.StatusBadRequest, "setStatus must be open, resolved or archived")
+		return
+	}
+	var category any
+	if payload.SetCategory != nil {
+		trimmed := strings.TrimSpace(*payload.SetCategory)
+		payload.SetCategory = &trimmed
+		category = trimmed
+	}
+	payload.UpdatedBy = staffID
+	payload.UpdatedAt = time.Now().UTC()
+
+	_, err := h.db.ExecContext(
+		ctx,
+		`INSERT INTO support_macros (name, title, body, set_status, set_category, updated_by, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)
+		 ON CONFLICT (name) DO UPDATE SET
+		   title = EXCLUDED.title,
+		   body = EXCLUDED.body,
+		   set_status = EXCLUDED.set_status,
+		   set_category = EXCLUDED.set_category,
+		   updated_by = EXCLUDED.updated_by,
+		   updated_at = EXCLUDED.updated_at`,
+		payload.Name,
+		payload.Title,
+		payload.Body,
+		payload.SetStatus,
+		category,
+		payload.UpdatedBy,
+		payload.UpdatedAt,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to save macro")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok", "macro": payload})
+}
+
+// staffApplyMacro handles POST /api/support/staff/tickets/{id}/macro. With
+// dryRun the rendered text is returned so the client can insert it into the
+// reply box instead of sending it.
+func (h *SupportHandler) staffApplyMacro(w http.ResponseWriter, r *http.Request, staffID string, ticketID int64) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var payload supportMacroApplyRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 8*1024)).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 20*time.Second)
+	defer cancel()
+
+	ticket, ok := h.staffLoadTicket(ctx, w, ticketID)
+	if !ok {
+		return
+	}
+	macro, err := h.loadSupportMacro(ctx, payload.Name)
+	if err == errSupportMacroNotFound {
+		writeError(w, http.StatusNotFound, "macro not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load macro")
+		return
+	}
+
+	if payload.DryRun {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"message":     renderSupportMacro(macro.Body, ticket, h.staffDisplayName(ctx, staffID)),
+			"setStatus":   macro.SetStatus,
+			"setCategory": macro.SetCategory,
+		})
+		return
+	}
+
+	ticket, messageID, err := h.applySupportMacro(ctx, ticket, staffID, macro, payload.Extra)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to apply macro")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok", "messageId": messageID, "ticket": ticket})
+}
+
+// applyDiscordMacro expands a "!macro name [extra]" command written in a
+// ticket thread or in reply to a ticket message. Commands from anyone but
+// support staff are dropped.
+func (h *SupportHandler) applyDiscordMacro(ctx context.Context, ticketID int64, staffID, command string) error {
+	matched := supportMacroCommand.FindStringSubmatch(strings.TrimSpace(command))
+	if len(matched) != 3 || !h.isSupportStaff(staffID) {
+		return nil
+	}
+	ticket, err := h.loadTicket(ctx, ticketID)
+	if err != nil {
+		return err
+	}
+	macro, err := h.loadSupportMacro(ctx, matched[1])
+	if err == errSupportMacroNotFound {
+		if ticket.DiscordThreadID != "" && h.supportThreadsEnabled() {
+			_, _ = h.postDiscordThreadMessage(ctx, ticket, fmt.Sprintf("Макрос `%s` не найден.", trimForDiscord(matched[1])), nil)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, _, err = h.applySupportMacro(ctx, ticket, staffID, macro, matched[2])
+	return err
+}
+
+// isSupportMacroCommand reports whether a Discord message is a macro command
+// rather than a reply.
+func isSupportMacroCommand(content string) bool {
+	return supportMacroCommand.MatchString(strings.TrimSpace(content))
+}
@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"amy/minecraft-server/internal/models"
+)
+
+func TestApplyDiscordMacroIgnoresNonStaff(t *testing.T) {
+	// No database: anything past the staff check would panic.
+	h := &SupportHandler{staffIDs: parseDiscordIDSet("100")}
+	for _, author := range []string{"200", "", " "} {
+		if err := h.applyDiscordMacro(context.Background(), 42, author, "!macro close готово"); err != nil {
+			t.Errorf("author %q: %v", author, err)
+		}
+	}
+}
+
+func TestRenderSupportMacro(t *testing.T) {
+	ticket := models.Ticket{ID: 42, DiscordNick: " Steve ", Subject: "Не пускает", Category: "bug"}
+	got := renderSupportMacro(" {player}, тикет {ticket} ({category}: {subject}) закрыл {staff}. ", ticket, "Alex")
+	if want := "Steve, тикет #42 (bug: Не пускает) закрыл Alex."; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
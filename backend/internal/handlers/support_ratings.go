@@ -0,0 +1,359 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"amy/minecraft-server/internal/models"
+	"amy/minecraft-server/internal/observability"
+)
+
+const (
+	maxSupportRatingCommentRunes = 1000
+	supportRatingMetricsWindow   = 30 * 24 * time.Hour
+)
+
+type supportRatingRequest struct {
+	Score   int    `json:"score"`
+	Comment string `json:"comment"`
+}
+
+type supportCSATRow struct {
+	Key       string  `json:"key"`
+	Name      string  `json:"name,omitempty"`
+	Ratings   int     `json:"ratings"`
+	Average   float64 `json:"average"`
+	Satisfied int     `json:"satisfied"`
+	CSAT      float64 `json:"csat"`
+}
+
+type supportFirstResponseRow struct {
+	Category      string  `json:"category"`
+	Tickets       int     `json:"tickets"`
+	MedianSeconds float64 `json:"medianSeconds"`
+	P90Seconds    float64 `json:"p90Seconds"`
+}
+
+type supportVolumeRow struct {
+	Day      string `json:"day"`
+	Created  int    `json:"created"`
+	Resolved int    `json:"resolved"`
+}
+
+// Rating lets the owner rate a resolved or archived ticket:
+// GET|POST /api/support/tickets/{id}/rating.
+func (h *SupportHandler) Rating(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost && r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	ticketID, ok := parseSupportTicketSubpathID(r.URL.Path, "rating")
+	if !ok {
+		writeError(w, http.StatusNotFound, "ticket not found")
+		return
+	}
+	ownerDiscordID := currentDiscordIDFromCookie(r)
+	if ownerDiscordID == "" {
+		writeError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	ticket, err := h.loadTicket(ctx, ticketID)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "ticket not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load ticket")
+		return
+	}
+	if ticket.OwnerDiscordID != ownerDiscordID {
+		writeError(w, http.StatusForbidden, "ticket access denied")
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, map[string]any{"rating": ticket.Rating})
+		return
+	}
+
+	if normalizedTicketStatus(ticket.Status) == "open" {
+		writeError(w, http.StatusConflict, "only resolved tickets can be rated")
+		return
+	}
+	var payload supportRatingRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 8*1024)).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	payload.Comment = strings.TrimSpace(payload.Comment)
+	if payload.Score < 1 || payload.Score > 5 {
+		writeError(w, http.StatusBadRequest, "score must be between 1 and 5")
+		return
+	}
+	if len([]rune(payload.Comment)) > maxSupportRatingCommentRunes {
+		writeError(w, http.StatusBadRequest, "comment is too long")
+		return
+	}
+
+	// The rating goes to whoever owned the ticket, or failing that to the
+	// last staff member who answered it.
+	staffID := ticket.AssigneeDiscordID
+	if staffID == "" {
+		_ = h.db.QueryRowContext(
+			ctx,
+			`SELECT author_discord_id FROM support_ticket_messages
+			 WHERE ticket_id = $1 AND author_type = 'admin' AND author_discord_id <> ''
+			 ORDER BY created_at DESC LIMIT 1`,
+			ticket.ID,
+		).Scan(&staffID)
+	}
+	now := time.Now().UTC()
+	err = h.changeTicket(
+		ctx,
+		ticket.ID,
+		`INSERT INTO support_ticket_ratings (ticket_id, score, comment, staff_discord_id, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $5)
+		 ON CONFLICT (ticket_id) DO UPDATE SET
+		   score = EXCLUDED.score,
+		   comment = EXCLUDED.comment,
+		   updated_at = EXCLUDED.updated_at`,
+		ticket.ID,
+		payload.Score,
+		payload.Comment,
+		staffID,
+		now,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to save rating")
+		return
+	}
+	ticket.Rating = &models.TicketRating{Score: payload.Score, Comment: payload.Comment, RatedAt: now}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok", "rating": ticket.Rating})
+}
+
+func ticketRatingText(rating models.TicketRating) string {
+	text := strings.Repeat("★", rating.Score) + strings.Repeat("☆", 5-rating.Score)
+	if rating.Comment != "" {
+		text += "\n" + truncateRunes(rating.Comment, 900)
+	}
+	return text
+}
+
+// staffReports handles GET /api/support/staff/reports?days=30.
+func (h *SupportHandler) staffReports(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	days := 30
+	if raw := strings.TrimSpace(r.URL.Query().Get("days")); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 || parsed > 365 {
+			writeError(w, http.StatusBadRequest, "days must be between 1 and 365")
+			return
+		}
+		days = parsed
+	}
+	since := time.Now().UTC().AddDate(0, 0, -days)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	byStaff, err := h.loadSupportCSAT(ctx, `r.staff_discord_id`, since)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load csat")
+		return
+	}
+	for index := range byStaff {
+		if byStaff[index].Key != "" {
+			byStaff[index].Name = h.staffDisplayName(ctx, byStaff[index].Key)
+		}
+	}
+	byCategory, err := h.loadSupportCSAT(ctx, `t.category`, since)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load csat")
+		return
+	}
+	firstResponse, err := h.loadSupportFirstResponse(ctx, since)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load first response times")
+		return
+	}
+	volume, err := h.loadSupportVolume(ctx, since)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load ticket volume")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"since":          since,
+		"days":           days,
+		"csatByStaff":    byStaff,
+		"csatByCategory": byCategory,
+		"firstResponse":  firstResponse,
+		"volume":         volume,
+	})
+}
+
+// loadSupportCSAT groups ratings by groupBy, which is a trusted column
+// expression over support_ticket_ratings r and support_tickets t.
+func (h *SupportHandler) loadSupportCSAT(ctx context.Context, groupBy string, since time.Time) ([]supportCSATRow, error) {
+	rows, err := h.db.QueryContext(
+		ctx,
+		`SELECT `+groupBy+`, COUNT(*), AVG(r.score)::FLOAT8, COUNT(*) FILTER (WHERE r.score >= 4)
+		 FROM support_ticket_ratings r
+		 JOIN support_tickets t ON t.id = r.ticket_id
+		 WHERE r.updated_at >= $1
+		 GROUP BY 1
+		 ORDER BY 2 DESC`,
+		since,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]supportCSATRow, 0)
+	for rows.Next() {
+		var item supportCSATRow
+		if err := rows.Scan(&item.Key, &item.Ratings, &item.Average, &item.Satisfied); err != nil {
+			return nil, err
+		}
+		if item.Ratings > 0 {
+			item.CSAT = float64(item.Satisfied) / float64(item.Ratings)
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (h *SupportHandler) loadSupportFirstResponse(ctx context.Context, since time.Time) ([]supportFirstResponseRow, error) {
+	rows, err := h.db.QueryContext(
+		ctx,
+		`SELECT COALESCE(category, '*'), COUNT(*),
+		        percentile_cont(0.5) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM first_response_at - created_at))::FLOAT8,
+		        percentile_cont(0.9) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM first_response_at - created_at))::FLOAT8
+		 FROM support_tickets
+		 WHERE created_at >= $1 AND first_response_at IS NOT NULL
+		 GROUP BY ROLLUP (category)
+		 ORDER BY 1`,
+		since,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]supportFirstResponseRow, 0)
+	for rows.Next() {
+		var item supportFirstResponseRow
+		if err := rows.Scan(&item.Category, &item.Tickets, &item.MedianSeconds, &item.P90Seconds); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (h *SupportHandler) loadSupportVolume(ctx context.Context, since time.Time) ([]supportVolumeRow, error) {
+	rows, err := h.db.QueryContext(
+		ctx,
+		`SELECT to_char(day, 'YYYY-MM-DD'), SUM(created)::INT, SUM(resolved)::INT
+		 FROM (
+		   SELECT date_trunc('day', created_at AT TIME ZONE 'UTC') AS day, 1 AS created, 0 AS resolved
+		   FROM support_tickets WHERE created_at >= $1
+		   UNION ALL
+		   SELECT date_trunc('day', resolved_at AT TIME ZONE 'UTC'), 0, 1
+		   FROM support_tickets WHERE resolved_at >= $1
+		 ) events
+		 GROUP BY day
+		 ORDER BY day`,
+		since,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]supportVolumeRow, 0)
+	for rows.Next() {
+		var item supportVolumeRow
+		if err := rows.Scan(&item.Day, &item.Created, &item.Resolved); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// refreshRatingMetrics exports the last 30 days of ratings per category and
+// staff member. Staff outside DISCORD_SUPPORT_STAFF_IDS are grouped as
+// "other" to keep label values bounded.
+func (h *SupportHandler) refreshRatingMetrics(ctx context.Context) error {
+	queryCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	policies, err := loadSupportSLAPolicies(queryCtx, h.db)
+	if err != nil {
+		return err
+	}
+	rows, err := h.db.QueryContext(
+		queryCtx,
+		`SELECT t.category, r.staff_discord_id, COUNT(*), SUM(r.score), COUNT(*) FILTER (WHERE r.score >= 4)
+		 FROM support_ticket_ratings r
+		 JOIN support_tickets t ON t.id = r.ticket_id
+		 WHERE r.updated_at >= $1
+		 GROUP BY 1, 2`,
+		time.Now().UTC().Add(-supportRatingMetricsWindow),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type ratingTotals struct{ count, sum, satisfied float64 }
+	totals := make(map[[2]string]*ratingTotals)
+	for rows.Next() {
+		var category, staffID string
+		var count, sum, satisfied float64
+		if err := rows.Scan(&category, &staffID, &count, &sum, &satisfied); err != nil {
+			return err
+		}
+		staffLabel := "none"
+		if staffID != "" {
+			staffLabel = "other"
+			if h.isSupportStaff(staffID) {
+				staffLabel = staffID
+			}
+		}
+		key := [2]string{supportMetricCategory(policies, category), staffLabel}
+		if totals[key] == nil {
+			totals[key] = &ratingTotals{}
+		}
+		totals[key].count += count
+		totals[key].sum += sum
+		totals[key].satisfied += satisfied
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	observability.SupportRatings.Reset()
+	observability.SupportRatingScoreSum.Reset()
+	observability.SupportSatisfiedRatings.Reset()
+	for key := range totals {
+		observability.SupportRatings.WithLabelValues(key[0], key[1]).Set(totals[key].count)
+		observability.SupportRatingScoreSum.WithLabelValues(key[0], key[1]).Set(totals[key].sum)
+		observability.SupportSatisfiedRatings.WithLabelValues(key[0], key[1]).Set(totals[key].satisfied)
+	}
+	return nil
+}
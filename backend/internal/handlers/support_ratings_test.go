@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"amy/minecraft-server/internal/models"
+)
+
+func TestTicketRatingText(t *testing.T) {
+	if got := ticketRatingText(models.TicketRating{Score: 4}); got != "★★★★☆" {
+		t.Errorf("got %q", got)
+	}
+	got := ticketRatingText(models.TicketRating{Score: 1, Comment: strings.Repeat("я", 1000)})
+	stars, comment, _ := strings.Cut(got, "\n")
+	if stars != "★☆☆☆☆" || len([]rune(comment)) > 903 {
+		t.Errorf("got %q with a %d rune comment", stars, len([]rune(comment)))
+	}
+}
+
+func TestRatingChecksRequestBeforeLoadingTheTicket(t *testing.T) {
+	// No database: anything past the request checks would panic.
+	h := &SupportHandler{}
+	cases := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodDelete, "/api/support/tickets/42/rating", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/api/support/tickets/abc/rating", http.StatusNotFound},
+		{http.MethodPost, "/api/support/tickets/42/rating", http.StatusUnauthorized},
+	}
+	for _, tc := range cases {
+		recorder := httptest.NewRecorder()
+		h.Rating(recorder, httptest.NewRequest(tc.method, tc.path, strings.NewReader(`{"score":5}`)))
+		if recorder.Code != tc.want {
+			t.Errorf("%s %s: got %d, want %d", tc.method, tc.path, recorder.Code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"amy/minecraft-server/internal/models"
+)
+
+type supportReadRequest struct {
+	UpToMessageID int64 `json:"upToMessageId"`
+}
+
+// markTicketReadByUser records when the owner saw staff replies. It returns
+// how many replies were newly marked.
+func (h *SupportHandler) markTicketReadByUser(ctx context.Context, ticket models.Ticket) int64 {
+	now := time.Now().UTC()
+	result, err := h.db.ExecContext(
+		ctx,
+		`UPDATE support_ticket_messages SET read_by_user = TRUE, read_by_user_at = $1
+		 WHERE ticket_id = $2 AND author_type = 'admin' AND read_by_user_at IS NULL AND deleted_at IS NULL`,
+		now,
+		ticket.ID,
+	)
+	if err != nil {
+		return 0
+	}
+	affected, _ := result.RowsAffected()
+	if affected == 0 {
+		return 0
+	}
+	h.events.Publish(supportEvent{Type: supportEventRead, TicketID: ticket.ID, Reader: "user", At: now})
+
+	// The "seen" field in Discord is informational; a lost edit is redone by
+	// the next change of the ticket.
+	if err := h.enqueueTicketUpdate(ctx, h.db, ticket.ID); err != nil {
+		log.Printf("support ticket %d seen indicator not queued: %v", ticket.ID, err)
+	}
+	return affected
+}
+
+// markTicketReadByStaff records that a staff member saw the player's
+// messages, up to upToMessageID when it is set.
+func (h *SupportHandler) markTicketReadByStaff(ctx context.Context, ticketID int64, staffID string, upToMessageID int64) int64 {
+	now := time.Now().UTC()
+	result, err := h.db.ExecContext(
+		ctx,
+		`UPDATE support_ticket_messages SET read_by_staff_at = $1, read_by_staff_id = $2
+		 WHERE ticket_id = $3 AND author_type = 'user' AND read_by_staff_at IS NULL
+		   AND ($4::BIGINT = 0 OR id <= $4::BIGINT)`,
+		now,
+		staffID,
+		ticketID,
+		upToMessageID,
+	)
+	if err != nil {
+		return 0
+	}
+	affected, _ := result.RowsAffected()
+	if affected > 0 {
+		h.events.Publish(supportEvent{Type: supportEventRead, TicketID: ticketID, Reader: "staff", At: now})
+	}
+	return affected
+}
+
+// staffRead handles POST /api/support/staff/tickets/{id}/read.
+func (h *SupportHandler) staffRead(w http.ResponseWriter, r *http.Request, staffID string, ticketID int64) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var payload supportReadRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var exists bool
+	if err := h.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM support_tickets WHERE id = $1)`, ticketID).Scan(&exists); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load ticket")
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "ticket not found")
+		return
+	}
+	marked := h.markTicketReadByStaff(ctx, ticketID, staffID, payload.UpToMessageID)
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok", "marked": marked})
+}
+
+// ticketSeenText is the "seen" indicator in the Discord ticket embed.
+func ticketSeenText(ticket models.Ticket) string {
+	if ticket.UnreadAdminCount > 0 {
+		return fmt.Sprintf("Не прочитано ответов: %d", ticket.UnreadAdminCount)
+	}
+	if ticket.UserSeenAt != nil {
+		return fmt.Sprintf("Прочитано <t:%d:R>", ticket.UserSeenAt.Unix())
+	}
+	return "-"
+}
+
+func scanNullableTime(value sql.NullTime) *time.Time {
+	if !value.Valid {
+		return nil
+	}
+	return &value.Time
+}
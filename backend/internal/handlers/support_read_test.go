@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"amy/minecraft-server/internal/models"
+)
+
+func TestMarkTicketReadPublishesReceipts(t *testing.T) {
+	db, script := newScriptedDB(t, nil)
+	h := &SupportHandler{db: db, events: newSupportHub(), outbox: NewDiscordOutbox(db)}
+	events, unsubscribe := h.events.Subscribe(42)
+	defer unsubscribe()
+	ctx := context.Background()
+
+	if marked := h.markTicketReadByStaff(ctx, 42, "200", 7); marked != 1 {
+		t.Fatalf("staff marked %d", marked)
+	}
+	if event := <-events; event.Type != supportEventRead || event.Reader != "staff" {
+		t.Errorf("staff read published %+v", event)
+	}
+	if update := script.find("read_by_staff_at = $1")[0]; update.args[1] != "200" || update.args[3] != int64(7) {
+		t.Errorf("staff read of %v", update.args)
+	}
+
+	if marked := h.markTicketReadByUser(ctx, models.Ticket{ID: 42}); marked != 1 {
+		t.Fatalf("owner marked %d", marked)
+	}
+	if event := <-events; event.Type != supportEventRead || event.Reader != "user" {
+		t.Errorf("owner read published %+v", event)
+	}
+	// Only the owner's read changes the "seen" field of the Discord embed.
+	if queued := script.find("INSERT INTO discord_outbox"); len(queued) != 1 || queued[0].args[2] != discordActionUpdate {
+		t.Errorf("got %d outbox rows, want one ticket update", len(queued))
+	}
+}
+
+func TestTicketSeenText(t *testing.T) {
+	seenAt := time.Unix(1772366400, 0)
+	cases := []struct {
+		ticket models.Ticket
+		want   string
+	}{
+		{models.Ticket{}, "-"},
+		{models.Ticket{UserSeenAt: &seenAt}, "Прочитано <t:1772366400:R>"},
+		{models.Ticket{UserSeenAt: &seenAt, UnreadAdminCount: 2}, "Не прочитано ответов: 2"},
+	}
+	for _, tc := range cases {
+		if got := ticketSeenText(tc.ticket); got != tc.want {
+			t.Errorf("got %q, want %q", got, tc.want)
+		}
+	}
+}
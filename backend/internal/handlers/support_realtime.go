@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"amy/minecraft-server/internal/models"
+	"amy/minecraft-server/internal/observability"
+)
+
+const (
+	supportEventMessage        = "message"
+	supportEventMessageUpdated = "message_updated"
+	supportEventRead           = "read"
+	supportEventStatus         = "status"
+	supportEventTyping         = "typing"
+
+	supportStreamBuffer    = 32
+	supportStreamHeartbeat = 25 * time.Second
+)
+
+// supportEvent is one change on a ticket pushed to the ticket owner. It only
+// carries data the owner may see, and stays JSON-serialisable so it can
+// travel through Postgres NOTIFY once the backend runs on several replicas.
+type supportEvent struct {
+	Type       string                `json:"type"`
+	TicketID   int64                 `json:"ticketId"`
+	Message    *models.TicketMessage `json:"message,omitempty"`
+	Status     string                `json:"status,omitempty"`
+	Reader     string                `json:"reader,omitempty"`
+	AuthorName string                `json:"authorName,omitempty"`
+	At         time.Time             `json:"at"`
+}
+
+// supportEventBus fans ticket events out to open streams. supportHub keeps
+// everything in process; a LISTEN/NOTIFY implementation can replace it
+// without touching the handlers.
+type supportEventBus interface {
+	Publish(event supportEvent)
+	Subscribe(ticketID int64) (<-chan supportEvent, func())
+}
+
+type supportHub struct {
+	mu          sync.Mutex
+	subscribers map[int64]map[*supportSubscriber]struct{}
+}
+
+type supportSubscriber struct {
+	events chan supportEvent
+	once   sync.Once
+}
+
+func newSupportHub() *supportHub {
+	return &supportHub{subscribers: make(map[int64]map[*supportSubscriber]struct{})}
+}
+
+func (h *supportHub) Publish(event supportEvent) {
+	if event.At.IsZero() {
+		event.At = time.Now().UTC()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for subscriber := range h.subscribers[event.TicketID] {
+		select {
+		case subscriber.events <- event:
+		default:
+			// A stream that cannot keep up is dropped; the client reconnects
+			// and reloads the ticket instead of missing events silently.
+			h.removeLocked(event.TicketID, subscriber)
+		}
+	}
+}
+
+func (h *supportHub) Subscribe(ticketID int64) (<-chan supportEvent, func()) {
+	subscriber := &supportSubscriber{events: make(chan supportEvent, supportStreamBuffer)}
+	h.mu.Lock()
+	if h.subscribers[ticketID] == nil {
+		h.subscribers[ticketID] = make(map[*supportSubscriber]struct{})
+	}
+	h.subscribers[ticketID][subscriber] = struct{}{}
+	h.mu.Unlock()
+	observability.SupportStreamConnections.Inc()
+
+	return subscriber.events, func() {
+		h.mu.Lock()
+		h.removeLocked(ticketID, subscriber)
+		h.mu.Unlock()
+	}
+}
+
+func (h *supportHub) removeLocked(ticketID int64, subscriber *supportSubscriber) {
+	subscriber.once.Do(func() {
+		delete(h.subscribers[ticketID], subscriber)
+		if len(h.subscribers[ticketID]) == 0 {
+			delete(h.subscribers, ticketID)
+		}
+		close(subscriber.events)
+		observability.SupportStreamConnections.Dec()
+	})
+}
+
+// Events streams ticket events to the owner as Server-Sent Events:
+// GET /api/support/tickets/{id}/events.
+func (h *SupportHandler) Events(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	ticketID, ok := parseSupportTicketSubpathID(r.URL.Path, "events")
+	if !ok {
+		writeError(w, http.StatusNotFound, "ticket not found")
+		return
+	}
+	ownerDiscordID := currentDiscordIDFromCookie(r)
+	if ownerDiscordID == "" {
+		writeError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	var owner string
+	err := h.db.QueryRowContext(ctx, `SELECT owner_discord_id FROM support_tickets WHERE id = $1`, ticketID).Scan(&owner)
+	cancel()
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "ticket not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load ticket")
+		return
+	}
+	if owner != ownerDiscordID {
+		writeError(w, http.StatusForbidden, "ticket access denied")
+		return
+	}
+
+	controller := http.NewResponseController(w)
+	events, unsubscribe := h.events.Subscribe(ticketID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprint(w, "retry: 3000\n\n")
+	if err := controller.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(supportStreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			raw, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, raw); err != nil {
+				return
+			}
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// publishTicketMessage pushes a stored message to the owner's open streams.
+func (h *SupportHandler) publishTicketMessage(ctx context.Context, ticketID, messageID int64, eventType string) {
+	messages, err := h.loadTicketMessages(ctx, ticketID)
+	if err != nil {
+		return
+	}
+	for _, message := range playerTicketMessages(messages) {
+		if message.ID == messageID {
+			h.events.Publish(supportEvent{Type: eventType, TicketID: ticketID, Message: &message})
+			return
+		}
+	}
+}
+
+// GatewayHooks wires Discord gateway activity in ticket threads back into
+// the support handler.
+func (h *SupportHandler) GatewayHooks() SupportGatewayHooks {
+	return SupportGatewayHooks{
+		Reply:             h.notifyDiscordReply,
+		MessagesChanged:   h.discordMessagesChanged,
+		ImportAttachments: h.importDiscordAttachments,
+		Macro:             h.applyDiscordMacro,
+		Typing: func(ctx context.Context, ticketID int64, authorName string) {
+			h.events.Publish(supportEvent{Type: supportEventTyping, TicketID: ticketID, AuthorName: authorName})
+		},
+	}
+}
+
+func (h *SupportHandler) notifyDiscordReply(ctx context.Context, ticketID, messageID int64, authorName, message string) {
+	ticket, err := h.loadTicket(ctx, ticketID)
+	if err != nil {
+		return
+	}
+	var staffID string
+	if err := h.db.QueryRowContext(ctx, `SELECT author_discord_id FROM support_ticket_messages WHERE id = $1`, messageID).Scan(&staffID); err == nil && staffID != "" {
+		h.markTicketReadByStaff(ctx, ticketID, staffID, messageID)
+	}
+	_ = h.writeTicketHistoryHTML(ctx, ticket)
+	h.publishTicketMessage(ctx, ticketID, messageID, supportEventMessage)
+	h.emailTicketUpdate(ctx, ticket, supportEmailKindReply, authorName, message)
+	h.sendTicketReplyPush(ctx, ticket, authorName, message)
+}
+
+func (h *SupportHandler) discordMessagesChanged(ctx context.Context, ticketID int64, messageIDs []int64) {
+	ticket, err := h.loadTicket(ctx, ticketID)
+	if err != nil {
+		return
+	}
+	_ = h.writeTicketHistoryHTML(ctx, ticket)
+	for _, messageID := range messageIDs {
+		h.publishTicketMessage(ctx, ticketID, messageID, supportEventMessageUpdated)
+	}
+}
+
+// staffTyping tells the ticket owner that a staff member is writing a reply.
+// Clients call it every few seconds while the reply box has focus.
+func (h *SupportHandler) staffTyping(w http.ResponseWriter, r *http.Request, staffID string, ticketID int64) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var exists bool
+	if err := h.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM support_tickets WHERE id = $1)`, ticketID).Scan(&exists); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load ticket")
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "ticket not found")
+		return
+	}
+	h.events.Publish(supportEvent{Type: supportEventTyping, TicketID: ticketID, AuthorName: h.staffDisplayName(ctx, staffID)})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func parseSupportTicketSubpathID(path, suffix string) (int64, bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) != 5 || parts[0] != "api" || parts[1] != "support" || parts[2] != "tickets" || parts[4] != suffix {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(parts[3], 10, 64)
+	return id, err == nil && id > 0
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"bufio"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSupportHubRoutesByTicket(t *testing.T) {
+	hub := newSupportHub()
+	first, unsubscribeFirst := hub.Subscribe(1)
+	second, unsubscribeSecond := hub.Subscribe(2)
+	defer unsubscribeSecond()
+
+	hub.Publish(supportEvent{Type: supportEventStatus, TicketID: 1, Status: "resolved"})
+	if event := <-first; event.Status != "resolved" || event.At.IsZero() {
+		t.Errorf("ticket 1 got %+v", event)
+	}
+	select {
+	case event := <-second:
+		t.Fatalf("ticket 2 got an event of ticket 1: %+v", event)
+	default:
+	}
+
+	// A stream that stops reading is closed instead of blocking the others.
+	for i := 0; i <= supportStreamBuffer; i++ {
+		hub.Publish(supportEvent{Type: supportEventTyping, TicketID: 1})
+	}
+	received := 0
+	for range first {
+		received++
+	}
+	if received != supportStreamBuffer {
+		t.Errorf("slow stream got %d events, want %d", received, supportStreamBuffer)
+	}
+	unsubscribeFirst()
+	if _, ok := hub.subscribers[1]; ok {
+		t.Error("the dropped stream is still subscribed")
+	}
+}
+
+func TestSupportEventsStreamsToTheOwner(t *testing.T) {
+	SetSessionSecret("test-session-secret")
+	db, _ := newScriptedDB(t, func(query string, args []driver.NamedValue) ([]string, [][]driver.Value) {
+		return []string{"owner_discord_id"}, [][]driver.Value{{"123"}}
+	})
+	h := &SupportHandler{db: db, events: newSupportHub()}
+	server := httptest.NewServer(http.HandlerFunc(h.Events))
+	defer server.Close()
+
+	open := func(discordID string) *http.Response {
+		request, _ := http.NewRequest(http.MethodGet, server.URL+"/api/support/tickets/42/events", nil)
+		request.AddCookie(&http.Cookie{Name: sessionCookieName, Value: signSession(discordID, time.Now().Add(time.Hour))})
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	forbidden := open("999")
+	forbidden.Body.Close()
+	if forbidden.StatusCode != http.StatusForbidden {
+		t.Errorf("another player got %d, want 403", forbidden.StatusCode)
+	}
+
+	response := open("123")
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("owner got %d %q", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+	lines := bufio.NewScanner(response.Body)
+	// Skip the retry hint; the stream is subscribed once it arrives.
+	for lines.Scan() && lines.Text() != "" {
+	}
+
+	h.events.Publish(supportEvent{Type: supportEventStatus, TicketID: 42, Status: "resolved"})
+	var frame []string
+	for lines.Scan() && lines.Text() != "" {
+		frame = append(frame, lines.Text())
+	}
+	if len(frame) != 2 || frame[0] != "event: status" || !strings.Contains(frame[1], `"status":"resolved"`) {
+		t.Errorf("unexpected event frame %q", frame)
+	}
+}
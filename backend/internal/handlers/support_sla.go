@@ -0,0 +1,462 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"amy/minecraft-server/internal/models"
+	"amy/minecraft-server/internal/observability"
+)
+
+type supportSLAPolicy struct {
+	Category           string `json:"category"`
+	FirstResponseMins  int    `json:"firstResponseMinutes"`
+	ResolutionMins     int    `json:"resolutionMinutes"`
+	firstResponseDelay time.Duration
+	resolutionDelay    time.Duration
+}
+
+type supportAssignmentRequest struct {
+	AssigneeDiscordID *string `json:"assigneeDiscordId"`
+	Priority          *string `json:"priority"`
+}
+
+const (
+	supportSLAStateOK       = "ok"
+	supportSLAStateAtRisk   = "at_risk"
+	supportSLAStateBreached = "breached"
+	supportSLAStateMet      = "met"
+	supportSLAStateMissed   = "missed"
+
+	supportSLAAtRiskShare = 0.25
+)
+
+var supportPriorityRank = map[string]int{
+	"urgent": 3,
+	"high":   2,
+	"normal": 1,
+	"low":    0,
+}
+
+func normalizedTicketPriority(priority string) string {
+	priority = strings.ToLower(strings.TrimSpace(priority))
+	if _, ok := supportPriorityRank[priority]; ok {
+		return priority
+	}
+	return "normal"
+}
+
+func (h *SupportHandler) isSupportStaff(discordID string) bool {
+	discordID = strings.TrimSpace(discordID)
+	if discordID == "" || len(h.staffIDs) == 0 {
+		return false
+	}
+	_, ok := h.staffIDs[discordID]
+	return ok
+}
+
+func (h *SupportHandler) requireSupportStaff(w http.ResponseWriter, r *http.Request) (string, bool) {
+	discordID := currentDiscordIDFromCookie(r)
+	if discordID == "" {
+		writeError(w, http.StatusUnauthorized, "not authenticated")
+		return "", false
+	}
+	if !h.isSupportStaff(discordID) {
+		writeError(w, http.StatusForbidden, "support staff access required")
+		return "", false
+	}
+	return discordID, true
+}
+
+func (h *SupportHandler) staffQueue(w http.ResponseWriter, r *http.Request, staffID string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 6*time.Second)
+	defer cancel()
+
+	query := supportTicketSelectSQL + ` WHERE status = 'open'`
+	args := make([]any, 0, 1)
+	switch assignee := strings.TrimSpace(r.URL.Query().Get("assignee")); assignee {
+	case "":
+	case "me":
+		args = append(args, staffID)
+		query += ` AND assignee_discord_id = $1`
+	case "unassigned":
+		query += ` AND assignee_discord_id = ''`
+	default:
+		args = append(args, assignee)
+		query += ` AND assignee_discord_id = $1`
+	}
+	// No cap: the ticket most at risk can be any open one, and open tickets
+	// are few enough to rank in full.
+	query += ` ORDER BY created_at ASC`
+
+	rows, err := h.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load queue")
+		return
+	}
+	defer rows.Close()
+
+	tickets := make([]models.Ticket, 0)
+	for rows.Next() {
+		ticket, err := scanSupportTicket(rows)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to scan tickets")
+			return
+		}
+		tickets = append(tickets, ticket)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to scan tickets")
+		return
+	}
+
+	policies, err := loadSupportSLAPolicies(ctx, h.db)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load sla policies")
+		return
+	}
+	now := time.Now().UTC()
+	for i := range tickets {
+		tickets[i].SLA = computeTicketSLA(tickets[i], policies, now)
+	}
+	sortSupportQueue(tickets)
+
+	writeJSON(w, http.StatusOK, map[string]any{"tickets": tickets})
+}
+
+func (h *SupportHandler) staffSLAPolicies(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if r.Method == http.MethodPut || r.Method == http.MethodPost {
+		var payload supportSLAPolicy
+		if err := json.NewDecoder(io.LimitReader(r.Body, 8*1024)).Decode(&payload); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+		payload.Category = strings.TrimSpace(payload.Category)
+		if payload.FirstResponseMins <= 0 || payload.ResolutionMins <= 0 || payload.FirstResponseMins > payload.ResolutionMins {
+			writeError(w, http.StatusBadRequest, "firstResponseMinutes and resolutionMinutes must be positive and ordered")
+			return
+		}
+		_, err := h.db.ExecContext(
+			ctx,
+			`INSERT INTO support_sla_policies (category, first_response_minutes, resolution_minutes, updated_at)
+			 VALUES ($1, $2, $3, $4)
+			 ON CONFLICT (category) DO UPDATE SET
+			   first_response_minutes = EXCLUDED.first_response_minutes,
+			   resolution_minutes = EXCLUDED.resolution_minutes,
+			   updated_at = EXCLUDED.updated_at`,
+			payload.Category,
+			payload.FirstResponseMins,
+			payload.ResolutionMins,
+			time.Now().UTC(),
+		)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to save sla policy")
+			return
+		}
+	} else if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	policies, err := loadSupportSLAPolicies(ctx, h.db)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load sla policies")
+		return
+	}
+	items := make([]supportSLAPolicy, 0, len(policies))
+	for _, policy := range policies {
+		items = append(items, policy)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Category < items[j].Category })
+	writeJSON(w, http.StatusOK, map[string]any{"policies": items})
+}
+
+func (h *SupportHandler) staffAssign(w http.ResponseWriter, r *http.Request, staffID string, ticketID int64) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPatch {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var payload supportAssignmentRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 8*1024)).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if payload.AssigneeDiscordID == nil && payload.Priority == nil {
+		writeError(w, http.StatusBadRequest, "assigneeDiscordId or priority required")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	ticket, err := h.loadTicket(ctx, ticketID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "ticket not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to load ticket")
+		return
+	}
+
+	if payload.Priority != nil {
+		priority := strings.ToLower(strings.TrimSpace(*payload.Priority))
+		if _, ok := supportPriorityRank[priority]; !ok {
+			writeError(w, http.StatusBadRequest, "priority must be low, normal, high or urgent")
+			return
+		}
+		ticket.Priority = priority
+	}
+	if payload.AssigneeDiscordID != nil {
+		assigneeID := strings.TrimSpace(*payload.AssigneeDiscordID)
+		if assigneeID == "me" {
+			assigneeID = staffID
+		}
+		if assigneeID != "" && !h.isSupportStaff(assigneeID) {
+			writeError(w, http.StatusBadRequest, "assignee must be a support staff member")
+			return
+		}
+		if assigneeID != ticket.AssigneeDiscordID {
+			ticket.AssigneeDiscordID = assigneeID
+			ticket.AssigneeName = ""
+			ticket.AssignedAt = nil
+			if assigneeID != "" {
+				now := time.Now().UTC()
+				ticket.AssigneeName = h.staffDisplayName(ctx, assigneeID)
+				ticket.AssignedAt = &now
+			}
+		}
+	}
+
+	err = h.changeTicket(
+		ctx,
+		ticket.ID,
+		`UPDATE support_tickets SET priority = $1, assignee_discord_id = $2, assignee_name = $3, assigned_at = $4 WHERE id = $5`,
+		normalizedTicketPriority(ticket.Priority),
+		ticket.AssigneeDiscordID,
+		ticket.AssigneeName,
+		nullableTime(ticket.AssignedAt),
+		ticket.ID,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to update ticket")
+		return
+	}
+
+	if policies, err := loadSupportSLAPolicies(ctx, h.db); err == nil {
+		ticket.SLA = computeTicketSLA(ticket, policies, time.Now().UTC())
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok", "ticket": ticket})
+}
+
+func (h *SupportHandler) staffDisplayName(ctx context.Context, discordID string) string {
+	var username, globalName, nick string
+	err := h.db.QueryRowContext(
+		ctx,
+		`SELECT username, global_name, nick FROM discord_member_states WHERE discord_id = $1`,
+		discordID,
+	).Scan(&username, &globalName, &nick)
+	if err != nil {
+		return "Техподдержка"
+	}
+	return bestDiscordDisplayName(nick, globalName, username, "Техподдержка")
+}
+
+func loadSupportSLAPolicies(ctx context.Context, db *sql.DB) (map[string]supportSLAPolicy, error) {
+	rows, err := db.QueryContext(ctx, `SELECT category, first_response_minutes, resolution_minutes FROM support_sla_policies`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := make(map[string]supportSLAPolicy)
+	for rows.Next() {
+		var policy supportSLAPolicy
+		if err := rows.Scan(&policy.Category, &policy.FirstResponseMins, &policy.ResolutionMins); err != nil {
+			return nil, err
+		}
+		policy.firstResponseDelay = time.Duration(policy.FirstResponseMins) * time.Minute
+		policy.resolutionDelay = time.Duration(policy.ResolutionMins) * time.Minute
+		policies[strings.ToLower(policy.Category)] = policy
+	}
+	return policies, rows.Err()
+}
+
+func supportSLAPolicyFor(policies map[string]supportSLAPolicy, category string) supportSLAPolicy {
+	if policy, ok := policies[strings.ToLower(strings.TrimSpace(category))]; ok {
+		return policy
+	}
+	if policy, ok := policies[""]; ok {
+		return policy
+	}
+	return supportSLAPolicy{
+		FirstResponseMins:  240,
+		ResolutionMins:     4320,
+		firstResponseDelay: 4 * time.Hour,
+		resolutionDelay:    72 * time.Hour,
+	}
+}
+
+// supportMetricCategory keeps free-form ticket categories out of metric labels.
+func supportMetricCategory(policies map[string]supportSLAPolicy, category string) string {
+	key := strings.ToLower(strings.TrimSpace(category))
+	if key == "" {
+		return "none"
+	}
+	if policy, ok := policies[key]; ok {
+		return policy.Category
+	}
+	return "other"
+}
+
+func computeTicketSLA(ticket models.Ticket, policies map[string]supportSLAPolicy, now time.Time) *models.TicketSLA {
+	policy := supportSLAPolicyFor(policies, ticket.Category)
+	sla := &models.TicketSLA{
+		FirstResponseDueAt: ticket.CreatedAt.Add(policy.firstResponseDelay),
+		ResolutionDueAt:    ticket.CreatedAt.Add(policy.resolutionDelay),
+	}
+
+	if normalizedTicketStatus(ticket.Status) != "open" {
+		sla.State = supportSLAStateMet
+		if ticket.ResolvedAt != nil && ticket.ResolvedAt.After(sla.ResolutionDueAt) {
+			sla.State = supportSLAStateMissed
+		}
+		return sla
+	}
+
+	dueAt := sla.ResolutionDueAt
+	window := policy.resolutionDelay
+	if ticket.FirstResponseAt == nil {
+		dueAt = sla.FirstResponseDueAt
+		window = policy.firstResponseDelay
+	}
+	remaining := dueAt.Sub(now)
+	sla.RemainingSeconds = int64(remaining / time.Second)
+	switch {
+	case remaining < 0:
+		sla.State = supportSLAStateBreached
+	case float64(remaining) < float64(window)*supportSLAAtRiskShare:
+		sla.State = supportSLAStateAtRisk
+	default:
+		sla.State = supportSLAStateOK
+	}
+	return sla
+}
+
+func sortSupportQueue(tickets []models.Ticket) {
+	sort.SliceStable(tickets, func(i, j int) bool {
+		left, right := tickets[i], tickets[j]
+		if left.SLA != nil && right.SLA != nil && left.SLA.RemainingSeconds != right.SLA.RemainingSeconds {
+			return left.SLA.RemainingSeconds < right.SLA.RemainingSeconds
+		}
+		leftRank := supportPriorityRank[normalizedTicketPriority(left.Priority)]
+		rightRank := supportPriorityRank[normalizedTicketPriority(right.Priority)]
+		if leftRank != rightRank {
+			return leftRank > rightRank
+		}
+		return left.CreatedAt.Before(right.CreatedAt)
+	})
+}
+
+// recordSupportFirstResponse stamps the first staff reply on a ticket and
+// reports the wait time once.
+func recordSupportFirstResponse(ctx context.Context, db *sql.DB, ticketID int64, at time.Time) {
+	var createdAt time.Time
+	var category, priority string
+	err := db.QueryRowContext(
+		ctx,
+		`UPDATE support_tickets SET first_response_at = $1
+		 WHERE id = $2 AND first_response_at IS NULL
+		 RETURNING created_at, category, priority`,
+		at,
+		ticketID,
+	).Scan(&createdAt, &category, &priority)
+	if err != nil {
+		return
+	}
+	policies, _ := loadSupportSLAPolicies(ctx, db)
+	observability.SupportFirstResponseDuration.
+		WithLabelValues(supportMetricCategory(policies, category), normalizedTicketPriority(priority)).
+		Observe(at.Sub(createdAt).Seconds())
+}
+
+func observeSupportResolution(ctx context.Context, db *sql.DB, ticket models.Ticket, resolvedAt time.Time) {
+	policies, _ := loadSupportSLAPolicies(ctx, db)
+	observability.SupportResolutionDuration.
+		WithLabelValues(supportMetricCategory(policies, ticket.Category), normalizedTicketPriority(ticket.Priority)).
+		Observe(resolvedAt.Sub(ticket.CreatedAt).Seconds())
+}
+
+// StartSLAMonitor keeps the open-ticket SLA and rating gauges fresh.
+func (h *SupportHandler) StartSLAMonitor(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			if err := h.refreshSLAMetrics(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("support sla metrics refresh failed: %v", err)
+			}
+			if err := h.refreshRatingMetrics(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("support rating metrics refresh failed: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (h *SupportHandler) refreshSLAMetrics(ctx context.Context) error {
+	queryCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	policies, err := loadSupportSLAPolicies(queryCtx, h.db)
+	if err != nil {
+		return err
+	}
+	rows, err := h.db.QueryContext(queryCtx, supportTicketSelectSQL+` WHERE status = 'open'`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	counts := map[string]float64{
+		supportSLAStateOK:       0,
+		supportSLAStateAtRisk:   0,
+		supportSLAStateBreached: 0,
+	}
+	now := time.Now().UTC()
+	for rows.Next() {
+		ticket, err := scanSupportTicket(rows)
+		if err != nil {
+			return err
+		}
+		counts[computeTicketSLA(ticket, policies, now).State]++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for state, count := range counts {
+		observability.SupportOpenTickets.WithLabelValues(state).Set(count)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"amy/minecraft-server/internal/models"
+)
+
+func TestComputeTicketSLA(t *testing.T) {
+	created := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		value := created.Add(d)
+		return &value
+	}
+	policies := map[string]supportSLAPolicy{
+		"bug": {Category: "bug", firstResponseDelay: time.Hour, resolutionDelay: 10 * time.Hour},
+	}
+
+	cases := []struct {
+		name      string
+		ticket    models.Ticket
+		now       time.Duration
+		state     string
+		remaining int64
+	}{
+		{"waiting for a reply", models.Ticket{Category: "bug"}, 10 * time.Minute, supportSLAStateOK, 50 * 60},
+		{"reply almost due", models.Ticket{Category: "Bug "}, 50 * time.Minute, supportSLAStateAtRisk, 10 * 60},
+		{"reply overdue", models.Ticket{Category: "bug"}, 2 * time.Hour, supportSLAStateBreached, -60 * 60},
+		{"answered counts to resolution", models.Ticket{Category: "bug", FirstResponseAt: at(30 * time.Minute)}, 2 * time.Hour, supportSLAStateOK, 8 * 60 * 60},
+		{"unknown category uses the default", models.Ticket{Category: "other"}, time.Hour, supportSLAStateOK, 3 * 60 * 60},
+		{"resolved in time", models.Ticket{Category: "bug", Status: "resolved", ResolvedAt: at(9 * time.Hour)}, 20 * time.Hour, supportSLAStateMet, 0},
+		{"resolved late", models.Ticket{Category: "bug", Status: "archived", ResolvedAt: at(11 * time.Hour)}, 20 * time.Hour, supportSLAStateMissed, 0},
+	}
+	for _, tc := range cases {
+		tc.ticket.CreatedAt = created
+		sla := computeTicketSLA(tc.ticket, policies, created.Add(tc.now))
+		if sla.State != tc.state || sla.RemainingSeconds != tc.remaining {
+			t.Errorf("%s: got %s with %ds left, want %s with %ds", tc.name, sla.State, sla.RemainingSeconds, tc.state, tc.remaining)
+		}
+	}
+}
+
+func TestSortSupportQueue(t *testing.T) {
+	created := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	sla := func(remaining int64) *models.TicketSLA { return &models.TicketSLA{RemainingSeconds: remaining} }
+	tickets := []models.Ticket{
+		{ID: 1, Priority: "low", CreatedAt: created, SLA: sla(600)},
+		{ID: 2, Priority: "normal", CreatedAt: created.Add(time.Minute), SLA: sla(600)},
+		{ID: 3, Priority: "urgent", CreatedAt: created.Add(2 * time.Minute), SLA: sla(600)},
+		{ID: 4, Priority: "low", CreatedAt: created.Add(3 * time.Minute), SLA: sla(-60)},
+		{ID: 5, Priority: "normal", CreatedAt: created.Add(-time.Minute), SLA: sla(600)},
+		{ID: 6, Priority: "bogus", CreatedAt: created.Add(-2 * time.Minute), SLA: sla(600)},
+	}
+	sortSupportQueue(tickets)
+
+	want := []int64{4, 3, 6, 5, 2, 1}
+	for i, ticket := range tickets {
+		if ticket.ID != want[i] {
+			t.Fatalf("position %d: got ticket %d, want order %v", i, ticket.ID, want)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"amy/minecraft-server/internal/models"
+)
+
+type supportStatusRequest struct {
+	Status string `json:"status"`
+}
+
+// Staff routes everything under /api/support/staff/.
+func (h *SupportHandler) Staff(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 4 || parts[0] != "api" || parts[1] != "support" || parts[2] != "staff" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	staffID, ok := h.requireSupportStaff(w, r)
+	if !ok {
+		return
+	}
+
+	if len(parts) == 4 {
+		switch parts[3] {
+		case "queue":
+			h.staffQueue(w, r, staffID)
+		case "sla":
+			h.staffSLAPolicies(w, r)
+		case "macros":
+			h.staffMacros(w, r, staffID)
+		case "autoclose":
+			h.staffAutoClosePolicies(w, r)
+		case "reports":
+			h.staffReports(w, r)
+		case "tickets":
+			h.staffListTickets(w, r, staffID)
+		default:
+			writeError(w, http.StatusNotFound, "not found")
+		}
+		return
+	}
+	if parts[3] == "macros" && len(parts) == 5 {
+		h.staffMacro(w, r, staffID, parts[4])
+		return
+	}
+	if parts[3] == "members" && len(parts) == 6 && parts[5] == "events" {
+		h.staffMemberEvents(w, r, parts[4])
+		return
+	}
+	if parts[3] != "tickets" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	ticketID, err := strconv.ParseInt(parts[4], 10, 64)
+	if err != nil || ticketID <= 0 {
+		writeError(w, http.StatusNotFound, "ticket not found")
+		return
+	}
+	switch {
+	case len(parts) == 5:
+		h.staffTicket(w, r, ticketID)
+	case len(parts) == 6 && parts[5] == "messages":
+		h.staffMessages(w, r, staffID, ticketID)
+	case len(parts) == 6 && parts[5] == "status":
+		h.staffStatus(w, r, ticketID)
+	case len(parts) == 6 && parts[5] == "assignment":
+		h.staffAssign(w, r, staffID, ticketID)
+	case len(parts) == 6 && parts[5] == "read":
+		h.staffRead(w, r, staffID, ticketID)
+	case len(parts) == 6 && parts[5] == "typing":
+		h.staffTyping(w, r, staffID, ticketID)
+	case len(parts) == 6 && parts[5] == "macro":
+		h.staffApplyMacro(w, r, staffID, ticketID)
+	case len(parts) == 7 && parts[5] == "attachments":
+		attachmentID, err := strconv.ParseInt(parts[6], 10, 64)
+		if err != nil || attachmentID <= 0 {
+			writeError(w, http.StatusNotFound, "attachment not found")
+			return
+		}
+		h.staffAttachment(w, r, ticketID, attachmentID)
+	case len(parts) == 8 && parts[5] == "attachments" && parts[7] == "release":
+		attachmentID, err := strconv.ParseInt(parts[6], 10, 64)
+		if err != nil || attachmentID <= 0 {
+			writeError(w, http.StatusNotFound, "attachment not found")
+			return
+		}
+		h.staffReleaseAttachment(w, r, ticketID, attachmentID)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (h *SupportHandler) staffListTickets(w http.ResponseWriter, r *http.Request, staffID string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	conditions := make([]string, 0, 4)
+	args := make([]any, 0, 6)
+	addArg := func(value any) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	switch status := strings.ToLower(strings.TrimSpace(query.Get("status"))); status {
+	case "", "all":
+	case "open", "resolved", "archived":
+		conditions = append(conditions, "status = "+addArg(status))
+	default:
+		writeError(w, http.StatusBadRequest, "invalid status")
+		return
+	}
+	switch assignee := strings.TrimSpace(query.Get("assignee")); assignee {
+	case "":
+	case "me":
+		conditions = append(conditions, "assignee_discord_id = "+addArg(staffID))
+	case "unassigned":
+		conditions = append(conditions, "assignee_discord_id = ''")
+	default:
+		conditions = append(conditions, "assignee_discord_id = "+addArg(assignee))
+	}
+	if category := strings.TrimSpace(query.Get("category")); category != "" {
+		conditions = append(conditions, "LOWER(category) = LOWER("+addArg(category)+")")
+	}
+	if search := strings.TrimSpace(query.Get("q")); search != "" {
+		if len([]rune(search)) > 120 {
+			writeError(w, http.StatusBadRequest, "search query is too long")
+			return
+		}
+		if id, err := strconv.ParseInt(strings.TrimPrefix(search, "#"), 10, 64); err == nil && id > 0 {
+			conditions = append(conditions, "id = "+addArg(id))
+		} else {
+			pattern := addArg("%" + escapeLikePattern(search) + "%")
+			conditions = append(conditions, `(subject ILIKE `+pattern+` OR discord_nick ILIKE `+pattern+` OR email ILIKE `+pattern+` OR name ILIKE `+pattern+`
+				OR EXISTS (SELECT 1 FROM support_ticket_messages m WHERE m.ticket_id = support_tickets.id AND m.message ILIKE `+pattern+`))`)
+		}
+	}
+
+	limit := 50
+	if value, err := strconv.Atoi(query.Get("limit")); err == nil && value > 0 && value <= 200 {
+		limit = value
+	}
+	offset := 0
+	if value, err := strconv.Atoi(query.Get("offset")); err == nil && value > 0 {
+		offset = value
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	var total int
+	if err := h.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM support_tickets`+where, args...).Scan(&total); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to count tickets")
+		return
+	}
+
+	rows, err := h.db.QueryContext(
+		ctx,
+		supportTicketSelectSQL+where+` ORDER BY created_at DESC LIMIT `+addArg(limit)+` OFFSET `+addArg(offset),
+		args...,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load tickets")
+		return
+	}
+	defer rows.Close()
+
+	policies, _ := loadSupportSLAPolicies(ctx, h.db)
+	now := time.Now().UTC()
+	tickets := make([]models.Ticket, 0)
+	for rows.Next() {
+		ticket, err := scanSupportTicket(rows)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to scan tickets")
+			return
+		}
+		ticket.SLA = computeTicketSLA(ticket, policies, now)
+		tickets = append(tickets, ticket)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to scan tickets")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"tickets": tickets, "total": total, "limit": limit, "offset": offset})
+}
+
+func (h *SupportHandler) staffTicket(w http.ResponseWriter, r *http.Request, ticketID int64) {
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	ticket, ok := h.staffLoadTicket(ctx, w, ticketID)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.writeStaffTicket(ctx, w, ticket)
+	case http.MethodDelete:
+		if err := h.deleteTicket(ctx, ticket); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to delete ticket")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (h *SupportHandler) staffMessages(w http.ResponseWriter, r *http.Request, staffID string, ticketID int64) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+
+	ticket, ok := h.staffLoadTicket(ctx, w, ticketID)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		message, files, err := h.readMessagePayload(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if message == "" && len(files) == 0 {
+			writeError(w, http.StatusBadRequest, "message or image required")
+			return
+		}
+		if len([]rune(message)) > 2000 {
+			writeError(w, http.StatusBadRequest, "message is too long")
+			return
+		}
+		if _, err := h.saveStaffTicketReply(ctx, ticket, staffID, message, files, "сайт"); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to save reply")
+			return
+		}
+		if reloaded, err := h.loadTicket(ctx, ticket.ID); err == nil {
+			ticket = reloaded
+		}
+	}
+
+	h.writeStaffTicket(ctx, w, ticket)
+}
+
+func (h *SupportHandler) staffStatus(w http.ResponseWriter, r *http.Request, ticketID int64) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPatch {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var payload supportStatusRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 8*1024)).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	nextStatus := strings.ToLower(strings.TrimSpace(payload.Status))
+	if nextStatus != "open" && nextStatus != "resolved" && nextStatus != "archived" {
+		writeError(w, http.StatusBadRequest, "status must be open, resolved or archived")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	ticket, ok := h.staffLoadTicket(ctx, w, ticketID)
+	if !ok {
+		return
+	}
+	if normalizedTicketStatus(ticket.Status) != nextStatus {
+		if err := h.setTicketStatus(ctx, &ticket, nextStatus); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to update ticket")
+			return
+		}
+	}
+
+	if policies, err := loadSupportSLAPolicies(ctx, h.db); err == nil {
+		ticket.SLA = computeTicketSLA(ticket, policies, time.Now().UTC())
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok", "ticket": ticket})
+}
+
+func (h *SupportHandler) staffAttachment(w http.ResponseWriter, r *http.Request, ticketID, attachmentID int64) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var fileName, mimeType, path, thumbnailPath string
+	var quarantined bool
+	err := h.db.QueryRowContext(
+		ctx,
+		`SELECT file_name, mime_type, storage_path, thumbnail_path, quarantined_at IS NOT NULL FROM support_ticket_attachments WHERE id = $1 AND ticket_id = $2`,
+		attachmentID,
+		ticketID,
+	).Scan(&fileName, &mimeType, &path, &thumbnailPath, &quarantined)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "attachment not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load attachment")
+		return
+	}
+	if quarantined {
+		// Quarantined files were never re-encoded, so they are only ever
+		// handed out as opaque downloads.
+		serveSupportAttachment(w, r, fileName, "application/octet-stream", path)
+		return
+	}
+	serveSupportAttachmentVariant(w, r, fileName, mimeType, path, thumbnailPath)
+}
+
+func (h *SupportHandler) staffLoadTicket(ctx context.Context, w http.ResponseWriter, ticketID int64) (models.Ticket, bool) {
+	ticket, err := h.loadTicket(ctx, ticketID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "ticket not found")
+			return ticket, false
+		}
+		writeError(w, http.StatusInternalServerError, "failed to load ticket")
+		return ticket, false
+	}
+	return ticket, true
+}
+
+func (h *SupportHandler) writeStaffTicket(ctx context.Context, w http.ResponseWriter, ticket models.Ticket) {
+	messages, err := h.loadTicketMessages(ctx, ticket.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load messages")
+		return
+	}
+	for i := range messages {
+		for j := range messages[i].Attachments {
+			attachment := &messages[i].Attachments[j]
+			attachment.URL = fmt.Sprintf("/support/staff/tickets/%d/attachments/%d", attachment.TicketID, attachment.ID)
+			if attachment.ThumbnailPath != "" {
+				attachment.ThumbnailURL = attachment.URL + "?size=thumb"
+			}
+		}
+	}
+	if policies, err := loadSupportSLAPolicies(ctx, h.db); err == nil {
+		ticket.SLA = computeTicketSLA(ticket, policies, time.Now().UTC())
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"ticket":         ticket,
+		"ownerDiscordId": ticket.OwnerDiscordID,
+		"messages":       messages,
+	})
+}
+
+// saveStaffTicketReply stores a reply written by an authenticated staff
+// member, including any images, and notifies the ticket owner. source labels
+// the copy posted into the Discord thread.
+func (h *SupportHandler) saveStaffTicketReply(ctx context.Context, ticket models.Ticket, staffID, message string, files []supportUpload, source string) (int64, error) {
+	message = strings.TrimSpace(message)
+	if message == "" && len(files) == 0 {
+		return 0, fmt.Errorf("empty reply")
+	}
+	authorName := h.staffDisplayName(ctx, staffID)
+	status := "unknown"
+	_ = h.db.QueryRowContext(ctx, `SELECT COALESCE(NULLIF(discord_status, ''), 'unknown') FROM discord_member_states WHERE discord_id = $1`, staffID).Scan(&status)
+
+	now := time.Now().UTC()
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var messageID int64
+	err = tx.QueryRowContext(
+		ctx,
+		`INSERT INTO support_ticket_messages
+		 (ticket_id, author_type, author_name, author_discord_id, author_discord_status, message, reply_source, read_by_user, created_at)
+		 VALUES ($1, 'admin', $2, $3, $4, $5, $6, FALSE, $7)
+		 RETURNING id`,
+		ticket.ID,
+		authorName,
+		staffID,
+		status,
+		message,
+		source,
+		now,
+	).Scan(&messageID)
+	if err != nil {
+		return 0, err
+	}
+	for _, file := range files {
+		if err := h.saveTicketAttachment(ctx, tx, ticket.ID, messageID, file); err != nil {
+			return 0, err
+		}
+	}
+	if err := h.enqueueTicketMessage(ctx, tx, ticket.ID, messageID); err != nil {
+		return 0, err
+	}
+	if err := h.outbox.commit(tx); err != nil {
+		return 0, err
+	}
+	recordSupportFirstResponse(ctx, h.db, ticket.ID, now)
+	h.markTicketReadByStaff(ctx, ticket.ID, staffID, 0)
+	_ = h.writeTicketHistoryHTML(ctx, ticket)
+
+	h.publishTicketMessage(ctx, ticket.ID, messageID, supportEventMessage)
+	notifyText := message
+	if notifyText == "" {
+		notifyText = fmt.Sprintf("[изображений: %d]", len(files))
+	}
+	h.emailTicketUpdate(ctx, ticket, supportEmailKindReply, authorName, notifyText)
+	h.sendTicketReplyPush(ctx, ticket, authorName, notifyText)
+	return messageID, nil
+}
+
+func escapeLikePattern(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
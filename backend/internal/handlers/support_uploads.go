@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"amy/minecraft-server/internal/observability"
+)
+
+// AttachmentScanner inspects a file before it is stored on a ticket. A
+// non-empty verdict names what was found and sends the file to quarantine
+// instead of the chat.
+type AttachmentScanner interface {
+	ScanAttachment(ctx context.Context, name string, data []byte) (string, error)
+}
+
+// SetAttachmentScanner enables scanning of every new ticket attachment.
+func (h *SupportHandler) SetAttachmentScanner(scanner AttachmentScanner) {
+	h.scanner = scanner
+}
+
+// ClamdScanner streams files to a clamd daemon with the INSTREAM command.
+type ClamdScanner struct {
+	network string
+	address string
+}
+
+// NewClamdScanner accepts "unix:/run/clamav/clamd.ctl", a bare socket path or
+// "host:port" (optionally prefixed with "tcp://").
+func NewClamdScanner(addr string) *ClamdScanner {
+	addr = strings.TrimSpace(addr)
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		return &ClamdScanner{network: "unix", address: strings.TrimPrefix(addr, "unix:")}
+	case strings.HasPrefix(addr, "/"):
+		return &ClamdScanner{network: "unix", address: addr}
+	default:
+		return &ClamdScanner{network: "tcp", address: strings.TrimPrefix(addr, "tcp://")}
+	}
+}
+
+func (s *ClamdScanner) ScanAttachment(ctx context.Context, name string, data []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	const chunkSize = 64 * 1024
+	size := make([]byte, 4)
+	for offset := 0; offset < len(data); offset += chunkSize {
+		chunk := data[offset:min(offset+chunkSize, len(data))]
+		binary.BigEndian.PutUint32(size, uint32(len(chunk)))
+		if _, err := conn.Write(size); err != nil {
+			return "", err
+		}
+		if _, err := conn.Write(chunk); err != nil {
+			return "", err
+		}
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := conn.Write(size); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", err
+	}
+	// Replies look like "stream: OK", "stream: Eicar-Signature FOUND" or
+	// "INSTREAM size limit exceeded. ERROR".
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	reply = strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// prepareSupportUpload scans a new attachment and re-encodes images. Files the
+// scanner flags, or that could not be scanned, come back marked for
+// quarantine and untouched so staff can look at the original.
+func (h *SupportHandler) prepareSupportUpload(ctx context.Context, upload supportUpload) (supportUpload, error) {
+	if h.scanner != nil {
+		verdict, err := h.scanner.ScanAttachment(ctx, upload.Name, upload.Bytes)
+		switch {
+		case err != nil:
+			log.Printf("support attachment %s scan failed: %v", upload.Name, err)
+			observability.SupportAttachmentScans.WithLabelValues("error").Inc()
+			upload.Quarantine = "scan failed"
+			return upload, nil
+		case verdict != "":
+			observability.SupportAttachmentScans.WithLabelValues("infected").Inc()
+			upload.Quarantine = verdict
+			return upload, nil
+		}
+		observability.SupportAttachmentScans.WithLabelValues("clean").Inc()
+	}
+	return sanitizeSupportUpload(upload)
+}
+
+func sanitizeSupportUpload(upload supportUpload) (supportUpload, error) {
+	if !strings.HasPrefix(upload.MimeType, "image/") {
+		return upload, nil
+	}
+	image, err := sanitizeSupportImage(upload.Bytes)
+	if err != nil {
+		return upload, err
+	}
+	upload.Bytes = image.Bytes
+	upload.MimeType = image.MimeType
+	upload.Name = supportImageFileName(upload.Name, image.MimeType)
+	upload.Thumbnail = image.Thumbnail
+	upload.ThumbnailType = image.ThumbnailType
+	return upload, nil
+}
+
+// deliverableSupportUploads drops quarantined files from what is forwarded to
+// Discord.
+func deliverableSupportUploads(files []supportUpload) []supportUpload {
+	deliverable := make([]supportUpload, 0, len(files))
+	for _, file := range files {
+		if file.Quarantine == "" {
+			deliverable = append(deliverable, file)
+		}
+	}
+	return deliverable
+}
+
+func supportThumbnailPath(path, mimeType string) string {
+	if mimeType == "image/png" {
+		return path + ".thumb.png"
+	}
+	return path + ".thumb.jpg"
+}
+
+// serveSupportAttachmentVariant serves the thumbnail for ?size=thumb when the
+// attachment has one and the original otherwise.
+func serveSupportAttachmentVariant(w http.ResponseWriter, r *http.Request, fileName, mimeType, path, thumbnailPath string) {
+	if r.URL.Query().Get("size") == "thumb" && thumbnailPath != "" {
+		serveSupportAttachment(w, r, fileName, mime.TypeByExtension(filepath.Ext(thumbnailPath)), thumbnailPath)
+		return
+	}
+	serveSupportAttachment(w, r, fileName, mimeType, path)
+}
+
+// staffReleaseAttachment moves a quarantined file back into the ticket after
+// staff have checked it: POST /staff/tickets/{id}/attachments/{id}/release.
+func (h *SupportHandler) staffReleaseAttachment(w http.ResponseWriter, r *http.Request, ticketID, attachmentID int64) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+
+	var fileName, mimeType, path string
+	var quarantinedAt sql.NullTime
+	err := h.db.QueryRowContext(
+		ctx,
+		`SELECT file_name, mime_type, storage_path, quarantined_at FROM support_ticket_attachments WHERE id = $1 AND ticket_id = $2`,
+		attachmentID,
+		ticketID,
+	).Scan(&fileName, &mimeType, &path, &quarantinedAt)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "attachment not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load attachment")
+		return
+	}
+	if !quarantinedAt.Valid {
+		writeError(w, http.StatusConflict, "attachment is not quarantined")
+		return
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to read attachment")
+		return
+	}
+	upload, err := sanitizeSupportUpload(supportUpload{Name: fileName, MimeType: mimeType, Bytes: raw})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dir := filepath.Join(h.storageDir, "tickets", strconv.FormatInt(ticketID, 10), "attachments")
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to prepare attachment storage")
+		return
+	}
+	releasedPath := filepath.Join(dir, fmt.Sprintf("%d_%s", time.Now().UnixNano(), upload.Name))
+	if err := os.WriteFile(releasedPath, upload.Bytes, 0640); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to save attachment")
+		return
+	}
+	thumbnailPath := ""
+	if len(upload.Thumbnail) > 0 {
+		thumbnailPath = supportThumbnailPath(releasedPath, upload.ThumbnailType)
+		if err := os.WriteFile(thumbnailPath, upload.Thumbnail, 0640); err != nil {
+			thumbnailPath = ""
+		}
+	}
+	_, err = h.db.ExecContext(
+		ctx,
+		`UPDATE support_ticket_attachments
+		 SET file_name = $1, mime_type = $2, size_bytes = $3, storage_path = $4, thumbnail_path = $5, quarantine_reason = '', quarantined_at = NULL
+		 WHERE id = $6`,
+		upload.Name,
+		upload.MimeType,
+		len(upload.Bytes),
+		releasedPath,
+		thumbnailPath,
+		attachmentID,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to release attachment")
+		return
+	}
+	_ = os.Remove(path)
+
+	if ticket, err := h.loadTicket(ctx, ticketID); err == nil {
+		_ = h.writeTicketHistoryHTML(ctx, ticket)
+		var messageID int64
+		if h.db.QueryRowContext(ctx, `SELECT message_id FROM support_ticket_attachments WHERE id = $1`, attachmentID).Scan(&messageID) == nil {
+			h.publishTicketMessage(ctx, ticketID, messageID, supportEventMessageUpdated)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
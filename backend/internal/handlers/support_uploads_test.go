@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// fakeClamd accepts one INSTREAM session per connection and answers with
+// reply(received bytes).
+func fakeClamd(t *testing.T, network, address string, reply func([]byte) string) string {
+	t.Helper()
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", network, err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				command, err := reader.ReadString(0)
+				if err != nil || command != "zINSTREAM\x00" {
+					_, _ = io.WriteString(conn, "UNKNOWN COMMAND\x00")
+					return
+				}
+				var received bytes.Buffer
+				for {
+					var size uint32
+					if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(&received, reader, int64(size)); err != nil {
+						return
+					}
+				}
+				_, _ = io.WriteString(conn, reply(received.Bytes())+"\x00")
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestClamdScannerVerdicts(t *testing.T) {
+	eicar := []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+	address := fakeClamd(t, "tcp", "127.0.0.1:0", func(data []byte) string {
+		switch {
+		case bytes.Equal(data, eicar):
+			return "stream: Eicar-Signature FOUND"
+		case len(data) > 100_000:
+			return "INSTREAM size limit exceeded. ERROR"
+		default:
+			return "stream: OK"
+		}
+	})
+	scanner := NewClamdScanner("tcp://" + address)
+	ctx := context.Background()
+
+	if verdict, err := scanner.ScanAttachment(ctx, "clean.txt", []byte("hello")); err != nil || verdict != "" {
+		t.Errorf("clean file: got %q, %v", verdict, err)
+	}
+	if verdict, err := scanner.ScanAttachment(ctx, "eicar.txt", eicar); err != nil || verdict != "Eicar-Signature" {
+		t.Errorf("infected file: got %q, %v", verdict, err)
+	}
+	// Spans several 64 KiB chunks.
+	if verdict, err := scanner.ScanAttachment(ctx, "big.bin", make([]byte, 150_000)); err == nil || verdict != "" {
+		t.Errorf("clamd error: got %q, %v", verdict, err)
+	}
+}
+
+func TestClamdScannerUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clamd.sock")
+	var got []byte
+	fakeClamd(t, "unix", path, func(data []byte) string {
+		got = append([]byte(nil), data...)
+		return "stream: OK"
+	})
+	payload := bytes.Repeat([]byte("amy"), 30_000)
+	if verdict, err := NewClamdScanner("unix:"+path).ScanAttachment(context.Background(), "a.bin", payload); err != nil || verdict != "" {
+		t.Fatalf("got %q, %v", verdict, err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("clamd received %d bytes, want %d", len(got), len(payload))
+	}
+}
+
+func TestNewClamdScannerAddresses(t *testing.T) {
+	cases := map[string][2]string{
+		"unix:/run/clamav/clamd.ctl": {"unix", "/run/clamav/clamd.ctl"},
+		"/run/clamav/clamd.ctl":      {"unix", "/run/clamav/clamd.ctl"},
+		"tcp://clamav:3310":          {"tcp", "clamav:3310"},
+		" clamav:3310 ":              {"tcp", "clamav:3310"},
+	}
+	for input, want := range cases {
+		scanner := NewClamdScanner(input)
+		if scanner.network != want[0] || scanner.address != want[1] {
+			t.Errorf("%q: got %s %s, want %s %s", input, scanner.network, scanner.address, want[0], want[1])
+		}
+	}
+}
+
+type fakeScanner struct {
+	verdict string
+	err     error
+	scanned []string
+}
+
+func (s *fakeScanner) ScanAttachment(_ context.Context, name string, _ []byte) (string, error) {
+	s.scanned = append(s.scanned, name)
+	return s.verdict, s.err
+}
+
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	img.Set(1, 1, color.NRGBA{R: 255, A: 255})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPrepareSupportUploadQuarantine(t *testing.T) {
+	raw := testPNG(t)
+	upload := func() supportUpload {
+		// A misleading name: the sanitized copy gets the real extension.
+		return supportUpload{Name: "photo.jpeg", MimeType: "image/png", Bytes: append([]byte(nil), raw...)}
+	}
+	ctx := context.Background()
+
+	clean := &fakeScanner{}
+	h := &SupportHandler{}
+	h.SetAttachmentScanner(clean)
+	prepared, err := h.prepareSupportUpload(ctx, upload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prepared.Quarantine != "" || prepared.Name != "photo.png" || len(prepared.Thumbnail) == 0 {
+		t.Errorf("clean image: got quarantine %q, name %q, %d byte thumbnail", prepared.Quarantine, prepared.Name, len(prepared.Thumbnail))
+	}
+	if len(clean.scanned) != 1 {
+		t.Errorf("scanner called %d times, want 1", len(clean.scanned))
+	}
+
+	h.SetAttachmentScanner(&fakeScanner{verdict: "Eicar-Signature"})
+	infected, err := h.prepareSupportUpload(ctx, upload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if infected.Quarantine != "Eicar-Signature" || !bytes.Equal(infected.Bytes, raw) || infected.Name != "photo.jpeg" {
+		t.Errorf("infected image should be quarantined untouched, got %q %q", infected.Quarantine, infected.Name)
+	}
+
+	h.SetAttachmentScanner(&fakeScanner{err: errors.New("clamd down")})
+	unscanned, err := h.prepareSupportUpload(ctx, upload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unscanned.Quarantine != "scan failed" || !bytes.Equal(unscanned.Bytes, raw) {
+		t.Errorf("unscanned image should be quarantined untouched, got %q", unscanned.Quarantine)
+	}
+
+	deliverable := deliverableSupportUploads([]supportUpload{prepared, infected, unscanned})
+	if len(deliverable) != 1 || deliverable[0].Name != "photo.png" {
+		t.Errorf("only the clean upload should reach Discord, got %d", len(deliverable))
+	}
+
+	// Staff release re-runs the same sanitizing on the quarantined original.
+	released, err := sanitizeSupportUpload(supportUpload{Name: infected.Name, MimeType: infected.MimeType, Bytes: infected.Bytes})
+	if err != nil || released.Name != "photo.png" || len(released.Thumbnail) == 0 {
+		t.Errorf("release: got %q, %v", released.Name, err)
+	}
+}
+
+func TestPrepareSupportUploadWithoutScanner(t *testing.T) {
+	h := &SupportHandler{}
+	text := supportUpload{Name: "log.txt", MimeType: "text/plain", Bytes: []byte("log")}
+	prepared, err := h.prepareSupportUpload(context.Background(), text)
+	if err != nil || prepared.Quarantine != "" || string(prepared.Bytes) != "log" {
+		t.Fatalf("got %+v, %v", prepared, err)
+	}
+	if _, err := h.prepareSupportUpload(context.Background(), supportUpload{Name: "x.png", MimeType: "image/png", Bytes: []byte("not a png")}); err == nil {
+		t.Fatal("expected an invalid image to be rejected")
+	}
+}
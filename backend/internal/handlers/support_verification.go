@@ -0,0 +1,334 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"amy/minecraft-server/internal/models"
+	"amy/minecraft-server/internal/observability"
+)
+
+const (
+	supportTicketsPerUserHour = 5
+	supportTicketsPerIPHour   = 10
+	supportVerificationTTL    = 24 * time.Hour
+
+	defaultCaptchaVerifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+)
+
+// supportCaptcha checks captcha tokens from anonymous ticket forms against a
+// Turnstile/hCaptcha style siteverify endpoint. Without a secret every token
+// passes, which is how local setups run.
+type supportCaptcha struct {
+	secret    string
+	verifyURL string
+	client    *http.Client
+}
+
+func newSupportCaptcha(secret, verifyURL string) supportCaptcha {
+	verifyURL = strings.TrimSpace(verifyURL)
+	if verifyURL == "" {
+		verifyURL = defaultCaptchaVerifyURL
+	}
+	return supportCaptcha{
+		secret:    strings.TrimSpace(secret),
+		verifyURL: verifyURL,
+		client:    &http.Client{Timeout: 8 * time.Second},
+	}
+}
+
+func (c supportCaptcha) Verify(ctx context.Context, token, remoteIP string) error {
+	if c.secret == "" {
+		return nil
+	}
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return fmt.Errorf("missing captcha token")
+	}
+	form := url.Values{"secret": {c.secret}, "response": {token}}
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errUnexpectedStatus(resp.StatusCode)
+	}
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&result); err != nil {
+		return err
+	}
+	if !result.Success {
+		return fmt.Errorf("captcha rejected")
+	}
+	return nil
+}
+
+// sessionDiscordID returns the signed-in user of a verified session cookie,
+// ignoring sessions of accounts that were deleted since.
+func (h *SupportHandler) sessionDiscordID(ctx context.Context, r *http.Request) string {
+	discordID := currentDiscordIDFromCookie(r)
+	if discordID == "" {
+		return ""
+	}
+	var exists bool
+	if err := h.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM discord_users WHERE discord_id = $1)`, discordID).Scan(&exists); err != nil || !exists {
+		return ""
+	}
+	return discordID
+}
+
+// findDuplicateTicket returns an open ticket from the same owner with the
+// same subject and text created in the last day.
+func (h *SupportHandler) findDuplicateTicket(ctx context.Context, ticket models.Ticket) (int64, error) {
+	var id int64
+	err := h.db.QueryRowContext(
+		ctx,
+		`SELECT id FROM support_tickets
+		 WHERE owner_discord_id = $1 AND status = 'open'
+		   AND LOWER(subject) = LOWER($2) AND message = $3 AND created_at >= $4
+		 ORDER BY created_at DESC
+		 LIMIT 1`,
+		ticket.OwnerDiscordID,
+		ticket.Subject,
+		ticket.Message,
+		time.Now().UTC().Add(-24*time.Hour),
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// requestTicketVerification parks an anonymous ticket and sends the member
+// named in it a Discord DM with a confirmation link.
+func (h *SupportHandler) requestTicketVerification(ctx context.Context, ticket models.Ticket, clientIP string) error {
+	if !h.discord.Configured() {
+		return fmt.Errorf("discord bot is not configured")
+	}
+	payload, err := json.Marshal(ticketRequest{
+		Name:        ticket.Name,
+		Email:       ticket.Email,
+		DiscordNick: ticket.DiscordNick,
+		Subject:     ticket.Subject,
+		Category:    ticket.Category,
+		Message:     ticket.Message,
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	token := randomHex(24)
+	_, _ = h.db.ExecContext(ctx, `DELETE FROM support_ticket_verifications WHERE expires_at < $1`, now)
+	_, err = h.db.ExecContext(
+		ctx,
+		`INSERT INTO support_ticket_verifications (token, discord_id, payload, client_ip, created_at, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6)`,
+		token,
+		ticket.OwnerDiscordID,
+		string(payload),
+		clientIP,
+		now,
+		now.Add(supportVerificationTTL),
+	)
+	if err != nil {
+		return err
+	}
+
+	base := strings.TrimRight(h.frontendURL, "/")
+	if base == "" {
+		base = "http://localhost:8080"
+	}
+	link := base + "/api/support/tickets/verify?token=" + url.QueryEscape(token)
+	content := fmt.Sprintf(
+		"Кто-то создаёт тикет поддержки Amy World от вашего имени: «%s».\nЕсли это вы, подтвердите его: %s\nСсылка действует 24 часа. Если это были не вы, просто проигнорируйте сообщение.",
+		truncateRunes(ticket.Subject, 200),
+		link,
+	)
+	if err := h.sendDiscordDM(ctx, ticket.OwnerDiscordID, content); err != nil {
+		_, _ = h.db.ExecContext(ctx, `DELETE FROM support_ticket_verifications WHERE token = $1`, token)
+		return err
+	}
+	return nil
+}
+
+func (h *SupportHandler) sendDiscordDM(ctx context.Context, discordID, content string) error {
+	var channel discordChannel
+	if err := h.discordBotJSON(ctx, "support_verification_dm", http.MethodPost, "/users/@me/channels", map[string]any{"recipient_id": discordID}, &channel); err != nil {
+		return err
+	}
+	// SUPPRESS_EMBEDS keeps Discord from unfurling the link, since its
+	// crawler would otherwise be the first to open it.
+	return h.discordBotJSON(ctx, "support_verification_dm", http.MethodPost, "/channels/"+url.PathEscape(channel.ID)+"/messages", map[string]any{
+		"content":          content,
+		"allowed_mentions": map[string]any{"parse": []string{}},
+		"flags":            4,
+	}, nil)
+}
+
+// VerifyTicket creates a parked anonymous ticket once its owner confirms it.
+// GET /api/support/tickets/verify?token=... (the link from the DM) only shows
+// a confirmation form, so link previews and scanners that open the URL do not
+// create the ticket; the form POSTs the token back to the same path.
+func (h *SupportHandler) VerifyTicket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	token := strings.TrimSpace(r.FormValue("token"))
+	if token == "" {
+		writeError(w, http.StatusBadRequest, "missing token")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+
+	if r.Method == http.MethodGet {
+		var subject string
+		err := h.db.QueryRowContext(
+			ctx,
+			`SELECT payload->>'subject' FROM support_ticket_verifications WHERE token = $1 AND expires_at >= $2`,
+			token,
+			time.Now().UTC(),
+		).Scan(&subject)
+		if err == sql.ErrNoRows {
+			h.writeTicketVerifiedHTML(w, 0, "Ссылка недействительна или устарела. Создайте тикет заново.")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to verify ticket")
+			return
+		}
+		h.writeTicketVerifyConfirmHTML(w, token, subject)
+		return
+	}
+
+	// Deleting first makes the link single-use even if it is opened twice
+	// at the same time.
+	var discordID, rawPayload string
+	err := h.db.QueryRowContext(
+		ctx,
+		`DELETE FROM support_ticket_verifications WHERE token = $1 AND expires_at >= $2 RETURNING discord_id, payload`,
+		token,
+		time.Now().UTC(),
+	).Scan(&discordID, &rawPayload)
+	if err == sql.ErrNoRows {
+		h.writeTicketVerifiedHTML(w, 0, "Ссылка недействительна или устарела. Создайте тикет заново.")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to verify ticket")
+		return
+	}
+	var payload ticketRequest
+	if err := json.Unmarshal([]byte(rawPayload), &payload); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to verify ticket")
+		return
+	}
+
+	ticket := models.Ticket{
+		Name:            payload.Name,
+		Email:           payload.Email,
+		DiscordNick:     payload.DiscordNick,
+		OwnerDiscordID:  discordID,
+		Subject:         payload.Subject,
+		Category:        payload.Category,
+		Message:         payload.Message,
+		Status:          "open",
+		Priority:        "normal",
+		ModerationToken: randomHex(20),
+		CreatedAt:       time.Now().UTC(),
+	}
+	if duplicateID, err := h.findDuplicateTicket(ctx, ticket); err == nil && duplicateID > 0 {
+		h.writeTicketVerifiedHTML(w, duplicateID, "")
+		return
+	}
+	if err := h.createTicket(ctx, &ticket); err != nil {
+		log.Printf("support ticket verification for %s failed: %v", discordID, err)
+		writeError(w, http.StatusInternalServerError, "failed to create ticket")
+		return
+	}
+	observability.SupportTicketVerifications.WithLabelValues("confirmed").Inc()
+	h.writeTicketVerifiedHTML(w, ticket.ID, "")
+}
+
+func (h *SupportHandler) writeTicketVerifyConfirmHTML(w http.ResponseWriter, token, subject string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	htmlBody := fmt.Sprintf(`<!doctype html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <title>Подтверждение тикета</title>
+    <style>
+      body{font-family:system-ui;background:#0f1118;color:#fff;margin:0;padding:40px}
+      .card{max-width:760px;margin:0 auto;padding:24px;border-radius:14px;background:#171a26;border:1px solid rgba(255,255,255,.12)}
+      .muted{color:#b4b6c7}
+      button{display:inline-flex;margin-top:12px;padding:10px 14px;border-radius:10px;border:0;background:#f7c948;color:#0b0b0f;font:inherit;font-weight:700;cursor:pointer}
+    </style>
+  </head>
+  <body>
+    <div class="card">
+      <h1>Создать тикет поддержки?</h1>
+      <p class="muted">Тема: «%s». Если тикет создавали не вы, просто закройте эту страницу.</p>
+      <form method="post" action="/api/support/tickets/verify">
+        <input type="hidden" name="token" value="%s">
+        <button type="submit">Да, это я</button>
+      </form>
+    </div>
+  </body>
+</html>`, html.EscapeString(subject), html.EscapeString(token))
+	_, _ = w.Write([]byte(htmlBody))
+}
+
+func (h *SupportHandler) writeTicketVerifiedHTML(w http.ResponseWriter, ticketID int64, errorText string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	title := fmt.Sprintf("Тикет #%d создан", ticketID)
+	text := "Поддержка ответит в Discord и на сайте. Войдите через Discord, чтобы следить за перепиской."
+	if errorText != "" {
+		title = "Тикет не подтверждён"
+		text = errorText
+	}
+	base := strings.TrimRight(h.frontendURL, "/")
+	htmlBody := fmt.Sprintf(`<!doctype html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <title>%s</title>
+    <style>
+      body{font-family:system-ui;background:#0f1118;color:#fff;margin:0;padding:40px}
+      .card{max-width:760px;margin:0 auto;padding:24px;border-radius:14px;background:#171a26;border:1px solid rgba(255,255,255,.12)}
+      .muted{color:#b4b6c7}
+      a{display:inline-flex;margin-right:10px;margin-top:12px;padding:10px 14px;border-radius:10px;background:#f7c948;color:#0b0b0f;text-decoration:none;font-weight:700}
+    </style>
+  </head>
+  <body>
+    <div class="card">
+      <h1>%s</h1>
+      <p class="muted">%s</p>
+      <a href="%s/support">Открыть поддержку</a>
+    </div>
+  </body>
+</html>`, html.EscapeString(title), html.EscapeString(title), html.EscapeString(text), html.EscapeString(base))
+	_, _ = w.Write([]byte(htmlBody))
+}
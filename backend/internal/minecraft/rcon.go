@@ -0,0 +1,169 @@
+// Package minecraft talks to the Minecraft server: RCON commands and the
+// chat text helpers the chat bridge needs.
+package minecraft
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rconTypeResponse = 0
+	rconTypeCommand  = 2
+	rconTypeLogin    = 3
+
+	// The server refuses command packets with a body over 1446 bytes.
+	maxCommandBytes  = 1446
+	maxResponseBytes = 4096
+	rconTimeout      = 5 * time.Second
+)
+
+// ErrAuth means the server refused the RCON password.
+var ErrAuth = errors.New("minecraft rcon: authentication failed")
+
+// ErrCommandTooLong is returned for commands over the server's packet limit.
+var ErrCommandTooLong = errors.New("minecraft rcon: command too long")
+
+// RCON keeps one authenticated connection and reconnects when it breaks.
+// Commands are sent one at a time; it is safe for concurrent use.
+type RCON struct {
+	addr     string
+	password string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	nextID int32
+}
+
+func NewRCON(addr, password string) *RCON {
+	return &RCON{addr: strings.TrimSpace(addr), password: password}
+}
+
+// Configured reports whether an address and password are set.
+func (c *RCON) Configured() bool {
+	return c != nil && c.addr != "" && c.password != ""
+}
+
+// Command runs a console command and returns the server's reply. A broken
+// connection is re-dialled once before the error is returned.
+func (c *RCON) Command(ctx context.Context, command string) (string, error) {
+	if !c.Configured() {
+		return "", errors.New("minecraft rcon is not configured")
+	}
+	if len(command) > maxCommandBytes {
+		return "", ErrCommandTooLong
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		if c.conn == nil {
+			if err := c.connect(ctx); err != nil {
+				return "", err
+			}
+		}
+		reply, err := c.exchange(ctx, rconTypeCommand, command)
+		if err == nil {
+			return reply, nil
+		}
+		c.closeLocked()
+		if attempt > 0 || ctx.Err() != nil {
+			return "", err
+		}
+	}
+}
+
+// Close drops the connection; the next command dials again.
+func (c *RCON) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closeLocked()
+}
+
+func (c *RCON) closeLocked() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+func (c *RCON) connect(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: rconTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return fmt.Errorf("minecraft rcon: dial %s: %w", c.addr, err)
+	}
+	c.conn = conn
+	if _, err := c.exchange(ctx, rconTypeLogin, c.password); err != nil {
+		c.closeLocked()
+		return err
+	}
+	return nil
+}
+
+// exchange writes one packet and reads its reply. The server answers a
+// failed login with request id -1.
+func (c *RCON) exchange(ctx context.Context, packetType int32, body string) (string, error) {
+	deadline := time.Now().Add(rconTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return "", err
+	}
+
+	c.nextID++
+	if c.nextID <= 0 {
+		c.nextID = 1
+	}
+	id := c.nextID
+
+	var packet bytes.Buffer
+	_ = binary.Write(&packet, binary.LittleEndian, int32(4+4+len(body)+2))
+	_ = binary.Write(&packet, binary.LittleEndian, id)
+	_ = binary.Write(&packet, binary.LittleEndian, packetType)
+	packet.WriteString(body)
+	packet.Write([]byte{0, 0})
+	if _, err := c.conn.Write(packet.Bytes()); err != nil {
+		return "", fmt.Errorf("minecraft rcon: write: %w", err)
+	}
+
+	for {
+		var header struct {
+			Length int32
+			ID     int32
+			Type   int32
+		}
+		if err := binary.Read(c.conn, binary.LittleEndian, &header); err != nil {
+			return "", fmt.Errorf("minecraft rcon: read: %w", err)
+		}
+		if header.Length < 10 || header.Length > maxResponseBytes+10 {
+			return "", fmt.Errorf("minecraft rcon: bad packet length %d", header.Length)
+		}
+		payload := make([]byte, header.Length-8)
+		if _, err := io.ReadFull(c.conn, payload); err != nil {
+			return "", fmt.Errorf("minecraft rcon: read: %w", err)
+		}
+		if packetType == rconTypeLogin && header.ID == -1 {
+			return "", ErrAuth
+		}
+		if header.ID != id {
+			// A late reply to a command that timed out earlier.
+			continue
+		}
+		if packetType != rconTypeLogin && header.Type != rconTypeResponse {
+			continue
+		}
+		return string(bytes.TrimRight(payload, "\x00")), nil
+	}
+}
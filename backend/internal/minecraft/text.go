@@ -0,0 +1,92 @@
+package minecraft
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode"
+)
+
+// TextComponent is one part of a JSON chat message, as used by tellraw.
+type TextComponent struct {
+	Text       string      `json:"text"`
+	Color      string      `json:"color,omitempty"`
+	Bold       bool        `json:"bold,omitempty"`
+	Italic     bool        `json:"italic,omitempty"`
+	HoverEvent *HoverEvent `json:"hoverEvent,omitempty"`
+	ClickEvent *ClickEvent `json:"clickEvent,omitempty"`
+}
+
+type HoverEvent struct {
+	Action   string `json:"action"`
+	Contents string `json:"contents"`
+}
+
+type ClickEvent struct {
+	Action string `json:"action"`
+	Value  string `json:"value"`
+}
+
+// Tellraw builds a tellraw command showing the components to target, for
+// example "@a". Component texts are cleaned with StripFormatting, so a chat
+// message cannot bring its own colours or obfuscated text into the game.
+func Tellraw(target string, components ...TextComponent) (string, error) {
+	parts := make([]any, 0, len(components)+1)
+	// An empty first element keeps the style of one part from leaking
+	// into the next.
+	parts = append(parts, "")
+	for _, component := range components {
+		component.Text = StripFormatting(component.Text)
+		if component.HoverEvent != nil {
+			hover := *component.HoverEvent
+			hover.Contents = StripFormatting(hover.Contents)
+			component.HoverEvent = &hover
+		}
+		parts = append(parts, component)
+	}
+	raw, err := json.Marshal(parts)
+	if err != nil {
+		return "", err
+	}
+	return "tellraw " + target + " " + string(raw), nil
+}
+
+// StripFormatting removes legacy "§" formatting codes, which the client
+// applies even inside JSON text, and control characters, and turns line
+// breaks into spaces. "&" is left alone: chat plugins that use "&a" codes
+// turn them into "§" before the message leaves the server, and anything
+// else is what the player typed, such as "rock&roll".
+func StripFormatting(text string) string {
+	var builder strings.Builder
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if r == '§' {
+			if i+1 < len(runes) && isFormattingCode(runes[i+1]) {
+				i++
+			}
+			continue
+		}
+		if r == '\n' || r == '\r' || r == '\t' {
+			builder.WriteRune(' ')
+			continue
+		}
+		if unicode.IsControl(r) {
+			continue
+		}
+		builder.WriteRune(r)
+	}
+	return strings.TrimSpace(builder.String())
+}
+
+func isFormattingCode(r rune) bool {
+	return strings.ContainsRune("0123456789abcdefklmnorxABCDEFKLMNORX", r)
+}
+
+// Truncate cuts text to at most limit runes, ending with "..." when cut.
+func Truncate(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	return strings.TrimSpace(string(runes[:limit-3])) + "..."
+}
@@ -0,0 +1,19 @@
+package minecraft
+
+import "testing"
+
+func TestStripFormatting(t *testing.T) {
+	cases := map[string]string{
+		"§aHello §lworld§r":     "Hello world",
+		"rock&roll & &a B&B":    "rock&roll & &a B&B",
+		"line\nbreak\ttab\x07":  "line break tab",
+		"dangling §":            "dangling",
+		"§§ab":                  "b",
+		"  §xspaces around§f  ": "spaces around",
+	}
+	for input, want := range cases {
+		if got := StripFormatting(input); got != want {
+			t.Errorf("StripFormatting(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
@@ -23,45 +23,87 @@ type News struct {
 
 // Ticket represents a support request.
 type Ticket struct {
-	ID               int64      `json:"id"`
-	Name             string     `json:"name"`
-	Email            string     `json:"email"`
-	DiscordNick      string     `json:"discordNick"`
-	OwnerDiscordID   string     `json:"-"`
-	Subject          string     `json:"subject"`
-	Category         string     `json:"category"`
-	Message          string     `json:"message"`
-	Status           string     `json:"status"`
-	ModerationToken  string     `json:"-"`
-	DiscordMessageID string     `json:"-"`
-	DiscordChannelID string     `json:"-"`
-	UnreadAdminCount int        `json:"unreadAdminCount"`
-	ResolvedAt       *time.Time `json:"resolvedAt,omitempty"`
-	ArchivedAt       *time.Time `json:"archivedAt,omitempty"`
-	CreatedAt        time.Time  `json:"createdAt"`
+	ID                int64         `json:"id"`
+	Name              string        `json:"name"`
+	Email             string        `json:"email"`
+	DiscordNick       string        `json:"discordNick"`
+	OwnerDiscordID    string        `json:"-"`
+	Subject           string        `json:"subject"`
+	Category          string        `json:"category"`
+	Message           string        `json:"message"`
+	Status            string        `json:"status"`
+	ModerationToken   string        `json:"-"`
+	DiscordMessageID  string        `json:"-"`
+	DiscordChannelID  string        `json:"-"`
+	DiscordThreadID   string        `json:"-"`
+	DiscordSync       string        `json:"discordSync,omitempty"`
+	UnreadAdminCount  int           `json:"unreadAdminCount"`
+	UnreadUserCount   int           `json:"unreadUserCount"`
+	UserSeenAt        *time.Time    `json:"userSeenAt,omitempty"`
+	Priority          string        `json:"priority"`
+	AssigneeDiscordID string        `json:"assigneeDiscordId,omitempty"`
+	AssigneeName      string        `json:"assigneeName,omitempty"`
+	AssignedAt        *time.Time    `json:"assignedAt,omitempty"`
+	FirstResponseAt   *time.Time    `json:"firstResponseAt,omitempty"`
+	ResolvedAt        *time.Time    `json:"resolvedAt,omitempty"`
+	ArchivedAt        *time.Time    `json:"archivedAt,omitempty"`
+	CreatedAt         time.Time     `json:"createdAt"`
+	SLA               *TicketSLA    `json:"sla,omitempty"`
+	Rating            *TicketRating `json:"rating,omitempty"`
+}
+
+// TicketRating is the player's satisfaction score for a closed ticket.
+type TicketRating struct {
+	Score   int       `json:"score"`
+	Comment string    `json:"comment"`
+	RatedAt time.Time `json:"ratedAt"`
+}
+
+// TicketSLA describes how a ticket stands against its category targets.
+type TicketSLA struct {
+	FirstResponseDueAt time.Time `json:"firstResponseDueAt"`
+	ResolutionDueAt    time.Time `json:"resolutionDueAt"`
+	State              string    `json:"state"`
+	RemainingSeconds   int64     `json:"remainingSeconds"`
 }
 
 type TicketMessage struct {
-	ID                  int64              `json:"id"`
-	TicketID            int64              `json:"ticketId"`
-	AuthorType          string             `json:"authorType"`
-	AuthorName          string             `json:"authorName"`
-	AuthorDiscordID     string             `json:"authorDiscordId,omitempty"`
-	AuthorDiscordStatus string             `json:"authorDiscordStatus,omitempty"`
-	Message             string             `json:"message"`
-	Attachments         []TicketAttachment `json:"attachments,omitempty"`
-	ReadByUser          bool               `json:"readByUser"`
-	CreatedAt           time.Time          `json:"createdAt"`
+	ID                  int64               `json:"id"`
+	TicketID            int64               `json:"ticketId"`
+	AuthorType          string              `json:"authorType"`
+	AuthorName          string              `json:"authorName"`
+	AuthorDiscordID     string              `json:"authorDiscordId,omitempty"`
+	AuthorDiscordStatus string              `json:"authorDiscordStatus,omitempty"`
+	Message             string              `json:"message"`
+	Attachments         []TicketAttachment  `json:"attachments,omitempty"`
+	ReadByUser          bool                `json:"readByUser"`
+	ReadByUserAt        *time.Time          `json:"readByUserAt,omitempty"`
+	ReadByStaffAt       *time.Time          `json:"readByStaffAt,omitempty"`
+	EditedAt            *time.Time          `json:"editedAt,omitempty"`
+	Deleted             bool                `json:"deleted,omitempty"`
+	Edits               []TicketMessageEdit `json:"edits,omitempty"`
+	CreatedAt           time.Time           `json:"createdAt"`
+}
+
+// TicketMessageEdit keeps the text a message had before an edit.
+type TicketMessageEdit struct {
+	Message  string    `json:"message"`
+	EditedAt time.Time `json:"editedAt"`
 }
 
 type TicketAttachment struct {
-	ID          int64     `json:"id"`
-	TicketID    int64     `json:"ticketId"`
-	MessageID   int64     `json:"messageId"`
-	FileName    string    `json:"fileName"`
-	MimeType    string    `json:"mimeType"`
-	SizeBytes   int64     `json:"sizeBytes"`
-	URL         string    `json:"url"`
-	StoragePath string    `json:"-"`
-	CreatedAt   time.Time `json:"createdAt"`
+	ID        int64  `json:"id"`
+	TicketID  int64  `json:"ticketId"`
+	MessageID int64  `json:"messageId"`
+	FileName  string `json:"fileName"`
+	MimeType  string `json:"mimeType"`
+	SizeBytes int64  `json:"sizeBytes"`
+	URL       string `json:"url"`
+	// ThumbnailURL is set for images; quarantined files have neither URL.
+	ThumbnailURL     string    `json:"thumbnailUrl,omitempty"`
+	Quarantined      bool      `json:"quarantined,omitempty"`
+	QuarantineReason string    `json:"quarantineReason,omitempty"`
+	StoragePath      string    `json:"-"`
+	ThumbnailPath    string    `json:"-"`
+	CreatedAt        time.Time `json:"createdAt"`
 }
@@ -56,6 +56,54 @@ var (
 		},
 		[]string{"kind"},
 	)
+	DiscordRateLimited = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "amy_backend_discord_rate_limited_total",
+			Help: "Discord 429 responses by request kind and scope (user, global or shared).",
+		},
+		[]string{"kind", "scope"},
+	)
+	DiscordGatewayState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "amy_backend_discord_gateway_state",
+			Help: "Discord gateway connection state. The current state is 1, the others 0.",
+		},
+		[]string{"state"},
+	)
+	DiscordGatewayReconnects = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "amy_backend_discord_gateway_reconnects_total",
+			Help: "Discord gateway disconnects by reason (reconnect, invalid_session, zombie, closed, read, dial, ...).",
+		},
+		[]string{"reason"},
+	)
+	DiscordGatewaySessions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "amy_backend_discord_gateway_sessions_total",
+			Help: "Discord gateway session starts by type (identify or resume).",
+		},
+		[]string{"type"},
+	)
+	DiscordGatewayLatency = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "amy_backend_discord_gateway_heartbeat_latency_seconds",
+			Help: "Time between the latest Discord gateway heartbeat and its acknowledgement.",
+		},
+	)
+	DiscordInteractions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "amy_backend_discord_interactions_total",
+			Help: "Verified Discord interactions by type and command or button.",
+		},
+		[]string{"type", "name"},
+	)
+	DiscordOutboxDeliveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "amy_backend_discord_outbox_deliveries_total",
+			Help: "Discord outbox side effects by entity, action and result (done, retry, failed).",
+		},
+		[]string{"entity", "action", "result"},
+	)
 	DiscordIntegrationConfigured = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "amy_backend_discord_integration_configured",
@@ -69,8 +117,130 @@ var (
 			Help: "Whether Discord OAuth has client id, client secret, and redirect URL configured.",
 		},
 	)
+	SupportFirstResponseDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "amy_backend_support_first_response_seconds",
+			Help:    "Time from support ticket creation to the first staff reply.",
+			Buckets: supportDurationBuckets,
+		},
+		[]string{"category", "priority"},
+	)
+	SupportResolutionDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "amy_backend_support_resolution_seconds",
+			Help:    "Time from support ticket creation to resolution.",
+			Buckets: supportDurationBuckets,
+		},
+		[]string{"category", "priority"},
+	)
+	SupportOpenTickets = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "amy_backend_support_open_tickets",
+			Help: "Open support tickets by SLA state.",
+		},
+		[]string{"sla_state"},
+	)
+	SupportStreamConnections = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "amy_backend_support_stream_connections",
+			Help: "Open real-time support ticket streams.",
+		},
+	)
+	CommunityChatStreamConnections = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "amy_backend_community_chat_stream_connections",
+			Help: "Open real-time community chat streams.",
+		},
+	)
+	CommunityChatStreamsDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "amy_backend_community_chat_streams_dropped_total",
+			Help: "Community chat streams refused or closed by the backend, by reason.",
+		},
+		[]string{"reason"},
+	)
+	MinecraftChatRelayed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "amy_backend_minecraft_chat_relayed_total",
+			Help: "Chat messages relayed between the community chat and the game, by direction and result.",
+		},
+		[]string{"direction", "result"},
+	)
+	SupportTicketsCreated = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "amy_backend_support_tickets_created_total",
+			Help: "Support tickets created.",
+		},
+		[]string{"category"},
+	)
+	SupportTicketsRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "amy_backend_support_tickets_rejected_total",
+			Help: "Support ticket submissions rejected by spam protection.",
+		},
+		[]string{"reason"},
+	)
+	SupportTicketVerifications = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "amy_backend_support_ticket_verifications_total",
+			Help: "Discord DM confirmations for tickets sent without a session.",
+		},
+		[]string{"result"},
+	)
+	SupportAttachmentScans = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "amy_backend_support_attachment_scans_total",
+			Help: "Support attachments checked by the attachment scanner.",
+		},
+		[]string{"result"},
+	)
+	NotificationsSent = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "amy_backend_notifications_total",
+			Help: "Player notifications delivered to the inbox or Web Push, by event kind.",
+		},
+		[]string{"kind"},
+	)
+	PushDeliveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "amy_backend_push_deliveries_total",
+			Help: "Web Push outbox delivery attempts by event kind and result (sent, retry, failed, expired, gone, pruned).",
+		},
+		[]string{"kind", "result"},
+	)
+	PushDeliveryDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "amy_backend_push_delivery_duration_seconds",
+			Help:    "Time the push service took to answer a Web Push request.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"result"},
+	)
+	SupportRatings = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "amy_backend_support_ratings",
+			Help: "Ticket satisfaction ratings over the last 30 days.",
+		},
+		[]string{"category", "staff"},
+	)
+	SupportRatingScoreSum = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "amy_backend_support_rating_score_sum",
+			Help: "Sum of ticket satisfaction scores (1-5) over the last 30 days.",
+		},
+		[]string{"category", "staff"},
+	)
+	SupportSatisfiedRatings = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "amy_backend_support_satisfied_ratings",
+			Help: "Ticket ratings of 4 or 5 over the last 30 days; divide by amy_backend_support_ratings for CSAT.",
+		},
+		[]string{"category", "staff"},
+	)
 )
 
+var supportDurationBuckets = []float64{60, 300, 900, 1800, 3600, 2 * 3600, 4 * 3600, 8 * 3600, 24 * 3600, 72 * 3600, 7 * 24 * 3600}
+
 func init() {
 	prometheus.MustRegister(
 		HTTPRequestsTotal,
@@ -79,8 +249,32 @@ func init() {
 		DiscordOutboundRequestsTotal,
 		DiscordOutboundRequestDuration,
 		DiscordOutboundLastSuccess,
+		DiscordRateLimited,
+		DiscordGatewayState,
+		DiscordGatewayReconnects,
+		DiscordGatewaySessions,
+		DiscordGatewayLatency,
+		DiscordInteractions,
+		DiscordOutboxDeliveries,
 		DiscordIntegrationConfigured,
 		DiscordOAuthConfigured,
+		SupportFirstResponseDuration,
+		SupportResolutionDuration,
+		SupportOpenTickets,
+		SupportStreamConnections,
+		CommunityChatStreamConnections,
+		CommunityChatStreamsDropped,
+		MinecraftChatRelayed,
+		SupportTicketsCreated,
+		SupportTicketsRejected,
+		SupportTicketVerifications,
+		SupportAttachmentScans,
+		NotificationsSent,
+		PushDeliveries,
+		PushDeliveryDuration,
+		SupportRatings,
+		SupportRatingScoreSum,
+		SupportSatisfiedRatings,
 	)
 }
 
@@ -148,6 +342,20 @@ func ClientIP(r *http.Request) string {
 		}
 	}
 
+	return remoteIP(r)
+}
+
+// ProxyClientIP returns the client address for rate limits. Clients can send
+// CF-Connecting-IP and X-Forwarded-For themselves, so only X-Real-IP, which
+// nginx overwrites with the peer it saw, and the peer address count.
+func ProxyClientIP(r *http.Request) string {
+	if parsed := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); parsed != nil {
+		return parsed.String()
+	}
+	return remoteIP(r)
+}
+
+func remoteIP(r *http.Request) string {
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err == nil {
 		if parsed := net.ParseIP(host); parsed != nil {
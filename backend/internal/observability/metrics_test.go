@@ -0,0 +1,26 @@
+package observability
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyClientIPIgnoresClientHeaders(t *testing.T) {
+	request := httptest.NewRequest("POST", "/api/support/tickets", nil)
+	request.RemoteAddr = "172.18.0.5:41234"
+	request.Header.Set("CF-Connecting-IP", "203.0.113.7")
+	request.Header.Set("X-Forwarded-For", "198.51.100.9, 172.18.0.1")
+	if got := ProxyClientIP(request); got != "172.18.0.5" {
+		t.Fatalf("got %s, want the peer address", got)
+	}
+
+	request.Header.Set("X-Real-IP", "192.0.2.44")
+	if got := ProxyClientIP(request); got != "192.0.2.44" {
+		t.Fatalf("got %s, want the nginx X-Real-IP", got)
+	}
+
+	request.Header.Set("X-Real-IP", "not an ip")
+	if got := ProxyClientIP(request); got != "172.18.0.5" {
+		t.Fatalf("got %s for an invalid X-Real-IP", got)
+	}
+}
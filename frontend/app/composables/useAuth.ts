@@ -12,6 +12,8 @@
   createdAt?: string
   updatedAt?: string
   moderatedAt?: string
+  discordSync?: 'pending' | 'synced' | 'failed'
+  moderationReason?: string
 }
 
 export type AuthUser = {
@@ -0,0 +1,64 @@
+const serviceWorkerPath = '/support-notifications-sw.js'
+
+const urlBase64ToUint8Array = (base64: string) => {
+  const padding = '='.repeat((4 - base64.length % 4) % 4)
+  const raw = atob((base64 + padding).replace(/-/g, '+').replace(/_/g, '/'))
+  return Uint8Array.from([...raw].map((char) => char.charCodeAt(0)))
+}
+
+export function usePushNotifications() {
+  const config = useRuntimeConfig()
+  const endpoint = `${config.public.apiBase}/notifications/push`
+
+  const supported = () => import.meta.client && 'Notification' in window && 'serviceWorker' in navigator && 'PushManager' in window
+
+  const enable = async () => {
+    if (!supported()) {
+      throw new Error('Браузер не поддерживает push-уведомления.')
+    }
+    const permission = await Notification.requestPermission()
+    if (permission !== 'granted') throw new Error('Разрешение на уведомления не выдано.')
+
+    const response = await $fetch<{ configured: boolean; publicKey: string }>(endpoint, {
+      credentials: 'include'
+    })
+    if (!response.configured || !response.publicKey) {
+      throw new Error('Push-уведомления не настроены на сервере.')
+    }
+
+    const registration = await navigator.serviceWorker.register(serviceWorkerPath)
+    const existing = await registration.pushManager.getSubscription()
+    const subscription = existing || await registration.pushManager.subscribe({
+      userVisibleOnly: true,
+      applicationServerKey: urlBase64ToUint8Array(response.publicKey)
+    })
+    await $fetch(endpoint, {
+      method: 'POST',
+      credentials: 'include',
+      body: subscription.toJSON()
+    })
+  }
+
+  const disable = async () => {
+    if (!import.meta.client) return
+    let subscriptionEndpoint = ''
+    if ('serviceWorker' in navigator) {
+      const registration = await navigator.serviceWorker.getRegistration(serviceWorkerPath)
+      const subscription = await registration?.pushManager.getSubscription()
+      subscriptionEndpoint = subscription?.endpoint || ''
+      await subscription?.unsubscribe()
+    }
+    await $fetch(`${endpoint}${subscriptionEndpoint ? `?endpoint=${encodeURIComponent(subscriptionEndpoint)}` : ''}`, {
+      method: 'DELETE',
+      credentials: 'include'
+    }).catch(() => undefined)
+  }
+
+  const subscribed = async () => {
+    if (!supported()) return false
+    const registration = await navigator.serviceWorker.getRegistration(serviceWorkerPath)
+    return Boolean(await registration?.pushManager.getSubscription())
+  }
+
+  return { supported, enable, disable, subscribed }
+}
@@ -5,7 +5,8 @@ export default defineNuxtConfig({
   css: ['~/assets/main.css'],
   runtimeConfig: {
     public: {
-      apiBase: process.env.NUXT_PUBLIC_API_BASE || '/api'
+      apiBase: process.env.NUXT_PUBLIC_API_BASE || '/api',
+      captchaSiteKey: process.env.NUXT_PUBLIC_CAPTCHA_SITE_KEY || ''
     }
   }
 })
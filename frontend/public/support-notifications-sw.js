@@ -1,8 +1,8 @@
 self.addEventListener('push', (event) => {
   let payload = {
-    title: 'Ответ поддержки',
-    body: 'В тикете появился новый ответ.',
-    url: '/support'
+    title: 'Amy World',
+    body: 'Новое уведомление.',
+    url: '/notifications'
   }
 
   if (event.data) {
@@ -15,14 +15,14 @@ self.addEventListener('push', (event) => {
 
   event.waitUntil(self.registration.showNotification(payload.title, {
     body: payload.body,
-    tag: payload.ticketId ? `support-ticket-${payload.ticketId}` : 'support-ticket',
-    data: { url: payload.url || '/support' }
+    tag: payload.tag || (payload.ticketId ? `support-ticket-${payload.ticketId}` : payload.kind || 'amy'),
+    data: { url: payload.url || '/notifications' }
   }))
 })
 
 self.addEventListener('notificationclick', (event) => {
   event.notification.close()
-  const targetUrl = new URL(event.notification.data?.url || '/support', self.location.origin).href
+  const targetUrl = new URL(event.notification.data?.url || '/notifications', self.location.origin).href
 
   event.waitUntil((async () => {
     const windowClients = await clients.matchAll({ type: 'window', includeUncontrolled: true })